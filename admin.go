@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// adminMux serves the admin endpoints, e.g. /metrics.
+var adminMux = http.NewServeMux()
+
+func init() {
+	adminMux.HandleFunc("/metrics", metricsHandler)
+}
+
+// The admin endpoints can redirect production traffic, so they can require
+// a bearer token, -admin.token.read or -admin.token.write, or a client
+// certificate verified by -admin.client-ca. Readers may GET and HEAD, writers,
+// the -admin.token.write and the certificates of -admin.writers, may also
+// change the mirroring. Without tokens and client CA, the endpoints are open.
+
+type adminRole int
+
+const (
+	adminNone adminRole = iota
+	adminReader
+	adminWriter
+)
+
+type adminAuth struct {
+	readToken  *secret
+	writeToken *secret
+	writers    map[string]bool
+}
+
+// newAdminAuth returns nil if the admin endpoints are open.
+func newAdminAuth() *adminAuth {
+	if *adminReadToken == "" && *adminWriteToken == "" && *adminClientCA == "" {
+		return nil
+	}
+	a := &adminAuth{writers: make(map[string]bool)}
+	if *adminReadToken != "" {
+		a.readToken = newSecret(*adminReadToken)
+	}
+	if *adminWriteToken != "" {
+		a.writeToken = newSecret(*adminWriteToken)
+	}
+	for _, name := range strings.Split(*adminWriters, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			a.writers[name] = true
+		}
+	}
+	return a
+}
+
+// role returns the role of the client of the request and who it is.
+func (a *adminAuth) role(r *http.Request) (adminRole, string) {
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+		if tokenMatches(a.writeToken, token) {
+			return adminWriter, "write token"
+		}
+		if tokenMatches(a.readToken, token) {
+			return adminReader, "read token"
+		}
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		name := r.TLS.PeerCertificates[0].Subject.CommonName
+		if a.writers[name] {
+			return adminWriter, "certificate " + name
+		}
+		return adminReader, "certificate " + name
+	}
+	return adminNone, ""
+}
+
+func tokenMatches(s *secret, token string) bool {
+	if s == nil {
+		return false
+	}
+	value, err := s.Value()
+	if err != nil {
+		log.Printf("Failed to read the admin token: %s", err)
+		return false
+	}
+	return value != "" && subtle.ConstantTimeCompare([]byte(value), []byte(token)) == 1
+}
+
+type adminPrincipalKey struct{}
+
+// wrap requires the reader role for GET and HEAD requests and the writer
+// role for the others.
+func (a *adminAuth) wrap(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := adminWriter
+		if r.Method == "GET" || r.Method == "HEAD" {
+			required = adminReader
+		}
+		role, principal := a.role(r)
+		if role == adminNone {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="teeproxy admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if role < required {
+			http.Error(w, "forbidden, "+principal+" may only read", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminPrincipalKey{}, principal)))
+	})
+}
+
+// adminSource describes the client of an admin request for the log and the
+// audit log.
+func adminSource(r *http.Request) string {
+	if principal, ok := r.Context().Value(adminPrincipalKey{}).(string); ok {
+		return "admin request from " + r.RemoteAddr + " with " + principal
+	}
+	return "admin request from " + r.RemoteAddr
+}
+
+// adminTLSConfig returns the TLS config of -admin.cert.file, nil without.
+func adminTLSConfig() (*tls.Config, error) {
+	if *adminCertificate == "" {
+		if *adminClientCA != "" {
+			return nil, fmt.Errorf("-admin.client-ca requires -admin.cert.file and -admin.key.file")
+		}
+		return nil, nil
+	}
+	cer, err := tls.LoadX509KeyPair(*adminCertificate, *adminPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cer}}
+	if *adminClientCA != "" {
+		if config.ClientCAs, err = loadCertPool(*adminClientCA); err != nil {
+			return nil, err
+		}
+		// clients without a certificate may still present a token
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// startAdmin serves the admin endpoints on a separate listener.
+func startAdmin(addr string) {
+	config, err := adminTLSConfig()
+	if err != nil {
+		fatalf("Invalid admin TLS: %s", err)
+	}
+	auth := newAdminAuth()
+	if auth == nil {
+		log.Printf("Starting admin endpoint at %s without authentication", addr)
+	} else {
+		log.Printf("Starting admin endpoint at %s", addr)
+	}
+	server := &http.Server{Addr: addr, Handler: auth.wrap(adminMux), TLSConfig: config}
+	go func() {
+		if config != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil {
+			fatalf("Failed to serve admin endpoint at %s: %s", addr, err)
+		}
+	}()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	defer func(read, write, ca, writers string) {
+		*adminReadToken, *adminWriteToken, *adminClientCA, *adminWriters = read, write, ca, writers
+	}(*adminReadToken, *adminWriteToken, *adminClientCA, *adminWriters)
+	*adminReadToken, *adminWriteToken, *adminWriters = "reader", "writer", "ops"
+
+	var source string
+	handler := newAdminAuth().wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source = adminSource(r)
+	}))
+	certificate := func(name string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+		return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	for _, test := range []struct {
+		method, token string
+		tls           *tls.ConnectionState
+		status        int
+	}{
+		{"GET", "", nil, http.StatusUnauthorized},
+		{"GET", "wrong", nil, http.StatusUnauthorized},
+		{"GET", "reader", nil, http.StatusOK},
+		{"POST", "reader", nil, http.StatusForbidden},
+		{"POST", "writer", nil, http.StatusOK},
+		{"GET", "", certificate("dashboard"), http.StatusOK},
+		{"POST", "", certificate("dashboard"), http.StatusForbidden},
+		{"POST", "", certificate("ops"), http.StatusOK},
+	} {
+		request := httptest.NewRequest(test.method, "/mirror/pause", nil)
+		if test.token != "" {
+			request.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		request.TLS = test.tls
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("Expected '%d' for %s with '%s', but received '%d'", test.status, test.method, test.token, recorder.Code)
+		}
+	}
+	if expectation := "admin request from 192.0.2.1:1234 with certificate ops"; source != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, source)
+	}
+}
+
+func TestAdminOpenWithoutAuth(t *testing.T) {
+	if newAdminAuth() != nil {
+		t.Errorf("Expected the admin endpoints to be open without tokens and client CA")
+	}
+}
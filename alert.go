@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Alerts post to a webhook, e.g. a Slack incoming webhook, when the rate of
+// alternate errors, of status mismatches between A and B or of failed
+// production requests exceeds its threshold within a window.
+
+// alertRate counts the requests and the bad ones of the current window.
+type alertRate struct {
+	name      string
+	text      string
+	threshold *float64
+
+	total    int64
+	bad      int64
+	lastSent time.Time
+}
+
+var (
+	alternateErrorAlert = &alertRate{name: "b-errors", text: "alternate backend error rate", threshold: alertAlternateErrors}
+	mismatchAlert       = &alertRate{name: "mismatch", text: "status mismatch rate between A and B", threshold: alertMismatch}
+	proxyErrorAlert     = &alertRate{name: "proxy-errors", text: "failed production request rate", threshold: alertProxyErrors}
+	alerts              = []*alertRate{alternateErrorAlert, mismatchAlert, proxyErrorAlert}
+)
+
+var alertsTotal = newCounterVec("teeproxy_alerts_total",
+	"Number of alerts sent to the -alert.webhook.", "alert")
+
+func (a *alertRate) enabled() bool {
+	return *alertWebhook != "" && *a.threshold > 0
+}
+
+// observe counts a request, bad if it failed.
+func (a *alertRate) observe(bad bool) {
+	if !a.enabled() {
+		return
+	}
+	atomic.AddInt64(&a.total, 1)
+	if bad {
+		atomic.AddInt64(&a.bad, 1)
+	}
+}
+
+// evaluate ends the window and alerts if the rate exceeded the threshold,
+// at most once per -alert.interval.
+func (a *alertRate) evaluate(now time.Time) {
+	total := atomic.SwapInt64(&a.total, 0)
+	bad := atomic.SwapInt64(&a.bad, 0)
+	if total == 0 || total < int64(*alertMinRequests) {
+		return
+	}
+	rate := float64(bad) / float64(total)
+	if rate < *a.threshold || now.Sub(a.lastSent) < time.Duration(*alertInterval)*time.Second {
+		return
+	}
+	a.lastSent = now
+	alertsTotal.Inc(a.name)
+	text := fmt.Sprintf("teeproxy %s: %s is %.1f%% (%d of %d requests in %ds), above %.1f%%",
+		*listen, a.text, 100*rate, bad, total, *alertWindow, 100**a.threshold)
+	log.Printf("Alert: %s", text)
+	go sendAlert(a.name, text, rate)
+}
+
+func sendAlert(name, text string, rate float64) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"text":      text,
+		"alert":     name,
+		"rate":      rate,
+		"listen":    *listen,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Post(*alertWebhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("Failed to send alert %s: %s", name, err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		log.Printf("Failed to send alert %s: webhook returned %s", name, response.Status)
+	}
+}
+
+// startAlerts evaluates the alert rates at the end of every window.
+func startAlerts() {
+	if *alertWebhook == "" {
+		return
+	}
+	go func() {
+		for now := range time.Tick(time.Duration(*alertWindow) * time.Second) {
+			for _, a := range alerts {
+				a.evaluate(now)
+			}
+		}
+	}()
+}
+
+// statusComparison pairs the production status of a request with the ones
+// of its mirrored requests, whichever finishes last records the mismatch.
+type statusComparison struct {
+	mu         sync.Mutex
+	done       bool
+	production int
+	alternates []int
+	// skipped are the production statuses the mirrored responses are not
+	// compared to, e.g. 304 if their conditions were stripped
+	skipped []int
+}
+
+func newStatusComparison() *statusComparison {
+	if !mismatchAlert.enabled() {
+		return nil
+	}
+	return &statusComparison{}
+}
+
+// statusCode returns the status of a response, 0 if the request failed.
+func statusCode(response *http.Response) int {
+	if response == nil {
+		return 0
+	}
+	return response.StatusCode
+}
+
+// skip does not compare the mirrored responses to a production response of
+// the status.
+func (c *statusComparison) skip(status int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.skipped = append(c.skipped, status)
+	c.mu.Unlock()
+}
+
+func (c *statusComparison) skips(status int) bool {
+	for _, skipped := range c.skipped {
+		if skipped == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *statusComparison) setProduction(status int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	c.production = status
+	if c.skips(status) {
+		c.alternates = nil
+		return
+	}
+	for _, alternate := range c.alternates {
+		mismatchAlert.observe(alternate/100 != status/100)
+	}
+	c.alternates = nil
+}
+
+func (c *statusComparison) addAlternate(status int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		if c.skips(c.production) {
+			return
+		}
+		mismatchAlert.observe(status/100 != c.production/100)
+	} else {
+		c.alternates = append(c.alternates, status)
+	}
+}
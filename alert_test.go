@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAlert(t *testing.T) {
+	received := make(chan map[string]interface{}, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+	}))
+	defer webhook.Close()
+	defer func(url string, threshold float64) { *alertWebhook, *alertMismatch = url, threshold }(*alertWebhook, *alertMismatch)
+	*alertWebhook = webhook.URL
+	*alertMismatch = 0.5
+
+	for i := 0; i < 40; i++ {
+		comparison := newStatusComparison()
+		comparison.addAlternate(500)
+		if i%4 == 0 {
+			comparison.setProduction(500)
+		} else {
+			comparison.setProduction(200)
+		}
+	}
+	now := time.Now()
+	mismatchAlert.evaluate(now)
+	select {
+	case payload := <-received:
+		if payload["alert"] != "mismatch" || payload["rate"] != 0.75 {
+			t.Errorf("Expected the mismatch alert with rate '0.75', but received '%v'", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected an alert")
+	}
+
+	for i := 0; i < 40; i++ {
+		mismatchAlert.observe(true)
+	}
+	mismatchAlert.evaluate(now.Add(time.Minute))
+	select {
+	case payload := <-received:
+		t.Errorf("Expected the alert to be rate limited, but received '%v'", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
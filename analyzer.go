@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// With -analyze, the production responses, headers and body along with the
+// request line and headers, are streamed to a local analyzer process
+// listening on a Unix socket, in the -analyze.format of the recordings. The
+// analyzer only reads: the exchanges are queued and written off the request
+// path, and dropped when the queue is full, the analyzer is not listening or
+// does not read within a second, counted in
+// teeproxy_recordings_dropped_total{sink="analyze"}.
+
+// analyzerWriteTimeout bounds the time a slow analyzer holds the queue.
+const analyzerWriteTimeout = time.Second
+
+// analyzerRedial is the minimum time between two connection attempts.
+const analyzerRedial = time.Second
+
+// unixSocketSink writes the exchanges to a Unix socket, reconnecting when the
+// listener goes away.
+type unixSocketSink struct {
+	path   string
+	format string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	dialed time.Time
+}
+
+func (s *unixSocketSink) Write(e *exchange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if time.Since(s.dialed) < analyzerRedial {
+			recordingsDropped.Inc("analyze")
+			return nil
+		}
+		s.dialed = time.Now()
+		conn, err := net.DialTimeout("unix", s.path, analyzerWriteTimeout)
+		if err != nil {
+			recordingsDropped.Inc("analyze")
+			return nil
+		}
+		log.Printf("Connected to the analyzer at %s", s.path)
+		s.conn = conn
+	}
+	data, err := encodeExchange(e, s.format)
+	if err != nil {
+		recordingsDropped.Inc("analyze")
+		return err
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(analyzerWriteTimeout))
+	if _, err := s.conn.Write(data); err != nil {
+		// a partially written exchange cannot be resumed, start over
+		recordingsDropped.Inc("analyze")
+		log.Printf("Disconnected from the analyzer at %s: %s", s.path, err)
+		s.conn.Close()
+		s.conn = nil
+	}
+	return nil
+}
+
+func (s *unixSocketSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// analyzeSink receives the production exchanges streamed to -analyze, nil if
+// disabled.
+var analyzeSink exchangeSink
+
+// startAnalyzer streams the production responses to -analyze.
+func startAnalyzer() {
+	if !validSinkFormat(*analyzeFormat) {
+		fatalf("Invalid -analyze.format %s, expected json or protobuf", *analyzeFormat)
+	}
+	if *analyzeQueue <= 0 {
+		fatalf("Invalid -analyze.queue %d, expected a positive size", *analyzeQueue)
+	}
+	analyzeSink = newAsyncSink("analyze", &unixSocketSink{path: *analyzeSocket, format: *analyzeFormat}, *analyzeQueue)
+	log.Printf("Streaming %v%% of the production responses to the analyzer at %s", *analyzePercent, *analyzeSocket)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAnalyzerStream(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "analyzer.sock")
+	sink := &unixSocketSink{path: socket, format: "json"}
+	defer sink.Close()
+	defer func(s exchangeSink) { analyzeSink = s }(analyzeSink)
+	analyzeSink = sink
+	defer evictIdleConnections()
+
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"total":42}`))
+	}))
+	defer production.Close()
+	h := newTestHandler(production.URL)
+
+	// without a listening analyzer the exchange is dropped
+	dropped := recordingsDropped.values[labelKey([]string{"analyze"})]
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders/1", nil))
+	if value := recordingsDropped.values[labelKey([]string{"analyze"})]; value != dropped+1 {
+		t.Errorf("Expected '%v', but received '%v'", dropped+1, value)
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sink.dialed = time.Time{}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/orders/2", nil))
+	if w.Body.String() != `{"total":42}` {
+		t.Errorf("Expected '{\"total\":42}', but received '%s'", w.Body.String())
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e exchange
+	if err := json.Unmarshal(line, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.URI != "/orders/2" || e.Status != 200 || e.ResponseHeader.Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected exchange %+v", e)
+	}
+	if len(e.ResponseChunks) != 1 || string(e.ResponseChunks[0].Data) != `{"total":42}` {
+		t.Errorf("Expected the response body, but received %+v", e.ResponseChunks)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Anonymization profiles combine header stripping and hashing, body
+// scrubbing and client IP anonymization. They are applied to the recording
+// and capture sinks and to the requests mirrored by a policy.
+
+const redacted = "[redacted]"
+
+type anonymizer struct {
+	Name string
+	// StripHeaders are removed, HashHeaders replaced by their HMAC.
+	StripHeaders []string
+	HashHeaders  []string
+	// ScrubFields are JSON object keys whose values are redacted, HashFields
+	// the ones whose values are replaced by their HMAC.
+	ScrubFields map[string]bool
+	HashFields  map[string]bool
+	// ScrubPatterns are redacted anywhere in the bodies.
+	ScrubPatterns []*regexp.Regexp
+	// IP is "truncate" or "hash" to anonymize the client IP headers.
+	IP string
+}
+
+type anonymizerConfig struct {
+	Name          string   `json:"name"`
+	StripHeaders  []string `json:"strip_headers"`
+	HashHeaders   []string `json:"hash_headers"`
+	ScrubFields   []string `json:"scrub_fields"`
+	HashFields    []string `json:"hash_fields"`
+	ScrubPatterns []string `json:"scrub_patterns"`
+	IP            string   `json:"ip"`
+}
+
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-Auth-Token"}
+
+// builtinAnonymizers are available without configuration.
+var builtinAnonymizers = []anonymizerConfig{
+	{
+		Name:          "strict",
+		StripHeaders:  credentialHeaders,
+		ScrubFields:   []string{"password", "secret", "token", "access_token", "refresh_token", "email", "phone", "name", "address", "iban", "card_number"},
+		ScrubPatterns: []string{`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`, `\b(?:\d[ -]?){13,19}\b`},
+		IP:            "truncate",
+	},
+	{
+		Name:         "hash-identifiers",
+		StripHeaders: []string{"Authorization", "Proxy-Authorization"},
+		HashHeaders:  []string{"Cookie", "X-User-Id", "X-Session-Id"},
+		HashFields:   []string{"id", "user_id", "userId", "account_id", "session_id", "email"},
+		IP:           "hash",
+	},
+}
+
+func (ac anonymizerConfig) build() (*anonymizer, error) {
+	a := &anonymizer{Name: ac.Name, IP: ac.IP, ScrubFields: make(map[string]bool), HashFields: make(map[string]bool)}
+	switch ac.IP {
+	case "", "truncate", "hash":
+	default:
+		return nil, fmt.Errorf("anonymization %q: unknown ip %q, expected truncate or hash", ac.Name, ac.IP)
+	}
+	for _, name := range ac.StripHeaders {
+		a.StripHeaders = append(a.StripHeaders, http.CanonicalHeaderKey(name))
+	}
+	for _, name := range ac.HashHeaders {
+		a.HashHeaders = append(a.HashHeaders, http.CanonicalHeaderKey(name))
+	}
+	for _, field := range ac.ScrubFields {
+		a.ScrubFields[strings.ToLower(field)] = true
+	}
+	for _, field := range ac.HashFields {
+		a.HashFields[strings.ToLower(field)] = true
+	}
+	for _, pattern := range ac.ScrubPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("anonymization %q: invalid pattern: %v", ac.Name, err)
+		}
+		a.ScrubPatterns = append(a.ScrubPatterns, re)
+	}
+	return a, nil
+}
+
+var (
+	anonymizersMutex sync.Mutex
+	anonymizers      = make(map[string]*anonymizer)
+	// builtins are the built-in profiles, kept across reloads
+	builtins []*anonymizer
+)
+
+func init() {
+	for _, ac := range builtinAnonymizers {
+		a, err := ac.build()
+		if err != nil {
+			panic(err)
+		}
+		anonymizers[a.Name] = a
+		builtins = append(builtins, a)
+	}
+}
+
+// buildAnonymizers returns the built-in and the configured profiles, the
+// built-in ones can be overridden.
+func buildAnonymizers(configs []anonymizerConfig) (map[string]*anonymizer, error) {
+	profiles := make(map[string]*anonymizer)
+	for _, a := range builtins {
+		profiles[a.Name] = a
+	}
+	for _, ac := range configs {
+		a, err := ac.build()
+		if err != nil {
+			return nil, err
+		}
+		profiles[a.Name] = a
+	}
+	return profiles, nil
+}
+
+// setAnonymizers replaces the profiles looked up by name.
+func setAnonymizers(profiles map[string]*anonymizer) {
+	anonymizersMutex.Lock()
+	defer anonymizersMutex.Unlock()
+	anonymizers = profiles
+}
+
+// lookupAnonymizer returns the profile, nil for the empty name.
+func lookupAnonymizer(name string) (*anonymizer, error) {
+	anonymizersMutex.Lock()
+	defer anonymizersMutex.Unlock()
+	return findAnonymizer(anonymizers, name)
+}
+
+// findAnonymizer returns the profile of the profiles, nil for the empty name.
+func findAnonymizer(profiles map[string]*anonymizer, name string) (*anonymizer, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if a, ok := profiles[name]; ok {
+		return a, nil
+	}
+	return nil, fmt.Errorf("unknown anonymization profile %q", name)
+}
+
+var (
+	anonymizeKeyOnce   sync.Once
+	anonymizeKey       *secret
+	anonymizeRandomKey []byte
+)
+
+// setAnonymizeKey reads the -anonymize.key, failing if it cannot be read, so
+// that the values are not hashed with a random key by mistake.
+func setAnonymizeKey() error {
+	if *anonymizeSecret == "" {
+		return nil
+	}
+	key := newSecret(*anonymizeSecret)
+	value, err := key.Value()
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		return fmt.Errorf("the key is empty")
+	}
+	anonymizeKey = key
+	return nil
+}
+
+// pseudonym returns the HMAC-SHA256 of the value with -anonymize.key, or
+// with a random key without it.
+func pseudonym(value string) string {
+	var key []byte
+	if k, _ := anonymizeKey.Value(); k != "" {
+		key = []byte(k)
+	} else {
+		anonymizeKeyOnce.Do(func() {
+			anonymizeRandomKey = make([]byte, 32)
+			rand.Read(anonymizeRandomKey)
+			log.Printf("No -anonymize.key given, hashed values are only stable until restart")
+		})
+		key = anonymizeRandomKey
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// anonymizeIP truncates an IP address to its /24 or /48 network or
+// replaces it by its HMAC, other values are returned unchanged.
+func anonymizeIP(value, mode string) string {
+	host, port, err := net.SplitHostPort(value)
+	bracketed := false
+	if err != nil {
+		bracketed = strings.HasPrefix(value, "[")
+		host, port = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"), ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || mode == "" {
+		return value
+	}
+	if mode == "hash" {
+		host = "ip-" + pseudonym(ip.String())[:16]
+	} else if ip4 := ip.To4(); ip4 != nil {
+		host = ip4.Mask(net.CIDRMask(24, 32)).String()
+	} else {
+		host = ip.Mask(net.CIDRMask(48, 128)).String()
+	}
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	if bracketed && strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// anonymizeClient applies -client-ip.anonymize to the client address and the
+// IP headers of an inbound request, before they are forwarded, logged or
+// recorded.
+func anonymizeClient(req *http.Request) {
+	if *clientIPAnonymize == "" {
+		return
+	}
+	anonymizeIPHeaders(req.Header, *clientIPAnonymize)
+	req.RemoteAddr = anonymizeIP(req.RemoteAddr, *clientIPAnonymize)
+}
+
+var forwardedFor = regexp.MustCompile(`(?i)(for=)("?)(\[[^\]]*\][^";,]*|[^";,]*)`)
+
+// anonymizeIPHeaders anonymizes the client IPs in X-Forwarded-For, X-Real-Ip
+// and Forwarded.
+func anonymizeIPHeaders(header http.Header, mode string) {
+	if mode == "" {
+		return
+	}
+	for i, value := range header.Values("X-Forwarded-For") {
+		ips := strings.Split(value, ",")
+		for j, ip := range ips {
+			ips[j] = anonymizeIP(strings.TrimSpace(ip), mode)
+		}
+		header["X-Forwarded-For"][i] = strings.Join(ips, ", ")
+	}
+	if value := header.Get("X-Real-Ip"); value != "" {
+		header.Set("X-Real-Ip", anonymizeIP(value, mode))
+	}
+	for i, value := range header.Values("Forwarded") {
+		header["Forwarded"][i] = forwardedFor.ReplaceAllStringFunc(value, func(match string) string {
+			parts := forwardedFor.FindStringSubmatch(match)
+			return parts[1] + parts[2] + anonymizeIP(parts[3], mode)
+		})
+	}
+}
+
+// Header anonymizes the headers in place.
+func (a *anonymizer) Header(header http.Header) {
+	for _, name := range a.StripHeaders {
+		header.Del(name)
+	}
+	for _, name := range a.HashHeaders {
+		for i, value := range header[name] {
+			header[name][i] = pseudonym(value)
+		}
+	}
+	anonymizeIPHeaders(header, a.IP)
+}
+
+func isJSON(contentType string) bool {
+	return strings.Contains(contentType, "json")
+}
+
+// Body anonymizes a body of the content type.
+func (a *anonymizer) Body(body []byte, contentType string) []byte {
+	if len(body) == 0 {
+		return body
+	}
+	if isJSON(contentType) && (len(a.ScrubFields) > 0 || len(a.HashFields) > 0) {
+		var document interface{}
+		if err := json.Unmarshal(body, &document); err == nil {
+			if scrubbed, err := json.Marshal(a.scrubJSON(document)); err == nil {
+				body = scrubbed
+			}
+		}
+	}
+	for _, pattern := range a.ScrubPatterns {
+		body = pattern.ReplaceAll(body, []byte(redacted))
+	}
+	return body
+}
+
+func (a *anonymizer) scrubJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			switch name := strings.ToLower(key); {
+			case a.ScrubFields[name]:
+				v[key] = redacted
+			case a.HashFields[name]:
+				v[key] = pseudonym(fmt.Sprint(field))
+			default:
+				v[key] = a.scrubJSON(field)
+			}
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = a.scrubJSON(element)
+		}
+	}
+	return value
+}
+
+// EncodedBody anonymizes a body with the Content-Encoding of the header. A
+// body that cannot be decoded is replaced, and its encoding removed from the
+// header.
+func (a *anonymizer) EncodedBody(body []byte, header http.Header) []byte {
+	contentType := header.Get("Content-Type")
+	switch header.Get("Content-Encoding") {
+	case "", "identity":
+		return a.Body(body, contentType)
+	case "gzip", "x-gzip":
+		if reader, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			if decoded, err := ioutil.ReadAll(reader); err == nil {
+				var encoded bytes.Buffer
+				writer := gzip.NewWriter(&encoded)
+				writer.Write(a.Body(decoded, contentType))
+				writer.Close()
+				return encoded.Bytes()
+			}
+		}
+	}
+	header.Del("Content-Encoding")
+	return []byte(redacted)
+}
+
+func isEncoded(header http.Header) bool {
+	encoding := header.Get("Content-Encoding")
+	return encoding != "" && encoding != "identity"
+}
+
+// chunks anonymizes a chunked body, JSON and encoded bodies are joined into
+// one chunk.
+func (a *anonymizer) chunks(chunks []chunk, header http.Header) []chunk {
+	if len(chunks) == 0 {
+		return chunks
+	}
+	contentType := header.Get("Content-Type")
+	if isJSON(contentType) || isEncoded(header) {
+		var body []byte
+		for _, c := range chunks {
+			body = append(body, c.Data...)
+		}
+		return []chunk{{Offset: chunks[0].Offset, Data: a.EncodedBody(body, header)}}
+	}
+	anonymized := make([]chunk, len(chunks))
+	for i, c := range chunks {
+		anonymized[i] = chunk{Offset: c.Offset, Data: a.Body(c.Data, contentType)}
+	}
+	return anonymized
+}
+
+// Exchange anonymizes a recorded exchange in place.
+func (a *anonymizer) Exchange(e *exchange) {
+	if e.Header != nil {
+		a.Header(e.Header)
+		e.RequestChunks = a.chunks(e.RequestChunks, e.Header)
+	}
+	if e.ResponseHeader != nil {
+		a.Header(e.ResponseHeader)
+		e.ResponseChunks = a.chunks(e.ResponseChunks, e.ResponseHeader)
+	}
+	for i := range e.Frames {
+		e.Frames[i].Data = a.Body(e.Frames[i].Data, "")
+	}
+	e.RequestMessages = a.messages(e.RequestMessages)
+	e.ResponseMessages = a.messages(e.ResponseMessages)
+}
+
+// messages anonymizes decoded gRPC messages, dropping them if a scrub
+// pattern left no valid JSON.
+func (a *anonymizer) messages(messages json.RawMessage) json.RawMessage {
+	if len(messages) == 0 {
+		return messages
+	}
+	if anonymized := a.Body(messages, "application/json"); json.Valid(anonymized) {
+		return anonymized
+	}
+	return nil
+}
+
+// Request anonymizes a mirrored request, a duplicate with its own headers.
+func (a *anonymizer) Request(req *http.Request) {
+	a.Header(req.Header)
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	body = a.EncodedBody(body, req.Header)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+}
+
+// anonymizingSink anonymizes the exchanges before writing them to a sink.
+type anonymizingSink struct {
+	exchangeSink
+	anonymizer *anonymizer
+}
+
+func (s anonymizingSink) Write(e *exchange) error {
+	s.anonymizer.Exchange(e)
+	return s.exchangeSink.Write(e)
+}
+
+// withAnonymizer wraps the sink with the named profile.
+func withAnonymizer(sink exchangeSink, name string) (exchangeSink, error) {
+	a, err := lookupAnonymizer(name)
+	if a == nil || err != nil {
+		return sink, err
+	}
+	return anonymizingSink{exchangeSink: sink, anonymizer: a}, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAnonymizeRequest(t *testing.T) {
+	strict, err := lookupAnonymizer("strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := httptest.NewRequest("POST", "/signup", strings.NewReader(`{"email":"jane@example.com","plan":"pro","note":"card 4111 1111 1111 1111"}`))
+	original.Header.Set("Content-Type", "application/json")
+	original.Header.Set("Authorization", "Bearer secret")
+	original.Header.Set("X-Forwarded-For", "203.0.113.7, 2001:db8:1234:5678::1")
+	original.Header.Set("Forwarded", `for=203.0.113.7;proto=https, for="[2001:db8::1]:4711"`)
+	req := DuplicateRequest(original)
+
+	strict.Request(req)
+	body, _ := ioutil.ReadAll(req.Body)
+	if expectation := `{"email":"[redacted]","note":"card [redacted]","plan":"pro"}`; string(body) != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, body)
+	}
+	if req.ContentLength != int64(len(body)) {
+		t.Errorf("Expected '%d', but received '%d'", len(body), req.ContentLength)
+	}
+	for name, expectation := range map[string]string{
+		"Authorization":   "",
+		"X-Forwarded-For": "203.0.113.0, 2001:db8:1234::",
+		"Forwarded":       `for=203.0.113.0;proto=https, for="[2001:db8::]:4711"`,
+	} {
+		if value := req.Header.Get(name); value != expectation {
+			t.Errorf("Expected '%s: %s', but received '%s'", name, expectation, value)
+		}
+	}
+	if original.Header.Get("Authorization") == "" {
+		t.Errorf("Expected the headers of the production request to be kept")
+	}
+}
+
+func TestAnonymizeHashIdentifiers(t *testing.T) {
+	hashing, err := lookupAnonymizer("hash-identifiers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := hashing.Body([]byte(`{"user_id":42}`), "application/json")
+	second := hashing.Body([]byte(`{"user_id":42}`), "application/json")
+	if string(first) != string(second) || strings.Contains(string(first), ":42") {
+		t.Errorf("Expected a stable pseudonym, but received '%s' and '%s'", first, second)
+	}
+	if ip := anonymizeIP("198.51.100.23:443", "hash"); !strings.HasPrefix(ip, "ip-") || !strings.HasSuffix(ip, ":443") {
+		t.Errorf("Expected a hashed IP with port, but received '%s'", ip)
+	}
+}
+
+func TestAnonymizeClient(t *testing.T) {
+	defer func(mode string, forward bool) { *clientIPAnonymize, *forwardClientIP = mode, forward }(*clientIPAnonymize, *forwardClientIP)
+	*clientIPAnonymize = "truncate"
+	*forwardClientIP = true
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "[2001:db8:aaaa:bbbb::7]:51234"
+	req.Header.Set("X-Forwarded-For", "192.0.2.44")
+	anonymizeClient(req)
+	updateForwardedHeaders(req)
+	if expectation := "192.0.2.0, 2001:db8:aaaa::"; req.Header.Get("X-Forwarded-For") != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, req.Header.Get("X-Forwarded-For"))
+	}
+	if expectation := `for="[2001:db8:aaaa::]"`; req.Header.Get("Forwarded") != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, req.Header.Get("Forwarded"))
+	}
+	if expectation := "[2001:db8:aaaa::]:51234"; req.RemoteAddr != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, req.RemoteAddr)
+	}
+}
+
+func TestSetAnonymizeKey(t *testing.T) {
+	defer func(spec string, key *secret) { *anonymizeSecret, anonymizeKey = spec, key }(*anonymizeSecret, anonymizeKey)
+	for spec, valid := range map[string]bool{"env:TEEPROXY_TEST_UNSET_KEY": false, "file:/nonexistent/key": false, "s3cret": true} {
+		*anonymizeSecret = spec
+		if err := setAnonymizeKey(); (err == nil) != valid {
+			t.Errorf("Expected valid '%v' for %s, but received '%v'", valid, spec, err)
+		}
+	}
+	expected := pseudonym("alice")
+	anonymizeKey = newSecret("other")
+	if pseudonym("alice") == expected {
+		t.Errorf("Expected the pseudonym to depend on the key")
+	}
+}
+
+func TestAnonymizeGzipBody(t *testing.T) {
+	strict, err := lookupAnonymizer("strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(`{"email":"jane@example.com"}`))
+	writer.Close()
+	req := httptest.NewRequest("POST", "/signup", bytes.NewReader(compressed.Bytes()))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	strict.Request(req)
+	reader, err := gzip.NewReader(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(reader)
+	if expectation := `{"email":"[redacted]"}`; string(body) != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, body)
+	}
+
+	req = httptest.NewRequest("POST", "/signup", strings.NewReader("jane@example.com"))
+	req.Header.Set("Content-Encoding", "br")
+	strict.Request(req)
+	body, _ = ioutil.ReadAll(req.Body)
+	if string(body) != redacted || req.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Expected the undecodable body to be replaced, but received '%s'", body)
+	}
+}
+
+func TestSetAnonymizersDropsRemoved(t *testing.T) {
+	profiles, err := buildAnonymizers([]anonymizerConfig{{Name: "partner", StripHeaders: []string{"Cookie"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAnonymizers(profiles)
+	if _, err := lookupAnonymizer("partner"); err != nil {
+		t.Fatal(err)
+	}
+	if profiles, err = buildAnonymizers(nil); err != nil {
+		t.Fatal(err)
+	}
+	setAnonymizers(profiles)
+	if _, err := lookupAnonymizer("partner"); err == nil {
+		t.Errorf("Expected the removed profile to be dropped")
+	}
+	if _, err := lookupAnonymizer("strict"); err != nil {
+		t.Errorf("Expected the built-in profile to be kept, but received '%s'", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// asyncLogWriter moves writing the log off the request path. Lines are queued
+// in a bounded buffer and dropped when it overflows, the number of dropped
+// lines is logged once the writer catches up.
+type asyncLogWriter struct {
+	out     io.Writer
+	lines   chan asyncLogLine
+	dropped int64
+}
+
+type asyncLogLine struct {
+	data []byte
+	ack  chan struct{}
+}
+
+var logLinesDropped = newCounterVec("teeproxy_log_lines_dropped_total",
+	"Number of log lines dropped because the asynchronous log buffer was full.")
+
+var asyncLog *asyncLogWriter
+
+func newAsyncLogWriter(out io.Writer, size int) *asyncLogWriter {
+	w := &asyncLogWriter{out: out, lines: make(chan asyncLogLine, size)}
+	go w.run()
+	return w
+}
+
+func (w *asyncLogWriter) Write(p []byte) (int, error) {
+	// the log package reuses its buffer
+	data := append([]byte(nil), p...)
+	select {
+	case w.lines <- asyncLogLine{data: data}:
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+		logLinesDropped.Inc()
+	}
+	return len(p), nil
+}
+
+func (w *asyncLogWriter) run() {
+	for line := range w.lines {
+		if line.ack != nil {
+			close(line.ack)
+			continue
+		}
+		w.out.Write(line.data)
+		if dropped := atomic.SwapInt64(&w.dropped, 0); dropped > 0 {
+			fmt.Fprintf(w.out, "%d log lines dropped, the log buffer was full\n", dropped)
+		}
+	}
+}
+
+// Flush waits until the queued lines are written.
+func (w *asyncLogWriter) Flush() {
+	ack := make(chan struct{})
+	w.lines <- asyncLogLine{ack: ack}
+	<-ack
+}
+
+// setAsyncLog writes the log asynchronously if -log.async is set.
+func setAsyncLog(out io.Writer) {
+	if *logAsync <= 0 {
+		log.SetOutput(out)
+		return
+	}
+	asyncLog = newAsyncLogWriter(out, *logAsync)
+	log.SetOutput(asyncLog)
+}
+
+// flushLog writes the queued log lines, e.g. before exiting.
+func flushLog() {
+	if asyncLog != nil {
+		asyncLog.Flush()
+	}
+}
+
+// fatalf is log.Fatalf writing the queued log lines before exiting, so that
+// the reason is not lost with -log.async.
+func fatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	flushLog()
+	os.Exit(1)
+}
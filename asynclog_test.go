@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type blockingWriter struct {
+	sync.Mutex
+	bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.Buffer.Write(p)
+}
+
+func TestAsyncLogDropsOnOverflow(t *testing.T) {
+	out := &blockingWriter{}
+	out.Lock()
+	w := newAsyncLogWriter(out, 1)
+	for i := 0; i < 5; i++ {
+		w.Write([]byte("line\n"))
+	}
+	out.Unlock()
+	w.Flush()
+	w.Write([]byte("last\n"))
+	w.Flush()
+
+	log := out.String()
+	if !strings.HasPrefix(log, "line\n") || !strings.Contains(log, "log lines dropped") || !strings.HasSuffix(log, "last\n") {
+		t.Errorf("Expected lines to be dropped and reported, but received '%s'", log)
+	}
+}
+
+type slowWriter struct{}
+
+func (slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(100 * time.Millisecond)
+	return os.Stderr.Write(p)
+}
+
+func TestFatalfFlushesAsyncLog(t *testing.T) {
+	if os.Getenv("TEEPROXY_TEST_FATALF") == "1" {
+		*logAsync = 16
+		setAsyncLog(slowWriter{})
+		fatalf("Invalid -test: %s", "the reason")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestFatalfFlushesAsyncLog")
+	cmd.Env = append(os.Environ(), "TEEPROXY_TEST_FATALF=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "Invalid -test: the reason") {
+		t.Errorf("Expected the fatal reason before exiting, but received '%s' (%v)", out, err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// With -audit, every change of the runtime configuration, pausing, the
+// percentages set through the admin endpoints, Redis or signals and the
+// policies of a reload, is appended to the file as a JSON line telling who
+// changed what when, for change tracking apart from the log.
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	// Source is who made the change, e.g. "admin request from 10.0.0.1:5312",
+	// "SIGHUP" or "redis".
+	Source string      `json:"source"`
+	Action string      `json:"action"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+var (
+	auditMutex  sync.Mutex
+	auditWriter io.Writer
+)
+
+// startAudit opens the -audit file for appending.
+func startAudit(filename string) error {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	auditMutex.Lock()
+	auditWriter = file
+	auditMutex.Unlock()
+	return nil
+}
+
+// audit appends a record of the change if -audit is set, unless nothing
+// changed.
+func audit(source, action string, before, after interface{}) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if auditWriter == nil || reflect.DeepEqual(before, after) {
+		return
+	}
+	line, err := json.Marshal(auditRecord{Time: time.Now().UTC(), Source: source, Action: action, Before: before, After: after})
+	if err != nil {
+		log.Printf("Failed to encode the audit record of %s: %s", action, err)
+		return
+	}
+	if _, err := auditWriter.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write the audit record of %s: %s", action, err)
+	}
+}
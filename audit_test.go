@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	var buffer bytes.Buffer
+	auditWriter = &buffer
+	defer func() { auditWriter = nil }()
+	defer setMirrorPercent(-1, "test")
+
+	setMirrorPercent(5, "admin request from 10.0.0.1:5312")
+	setMirrorPercent(5, "admin request from 10.0.0.1:5312")
+	audit("SIGHUP", "policies", []string{"default"}, []string{"default"})
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected a record of the change only, but received '%s'", buffer.String())
+	}
+	var record auditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Source != "admin request from 10.0.0.1:5312" || record.Action != "percent" || record.Before != nil || record.After != 5.0 {
+		t.Errorf("Expected the percent set from unset to 5, but received '%s'", lines[0])
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The Authorization header of the client is valid for production, not
+// necessarily for the alternate backends. The authorization policy of a
+// backend decides what it receives:
+//
+//	pass      the Authorization of the client, the default
+//	strip     no Authorization, or the basic auth of the backend URL
+//	static    the configured token, as Bearer unless it names its scheme
+//	exchange  the Authorization returned by a hook for the one of the client
+//
+// The exchange hook receives a POST with {"backend", "authorization"} and
+// answers {"authorization", "expires_in"}, an empty authorization stripping
+// the header. Its answers are cached until they expire, and a failing hook
+// fails the mirrored request rather than passing the production credentials.
+
+const (
+	authorizationPass     = "pass"
+	authorizationStrip    = "strip"
+	authorizationStatic   = "static"
+	authorizationExchange = "exchange"
+)
+
+// exchangedAuthorizationLimit bounds the cached exchanges per backend, when
+// reached the cache is cleared.
+const exchangedAuthorizationLimit = 10000
+
+var authorizationExchangesTotal = newCounterVec("teeproxy_authorization_exchanges_total",
+	"Number of Authorization headers exchanged through the hook by backend and result, success or error.", "backend", "result")
+
+type authorizationConfig struct {
+	// Backend is the URL of the alternate backend, as in the policies.
+	Backend string `json:"backend"`
+	// Mode is pass, strip, static or exchange.
+	Mode string `json:"mode"`
+	// Token is the static token, literally or as env:NAME or file:PATH.
+	Token string `json:"token"`
+	// Hook is the URL of the exchange hook.
+	Hook string `json:"hook"`
+}
+
+type exchangedAuthorization struct {
+	value   string
+	expires time.Time
+}
+
+// authorizationPolicy sets the Authorization of the requests to a backend.
+type authorizationPolicy struct {
+	mode    string
+	token   *secret
+	hook    string
+	backend string
+	client  *http.Client
+
+	mu        sync.Mutex
+	exchanged map[string]exchangedAuthorization
+}
+
+func newAuthorizationPolicy(config authorizationConfig) (*authorizationPolicy, error) {
+	p := &authorizationPolicy{mode: config.Mode, backend: config.Backend}
+	switch config.Mode {
+	case "", authorizationPass:
+		return nil, nil
+	case authorizationStrip:
+	case authorizationStatic:
+		if config.Token == "" {
+			return nil, fmt.Errorf("static authorization of %s requires a token", config.Backend)
+		}
+		p.token = newSecret(config.Token)
+		if _, err := p.token.Value(); err != nil {
+			return nil, fmt.Errorf("static authorization of %s: %v", config.Backend, err)
+		}
+	case authorizationExchange:
+		if _, err := parseTarget(config.Hook); err != nil {
+			return nil, fmt.Errorf("exchange authorization of %s requires a hook URL: %v", config.Backend, err)
+		}
+		p.hook = config.Hook
+		p.client = &http.Client{Timeout: time.Duration(*alternateTimeout) * time.Millisecond}
+		p.exchanged = make(map[string]exchangedAuthorization)
+	default:
+		return nil, fmt.Errorf("unknown authorization %q of %s, expected pass, strip, static or exchange", config.Mode, config.Backend)
+	}
+	return p, nil
+}
+
+// Authorization returns the Authorization for the backend given the one of
+// the client, empty to send none.
+func (p *authorizationPolicy) Authorization(client string, now time.Time) (string, error) {
+	switch p.mode {
+	case authorizationStrip:
+		return "", nil
+	case authorizationStatic:
+		token, err := p.token.Value()
+		if err != nil {
+			return "", err
+		}
+		if !strings.Contains(token, " ") {
+			token = "Bearer " + token
+		}
+		return token, nil
+	}
+	if client == "" {
+		return "", nil
+	}
+	key := sha256Hex([]byte(client))
+	p.mu.Lock()
+	cached, ok := p.exchanged[key]
+	p.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.value, nil
+	}
+	exchanged, err := p.exchange(client, now)
+	if err != nil {
+		authorizationExchangesTotal.Inc(p.backend, "error")
+		return "", fmt.Errorf("exchanging the authorization: %v", err)
+	}
+	authorizationExchangesTotal.Inc(p.backend, "success")
+	p.mu.Lock()
+	if len(p.exchanged) >= exchangedAuthorizationLimit {
+		p.exchanged = make(map[string]exchangedAuthorization)
+	}
+	p.exchanged[key] = exchanged
+	p.mu.Unlock()
+	return exchanged.value, nil
+}
+
+func (p *authorizationPolicy) exchange(client string, now time.Time) (exchangedAuthorization, error) {
+	payload, _ := json.Marshal(map[string]string{"backend": p.backend, "authorization": client})
+	response, err := p.client.Post(p.hook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return exchangedAuthorization{}, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return exchangedAuthorization{}, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return exchangedAuthorization{}, fmt.Errorf("hook returned %s", response.Status)
+	}
+	var result struct {
+		Authorization string `json:"authorization"`
+		ExpiresIn     int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return exchangedAuthorization{}, fmt.Errorf("invalid hook response: %v", err)
+	}
+	return exchangedAuthorization{value: result.Authorization, expires: now.Add(time.Duration(result.ExpiresIn) * time.Second)}, nil
+}
+
+// authorizationTransport applies the authorization policy of the backend,
+// then sends the userinfo of its URL as basic auth if there is no
+// Authorization.
+type authorizationTransport struct {
+	http.RoundTripper
+	backend *backend
+}
+
+func (t *authorizationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	policy := t.backend.AuthorizationPolicy()
+	if policy == nil && (t.backend.User == nil || req.Header.Get("Authorization") != "") {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	authorized := req.Clone(req.Context())
+	if policy != nil {
+		authorization, err := policy.Authorization(req.Header.Get("Authorization"), time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if authorization == "" {
+			authorized.Header.Del("Authorization")
+		} else {
+			authorized.Header.Set("Authorization", authorization)
+		}
+	}
+	setBasicAuth(authorized, t.backend.User)
+	return t.RoundTripper.RoundTrip(authorized)
+}
+
+// buildAuthorizationPolicies builds the authorization policies of the
+// backends, the -b.authorization flags apply to the -b backends and the
+// config file to the backends listed. The returned func sets them on the
+// backends.
+func buildAuthorizationPolicies(configs []authorizationConfig, altServers []*backend) (func(), error) {
+	policies := make(map[*backend]*authorizationPolicy)
+	for _, b := range altServers {
+		policy, err := newAuthorizationPolicy(authorizationConfig{
+			Backend: b.Alternative,
+			Mode:    *alternateAuthorization,
+			Token:   *alternateAuthToken,
+			Hook:    *alternateAuthHook,
+		})
+		if err != nil {
+			return nil, err
+		}
+		policies[b] = policy
+	}
+	for _, config := range configs {
+		b, err := parseBackend(config.Backend)
+		if err != nil {
+			return nil, err
+		}
+		config.Backend = b.Alternative
+		policy, err := newAuthorizationPolicy(config)
+		if err != nil {
+			return nil, err
+		}
+		policies[b] = policy
+	}
+	return func() {
+		for _, b := range registeredBackends() {
+			b.setAuthorizationPolicy(policies[b])
+		}
+	}, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthorizationPolicies(t *testing.T) {
+	received := make(chan string, 1)
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("Authorization")
+	}))
+	defer alternate.Close()
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer production.Close()
+	defer evictIdleConnections()
+	t.Setenv("TEEPROXY_SHADOW_TOKEN", "shadow-token")
+
+	host := strings.TrimPrefix(alternate.URL, "http://")
+	for _, tc := range []struct {
+		backend     string
+		config      authorizationConfig
+		client      string
+		expectation string
+	}{
+		{"http://" + host + "/pass", authorizationConfig{Mode: "pass"}, "Bearer production", "Bearer production"},
+		{"http://" + host + "/strip", authorizationConfig{Mode: "strip"}, "Bearer production", ""},
+		{"http://shadow:pass@" + host + "/strip-userinfo", authorizationConfig{Mode: "strip"}, "Bearer production", "Basic c2hhZG93OnBhc3M="},
+		{"http://" + host + "/static", authorizationConfig{Mode: "static", Token: "env:TEEPROXY_SHADOW_TOKEN"}, "Bearer production", "Bearer shadow-token"},
+	} {
+		h := newTestHandler(strings.TrimPrefix(production.URL, "http://"), tc.backend)
+		b := h.Alternatives[0]
+		tc.config.Backend = b.Alternative
+		policy, err := newAuthorizationPolicy(tc.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.setAuthorizationPolicy(policy)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", tc.client)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		mirrorsInFlight.Wait()
+		b.setAuthorizationPolicy(nil)
+		if authorization := <-received; authorization != tc.expectation {
+			t.Errorf("Expected '%s' for %s, but received '%s'", tc.expectation, tc.config.Mode, authorization)
+		}
+	}
+}
+
+func TestAuthorizationExchange(t *testing.T) {
+	exchanges := 0
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Backend, Authorization string }
+		json.NewDecoder(r.Body).Decode(&body)
+		exchanges++
+		if body.Authorization == "Bearer invalid" {
+			http.Error(w, "unknown token", http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"authorization": "Bearer shadow-of-" + strings.TrimPrefix(body.Authorization, "Bearer "), "expires_in": 60})
+	}))
+	defer hook.Close()
+	defer evictIdleConnections()
+
+	policy, err := newAuthorizationPolicy(authorizationConfig{Backend: "exchange.example", Mode: "exchange", Hook: hook.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if authorization, err := policy.Authorization("Bearer alice", now); err != nil || authorization != "Bearer shadow-of-alice" {
+			t.Errorf("Expected '%s', but received '%s' (%v)", "Bearer shadow-of-alice", authorization, err)
+		}
+	}
+	if exchanges != 1 {
+		t.Errorf("Expected '1' exchange, but received '%d'", exchanges)
+	}
+	if _, err := policy.Authorization("Bearer alice", now.Add(time.Minute)); err != nil || exchanges != 2 {
+		t.Errorf("Expected the expired exchange to be renewed, but received '%d' exchanges (%v)", exchanges, err)
+	}
+	if _, err := policy.Authorization("Bearer invalid", now); err == nil {
+		t.Errorf("Expected an error for a failed exchange")
+	}
+	if authorization, err := policy.Authorization("", now); err != nil || authorization != "" {
+		t.Errorf("Expected no authorization without one of the client, but received '%s'", authorization)
+	}
+}
+
+func TestInvalidAuthorizationPolicy(t *testing.T) {
+	for _, config := range []authorizationConfig{
+		{Mode: "forward"},
+		{Mode: "static"},
+		{Mode: "exchange", Hook: "ftp://hook"},
+	} {
+		if _, err := newAuthorizationPolicy(config); err == nil {
+			t.Errorf("Expected an error for '%+v'", config)
+		}
+	}
+}
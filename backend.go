@@ -0,0 +1,255 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backendDownAfterFailures is the number of consecutive failed requests after
+// which an alternate backend is considered down.
+const backendDownAfterFailures = 5
+
+type backend struct {
+	Alternative       string
+	AlternativeScheme string
+	// User is the userinfo of the backend URL, sent as basic auth
+	User *url.Userinfo
+	// template resolves the endpoint per request if the URL has placeholders
+	template *targetTemplate
+
+	// notReady is set while a health check reports the backend as unavailable
+	notReady int32
+	// warmupStart is the time in unix nanoseconds the current warm-up began
+	warmupStart int64
+	// failures counts the consecutive failed requests
+	failures int32
+	// throttledUntil is the time in unix nanoseconds the backoff requested by
+	// the backend with Retry-After ends
+	throttledUntil int64
+	// started is set once the warm-up and health checks of the backend began
+	started bool
+
+	// tokenSource holds the *tokenSource of the OAuth2 flow if configured
+	tokenSource atomic.Value
+	// bandwidth holds the *bandwidthLimiter of the backend if limited
+	bandwidth atomic.Value
+	// redirects is the number of redirects followed
+	redirects int32
+	// authorization holds the *authorizationPolicy of the backend if set
+	authorization atomic.Value
+	// uploads holds the *uploadPolicy of the backend if set
+	uploads atomic.Value
+
+	transportOnce sync.Once
+	transport     http.RoundTripper
+}
+
+// TokenSource returns the OAuth2 token source of the backend, nil if none.
+func (b *backend) TokenSource() *tokenSource {
+	source, _ := b.tokenSource.Load().(*tokenSource)
+	return source
+}
+
+func (b *backend) setTokenSource(source *tokenSource) {
+	b.tokenSource.Store(source)
+}
+
+// BandwidthLimiter returns the bandwidth limit of the backend, nil if none.
+func (b *backend) BandwidthLimiter() *bandwidthLimiter {
+	limiter, _ := b.bandwidth.Load().(*bandwidthLimiter)
+	return limiter
+}
+
+func (b *backend) setBandwidthLimiter(limiter *bandwidthLimiter) {
+	b.bandwidth.Store(limiter)
+}
+
+// RedirectLimit returns the number of redirects followed for the backend.
+func (b *backend) RedirectLimit() int {
+	return int(atomic.LoadInt32(&b.redirects))
+}
+
+func (b *backend) setRedirectLimit(limit int) {
+	atomic.StoreInt32(&b.redirects, int32(limit))
+}
+
+// AuthorizationPolicy returns the authorization policy of the backend, nil to
+// pass the Authorization of the client.
+func (b *backend) AuthorizationPolicy() *authorizationPolicy {
+	policy, _ := b.authorization.Load().(*authorizationPolicy)
+	return policy
+}
+
+func (b *backend) setAuthorizationPolicy(policy *authorizationPolicy) {
+	b.authorization.Store(policy)
+}
+
+// UploadPolicy returns the upload policy of the backend, nil to buffer the
+// bodies.
+func (b *backend) UploadPolicy() *uploadPolicy {
+	policy, _ := b.uploads.Load().(*uploadPolicy)
+	return policy
+}
+
+func (b *backend) setUploadPolicy(policy *uploadPolicy) {
+	b.uploads.Store(policy)
+}
+
+// Transport returns the transport for the requests mirrored to the backend.
+func (b *backend) Transport() http.RoundTripper {
+	b.transportOnce.Do(func() {
+		scheme := b.AlternativeScheme
+		if isServerless(scheme) {
+			scheme = "https"
+		}
+		transport := getTransport(scheme, time.Duration(*alternateTimeout)*time.Millisecond,
+			*closeConnections || *alternateCloseConnections)
+		limited := &bandwidthTransport{RoundTripper: withInvocation(withOrderedHeaders(transport), b), backend: b}
+		b.transport = &authorizationTransport{RoundTripper: withRedirects(withGzip(withSigner(&oauth2Transport{RoundTripper: limited, backend: b}, alternateSigner)), b.RedirectLimit), backend: b}
+	})
+	return b.transport
+}
+
+// startBackends begins the warm-up and the health checks of the backends not
+// started yet.
+func startBackends(alternatives []*backend) {
+	for _, alt := range alternatives {
+		if alt.started {
+			continue
+		}
+		alt.started = true
+		alt.startWarmup()
+		if *grpcHealth && alt.template == nil {
+			alt.setReady(false)
+			go watchGrpcBackend(alt)
+		}
+	}
+}
+
+// Ready reports whether requests should be mirrored to the backend.
+func (b *backend) Ready() bool {
+	return atomic.LoadInt32(&b.notReady) == 0
+}
+
+func (b *backend) setReady(ready bool) {
+	var notReady int32
+	if !ready {
+		notReady = 1
+	}
+	if atomic.SwapInt32(&b.notReady, notReady) == 1 && ready {
+		b.startWarmup()
+	}
+}
+
+// startWarmup restarts ramping the mirrored traffic from 0.
+func (b *backend) startWarmup() {
+	atomic.StoreInt64(&b.warmupStart, time.Now().UnixNano())
+}
+
+// warmupFactor is the fraction of the sampled traffic to mirror to the backend
+// while it warms up.
+func (b *backend) warmupFactor(now time.Time) float64 {
+	if *alternateWarmup <= 0 {
+		return 1
+	}
+	elapsed := now.Sub(time.Unix(0, atomic.LoadInt64(&b.warmupStart)))
+	factor := elapsed.Seconds() / float64(*alternateWarmup)
+	if factor >= 1 {
+		return 1
+	}
+	if factor < 0 {
+		return 0
+	}
+	return factor
+}
+
+// warmedUp decides whether a sampled request is mirrored to the backend
+// considering the warm-up ramp.
+func (b *backend) warmedUp(randomizer *rand.Rand) bool {
+	factor := b.warmupFactor(time.Now())
+	return factor >= 1 || randomizer.Float64() < factor
+}
+
+// recordOutcome tracks consecutive failures, a backend recovering from being
+// down starts a new warm-up.
+func (b *backend) recordOutcome(success bool) {
+	if !success {
+		if atomic.AddInt32(&b.failures, 1) == backendDownAfterFailures {
+			log.Printf("Alternate backend %s is down after %d failed requests", b.Alternative, backendDownAfterFailures)
+		}
+		return
+	}
+	if atomic.SwapInt32(&b.failures, 0) >= backendDownAfterFailures {
+		log.Printf("Alternate backend %s recovered", b.Alternative)
+		b.startWarmup()
+	}
+}
+
+var backendThrottledTotal = newCounterVec("teeproxy_backend_throttled_total",
+	"Number of 429 and 503 responses with Retry-After starting or extending a backoff of the alternate backend.", "backend")
+
+// retryAfter parses the Retry-After header given in seconds or as a date.
+func retryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return date.Sub(now), true
+	}
+	return 0, false
+}
+
+// recordThrottling starts a backoff when the backend answers 429 or 503 with
+// Retry-After, limited to -b.backoff.max seconds.
+func (b *backend) recordThrottling(response *http.Response) {
+	if response == nil || (response.StatusCode != http.StatusTooManyRequests && response.StatusCode != http.StatusServiceUnavailable) {
+		return
+	}
+	now := time.Now()
+	delay, ok := retryAfter(response.Header.Get("Retry-After"), now)
+	if !ok || delay <= 0 {
+		return
+	}
+	if max := time.Duration(*alternateBackoffMax) * time.Second; delay > max {
+		delay = max
+	}
+	until := now.Add(delay).UnixNano()
+	for {
+		current := atomic.LoadInt64(&b.throttledUntil)
+		if until <= current {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&b.throttledUntil, current, until) {
+			break
+		}
+	}
+	backendThrottledTotal.Inc(b.Alternative)
+	log.Printf("Alternate backend %s answered %s, mirroring %v%% of the requests for %v",
+		b.Alternative, response.Status, *alternateBackoffPercent, delay)
+}
+
+// Throttled reports whether the backend asked to back off.
+func (b *backend) Throttled(now time.Time) bool {
+	return now.UnixNano() < atomic.LoadInt64(&b.throttledUntil)
+}
+
+// admitThrottled decides whether a sampled request is mirrored to the backend
+// considering its backoff.
+func (b *backend) admitThrottled(randomizer *rand.Rand) bool {
+	if !b.Throttled(time.Now()) {
+		return true
+	}
+	return *alternateBackoffPercent > 0 && randomizer.Float64()*100 < *alternateBackoffPercent
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestWarmupFactor(t *testing.T) {
+	defer func(warmup int) { *alternateWarmup = warmup }(*alternateWarmup)
+	*alternateWarmup = 10
+
+	b := &backend{}
+	b.startWarmup()
+	start := time.Unix(0, b.warmupStart)
+	for elapsed, expectation := range map[time.Duration]float64{
+		0:                0,
+		5 * time.Second:  0.5,
+		10 * time.Second: 1,
+		20 * time.Second: 1,
+	} {
+		if factor := b.warmupFactor(start.Add(elapsed)); factor != expectation {
+			t.Errorf("Expected '%v', but received '%v'", expectation, factor)
+		}
+	}
+}
+
+func TestWarmupRestartsAfterRecovery(t *testing.T) {
+	defer func(warmup int) { *alternateWarmup = warmup }(*alternateWarmup)
+	*alternateWarmup = 10
+
+	b := &backend{}
+	b.warmupStart = time.Now().Add(-time.Minute).UnixNano()
+	for i := 0; i < backendDownAfterFailures; i++ {
+		b.recordOutcome(false)
+	}
+	if factor := b.warmupFactor(time.Now()); factor != 1 {
+		t.Errorf("Expected '1', but received '%v'", factor)
+	}
+	b.recordOutcome(true)
+	if factor := b.warmupFactor(time.Now()); factor > 0.1 {
+		t.Errorf("Expected the warm-up to restart, but received '%v'", factor)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for header, expectation := range map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"Mon, 01 Jan 2024 12:00:30 GMT": 30 * time.Second,
+	} {
+		if delay, ok := retryAfter(header, now); !ok || delay != expectation {
+			t.Errorf("Expected '%v' for '%s', but received '%v'", expectation, header, delay)
+		}
+	}
+	for _, header := range []string{"", "-1", "soon"} {
+		if _, ok := retryAfter(header, now); ok {
+			t.Errorf("Expected '%s' to be invalid", header)
+		}
+	}
+}
+
+func TestThrottling(t *testing.T) {
+	defer func(max int) { *alternateBackoffMax = max }(*alternateBackoffMax)
+	*alternateBackoffMax = 60
+
+	b := &backend{Alternative: "shadow:8081"}
+	b.recordThrottling(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}})
+	if b.Throttled(time.Now()) {
+		t.Errorf("Expected no backoff without Retry-After")
+	}
+	b.recordThrottling(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"3600"}}})
+	if !b.Throttled(time.Now().Add(59 * time.Second)) {
+		t.Errorf("Expected a backoff")
+	}
+	if b.Throttled(time.Now().Add(61 * time.Second)) {
+		t.Errorf("Expected the backoff to be capped at -b.backoff.max")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The bytes of the mirrored requests and of their responses can be limited
+// per alternate backend, so that large bodies shadowed across regions do not
+// saturate the link to the test environment. The limit is a token bucket
+// holding one second of traffic, shared by all requests to the backend.
+
+var bandwidthWaitSeconds = newCounterVec("teeproxy_bandwidth_wait_seconds_total",
+	"Seconds the mirrored requests waited for the bandwidth limit of their backend.", "backend")
+
+type bandwidthConfig struct {
+	// Backend is the URL of the alternate backend, as in the policies.
+	Backend string `json:"backend"`
+	// BytesPerSecond is the limit of the request and response bodies.
+	BytesPerSecond int64 `json:"bytes_per_second"`
+}
+
+type bandwidthLimiter struct {
+	backend string
+	rate    float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBandwidthLimiter(backend string, bytesPerSecond int64) *bandwidthLimiter {
+	return &bandwidthLimiter{backend: backend, rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond)}
+}
+
+// reserve takes n bytes and returns how long to wait until they may be
+// transferred.
+func (l *bandwidthLimiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+func (l *bandwidthLimiter) wait(n int) {
+	if delay := l.reserve(n, time.Now()); delay > 0 {
+		bandwidthWaitSeconds.Add(delay.Seconds(), l.backend)
+		time.Sleep(delay)
+	}
+}
+
+// limitedBody reads a body at the rate of the limiter, in parts of at most a
+// tenth of a second of traffic.
+type limitedBody struct {
+	io.ReadCloser
+	limiter *bandwidthLimiter
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if max := int(b.limiter.rate / 10); max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.limiter.wait(n)
+	}
+	return n, err
+}
+
+// bandwidthTransport limits the bodies of the requests to a backend and of
+// their responses.
+type bandwidthTransport struct {
+	http.RoundTripper
+	backend *backend
+}
+
+func (t *bandwidthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	limiter := t.backend.BandwidthLimiter()
+	if limiter == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		limited := req.Clone(req.Context())
+		limited.Body = &limitedBody{ReadCloser: req.Body, limiter: limiter}
+		req = limited
+	}
+	response, err := t.RoundTripper.RoundTrip(req)
+	if response != nil {
+		response.Body = &limitedBody{ReadCloser: response.Body, limiter: limiter}
+	}
+	return response, err
+}
+
+// buildBandwidthLimits builds the bandwidth limits of the backends,
+// -b.bandwidth applies to the -b backends and the config file to the
+// backends listed. The returned func sets them on the backends.
+func buildBandwidthLimits(configs []bandwidthConfig, altServers []*backend) (func(), error) {
+	limiters := make(map[*backend]*bandwidthLimiter)
+	if *alternateBandwidth > 0 {
+		for _, b := range altServers {
+			limiters[b] = newBandwidthLimiter(b.Alternative, *alternateBandwidth)
+		}
+	}
+	for _, config := range configs {
+		if config.BytesPerSecond <= 0 {
+			return nil, fmt.Errorf("bandwidth of %s must be positive", config.Backend)
+		}
+		b, err := parseBackend(config.Backend)
+		if err != nil {
+			return nil, err
+		}
+		limiters[b] = newBandwidthLimiter(b.Alternative, config.BytesPerSecond)
+	}
+	return func() {
+		for _, b := range registeredBackends() {
+			b.setBandwidthLimiter(limiters[b])
+		}
+	}, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthReserve(t *testing.T) {
+	l := newBandwidthLimiter("localhost", 1000)
+	now := time.Now()
+	if delay := l.reserve(1000, now); delay != 0 {
+		t.Errorf("Expected the burst of one second, but received '%v'", delay)
+	}
+	if delay := l.reserve(500, now); delay != 500*time.Millisecond {
+		t.Errorf("Expected '%v', but received '%v'", 500*time.Millisecond, delay)
+	}
+	// the bucket refills at the rate
+	if delay := l.reserve(500, now.Add(time.Second)); delay != 0 {
+		t.Errorf("Expected '%v', but received '%v'", time.Duration(0), delay)
+	}
+}
+
+func TestBandwidthTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+	b := &backend{Alternative: "limited"}
+	b.setBandwidthLimiter(newBandwidthLimiter(b.Alternative, 20000))
+	transport := &bandwidthTransport{RoundTripper: getTransport("http", time.Second, false), backend: b}
+
+	start := time.Now()
+	request, _ := http.NewRequest("POST", server.URL, strings.NewReader(strings.Repeat("x", 12000)))
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoed, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	// 24000 bytes sent and received, 4000 above the burst
+	if elapsed := time.Since(start); len(echoed) != 12000 || elapsed < 150*time.Millisecond {
+		t.Errorf("Expected the 12000 bytes to take at least 150ms, but received %d bytes in '%v'", len(echoed), elapsed)
+	}
+}
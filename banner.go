@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+)
+
+// Once started, teeproxy logs a single line `| STARTUP | {...}` describing
+// what it runs: the listeners, the targets, the TLS mode, the sampling and
+// the subsystems enabled, without the credentials, like /config.
+// Orchestration tooling can verify a deployment by parsing the log instead
+// of probing the behavior.
+
+type startupTLS struct {
+	// Mode is off, tls or mutual.
+	Mode      string `json:"mode"`
+	Plaintext string `json:"plaintext,omitempty"`
+	Redirect  string `json:"redirect,omitempty"`
+}
+
+type startupSampling struct {
+	Strategy string  `json:"strategy"`
+	Key      string  `json:"key,omitempty"`
+	Percent  float64 `json:"percent"`
+	Rate     float64 `json:"rate,omitempty"`
+}
+
+type startupBanner struct {
+	Version    string              `json:"version"`
+	PID        int                 `json:"pid"`
+	Listen     string              `json:"listen"`
+	Admin      string              `json:"admin,omitempty"`
+	TLS        startupTLS          `json:"tls"`
+	Target     string              `json:"target"`
+	Sampling   startupSampling     `json:"sampling"`
+	Policies   []effectivePolicy   `json:"policies"`
+	Listeners  []effectiveListener `json:"listeners,omitempty"`
+	Subsystems []string            `json:"subsystems"`
+}
+
+// enabledSubsystems returns the names of the optional subsystems enabled.
+func enabledSubsystems() []string {
+	subsystems := []string{}
+	for name, enabled := range map[string]bool{
+		"analyze":       *analyzeSocket != "",
+		"audit":         *auditLog != "",
+		"body-checksum": *bodyChecksumHeader != "",
+		"capture":       *captureURL != "",
+		"compare":       *compareResponses,
+		"delay":         *mirrorDelay > 0,
+		"feature-flags": *flagProvider != "",
+		"record":        *recordFile != "",
+		"redis":         *redisAddress != "",
+		"safe-defaults": *safeDefaultsPreset,
+		"sequential":    *mirrorSequential,
+		"signing":       *productionSign != "" || *alternateSign != "",
+		"slowlog":       *slowLog > 0,
+		"verify":        *verifyHMACKey != "",
+		"webhook-fork":  *webhookDestinations != "",
+	} {
+		if enabled {
+			subsystems = append(subsystems, name)
+		}
+	}
+	sort.Strings(subsystems)
+	return subsystems
+}
+
+// newStartupBanner describes the running handler and listeners.
+func newStartupBanner(h *handler, instances []*instance, listen string) startupBanner {
+	effective := effectiveConfiguration(h, instances)
+	b := startupBanner{
+		Version:    version,
+		PID:        os.Getpid(),
+		Listen:     listen,
+		Admin:      *adminListen,
+		TLS:        startupTLS{Mode: "off"},
+		Target:     effective.Target,
+		Policies:   effective.Policies,
+		Listeners:  effective.Listeners,
+		Subsystems: enabledSubsystems(),
+		Sampling: startupSampling{
+			Strategy: *sampleStrategy,
+			Key:      *sampleKeySource,
+			Percent:  *percent,
+			Rate:     *sampleRate,
+		},
+	}
+	if *tlsPrivateKey != "" {
+		b.TLS = startupTLS{Mode: "tls", Plaintext: *tlsPlaintext, Redirect: *tlsRedirect}
+		if *tlsClientCA != "" {
+			b.TLS.Mode = "mutual"
+		}
+	}
+	if b.Sampling.Strategy == "" {
+		b.Sampling.Strategy = "percentage"
+		if *sampleKeySource != "" {
+			b.Sampling.Strategy = "consistent"
+		}
+	}
+	if value, ok := mirrorPercent(); ok {
+		b.Sampling.Percent = value
+	}
+	return b
+}
+
+// logStartupBanner logs the startup banner as a JSON line.
+func logStartupBanner(h *handler, instances []*instance, listen string) {
+	banner, err := json.Marshal(newStartupBanner(h, instances, listen))
+	if err != nil {
+		log.Printf("Failed to describe the startup: %s", err)
+		return
+	}
+	log.Printf("| STARTUP | %s", banner)
+}
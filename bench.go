@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// -bench-inprocess loops synthetic requests through the handler, proxying to
+// and mirroring to in-process stub backends like `teeproxy test`, and
+// reports the throughput, so that changes to the hot path can be measured
+// with the other flags, e.g. -compare, as configured. The log is discarded
+// while it runs.
+
+// benchResult is the outcome of an in-process benchmark.
+type benchResult struct {
+	Requests  int
+	Mirrored  int
+	Failed    int
+	Duration  time.Duration
+	Latencies []time.Duration // sorted
+	Allocs    uint64
+}
+
+// Throughput returns the requests per second.
+func (r benchResult) Throughput() float64 {
+	return float64(r.Requests) / r.Duration.Seconds()
+}
+
+// Percentile returns the latency of ServeHTTP at the percentile.
+func (r benchResult) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	return r.Latencies[int(p/100*float64(len(r.Latencies)-1))]
+}
+
+func (r benchResult) String() string {
+	return fmt.Sprintf("%d requests in %s: %.0f req/s, p50 %s, p99 %s, %d allocs/req, %d mirrored, %d failed",
+		r.Requests, r.Duration.Round(time.Millisecond), r.Throughput(), r.Percentile(50), r.Percentile(99),
+		r.Allocs/uint64(r.Requests), r.Mirrored, r.Failed)
+}
+
+// runInProcessBenchmark sends the requests through the handler, concurrency
+// at once, with bodies of bodySize bytes, and waits for the mirrored ones.
+func runInProcessBenchmark(requests, concurrency, bodySize int) (benchResult, error) {
+	normalizers, err := parseNormalizers(*compareNormalize)
+	if err != nil {
+		return benchResult{}, err
+	}
+	compareNormalizers = normalizers
+	a, err := newStubBackend("a")
+	if err != nil {
+		return benchResult{}, err
+	}
+	defer a.Close()
+	b, err := newStubBackend("b")
+	if err != nil {
+		return benchResult{}, err
+	}
+	defer b.Close()
+	a.Discard, b.Discard = true, true
+	h := newHarnessHandler(a, b)
+	body := bytes.Repeat([]byte("x"), bodySize)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	latencies := make([]time.Duration, requests)
+	var failed int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	next := make(chan int)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				req := httptest.NewRequest("GET", fmt.Sprintf("/bench/items/%d?page=%d", i, i%10), nil)
+				if bodySize > 0 {
+					req = httptest.NewRequest("POST", fmt.Sprintf("/bench/items/%d", i), bytes.NewReader(body))
+				}
+				recorder := httptest.NewRecorder()
+				began := time.Now()
+				h.ServeHTTP(recorder, req)
+				latencies[i] = time.Since(began)
+				if recorder.Code != http.StatusOK {
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	mirrorsInFlight.Wait()
+	duration := time.Since(start)
+	runtime.ReadMemStats(&after)
+	evictIdleConnections()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return benchResult{
+		Requests:  requests,
+		Mirrored:  b.Count(),
+		Failed:    failed,
+		Duration:  duration,
+		Latencies: latencies,
+		Allocs:    after.Mallocs - before.Mallocs,
+	}, nil
+}
+
+// benchCommand implements -bench-inprocess, it exits with 1 if requests
+// failed.
+func benchCommand() int {
+	log.SetOutput(ioutil.Discard)
+	result, err := runInProcessBenchmark(*benchRequests, *benchConcurrency, *benchBodySize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to benchmark: %s\n", err)
+		return 1
+	}
+	fmt.Printf("| BENCH | %d concurrent, %dB bodies, %s\n", *benchConcurrency, *benchBodySize, result)
+	if result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInProcessBenchmark(t *testing.T) {
+	result, err := runInProcessBenchmark(50, 4, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Requests != 50 || result.Mirrored != 50 || result.Failed != 0 {
+		t.Errorf("Expected 50 requests mirrored without failures, but received '%s'", result)
+	}
+	if result.Percentile(50) > result.Percentile(99) {
+		t.Errorf("Expected sorted latencies, but received '%s'", result)
+	}
+}
+
+// BenchmarkServeHTTP forwards requests through the handler to in-process
+// backends, mirroring all of them.
+func BenchmarkServeHTTP(b *testing.B) {
+	a, err := newStubBackend("a")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer a.Close()
+	alt, err := newStubBackend("b")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer alt.Close()
+	a.Discard, alt.Discard = true, true
+	h := newHarnessHandler(a, alt)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/items?id=1", nil))
+	}
+	mirrorsInFlight.Wait()
+	evictIdleConnections()
+}
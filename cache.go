@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An in-memory LRU cache of production responses to GET requests, enabled
+// per route by the "cache" rules of the -config file. The Cache-Control and
+// Expires headers of the responses are honored, mirroring is not affected.
+
+// cacheRule makes the matching requests cacheable.
+type cacheRule struct {
+	Name string
+	Path *regexp.Regexp
+	Host *regexp.Regexp
+	// TTL is used for responses without max-age or Expires, such responses
+	// are not cached if 0.
+	TTL time.Duration
+}
+
+// Matches reports whether the request fulfills all filters of the rule.
+func (r *cacheRule) Matches(req *http.Request) bool {
+	if r.Path != nil && !r.Path.MatchString(req.URL.Path) {
+		return false
+	}
+	if r.Host != nil && !r.Host.MatchString(req.Host) {
+		return false
+	}
+	return true
+}
+
+type cacheRuleConfig struct {
+	Name string `json:"name"`
+	// Path and Host are regular expressions, all given must match.
+	Path string `json:"path"`
+	Host string `json:"host"`
+	// TTL in seconds for responses without max-age or Expires.
+	TTL int `json:"ttl"`
+}
+
+func (cc cacheRuleConfig) build() (*cacheRule, error) {
+	r := &cacheRule{Name: cc.Name, TTL: time.Duration(cc.TTL) * time.Second}
+	var err error
+	if r.Path, err = compileOptional("path", cc.Path); err != nil {
+		return nil, fmt.Errorf("cache %q: %v", cc.Name, err)
+	}
+	if r.Host, err = compileOptional("host", cc.Host); err != nil {
+		return nil, fmt.Errorf("cache %q: %v", cc.Name, err)
+	}
+	return r, nil
+}
+
+// buildCacheRules creates the cache rules of the config.
+func (c *config) buildCacheRules() (rules []*cacheRule, err error) {
+	for _, cc := range c.Cache {
+		r, err := cc.build()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func logCacheRules(rules []*cacheRule) {
+	for _, r := range rules {
+		log.Printf("Cache %s stores the matching production responses up to %d MiB in total", r.Name, *cacheSize)
+	}
+}
+
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func (c *cachedResponse) size() int64 {
+	size := int64(len(c.key) + len(c.body))
+	for k, values := range c.header {
+		for _, v := range values {
+			size += int64(len(k) + len(v))
+		}
+	}
+	return size
+}
+
+// responseCache evicts the least recently used responses when full.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List
+	size    int64
+}
+
+var responses = &responseCache{entries: make(map[string]*list.Element)}
+
+var cacheRequestsTotal = newCounterVec("teeproxy_cache_requests_total",
+	"Cacheable requests by result, hit or miss.", "result")
+
+// Get returns the fresh response stored for the key.
+func (c *responseCache) Get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	cached := element.Value.(*cachedResponse)
+	if time.Now().After(cached.expires) {
+		c.remove(element)
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return cached
+}
+
+// Put stores the response, evicting others to stay below the limit.
+func (c *responseCache) Put(cached *cachedResponse, limit int64) {
+	size := cached.size()
+	if size > limit {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[cached.key]; ok {
+		c.remove(element)
+	}
+	for c.size+size > limit {
+		c.remove(c.lru.Back())
+	}
+	c.entries[cached.key] = c.lru.PushFront(cached)
+	c.size += size
+}
+
+func (c *responseCache) remove(element *list.Element) {
+	cached := c.lru.Remove(element).(*cachedResponse)
+	delete(c.entries, cached.key)
+	c.size -= cached.size()
+}
+
+// cacheKey returns the key of a cacheable request, or "" if the request
+// must not be answered from the cache.
+func cacheKey(req *http.Request) string {
+	if req.Method != "GET" || req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" {
+		return ""
+	}
+	directives := req.Header.Get("Cache-Control") + "," + req.Header.Get("Pragma")
+	if hasDirective(directives, "no-cache") || hasDirective(directives, "no-store") {
+		return ""
+	}
+	return req.Host + " " + req.URL.RequestURI()
+}
+
+func hasDirective(header, name string) bool {
+	_, ok := directive(header, name)
+	return ok
+}
+
+// directive returns the value of a Cache-Control directive.
+func directive(header, name string) (string, bool) {
+	for _, d := range strings.Split(header, ",") {
+		d = strings.TrimSpace(d)
+		key, value, _ := strings.Cut(d, "=")
+		if strings.EqualFold(key, name) {
+			return strings.Trim(value, `"`), true
+		}
+	}
+	return "", false
+}
+
+// freshness returns how long the response may be cached, 0 if it must not.
+func freshness(resp *http.Response, ttl time.Duration) time.Duration {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") != "" {
+		return 0
+	}
+	cacheControl := resp.Header.Get("Cache-Control")
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if hasDirective(cacheControl, name) {
+			return 0
+		}
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directive(cacheControl, name); ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	if expires := resp.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return time.Until(t)
+	}
+	return ttl
+}
+
+// serveCached writes a cached response with its Age header.
+func serveCached(w http.ResponseWriter, cached *cachedResponse) {
+	for k, v := range cached.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(cached.stored).Seconds())))
+	w.WriteHeader(cached.status)
+	w.Write(cached.body)
+}
+
+// cachingBody buffers a response body while it is forwarded to the client
+// and stores the response once the body is complete. A body larger than the
+// cache, as announced or read, is not buffered any further.
+type cachingBody struct {
+	io.Reader
+	buffer limitedBuffer
+	cached *cachedResponse
+	limit  int64
+}
+
+func newCachingBody(body io.Reader, key string, resp *http.Response, ttl time.Duration) *cachingBody {
+	now := time.Now()
+	c := &cachingBody{
+		cached: &cachedResponse{key: key, status: resp.StatusCode, header: resp.Header.Clone(), stored: now, expires: now.Add(ttl)},
+		limit:  int64(*cacheSize) << 20,
+	}
+	c.buffer.limit = c.limit
+	c.buffer.exceeded = resp.ContentLength > c.limit
+	c.Reader = io.TeeReader(body, &c.buffer)
+	return c
+}
+
+// store caches the response if the body was read without error.
+func (c *cachingBody) store(err error) {
+	if err != nil || c.buffer.exceeded {
+		return
+	}
+	c.cached.body = c.buffer.Bytes()
+	responses.Put(c.cached, c.limit)
+}
+
+// limitedBuffer buffers the bytes written until they exceed the limit, then
+// drops them and ignores the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int64
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if !b.exceeded && int64(b.Len()+len(p)) > b.limit {
+		b.exceeded = true
+		b.Buffer = bytes.Buffer{}
+	}
+	if b.exceeded {
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	defer func(cache *responseCache) { responses = cache }(responses)
+	responses = &responseCache{entries: make(map[string]*list.Element)}
+
+	calls := 0
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("content"))
+	}))
+	defer production.Close()
+
+	h := newTestHandler(production.URL)
+	h.SetCacheRules([]*cacheRule{{Name: "all"}})
+	for _, test := range []struct {
+		path  string
+		calls int
+	}{
+		{"/static/app.js", 1},
+		{"/static/app.js", 1},
+		{"/private", 2},
+		{"/private", 3},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Body.String() != "content" {
+			t.Errorf("Expected 'content', but received '%s'", w.Body)
+		}
+		if calls != test.calls {
+			t.Errorf("Expected '%d' calls of the production target, but received '%d'", test.calls, calls)
+		}
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	for header, expectation := range map[string]time.Duration{
+		"max-age=60":              time.Minute,
+		"public, s-maxage=10":     10 * time.Second,
+		"no-store":                0,
+		"max-age=60, no-cache":    0,
+		"":                        5 * time.Second,
+		"max-age=\"invalid\"":     0,
+		"max-age=30, s-maxage=20": 20 * time.Second,
+	} {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+		if header != "" {
+			resp.Header.Set("Cache-Control", header)
+		}
+		if ttl := freshness(resp, 5*time.Second); ttl != expectation {
+			t.Errorf("Expected '%s' for '%s', but received '%s'", expectation, header, ttl)
+		}
+	}
+}
+
+func TestCachingBodyOverLimit(t *testing.T) {
+	defer func(cache *responseCache) { responses = cache }(responses)
+	responses = &responseCache{entries: make(map[string]*list.Element)}
+	defer func(size int) { *cacheSize = size }(*cacheSize)
+	*cacheSize = 1
+
+	large := bytes.Repeat([]byte("x"), 2<<20)
+	for _, length := range []int64{-1, int64(len(large))} {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, ContentLength: length}
+		c := newCachingBody(bytes.NewReader(large), "/large", resp, time.Minute)
+		buffered := 0
+		for chunk := make([]byte, 32<<10); ; {
+			_, err := c.Read(chunk)
+			if c.buffer.Len() > buffered {
+				buffered = c.buffer.Len()
+			}
+			if err != nil {
+				c.store(nil)
+				break
+			}
+		}
+		if buffered > 1<<20 || !c.buffer.exceeded {
+			t.Errorf("Expected the buffering to stop at the limit, but buffered '%d' bytes", buffered)
+		}
+		if responses.Get("/large") != nil {
+			t.Errorf("Expected the large response not to be cached")
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// With -body.checksum, the request body is read into memory and its SHA-256
+// attached as a header to the production and mirrored requests and to the
+// recordings, so that downstream consumers can verify that the duplication,
+// anonymization or any other transformation did not corrupt the payload. The
+// value is the hex digest, or the RFC 9530 sha-256=:<base64>: form if the
+// header is Content-Digest. A value sent by the client is replaced.
+
+// setBodyChecksum buffers the body of the request and sets its checksum
+// header, bodyless requests are left alone.
+func setBodyChecksum(req *http.Request, header string) error {
+	if isBodyless(req) {
+		return nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.Header.Set(header, bodyChecksum(body, header))
+	return nil
+}
+
+// bodyChecksum formats the SHA-256 of the body for the header.
+func bodyChecksum(body []byte, header string) string {
+	sum := sha256.Sum256(body)
+	if strings.EqualFold(header, "Content-Digest") {
+		return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	}
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBodyChecksum(t *testing.T) {
+	defer func(v string) { *bodyChecksumHeader = v }(*bodyChecksumHeader)
+	*bodyChecksumHeader = "X-Body-Sha256"
+	sink := &memorySink{}
+	defer func(s exchangeSink) { recordSink = s }(recordSink)
+	recordSink = sink
+
+	var mu sync.Mutex
+	received := make(map[string]string)
+	record := func(side string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			mu.Lock()
+			received[side] = r.Header.Get("X-Body-Sha256") + " " + string(body)
+			mu.Unlock()
+		}
+	}
+	production := httptest.NewServer(record("a"))
+	defer production.Close()
+	alternate := httptest.NewServer(record("b"))
+	defer alternate.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler(production.URL, alternate.URL+"/checksum")
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("hello"))
+	req.Header.Set("X-Body-Sha256", "forged")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	mirrorsInFlight.Wait()
+
+	expectation := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824 hello"
+	for _, side := range []string{"a", "b"} {
+		if received[side] != expectation {
+			t.Errorf("Expected '%s' for %s, but received '%s'", expectation, side, received[side])
+		}
+	}
+	if checksum := sink.wait(t).Header.Get("X-Body-Sha256"); !strings.HasPrefix(expectation, checksum) || checksum == "" {
+		t.Errorf("Expected the recorded checksum, but received '%s'", checksum)
+	}
+
+	if digest := bodyChecksum([]byte("hello"), "Content-Digest"); digest != "sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:" {
+		t.Errorf("Expected 'sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:', but received '%s'", digest)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// When teeproxy terminates TLS, the backends lose sight of the client
+// connection. With -tls.client-headers, the negotiated version and cipher
+// suite, and the subject and SHA-256 fingerprint of a client certificate
+// verified by -tls.client-ca, are sent to A and B as headers. Headers of
+// these names sent by the clients are removed, so they cannot be forged.
+
+var clientTLSHeaders = []string{"X-Client-Tls-Version", "X-Client-Tls-Cipher", "X-Client-Cert-Subject", "X-Client-Cert-Fingerprint"}
+
+// setClientTLSHeaders replaces the client TLS headers of the request by the
+// metadata of its connection.
+func setClientTLSHeaders(req *http.Request) {
+	for _, name := range clientTLSHeaders {
+		req.Header.Del(name)
+	}
+	if req.TLS == nil {
+		return
+	}
+	req.Header.Set("X-Client-Tls-Version", tls.VersionName(req.TLS.Version))
+	req.Header.Set("X-Client-Tls-Cipher", tls.CipherSuiteName(req.TLS.CipherSuite))
+	// unverified certificates are not worth a policy decision
+	if len(req.TLS.VerifiedChains) > 0 {
+		cert := req.TLS.PeerCertificates[0]
+		req.Header.Set("X-Client-Cert-Subject", cert.Subject.String())
+		req.Header.Set("X-Client-Cert-Fingerprint", sha256Hex(cert.Raw))
+	}
+}
+
+// loadCertPool reads the PEM certificates of the file.
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", filename)
+	}
+	return pool, nil
+}
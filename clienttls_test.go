@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestClientTLSHeaders(t *testing.T) {
+	defer func(v bool) { *tlsClientHeaders = v }(*tlsClientHeaders)
+	*tlsClientHeaders = true
+
+	var mu sync.Mutex
+	var received []http.Header
+	record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, r.Header)
+		mu.Unlock()
+	})
+	a := httptest.NewServer(record)
+	defer a.Close()
+	b := httptest.NewServer(record)
+	defer b.Close()
+	defer evictIdleConnections()
+
+	cert := &x509.Certificate{Raw: []byte("certificate"), Subject: pkix.Name{CommonName: "billing", Organization: []string{"Example"}}}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256,
+		PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	h := newTestHandler(strings.TrimPrefix(a.URL, "http://"), strings.TrimPrefix(b.URL, "http://"))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	mirrorsInFlight.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("Expected '2' requests, but received '%d'", len(received))
+	}
+	for _, header := range received {
+		for name, expectation := range map[string]string{
+			"X-Client-Tls-Version":      "TLS 1.3",
+			"X-Client-Tls-Cipher":       "TLS_AES_128_GCM_SHA256",
+			"X-Client-Cert-Subject":     "CN=billing,O=Example",
+			"X-Client-Cert-Fingerprint": sha256Hex([]byte("certificate")),
+		} {
+			if value := header.Get(name); value != expectation {
+				t.Errorf("Expected '%s' for %s, but received '%s'", expectation, name, value)
+			}
+		}
+	}
+
+	forged := httptest.NewRequest("GET", "/", nil)
+	forged.Header.Set("X-Client-Cert-Subject", "CN=admin")
+	setClientTLSHeaders(forged)
+	if subject := forged.Header.Get("X-Client-Cert-Subject"); subject != "" {
+		t.Errorf("Expected the forged header removed, but received '%s'", subject)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -compare, the response of every mirrored request is compared to the
+// production response: the status, the -compare.headers and the body. Both
+// sides are normalized first, so that implementations differing only in the
+// order of query parameters or JSON keys, or in the whitespace of headers,
+// are not reported.
+
+var comparisonsTotal = newCounterVec("teeproxy_comparisons_total",
+	"Number of mirrored responses compared to the production response by result, match, mismatch, error or skipped.", "route", "result")
+
+// normalizer rewrites a compared response in place.
+type normalizer func(r *comparedResponse)
+
+var normalizers = map[string]normalizer{
+	"query":   normalizeQuery,
+	"json":    normalizeJSON,
+	"headers": normalizeHeaders,
+	"grpc":    normalizeGrpc,
+	"xml":     normalizeXML,
+}
+
+// parseNormalizers parses the comma separated -compare.normalize.
+func parseNormalizers(spec string) ([]normalizer, error) {
+	var result []normalizer
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		n, ok := normalizers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown normalization %q, expected query, json, headers, grpc or xml", name)
+		}
+		if name == "xml" {
+			paths, err := parseXMLPaths(*compareXMLIgnore)
+			if err != nil {
+				return nil, fmt.Errorf("-compare.xml-ignore: %v", err)
+			}
+			xmlIgnorePaths = paths
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+// compareNormalizers are the normalizations of -compare.normalize, set in main
+// and by newHarness.
+var compareNormalizers []normalizer
+
+// responseComparison pairs the production response of a request with the
+// ones of its mirrored requests, whichever finishes last compares them.
+type responseComparison struct {
+	method string
+	uri    string
+	route  string
+
+	mu         sync.Mutex
+	production *comparedResponse
+	alternates []*comparedResponse
+	// skipped are the production statuses the mirrored responses are not
+	// compared to, e.g. 304 if their conditions were stripped
+	skipped []int
+}
+
+// comparedResponse is a response captured for the comparison, its body
+// limited to -compare.body bytes.
+type comparedResponse struct {
+	comparison *responseComparison
+	side       string
+	backend    string
+	started    time.Time
+	latency    time.Duration
+	status     int
+	header     http.Header
+	body       bytes.Buffer
+	truncated  bool
+	// messages are the recorded gRPC messages decoded to JSON, and decoded
+	// is set if the body was replaced by them
+	messages json.RawMessage
+	decoded  bool
+}
+
+// newResponseComparison returns nil unless -compare is set.
+func newResponseComparison(req *http.Request, route string) *responseComparison {
+	if !*compareResponses {
+		return nil
+	}
+	return &responseComparison{method: req.Method, uri: req.URL.RequestURI(), route: route}
+}
+
+// response starts capturing the response of the backend, side "a" or "b".
+func (c *responseComparison) response(side, backend string) *comparedResponse {
+	if c == nil {
+		return nil
+	}
+	return &comparedResponse{comparison: c, side: side, backend: backend, started: time.Now()}
+}
+
+// capture records the status and headers of the response and returns its
+// body, copying what is read from it.
+func (r *comparedResponse) capture(resp *http.Response, body io.ReadCloser) io.ReadCloser {
+	if r == nil || resp == nil {
+		return body
+	}
+	r.latency = time.Since(r.started)
+	r.status = resp.StatusCode
+	r.header = resp.Header.Clone()
+	return &comparedBody{ReadCloser: body, response: r}
+}
+
+type comparedBody struct {
+	io.ReadCloser
+	response *comparedResponse
+}
+
+func (b *comparedBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	r := b.response
+	if room := *compareBodyLimit - r.body.Len(); n > room {
+		r.truncated = true
+		if room > 0 {
+			r.body.Write(p[:room])
+		}
+	} else {
+		r.body.Write(p[:n])
+	}
+	return
+}
+
+// finish compares the response once both sides are complete.
+func (r *comparedResponse) finish() {
+	if r == nil {
+		return
+	}
+	for _, n := range compareNormalizers {
+		n(r)
+	}
+	c := r.comparison
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r.side == "a" {
+		c.production = r
+		for _, alternate := range c.alternates {
+			c.compare(alternate)
+		}
+		c.alternates = nil
+	} else if c.production != nil {
+		c.compare(r)
+	} else {
+		c.alternates = append(c.alternates, r)
+	}
+}
+
+// skip does not compare the mirrored responses to a production response of
+// the status.
+func (c *responseComparison) skip(status int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.skipped = append(c.skipped, status)
+	c.mu.Unlock()
+}
+
+func (c *responseComparison) skips(status int) bool {
+	for _, skipped := range c.skipped {
+		if skipped == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *responseComparison) compare(alternate *comparedResponse) {
+	if c.skips(c.production.status) {
+		comparisonsTotal.Inc(c.route, "skipped")
+		return
+	}
+	sample := fidelitySample{at: time.Now(), errorA: c.production.failed(), errorB: alternate.failed()}
+	defer func() { fidelity.observe(alternate.backend, sample) }()
+	if c.production.status == 0 || alternate.status == 0 {
+		comparisonsTotal.Inc(c.route, "error")
+		return
+	}
+	sample.delta, sample.timed = alternate.latency-c.production.latency, true
+	differences := differences(c.production, alternate)
+	if len(differences) == 0 {
+		sample.match = true
+		comparisonsTotal.Inc(c.route, "match")
+		return
+	}
+	comparisonsTotal.Inc(c.route, "mismatch")
+	log.Printf("| DIFF | %s \"%s %s\" %s", alternate.backend, c.method, c.uri, strings.Join(differences, "; "))
+}
+
+// differences describes how the normalized responses differ.
+func differences(a, b *comparedResponse) (result []string) {
+	if a.status != b.status {
+		result = append(result, fmt.Sprintf("status %d != %d", a.status, b.status))
+	}
+	for _, name := range strings.Split(*compareHeaders, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if va, vb := strings.Join(a.header.Values(name), ", "), strings.Join(b.header.Values(name), ", "); va != vb {
+			result = append(result, fmt.Sprintf("header %s %q != %q", http.CanonicalHeaderKey(name), va, vb))
+		}
+	}
+	if a.truncated || b.truncated {
+		return result
+	}
+	if a.decoded && b.decoded {
+		if path, ok := jsonDifference(a.body.Bytes(), b.body.Bytes()); ok {
+			return append(result, "body field "+path)
+		}
+	}
+	if !bytes.Equal(a.body.Bytes(), b.body.Bytes()) {
+		result = append(result, fmt.Sprintf("body differs at byte %d (%dB != %dB)",
+			commonPrefix(a.body.Bytes(), b.body.Bytes()), a.body.Len(), b.body.Len()))
+	}
+	return result
+}
+
+func commonPrefix(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// normalizeQuery sorts the query parameters of the URLs in the Location and
+// Content-Location headers and of form encoded bodies.
+func normalizeQuery(r *comparedResponse) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		if location := r.header.Get(name); location != "" {
+			if u, err := url.Parse(location); err == nil && u.RawQuery != "" {
+				u.RawQuery = sortQuery(u.RawQuery)
+				r.header.Set(name, u.String())
+			}
+		}
+	}
+	if mediaType(r.header) == "application/x-www-form-urlencoded" && !r.truncated {
+		sorted := sortQuery(r.body.String())
+		r.body.Reset()
+		r.body.WriteString(sorted)
+	}
+}
+
+// sortQuery sorts the parameters by name, keeping the order of the values of
+// a parameter, url.Values.Encode sorts by key.
+func sortQuery(query string) string {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return query
+	}
+	return values.Encode()
+}
+
+// normalizeJSON re-encodes JSON bodies with sorted keys, without whitespace
+// and with the numbers in their shortest form.
+func normalizeJSON(r *comparedResponse) {
+	if r.truncated || r.body.Len() == 0 {
+		return
+	}
+	if t := mediaType(r.header); t != "application/json" && !strings.HasSuffix(t, "+json") {
+		return
+	}
+	decoder := json.NewDecoder(bytes.NewReader(r.body.Bytes()))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return
+	}
+	canonical, err := json.Marshal(canonicalNumbers(value))
+	if err != nil {
+		return
+	}
+	r.body.Reset()
+	r.body.Write(canonical)
+}
+
+func canonicalNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, element := range v {
+			v[key] = canonicalNumbers(element)
+		}
+	case []interface{}:
+		for i, element := range v {
+			v[i] = canonicalNumbers(element)
+		}
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return v
+		}
+		if f, err := v.Float64(); err == nil {
+			return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+	}
+	return value
+}
+
+// normalizeHeaders canonicalizes the header names, trims the values and
+// collapses their whitespace, also around the commas of lists.
+func normalizeHeaders(r *comparedResponse) {
+	normalized := make(http.Header, len(r.header))
+	for name, values := range r.header {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		for _, value := range values {
+			items := strings.Split(value, ",")
+			for i, item := range items {
+				items[i] = strings.Join(strings.Fields(item), " ")
+			}
+			normalized[name] = append(normalized[name], strings.Join(items, ", "))
+		}
+	}
+	for _, values := range normalized {
+		sort.Strings(values)
+	}
+	r.header = normalized
+}
+
+func mediaType(header http.Header) string {
+	t, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return t
+}
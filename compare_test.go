@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func comparedTestResponse(contentType, location, body string) *comparedResponse {
+	r := &comparedResponse{status: 200, header: http.Header{"Content-Type": {contentType}}}
+	if location != "" {
+		r.header.Set("Location", location)
+	}
+	r.body.WriteString(body)
+	for _, n := range compareNormalizers {
+		n(r)
+	}
+	return r
+}
+
+func TestCompareNormalization(t *testing.T) {
+	defer func(n []normalizer) { compareNormalizers = n }(compareNormalizers)
+	var err error
+	if compareNormalizers, err = parseNormalizers("query,json,headers"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		a, b  *comparedResponse
+		equal bool
+	}{
+		{comparedTestResponse("application/json", "", `{"b": 1.0, "a": [1, 2]}`),
+			comparedTestResponse("application/json; charset=utf-8", "", `{"a":[1,2],"b":1}`), false},
+		{comparedTestResponse("application/json", "", `{"b": 1.0, "a": [1, 2]}`),
+			comparedTestResponse("application/json", "", `{"a":[1,2],"b":1}`), true},
+		{comparedTestResponse("application/json", "", `{"a":[1,2]}`),
+			comparedTestResponse("application/json", "", `{"a":[2,1]}`), false},
+		{comparedTestResponse("text/plain", "/next?b=2&a=1", "ok"),
+			comparedTestResponse("text/plain", "/next?a=1&b=2", "ok"), true},
+		{comparedTestResponse("application/x-www-form-urlencoded", "", "b=2&a=1"),
+			comparedTestResponse("application/x-www-form-urlencoded", "", "a=1&b=2"), true},
+		{comparedTestResponse("text/html;  charset=utf-8", "", ""),
+			comparedTestResponse("text/html; charset=utf-8", "", ""), true},
+	} {
+		if d := differences(test.a, test.b); (len(d) == 0) != test.equal {
+			t.Errorf("Expected equal '%v' for %q and %q, but received '%v'", test.equal, test.a.body.String(), test.b.body.String(), d)
+		}
+	}
+	if _, err := parseNormalizers("yaml"); err == nil {
+		t.Errorf("Expected an error for an unknown normalization")
+	}
+}
+
+func TestCompareResponses(t *testing.T) {
+	defer func(compare bool) { *compareResponses = compare }(*compareResponses)
+	*compareResponses = true
+	defer func(n []normalizer) { compareNormalizers = n }(compareNormalizers)
+	compareNormalizers, _ = parseNormalizers(*compareNormalize)
+
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": 1, "name": "a"}`)
+	}))
+	defer production.Close()
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/changed" {
+			fmt.Fprint(w, `{"id":1,"name":"b"}`)
+			return
+		}
+		fmt.Fprint(w, `{"name":"a","id":1}`)
+	}))
+	defer alternate.Close()
+
+	h := newTestHandler(strings.TrimPrefix(production.URL, "http://"), strings.TrimPrefix(alternate.URL, "http://"))
+	for _, path := range []string{"/same", "/changed"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	mirrorsInFlight.Wait()
+	if matches := comparisonsTotal.values[labelKey([]string{"/same", "match"})]; matches != 1 {
+		t.Errorf("Expected '1' match, but received '%v'", matches)
+	}
+	if mismatches := comparisonsTotal.values[labelKey([]string{"/changed", "mismatch"})]; mismatches != 1 {
+		t.Errorf("Expected '1' mismatch, but received '%v'", mismatches)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// `teeproxy compare <recording-A> <recording-B>` compares two recordings
+// offline, e.g. of the same session replayed against two environments, with
+// the comparator of -compare: the n-th exchange of a method and URI in A is
+// compared to the n-th one in B after the -compare.normalize normalizations.
+// The differences are printed as | DIFF | lines, the exchanges only one of
+// the recordings has as | ONLY A | and | ONLY B |, followed by a summary.
+// The exit status is 1 if they differ.
+
+// compareReport summarizes the comparison of two recordings.
+type compareReport struct {
+	Scores fidelityScores
+	OnlyA  int
+	OnlyB  int
+}
+
+// Differs reports whether the recordings differ.
+func (r compareReport) Differs() bool {
+	return r.OnlyA > 0 || r.OnlyB > 0 || r.Scores.Compared > 0 && r.Scores.MatchRate < 1
+}
+
+func (r compareReport) String() string {
+	s := r.Scores
+	summary := fmt.Sprintf("compared %d, match rate %.4f, error rate A %.4f, B %.4f", s.Compared, s.MatchRate, s.ErrorRateA, s.ErrorRateB)
+	if s.LatencyDelta != nil {
+		summary += fmt.Sprintf(", latency delta p50 %+.1fms p90 %+.1fms p99 %+.1fms", s.LatencyDelta["p50"], s.LatencyDelta["p90"], s.LatencyDelta["p99"])
+	}
+	return summary + fmt.Sprintf(", only in A %d, only in B %d", r.OnlyA, r.OnlyB)
+}
+
+// recordedResponse turns the response of a recorded exchange into a
+// compared one, its body limited to -compare.body bytes.
+func recordedResponse(e *exchange, side string) *comparedResponse {
+	r := &comparedResponse{side: side, status: e.Status, header: e.ResponseHeader, truncated: e.Truncated,
+		latency:    time.Duration(e.Duration) * time.Microsecond,
+		comparison: &responseComparison{method: e.Method, uri: e.URI}, messages: e.ResponseMessages}
+	if r.header == nil {
+		r.header = make(map[string][]string)
+	}
+	for _, c := range e.ResponseChunks {
+		if room := *compareBodyLimit - r.body.Len(); len(c.Data) > room {
+			r.truncated = true
+			r.body.Write(c.Data[:room])
+			break
+		}
+		r.body.Write(c.Data)
+	}
+	for _, n := range compareNormalizers {
+		n(r)
+	}
+	return r
+}
+
+// readExchanges groups the exchanges of a recording by method and URI, in
+// their order, skipping the WebSocket sessions.
+func readExchanges(r io.Reader) (map[string][]*exchange, []string, error) {
+	decoder := newExchangeDecoder(r, *recordFormat)
+	exchanges := make(map[string][]*exchange)
+	var order []string
+	for {
+		e, err := decoder.Decode()
+		if err == io.EOF {
+			return exchanges, order, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(e.Frames) > 0 {
+			continue
+		}
+		key := e.Method + " " + e.URI
+		if _, ok := exchanges[key]; !ok {
+			order = append(order, key)
+		}
+		exchanges[key] = append(exchanges[key], e)
+	}
+}
+
+// compareRecordings compares the recordings and writes the differences to
+// out.
+func compareRecordings(a, b io.Reader, out io.Writer) (compareReport, error) {
+	exchangesA, order, err := readExchanges(a)
+	if err != nil {
+		return compareReport{}, fmt.Errorf("reading A: %v", err)
+	}
+	exchangesB, orderB, err := readExchanges(b)
+	if err != nil {
+		return compareReport{}, fmt.Errorf("reading B: %v", err)
+	}
+	for _, key := range orderB {
+		if _, ok := exchangesA[key]; !ok {
+			order = append(order, key)
+		}
+	}
+	var report compareReport
+	var samples []fidelitySample
+	for _, key := range order {
+		ea, eb := exchangesA[key], exchangesB[key]
+		for i := 0; i < len(ea) || i < len(eb); i++ {
+			switch {
+			case i >= len(eb):
+				report.OnlyA++
+				fmt.Fprintf(out, "| ONLY A | \"%s\" %d\n", key, ea[i].Status)
+				continue
+			case i >= len(ea):
+				report.OnlyB++
+				fmt.Fprintf(out, "| ONLY B | \"%s\" %d\n", key, eb[i].Status)
+				continue
+			}
+			ra, rb := recordedResponse(ea[i], "a"), recordedResponse(eb[i], "b")
+			sample := fidelitySample{errorA: ra.failed(), errorB: rb.failed()}
+			if ra.status != 0 && rb.status != 0 {
+				sample.delta, sample.timed = rb.latency-ra.latency, true
+			}
+			if differences := differences(ra, rb); len(differences) > 0 {
+				fmt.Fprintf(out, "| DIFF | \"%s\" %s\n", key, strings.Join(differences, "; "))
+			} else {
+				sample.match = true
+			}
+			samples = append(samples, sample)
+		}
+	}
+	if len(samples) > 0 {
+		report.Scores = summarizeFidelity(samples)
+	}
+	return report, nil
+}
+
+// compareCommand runs `teeproxy compare`.
+func compareCommand(nameA, nameB string) int {
+	normalizers, err := parseNormalizers(*compareNormalize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -compare.normalize: %s\n", err)
+		return 2
+	}
+	compareNormalizers = normalizers
+	if err := startGrpcDecoding("", ""); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -grpc.descriptors: %s\n", err)
+		return 2
+	}
+	var readers []io.Reader
+	for _, name := range []string{nameA, nameB} {
+		recording, err := openRecording(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer recording.Close()
+		readers = append(readers, recording)
+	}
+	report, err := compareRecordings(readers[0], readers[1], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("| SUMMARY | %s\n", report)
+	if report.Differs() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encodeRecording(t *testing.T, exchanges ...*exchange) *bytes.Buffer {
+	var data bytes.Buffer
+	for _, e := range exchanges {
+		line, err := encodeExchange(e, "json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data.Write(line)
+	}
+	return &data
+}
+
+func TestCompareRecordings(t *testing.T) {
+	defer func(n []normalizer) { compareNormalizers = n }(compareNormalizers)
+	compareNormalizers, _ = parseNormalizers("json")
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	recorded := func(uri string, status int, body string, duration int64) *exchange {
+		return &exchange{Time: time.Now(), Side: "a", Method: "GET", URI: uri, Proto: "HTTP/1.1",
+			Status: status, ResponseHeader: jsonHeader, ResponseChunks: []chunk{{Data: []byte(body)}}, Duration: duration}
+	}
+	a := encodeRecording(t,
+		recorded("/same", 200, `{"a":1,"b":2}`, 1000),
+		recorded("/changed", 200, `{"a":1}`, 1000),
+		recorded("/same", 200, `{"a":3}`, 1000),
+		recorded("/gone", 200, `{}`, 1000),
+	)
+	b := encodeRecording(t,
+		recorded("/same", 200, `{"b":2,"a":1}`, 3000),
+		recorded("/same", 200, `{"a":3}`, 3000),
+		recorded("/changed", 500, `{"a":2}`, 3000),
+		recorded("/new", 200, `{}`, 3000),
+	)
+
+	var out bytes.Buffer
+	report, err := compareRecordings(a, b, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Scores.Compared != 3 || report.OnlyA != 1 || report.OnlyB != 1 || !report.Differs() {
+		t.Errorf("Expected '3 compared, 1 only in A and B', but received '%+v'", report)
+	}
+	if report.Scores.ErrorRateB == 0 || report.Scores.LatencyDelta["p50"] != 2 {
+		t.Errorf("Expected 'errors and a 2ms latency delta in B', but received '%+v'", report.Scores)
+	}
+	expected := "| DIFF | \"GET /changed\" status 200 != 500; body differs at byte 5 (7B != 7B)\n" +
+		"| ONLY A | \"GET /gone\" 200\n" +
+		"| ONLY B | \"GET /new\" 200\n"
+	if out.String() != expected {
+		t.Errorf("Expected '%s', but received '%s'", expected, out.String())
+	}
+
+	same := encodeRecording(t, recorded("/same", 200, `{"a":1}`, 1000))
+	report, err = compareRecordings(same, encodeRecording(t, recorded("/same", 200, `{"a":1}`, 1000)), &out)
+	if err != nil || report.Differs() {
+		t.Errorf("Expected 'identical recordings', but received '%+v' %v", report, err)
+	}
+	if _, err := compareRecordings(strings.NewReader("{"), same, &out); err == nil {
+		t.Errorf("Expected 'an error for an invalid recording', but received none")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// With -b.gzip, the bodies of the mirrored requests are gzipped before being
+// sent to the alternate backends, which must accept "Content-Encoding: gzip",
+// to reduce the egress costs of shadowing to a remote region.
+
+var mirrorGzipBytes = newCounterVec("teeproxy_mirror_gzip_bytes_total",
+	"Bytes of the mirrored request bodies before (original) and after (compressed) gzipping them.", "backend", "size")
+
+// gzipTransport compresses the request bodies.
+type gzipTransport struct {
+	http.RoundTripper
+}
+
+// withGzip wraps the transport to gzip the request bodies with -b.gzip.
+func withGzip(transport http.RoundTripper) http.RoundTripper {
+	if !*alternateGzip {
+		return transport
+	}
+	return &gzipTransport{RoundTripper: transport}
+}
+
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" ||
+		req.ContentLength >= 0 && req.ContentLength < int64(*alternateGzipMinSize) || incompressible(req.Header.Get("Content-Type")) {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	compressed := req.Clone(req.Context())
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write(body)
+	writer.Close()
+	if len(body) < *alternateGzipMinSize || buffer.Len() >= len(body) {
+		compressed.Body = ioutil.NopCloser(bytes.NewReader(body))
+		compressed.ContentLength = int64(len(body))
+		return t.RoundTripper.RoundTrip(compressed)
+	}
+	mirrorGzipBytes.Add(float64(len(body)), backendLabel(req), "original")
+	mirrorGzipBytes.Add(float64(buffer.Len()), backendLabel(req), "compressed")
+	data := buffer.Bytes()
+	compressed.Body = ioutil.NopCloser(bytes.NewReader(data))
+	compressed.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(data)), nil }
+	compressed.ContentLength = int64(len(data))
+	compressed.Header.Set("Content-Encoding", "gzip")
+	compressed.Header.Del("Content-Md5")
+	return t.RoundTripper.RoundTrip(compressed)
+}
+
+// incompressible reports whether bodies of the content type are compressed
+// already.
+func incompressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/zip", "application/gzip", "application/x-gzip", "application/zstd"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return !strings.HasPrefix(contentType, "image/svg")
+		}
+	}
+	return false
+}
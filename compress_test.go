@@ -0,0 +1,50 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGzipTransport(t *testing.T) {
+	defer func(enabled bool) { *alternateGzip = enabled }(*alternateGzip)
+	*alternateGzip = true
+	var encoding, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		reader := r.Body
+		if encoding == "gzip" {
+			reader, _ = gzip.NewReader(r.Body)
+		}
+		data, _ := ioutil.ReadAll(reader)
+		body = string(data)
+	}))
+	defer server.Close()
+	transport := withGzip(getTransport("http", time.Second, false))
+
+	for _, test := range []struct {
+		contentType, body, encoding string
+	}{
+		{"application/json", strings.Repeat(`{"id":1}`, 500), "gzip"},
+		{"application/json", `{"id":1}`, ""},
+		{"image/png", strings.Repeat("x", 4000), ""},
+	} {
+		request, _ := http.NewRequest("POST", server.URL, strings.NewReader(test.body))
+		request.Header.Set("Content-Type", test.contentType)
+		response, err := transport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if encoding != test.encoding || body != test.body {
+			t.Errorf("Expected '%s' encoding of %d bytes, but received '%s' of %d bytes", test.encoding, len(test.body), encoding, len(body))
+		}
+		if request.Header.Get("Content-Encoding") != "" {
+			t.Errorf("Expected the original request to be unchanged")
+		}
+	}
+}
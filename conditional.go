@@ -0,0 +1,29 @@
+package main
+
+import "net/http"
+
+// A conditional GET answered with 304 Not Modified by the alternate backend
+// has no body to compare. With -b.unconditional, the validators are removed
+// from the mirrored requests, so that B answers with full responses, while
+// the production request keeps them. Mirrored responses are not compared to
+// a production 304.
+
+// conditionalHeaders are the validators of a conditional GET.
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+// hasConditions reports whether the request has validators.
+func hasConditions(req *http.Request) bool {
+	for _, name := range conditionalHeaders {
+		if req.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// stripConditions removes the validators of the mirrored request.
+func stripConditions(req *http.Request) {
+	for _, name := range conditionalHeaders {
+		req.Header.Del(name)
+	}
+}
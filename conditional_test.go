@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUnconditionalMirroring(t *testing.T) {
+	defer func(v bool) { *alternateUnconditional = v }(*alternateUnconditional)
+	*alternateUnconditional = true
+	defer func(compare bool) { *compareResponses = compare }(*compareResponses)
+	*compareResponses = true
+	defer func(n []normalizer) { compareNormalizers = n }(compareNormalizers)
+	compareNormalizers, _ = parseNormalizers(*compareNormalize)
+
+	var mu sync.Mutex
+	var production, alternate []string
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		production = append(production, r.Header.Get("If-None-Match"))
+		mu.Unlock()
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "v1")
+	}))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		alternate = append(alternate, r.Header.Get("If-None-Match")+r.Header.Get("If-Modified-Since"))
+		mu.Unlock()
+		fmt.Fprint(w, "v1")
+	}))
+	defer b.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler(strings.TrimPrefix(a.URL, "http://"), strings.TrimPrefix(b.URL, "http://"))
+	req := httptest.NewRequest("GET", "/unconditional", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	req.Header.Set("If-Modified-Since", "Mon, 12 Oct 2026 10:00:00 GMT")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	mirrorsInFlight.Wait()
+
+	if w.Code != http.StatusNotModified {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusNotModified, w.Code)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(production) != 1 || production[0] != `"v1"` {
+		t.Errorf("Expected '%s', but received '%v'", `"v1"`, production)
+	}
+	if len(alternate) != 1 || alternate[0] != "" {
+		t.Errorf("Expected no conditions, but received '%v'", alternate)
+	}
+	if skipped := comparisonsTotal.values[labelKey([]string{"/unconditional", "skipped"})]; skipped != 1 {
+		t.Errorf("Expected '1' skipped comparison, but received '%v'", skipped)
+	}
+	if mismatches := comparisonsTotal.values[labelKey([]string{"/unconditional", "mismatch"})]; mismatches != 0 {
+		t.Errorf("Expected '0' mismatches, but received '%v'", mismatches)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// config is the optional JSON configuration file given by -config.
+type config struct {
+	// Policies are mirrored in addition to the -b backends.
+	Policies []policyConfig `json:"policies"`
+	// Maintenance responses are returned instead of forwarding to A.
+	Maintenance []maintenanceConfig `json:"maintenance"`
+	// Cache rules make the production responses of routes cacheable.
+	Cache []cacheRuleConfig `json:"cache"`
+	// Anonymization profiles in addition to "strict" and "hash-identifiers".
+	Anonymization []anonymizerConfig `json:"anonymization"`
+	// Priorities classify the requests, the first matching rule applies.
+	Priorities []priorityConfig `json:"priorities"`
+	// OAuth2 client credentials flows of the alternate backends.
+	OAuth2 []oauth2Config `json:"oauth2"`
+	// Bandwidth limits of the alternate backends.
+	Bandwidth []bandwidthConfig `json:"bandwidth"`
+	// Redirects followed for the alternate backends.
+	Redirects []redirectConfig `json:"redirects"`
+	// Authorization policies of the alternate backends.
+	Authorization []authorizationConfig `json:"authorization"`
+	// Uploads are the upload policies of the alternate backends.
+	Uploads []uploadConfig `json:"uploads"`
+	// Listeners are additional proxies with their own address, target and policies.
+	Listeners []listenerConfig `json:"listeners"`
+}
+
+type policyConfig struct {
+	Name string `json:"name"`
+	// Path, Methods and Host are regular expressions, all given must match.
+	Path    string `json:"path"`
+	Methods string `json:"methods"`
+	Host    string `json:"host"`
+	// Percent of the matched requests to mirror, 100 if omitted.
+	Percent  *float64 `json:"percent"`
+	Backends []string `json:"backends"`
+	// Groups receive each request on exactly count of their backends.
+	Groups []groupConfig `json:"groups"`
+	// Anonymize names the anonymization profile applied to the mirrored requests.
+	Anonymize string `json:"anonymize"`
+	// Tenants limits the policy to the requests of these -tenant.key ids.
+	Tenants []string `json:"tenants"`
+	// Sampler is the sampling strategy of the policy, -sample.strategy if empty.
+	Sampler string `json:"sampler"`
+}
+
+type groupConfig struct {
+	Name string `json:"name"`
+	// Select is either "round-robin" (default) or "random".
+	Select   string   `json:"select"`
+	Backends []string `json:"backends"`
+	// Count is the number of backends each request is mirrored to, 1 if
+	// omitted.
+	Count int `json:"count"`
+	// Weights of the backends for the random selection, in their order.
+	Weights []float64 `json:"weights"`
+}
+
+func loadConfig(filename string) (*config, error) {
+	merged, err := loadConfigLayers(filename, nil)
+	if err != nil {
+		return nil, err
+	}
+	object := merged.(map[string]interface{})
+	profiles, _ := object["profiles"].(map[string]interface{})
+	delete(object, "profiles")
+	for _, name := range strings.Split(*configProfile, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		profile, ok := profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q in %s", name, redactURL(filename, false))
+		}
+		merged = mergeConfig(merged, profile)
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var c config
+	if err := decoder.Decode(&c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", redactURL(filename, false), err)
+	}
+	return &c, nil
+}
+
+// currentConfig loads the -config file, an empty config without one. It is
+// loaded once per reload, so that all the builders see the same config.
+func currentConfig() (*config, error) {
+	if *configFile == "" {
+		return &config{}, nil
+	}
+	return loadConfig(*configFile)
+}
+
+// loadConfigLayers reads the config file merged onto the files it includes,
+// in their order, include paths being relative to the including file.
+func loadConfigLayers(filename string, including []string) (interface{}, error) {
+	for _, parent := range including {
+		if parent == filename {
+			return nil, fmt.Errorf("%s includes itself", redactURL(filename, false))
+		}
+	}
+	content, err := readConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var layer map[string]interface{}
+	if err := decoder.Decode(&layer); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", redactURL(filename, false), err)
+	}
+	var merged interface{} = map[string]interface{}{}
+	if value, ok := layer["include"]; ok {
+		includes, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("parsing %s: include must be a list of files", redactURL(filename, false))
+		}
+		for _, include := range includes {
+			path, ok := include.(string)
+			if !ok {
+				return nil, fmt.Errorf("parsing %s: include must be a list of files", redactURL(filename, false))
+			}
+			included, err := loadConfigLayers(includedConfig(filename, path), append(including, filename))
+			if err != nil {
+				return nil, err
+			}
+			merged = mergeConfig(merged, included)
+		}
+		delete(layer, "include")
+	}
+	return mergeConfig(merged, layer), nil
+}
+
+// mergeConfig merges the overlay onto the base: objects key by key, lists of
+// objects by their name or backend, appending the others, and other values
+// are replaced.
+func mergeConfig(base, overlay interface{}) interface{} {
+	switch overlay := overlay.(type) {
+	case map[string]interface{}:
+		object, ok := base.(map[string]interface{})
+		if !ok {
+			return overlay
+		}
+		merged := make(map[string]interface{}, len(object))
+		for key, value := range object {
+			merged[key] = value
+		}
+		for key, value := range overlay {
+			merged[key] = mergeConfig(merged[key], value)
+		}
+		return merged
+	case []interface{}:
+		list, ok := base.([]interface{})
+		if !ok || !keyedList(list) || !keyedList(overlay) {
+			return overlay
+		}
+		merged := append([]interface{}(nil), list...)
+		for _, element := range overlay {
+			if i := configIndex(merged, element); i >= 0 {
+				merged[i] = mergeConfig(merged[i], element)
+			} else {
+				merged = append(merged, element)
+			}
+		}
+		return merged
+	}
+	return overlay
+}
+
+// keyedList reports whether the list holds objects, merged by their key.
+func keyedList(list []interface{}) bool {
+	for _, element := range list {
+		if _, ok := element.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// configIndex returns the index of the object with the key of the element,
+// -1 if there is none or the element has no key.
+func configIndex(list []interface{}, element interface{}) int {
+	if key := configKey(element); key != "" {
+		for i := range list {
+			if configKey(list[i]) == key {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// configKey identifies an object of a list by its name or backend.
+func configKey(element interface{}) string {
+	object, _ := element.(map[string]interface{})
+	for _, key := range []string{"name", "backend"} {
+		if value, ok := object[key].(string); ok && value != "" {
+			return key + "=" + value
+		}
+	}
+	return ""
+}
+
+func compileOptional(name, expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return re, nil
+}
+
+func (pc policyConfig) build(profiles map[string]*anonymizer) (*policy, error) {
+	p := &policy{Name: pc.Name, Percent: 100.0}
+	if pc.Percent != nil {
+		p.Percent = *pc.Percent
+	}
+	if len(pc.Backends) == 0 && len(pc.Groups) == 0 {
+		return nil, fmt.Errorf("policy %q has no backends", pc.Name)
+	}
+	var err error
+	if p.Path, err = compileOptional("path", pc.Path); err != nil {
+		return nil, fmt.Errorf("policy %q: %v", pc.Name, err)
+	}
+	if p.Methods, err = compileOptional("methods", pc.Methods); err != nil {
+		return nil, fmt.Errorf("policy %q: %v", pc.Name, err)
+	}
+	if p.Host, err = compileOptional("host", pc.Host); err != nil {
+		return nil, fmt.Errorf("policy %q: %v", pc.Name, err)
+	}
+	if len(pc.Tenants) > 0 {
+		if *tenantKey == "" {
+			return nil, fmt.Errorf("policy %q: tenants require -tenant.key", pc.Name)
+		}
+		p.Tenants = make(map[string]bool)
+		for _, tenant := range pc.Tenants {
+			p.Tenants[tenant] = true
+		}
+	}
+	if p.Anonymize, err = findAnonymizer(profiles, pc.Anonymize); err != nil {
+		return nil, fmt.Errorf("policy %q: %v", pc.Name, err)
+	}
+	strategy := pc.Sampler
+	if strategy == "" {
+		strategy = *sampleStrategy
+	}
+	if p.Sampler, err = newSampler(strategy); err != nil {
+		return nil, fmt.Errorf("policy %q: %v", pc.Name, err)
+	}
+	for _, url := range pc.Backends {
+		b, err := parseBackend(url)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %v", pc.Name, err)
+		}
+		p.Backends = append(p.Backends, b)
+	}
+	for _, gc := range pc.Groups {
+		group, err := newBackendGroup(gc.Name, gc.Select, gc.Backends)
+		if err == nil {
+			err = group.setChoice(gc.Count, gc.Weights)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %v", pc.Name, err)
+		}
+		p.Groups = append(p.Groups, group)
+	}
+	return p, nil
+}
+
+// buildPolicies turns the configured policies into the runtime ones, using
+// the anonymization profiles.
+func (c *config) buildPolicies(profiles map[string]*anonymizer) (policies []*policy, err error) {
+	for _, pc := range c.Policies {
+		p, err := pc.build(profiles)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return
+}
+
+// buildPolicies creates the default policy of the -b flags and the policies
+// of the config. The returned apply configures the backends, it is called
+// once the whole config was built, so that a failed reload changes nothing.
+func buildPolicies(c *config, profiles map[string]*anonymizer, altServers []*backend, altGroups []string) (policies []*policy, apply func(), err error) {
+	configured, err := c.buildPolicies(profiles)
+	if err != nil {
+		return nil, nil, err
+	}
+	setTokenSources, err := buildTokenSources(c.OAuth2, altServers)
+	if err != nil {
+		return nil, nil, err
+	}
+	setBandwidthLimits, err := buildBandwidthLimits(c.Bandwidth, altServers)
+	if err != nil {
+		return nil, nil, err
+	}
+	setRedirectLimits, err := buildRedirectLimits(c.Redirects, altServers)
+	if err != nil {
+		return nil, nil, err
+	}
+	setAuthorizationPolicies, err := buildAuthorizationPolicies(c.Authorization, altServers)
+	if err != nil {
+		return nil, nil, err
+	}
+	setUploadPolicies, err := buildUploadPolicies(c.Uploads, altServers)
+	if err != nil {
+		return nil, nil, err
+	}
+	apply = func() {
+		setTokenSources()
+		setBandwidthLimits()
+		setRedirectLimits()
+		setAuthorizationPolicies()
+		setUploadPolicies()
+	}
+	if len(altServers) > 0 || len(altGroups) > 0 {
+		defaultPolicy := &policy{Name: "default", Percent: *percent, Backends: altServers, Adjustable: true}
+		if *alternateMethods != "" {
+			methods, err := regexp.Compile(*alternateMethods)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid -b.methods: %v", err)
+			}
+			defaultPolicy.Methods = methods
+		}
+		anonymizer, err := findAnonymizer(profiles, *alternateAnonymize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid -b.anonymize: %v", err)
+		}
+		defaultPolicy.Anonymize = anonymizer
+		if defaultPolicy.Sampler, err = newSampler(*sampleStrategy); err != nil {
+			return nil, nil, fmt.Errorf("invalid -sample.strategy: %v", err)
+		}
+		for i, members := range altGroups {
+			group, err := newBackendGroup(fmt.Sprintf("group%d", i+1), *alternateGroupSelect, strings.Split(members, ","))
+			if err == nil {
+				err = group.setChoice(*alternateGroupCount, nil)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid -b.group: %v", err)
+			}
+			defaultPolicy.Groups = append(defaultPolicy.Groups, group)
+		}
+		policies = append(policies, defaultPolicy)
+	}
+	return append(policies, configured...), apply, nil
+}
+
+func logPolicies(policies []*policy) {
+	for _, p := range policies {
+		log.Printf("Mirroring policy %s sends %v%% of the matching requests to B: %s", p.Name, p.Percent, arrayAlternatives(p.Backends))
+		for _, group := range p.Groups {
+			count := "one"
+			if group.Count > 1 {
+				count = strconv.Itoa(group.Count)
+			}
+			log.Printf("Mirroring policy %s sends each of them to %s of group %s: %s", p.Name, count, group.Name, arrayAlternatives(group.Members))
+		}
+	}
+}
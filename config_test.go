@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "teeproxy.json")
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestConfigPolicies(t *testing.T) {
+	c, err := loadConfig(writeConfig(t, `{
+		"policies": [
+			{"name": "search", "path": "^/search", "backends": ["http://team-a:8080"]},
+			{"name": "analytics", "percent": 5, "methods": "GET", "backends": ["http://sink:9000", "http://team-a:8080"]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := c.buildPolicies(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 {
+		t.Fatalf("Expected '2' policies, but received '%d'", len(policies))
+	}
+	search, analytics := policies[0], policies[1]
+	if search.Percent != 100 || analytics.Percent != 5 {
+		t.Errorf("Expected '100' and '5' percent, but received '%v' and '%v'", search.Percent, analytics.Percent)
+	}
+	if search.Backends[0] != analytics.Backends[1] {
+		t.Errorf("Expected policies to share the backend for the same URL")
+	}
+
+	request, _ := http.NewRequest("POST", "http://proxy/search?q=1", nil)
+	if !search.Matches(request) {
+		t.Errorf("Expected the search policy to match %s", request.URL)
+	}
+	if analytics.Matches(request) {
+		t.Errorf("Expected the analytics policy not to match %s %s", request.Method, request.URL)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		`{"policies": [{"name": "empty"}]}`,
+		`{"policies": [{"name": "regex", "path": "(", "backends": ["http://b"]}]}`,
+		`{"policy": []}`,
+		`{"policies": [{"name": "template", "backends": ["http://{header.X-Tenant"]}]}`,
+		`{"policies": [{"name": "group", "groups": [{"name": "functions", "backends": ["gcf://project"]}]}]}`,
+	} {
+		c, err := loadConfig(writeConfig(t, content))
+		if err == nil {
+			_, err = c.buildPolicies(nil)
+		}
+		if err == nil {
+			t.Errorf("Expected an error for %s", content)
+		}
+	}
+}
+
+func TestConfigMissing(t *testing.T) {
+	if _, err := loadConfig(filepath.Join(os.TempDir(), "does-not-exist.json")); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
+
+func TestConfigIncludesAndProfiles(t *testing.T) {
+	defer func(profile string) { *configProfile = profile }(*configProfile)
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"rules.json": `{"anonymization": [{"name": "shared", "strip_headers": ["Cookie"]}]}`,
+		"base.json": `{
+			"include": ["rules.json"],
+			"policies": [
+				{"name": "search", "path": "^/search", "percent": 10, "backends": ["http://shadow:8080"]},
+				{"name": "orders", "path": "^/orders", "backends": ["http://shadow:8080"]}
+			]
+		}`,
+		"teeproxy.json": `{
+			"include": ["base.json"],
+			"policies": [{"name": "search", "percent": 50}],
+			"profiles": {
+				"staging": {"policies": [{"name": "orders", "backends": ["http://staging-shadow:8080"]}, {"name": "debug", "backends": ["http://debug:8080"]}]}
+			}
+		}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filename := filepath.Join(dir, "teeproxy.json")
+
+	*configProfile = ""
+	c, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Policies) != 2 || c.Policies[0].Path != "^/search" || *c.Policies[0].Percent != 50 {
+		t.Errorf("Expected the search policy of the base at 50 percent, but received '%+v'", c.Policies)
+	}
+	if len(c.Anonymization) != 1 || c.Anonymization[0].Name != "shared" {
+		t.Errorf("Expected the included anonymization profile, but received '%+v'", c.Anonymization)
+	}
+
+	*configProfile = "staging"
+	if c, err = loadConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Policies) != 3 || c.Policies[1].Backends[0] != "http://staging-shadow:8080" || c.Policies[1].Path != "^/orders" || c.Policies[2].Name != "debug" {
+		t.Errorf("Expected the staging overlay, but received '%+v'", c.Policies)
+	}
+
+	*configProfile = "production"
+	if _, err := loadConfig(filename); err == nil {
+		t.Errorf("Expected an error for an unknown profile")
+	}
+	*configProfile = ""
+	if err := ioutil.WriteFile(filepath.Join(dir, "rules.json"), []byte(`{"include": ["teeproxy.json"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(filename); err == nil {
+		t.Errorf("Expected an error for an include cycle")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"weak"
+)
+
+// Outbound connections are counted and capped by -max-connections to protect
+// against ephemeral port exhaustion. When the cap is reached, idle
+// connections of all transports are evicted before waiting for a free slot.
+// The transports are tracked weakly: one no longer used is dropped once it
+// was collected, which its idle connections prevent until they are closed.
+
+var (
+	transportsMutex sync.Mutex
+	transports      []weak.Pointer[http.Transport]
+
+	openConnections int64
+	connectionSlots chan struct{}
+	slotsOnce       sync.Once
+)
+
+var errTooManyConnections = errors.New("too many outbound connections")
+
+var connectionsEvicted = newCounterVec("teeproxy_idle_connections_evicted_total",
+	"Number of times idle outbound connections were evicted because -max-connections was reached.")
+
+func init() {
+	newGaugeFunc("teeproxy_outbound_connections", "Number of open outbound connections.", func() float64 {
+		return float64(atomic.LoadInt64(&openConnections))
+	})
+}
+
+func registerTransport(transport *http.Transport) {
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+	live := transports[:0]
+	for _, p := range transports {
+		if p.Value() != nil {
+			live = append(live, p)
+		}
+	}
+	transports = append(live, weak.Make(transport))
+}
+
+// evictIdleConnections closes the idle connections of all transports.
+func evictIdleConnections() {
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+	for _, p := range transports {
+		if transport := p.Value(); transport != nil {
+			transport.CloseIdleConnections()
+		}
+	}
+}
+
+// acquireConnectionSlot waits for a free slot when -max-connections is set.
+func acquireConnectionSlot(ctx context.Context, timeout time.Duration) error {
+	slotsOnce.Do(func() {
+		connectionSlots = make(chan struct{}, *maxConnections)
+	})
+	select {
+	case connectionSlots <- struct{}{}:
+		return nil
+	default:
+	}
+	connectionsEvicted.Inc()
+	evictIdleConnections()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case connectionSlots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errTooManyConnections
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseConnectionSlot() {
+	<-connectionSlots
+}
+
+// trackedConn releases its slot when closed.
+type trackedConn struct {
+	net.Conn
+	slot bool
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&openConnections, -1)
+		if c.slot {
+			releaseConnectionSlot()
+		}
+	})
+	return c.Conn.Close()
+}
+
+// trackingDialer wraps the dial function to count and cap the connections.
+func trackingDialer(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		slot := *maxConnections > 0
+		if slot {
+			if err := acquireConnectionSlot(ctx, dialer.Timeout); err != nil {
+				return nil, err
+			}
+		}
+		conn, err := dialAddress(ctx, dialer, network, address)
+		if err != nil {
+			if slot {
+				releaseConnectionSlot()
+			}
+			return nil, err
+		}
+		atomic.AddInt64(&openConnections, 1)
+		return &trackedConn{Conn: conn, slot: slot}, nil
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxConnectionsEvictsIdle(t *testing.T) {
+	defer func(max int) { *maxConnections = max }(*maxConnections)
+	*maxConnections = 1
+	slotsOnce.Do(func() {})
+	connectionSlots = make(chan struct{}, 1)
+
+	server1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server1.Close()
+	server2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server2.Close()
+	transport1 := getTransport("http", time.Second, false)
+	transport2 := getTransport("http", time.Second, false)
+
+	for _, test := range []struct {
+		transport *http.Transport
+		url       string
+	}{{transport1, server1.URL}, {transport2, server2.URL}, {transport1, server1.URL}} {
+		request, _ := http.NewRequest("GET", test.url, nil)
+		response := handleRequest("a", request, test.transport)
+		if response == nil {
+			t.Fatalf("Expected a response from %s", test.url)
+		}
+		ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if open := atomic.LoadInt64(&openConnections); open > 1 {
+			t.Errorf("Expected at most '1' open connection, but received '%d'", open)
+		}
+	}
+}
+
+func TestTransportsDroppedOnceCollected(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		getTransport("http", time.Second, false)
+	}
+	runtime.GC()
+	kept := getTransport("http", time.Second, false)
+	transportsMutex.Lock()
+	count := len(transports)
+	transportsMutex.Unlock()
+	if count > 50 {
+		t.Errorf("Expected the unused transports to be dropped, but received '%d'", count)
+	}
+	runtime.KeepAlive(kept)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORS preflight requests are answered by the proxy when -cors.preflight is
+// set, they are neither forwarded to the production target nor mirrored.
+
+// isPreflight reports whether the request is a CORS preflight request.
+func isPreflight(req *http.Request) bool {
+	return req.Method == "OPTIONS" &&
+		req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// listContains reports whether the comma separated list contains the value
+// or the wildcard *.
+func listContains(list, value string, fold bool) bool {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "*" || item == value || fold && strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerPreflight responds to a CORS preflight request, allowing it only if
+// the origin, method and all requested headers are allowed.
+func answerPreflight(w http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get("Origin")
+	method := req.Header.Get("Access-Control-Request-Method")
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	allowed := listContains(*corsOrigins, origin, false) && listContains(*corsMethods, method, false)
+	requested := req.Header.Get("Access-Control-Request-Headers")
+	for _, name := range strings.Split(requested, ",") {
+		if name = strings.TrimSpace(name); name != "" && !listContains(*corsHeaders, name, true) {
+			allowed = false
+		}
+	}
+	if !allowed {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	header.Set("Access-Control-Allow-Origin", origin)
+	header.Set("Access-Control-Allow-Methods", method)
+	if requested != "" {
+		header.Set("Access-Control-Allow-Headers", requested)
+	}
+	if *corsCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if *corsMaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(*corsMaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
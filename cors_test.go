@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	defer func(enabled bool, origins string) { *corsPreflight, *corsOrigins = enabled, origins }(*corsPreflight, *corsOrigins)
+	*corsPreflight = true
+	*corsOrigins = "https://app.example.com"
+
+	forwarded := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = true
+	}))
+	defer target.Close()
+	h := newTestHandler(target.URL)
+
+	for origin, expectation := range map[string]int{
+		"https://app.example.com":  http.StatusNoContent,
+		"https://evil.example.com": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("OPTIONS", "/api", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "PUT")
+		req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != expectation {
+			t.Errorf("Expected '%d', but received '%d'", expectation, w.Code)
+		}
+		if expectation == http.StatusNoContent && w.Header().Get("Access-Control-Allow-Origin") != origin {
+			t.Errorf("Expected '%s', but received '%s'", origin, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+	}
+	if forwarded {
+		t.Errorf("Expected the preflight requests not to be forwarded")
+	}
+}
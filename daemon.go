@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+)
+
+// writePidFile writes the process id to -pidfile.
+func writePidFile() error {
+	if *pidFile == "" {
+		return nil
+	}
+	return ioutil.WriteFile(*pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// shutdown closes the source, which waits up to -shutdown.timeout for the
+// in-flight requests, and removes the pid file.
+func shutdown(source Source) {
+	log.Printf("Shutting down")
+	if err := source.Close(); err != nil {
+		log.Printf("Failed to drain the in-flight requests: %s", err)
+	}
+	if *pidFile != "" {
+		os.Remove(*pidFile)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A request carrying the -debug.header is traced verbosely, without turning
+// on -debug for all requests: its timings, the mirroring decisions and the
+// headers after each transform are logged as | DEBUG | lines with its request
+// id, which is returned in X-Request-Id. The header is trusted if its value is
+// the -debug.token, or 1 from a client address in -debug.networks, and it is
+// never forwarded. The credentials in the logged headers are redacted, and
+// the client addresses anonymized with -client-ip.anonymize.
+
+var debugTracesTotal = newCounterVec("teeproxy_debug_traces_total",
+	"Number of requests with the debug header by result, traced or rejected.", "result")
+
+// debugTrustedNetworks are the networks of -debug.networks.
+var debugTrustedNetworks []*net.IPNet
+
+// debugToken is the -debug.token, nil if not set.
+var debugToken *secret
+
+// parseNetworks parses comma separated CIDRs.
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(value, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// debugTrace logs the steps of a traced request, a nil trace logs nothing.
+type debugTrace struct {
+	id    string
+	start time.Time
+}
+
+// startDebugTrace removes the debug header from the request and returns the
+// trace of the request if the header is trusted, nil otherwise.
+func startDebugTrace(w http.ResponseWriter, req *http.Request) *debugTrace {
+	if *debugTraceHeader == "" {
+		return nil
+	}
+	value := req.Header.Get(*debugTraceHeader)
+	if value == "" {
+		return nil
+	}
+	req.Header.Del(*debugTraceHeader)
+	if !debugTrusted(value, req.RemoteAddr) {
+		debugTracesTotal.Inc("rejected")
+		return nil
+	}
+	debugTracesTotal.Inc("traced")
+	t := &debugTrace{id: requestID(req), start: time.Now()}
+	w.Header().Set("X-Request-Id", t.id)
+	t.logf("%s %s %s from %s", req.Method, req.URL.RequestURI(), req.Proto, anonymizeIP(req.RemoteAddr, *clientIPAnonymize))
+	received := req.Header.Clone()
+	anonymizeIPHeaders(received, *clientIPAnonymize)
+	t.headers("received", received)
+	return t
+}
+
+// debugTrusted reports whether the debug header value is the token, or 1 from
+// a trusted network.
+func debugTrusted(value, remoteAddr string) bool {
+	if debugToken != nil {
+		token, err := debugToken.Value()
+		if err == nil && token != "" && subtle.ConstantTimeCompare([]byte(value), []byte(token)) == 1 {
+			return true
+		}
+	}
+	if value != "1" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, network := range debugTrustedNetworks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *debugTrace) logf(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	log.Printf("| DEBUG | %s +%.1fms %s", t.id, float64(time.Since(t.start).Microseconds())/1000, fmt.Sprintf(format, args...))
+}
+
+// headers logs the headers after a stage, the credentials redacted.
+func (t *debugTrace) headers(stage string, header http.Header) {
+	if t == nil {
+		return
+	}
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var fields []string
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		for _, credential := range credentialHeaders {
+			if strings.EqualFold(name, credential) {
+				value = "[redacted]"
+			}
+		}
+		fields = append(fields, fmt.Sprintf("%s: %q", name, value))
+	}
+	t.logf("headers %s: %s", stage, strings.Join(fields, ", "))
+}
+
+// responseStatus returns the status of the response for the trace.
+func responseStatus(response *http.Response) string {
+	if response == nil {
+		return "failed"
+	}
+	return response.Status
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDebugTrace(t *testing.T) {
+	defer func(token *secret) { debugToken = token }(debugToken)
+	defer func(networks []*net.IPNet) { debugTrustedNetworks = networks }(debugTrustedNetworks)
+	debugToken = newSecret("s3cret")
+	var err error
+	if debugTrustedNetworks, err = parseNetworks("10.0.0.0/8, 192.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	var forwarded string
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get("X-Teeproxy-Debug")
+	}))
+	defer production.Close()
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer alternate.Close()
+	defer evictIdleConnections()
+	h := newTestHandler(production.URL, alternate.URL+"/debug")
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+	for _, test := range []struct {
+		value, remote string
+		traced        bool
+	}{
+		{"1", "192.0.2.1:1234", true},
+		{"s3cret", "203.0.113.1:1234", true},
+		{"1", "203.0.113.1:1234", false},
+		{"wrong", "192.0.2.1:1234", false},
+	} {
+		output.Reset()
+		req := httptest.NewRequest("GET", "/orders", nil)
+		req.RemoteAddr = test.remote
+		req.Header.Set("X-Teeproxy-Debug", test.value)
+		req.Header.Set("X-Request-Id", "req-7")
+		req.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		mirrorsInFlight.Wait()
+
+		if forwarded != "" {
+			t.Errorf("Expected 'the debug header stripped', but received '%s'", forwarded)
+		}
+		traced := strings.Contains(output.String(), "| DEBUG | req-7 ")
+		if traced != test.traced {
+			t.Errorf("Expected '%v' for %s from %s, but received '%v'", test.traced, test.value, test.remote, traced)
+		}
+		if !traced {
+			continue
+		}
+		for _, expectation := range []string{"GET /orders HTTP/1.1 from " + test.remote, "Authorization: \"[redacted]\"",
+			"mirrored by policy default to ", "production answered 200 OK", " answered 200 OK", "done"} {
+			if !strings.Contains(output.String(), expectation) {
+				t.Errorf("Expected '%s', but received '%s'", expectation, output.String())
+			}
+		}
+		if strings.Contains(output.String(), "Bearer token") {
+			t.Errorf("Expected 'the credentials redacted', but received '%s'", output.String())
+		}
+		if id := w.Header().Get("X-Request-Id"); id != "req-7" {
+			t.Errorf("Expected 'req-7', but received '%s'", id)
+		}
+	}
+	if _, err := parseNetworks("10.0.0.0"); err == nil {
+		t.Errorf("Expected 'an error for a network without a mask', but received none")
+	}
+}
+
+func TestDebugTraceAnonymizesClient(t *testing.T) {
+	defer func(networks []*net.IPNet) { debugTrustedNetworks = networks }(debugTrustedNetworks)
+	defer func(mode string) { *clientIPAnonymize = mode }(*clientIPAnonymize)
+	*clientIPAnonymize = "truncate"
+	debugTrustedNetworks, _ = parseNetworks("192.0.2.0/24")
+
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+	req := httptest.NewRequest("GET", "/orders", nil)
+	req.RemoteAddr = "192.0.2.77:1234"
+	req.Header.Set("X-Teeproxy-Debug", "1")
+	req.Header.Set("X-Forwarded-For", "198.51.100.23")
+	startDebugTrace(httptest.NewRecorder(), req)
+	if strings.Contains(output.String(), "192.0.2.77") || strings.Contains(output.String(), "198.51.100.23") {
+		t.Errorf("Expected the client addresses anonymized, but received '%s'", output.String())
+	}
+	if req.RemoteAddr != "192.0.2.77:1234" {
+		t.Errorf("Expected the request to be kept, but received '%s'", req.RemoteAddr)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// The delay buffer holds the mirrored requests for -mirror.delay seconds
+// before sending them, shifting the shadow traffic in time, e.g. for shadow
+// databases restored from a snapshot which need to catch up. As all requests
+// are held equally long, they leave the buffer in the order they entered.
+
+type delayedMirror struct {
+	due   time.Time
+	class int
+	task  *mirrorTask
+}
+
+// delayedMirrors is the buffer, nil without -mirror.delay.
+var delayedMirrors chan delayedMirror
+
+var mirrorDelayDropped = newCounterVec("teeproxy_mirror_delay_dropped_total",
+	"Number of mirrored requests dropped because the delay buffer was full.")
+
+func init() {
+	newGaugeFunc("teeproxy_mirror_delayed", "Number of mirrored requests held in the delay buffer.", func() float64 {
+		return float64(len(delayedMirrors))
+	})
+}
+
+// startDelayBuffer holds the mirrored requests for -mirror.delay seconds.
+func startDelayBuffer() {
+	if *mirrorDelay <= 0 {
+		return
+	}
+	delayedMirrors = make(chan delayedMirror, *mirrorDelaySize)
+	go func() {
+		for delayed := range delayedMirrors {
+			time.Sleep(time.Until(delayed.due))
+			sendMirror(delayed.class, delayed.task)
+		}
+	}()
+	log.Printf("Delaying the mirrored requests by %v, holding up to %d requests", time.Duration(*mirrorDelay)*time.Second, *mirrorDelaySize)
+}
+
+// delayMirror adds a dispatched request to the delay buffer, dropping it if
+// the buffer is full.
+func delayMirror(class int, task *mirrorTask) {
+	select {
+	case delayedMirrors <- delayedMirror{due: time.Now().Add(time.Duration(*mirrorDelay) * time.Second), class: class, task: task}:
+	default:
+		mirrorsInFlight.Done()
+		mirrorDelayDropped.Inc()
+		if *debug {
+			log.Printf("Dropped mirroring %s %s to %s, the delay buffer is full",
+				task.request.Method, task.request.URL.RequestURI(), task.alt.Alternative)
+		}
+	}
+}
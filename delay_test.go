@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMirrorDelay(t *testing.T) {
+	defer func(delay, size int) { *mirrorDelay, *mirrorDelaySize = delay, size }(*mirrorDelay, *mirrorDelaySize)
+	defer func(buffer chan delayedMirror) { delayedMirrors = buffer }(delayedMirrors)
+	*mirrorDelay, *mirrorDelaySize = 1, 10
+	startDelayBuffer()
+	defer close(delayedMirrors)
+
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer production.Close()
+	mirroredAt := make(chan time.Time, 1)
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirroredAt <- time.Now()
+	}))
+	defer alternate.Close()
+
+	start := time.Now()
+	newTestHandler(production.URL, alternate.URL).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	select {
+	case at := <-mirroredAt:
+		if delay := at.Sub(start); delay < time.Second {
+			t.Errorf("Expected a delay of '1s', but received '%v'", delay)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the delayed request to be mirrored")
+	}
+	mirrorsInFlight.Wait()
+}
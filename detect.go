@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -key.file, the listener expects TLS. -tls.plaintext selects what
+// happens to the clients speaking plain HTTP to it instead: refuse answers
+// them 400, redirect answers 301 to the same URL with https, serve proxies
+// them as well, so that one port serves both. The protocol is detected from
+// the first byte a client sends, a TLS handshake record starting with 0x16.
+
+const (
+	plaintextRefuse   = "refuse"
+	plaintextRedirect = "redirect"
+	plaintextServe    = "serve"
+)
+
+// detectTimeout bounds the wait for the first byte of a client.
+const detectTimeout = 10 * time.Second
+
+var plaintextConnectionsTotal = newCounterVec("teeproxy_plaintext_connections_total",
+	"Number of plain HTTP connections to the TLS listener by action, refuse, redirect or serve.", "action")
+
+func checkPlaintextPolicy(policy string) error {
+	if policy != plaintextRefuse && policy != plaintextRedirect && policy != plaintextServe {
+		return fmt.Errorf("unknown policy %q, expected refuse, redirect or serve", policy)
+	}
+	return nil
+}
+
+// detectingListener accepts TLS and plain HTTP connections.
+type detectingListener struct {
+	net.Listener
+	config *tls.Config
+	policy string
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newDetectingListener(listener net.Listener, config *tls.Config, policy string) *detectingListener {
+	l := &detectingListener{
+		Listener: listener,
+		config:   config,
+		policy:   policy,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go l.accept()
+	return l
+}
+
+// accept detects the protocol of every connection in its own goroutine, so
+// that slow clients do not hold up the others. Like http.Server, it retries
+// after a failed Accept, e.g. when out of file descriptors, until the
+// listener is closed.
+func (l *detectingListener) accept() {
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			l.errs <- err
+			return
+		}
+		if err != nil {
+			if delay *= 2; delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("Failed to accept a connection, retrying in %v: %s", delay, err)
+			select {
+			case <-time.After(delay):
+			case <-l.done:
+				l.errs <- net.ErrClosed
+				return
+			}
+			continue
+		}
+		delay = 0
+		go l.detect(conn)
+	}
+}
+
+func (l *detectingListener) detect(conn net.Conn) {
+	peeked := &peekedConn{Conn: conn, reader: bufio.NewReader(conn)}
+	conn.SetReadDeadline(time.Now().Add(detectTimeout))
+	first, err := peeked.reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var accepted net.Conn = peeked
+	if first[0] == 0x16 {
+		accepted = tls.Server(peeked, l.config)
+	} else {
+		plaintextConnectionsTotal.Inc(l.policy)
+		if l.policy != plaintextServe {
+			answerPlaintext(peeked, l.policy)
+			return
+		}
+	}
+	select {
+	case l.conns <- accepted:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// answerPlaintext refuses or redirects the requests of a plain HTTP client.
+func answerPlaintext(conn *peekedConn, policy string) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(detectTimeout))
+	req, err := http.ReadRequest(conn.reader)
+	if err != nil {
+		return
+	}
+	response := &http.Response{ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}, Close: true}
+	if policy == plaintextRedirect && req.Host != "" {
+		response.StatusCode = http.StatusMovedPermanently
+		response.Header.Set("Location", httpsLocation(req.Host, req.URL.RequestURI(), ""))
+	} else {
+		response.StatusCode = http.StatusBadRequest
+		response.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		response.Body = ioutil.NopCloser(strings.NewReader("Client sent an HTTP request to an HTTPS server.\n"))
+		response.ContentLength = -1
+	}
+	if err := response.Write(conn); err != nil && *debug {
+		log.Printf("Failed to answer the plain HTTP client %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+func (l *detectingListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		l.errs <- err
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *detectingListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// peekedConn reads through the reader that peeked at the first byte.
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+func TestDetectingListener(t *testing.T) {
+	// borrow the certificate and the client trusting it
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	config := &tls.Config{Certificates: tlsServer.TLS.Certificates}
+	client := tlsServer.Client()
+	tlsServer.Close()
+
+	for _, test := range []struct {
+		policy, status, location string
+	}{
+		{plaintextServe, "200 OK", ""},
+		{plaintextRedirect, "301 Moved Permanently", "https://www.example.com/path?q=1"},
+		{plaintextRefuse, "400 Bad Request", ""},
+	} {
+		plain, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener := newDetectingListener(plain, config, test.policy)
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, requestScheme(r))
+		})}
+		go server.Serve(listener)
+
+		response, err := client.Get("https://" + listener.Addr().String() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if string(body) != "https" {
+			t.Errorf("Expected '%s', but received '%s'", "https", body)
+		}
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, "GET /path?q=1 HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+		plainResponse, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if plainResponse.Status != test.status || plainResponse.Header.Get("Location") != test.location {
+			t.Errorf("Expected '%s %s', but received '%s %s'", test.status, test.location, plainResponse.Status, plainResponse.Header.Get("Location"))
+		}
+		conn.Close()
+		server.Close()
+	}
+	client.CloseIdleConnections()
+	if err := checkPlaintextPolicy("ignore"); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+}
+
+// flakyListener fails the first Accept calls like a process out of file
+// descriptors.
+type flakyListener struct {
+	net.Listener
+	failures int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.failures, -1) >= 0 {
+		return nil, syscall.EMFILE
+	}
+	return l.Listener.Accept()
+}
+
+func TestDetectingListenerRetriesAccept(t *testing.T) {
+	plain, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := newDetectingListener(&flakyListener{Listener: plain, failures: 2}, &tls.Config{}, plaintextServe)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "served")
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	response, err := http.Get("http://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "served" {
+		t.Errorf("Expected 'served', but received '%s'", body)
+	}
+}
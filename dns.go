@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend host names can be resolved by the -dns.servers instead of the
+// system resolver, e.g. where split-horizon DNS answers differently than
+// teeproxy should use, and cached for -dns.ttl seconds where the system
+// resolver is slow. An expired entry is still used if the lookup fails, until
+// it is dropped by the compaction or to make room, as at most dnsCacheLimit
+// hosts are cached, which the clients choose with templated backends.
+
+const dnsCacheLimit = 10000
+
+type dnsEntry struct {
+	addresses []string
+	expires   time.Time
+}
+
+type dnsResolver struct {
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]string, error)
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+	// next rotates the addresses dialed first
+	next uint32
+}
+
+// backendResolver resolves the backend hosts, nil to dial with the system
+// resolver.
+var backendResolver *dnsResolver
+
+var dnsLookupsTotal = newCounterVec("teeproxy_dns_lookups_total",
+	"Number of backend host name resolutions by result: hit, miss, stale or error.", "result")
+
+// newResolver creates the resolver of the -dns.servers, comma separated
+// host:port, and the -dns.ttl. It returns nil if neither is set.
+func newResolver(servers string, ttl time.Duration) (*dnsResolver, error) {
+	if servers == "" && ttl <= 0 {
+		return nil, nil
+	}
+	resolver := net.DefaultResolver
+	if servers != "" {
+		var addresses []string
+		for _, server := range strings.Split(servers, ",") {
+			server = strings.TrimSpace(server)
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			if host, _, _ := net.SplitHostPort(server); net.ParseIP(host) == nil {
+				return nil, errors.New("DNS server " + server + " is not an IP address")
+			}
+			addresses = append(addresses, server)
+		}
+		var next uint32
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				server := addresses[int(atomic.AddUint32(&next, 1)-1)%len(addresses)]
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return &dnsResolver{ttl: ttl, lookup: resolver.LookupHost, entries: make(map[string]dnsEntry)}, nil
+}
+
+// Lookup returns the addresses of the host, from the cache if fresh.
+func (r *dnsResolver) Lookup(ctx context.Context, host string) ([]string, error) {
+	now := time.Now()
+	r.mu.Lock()
+	entry, cached := r.entries[host]
+	r.mu.Unlock()
+	if cached && now.Before(entry.expires) {
+		dnsLookupsTotal.Inc("hit")
+		return entry.addresses, nil
+	}
+	addresses, err := r.lookup(ctx, host)
+	if err != nil {
+		if cached {
+			dnsLookupsTotal.Inc("stale")
+			return entry.addresses, nil
+		}
+		dnsLookupsTotal.Inc("error")
+		return nil, err
+	}
+	dnsLookupsTotal.Inc("miss")
+	if r.ttl > 0 {
+		r.store(host, dnsEntry{addresses: addresses, expires: now.Add(r.ttl)}, now)
+	}
+	return addresses, nil
+}
+
+// store caches the entry, dropping the expired entries, or else the one
+// expiring first, if the cache is full.
+func (r *dnsResolver) store(host string, entry dnsEntry, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[host]; !ok && len(r.entries) >= dnsCacheLimit {
+		if r.dropExpired(now) == 0 {
+			first := ""
+			for cached, e := range r.entries {
+				if first == "" || e.expires.Before(r.entries[first].expires) {
+					first = cached
+				}
+			}
+			delete(r.entries, first)
+		}
+	}
+	r.entries[host] = entry
+}
+
+// dropExpired drops the expired entries and returns their number.
+func (r *dnsResolver) dropExpired(now time.Time) int {
+	dropped := 0
+	for host, entry := range r.entries {
+		if now.After(entry.expires) {
+			delete(r.entries, host)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// compact drops the expired entries and returns their number.
+func (r *dnsResolver) compact(now time.Time) int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dropExpired(now)
+}
+
+// dialAddress dials the address, resolving its host with the
+// backendResolver if set and trying its addresses in turn.
+func dialAddress(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	r := backendResolver
+	if r == nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+	addresses, err := r.Lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) == 0 {
+		return nil, &net.DNSError{Err: "no addresses", Name: host, IsNotFound: true}
+	}
+	start := int(atomic.AddUint32(&r.next, 1)-1) % len(addresses)
+	for i := range addresses {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addresses[(start+i)%len(addresses)], port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
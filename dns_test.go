@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDNSCache(t *testing.T) {
+	lookups := 0
+	var failure error
+	r := &dnsResolver{ttl: time.Minute, entries: make(map[string]dnsEntry)}
+	r.lookup = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		return []string{"127.0.0.1"}, failure
+	}
+	for i := 0; i < 3; i++ {
+		if addresses, err := r.Lookup(context.Background(), "shadow"); err != nil || addresses[0] != "127.0.0.1" {
+			t.Errorf("Expected '127.0.0.1', but received '%v' and '%v'", addresses, err)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("Expected '1' lookup, but received '%d'", lookups)
+	}
+
+	// expired entries are used while the lookups fail
+	r.entries["shadow"] = dnsEntry{addresses: []string{"127.0.0.1"}, expires: time.Now().Add(-time.Second)}
+	failure = errors.New("timeout")
+	if addresses, err := r.Lookup(context.Background(), "shadow"); err != nil || len(addresses) != 1 {
+		t.Errorf("Expected the stale address, but received '%v' and '%v'", addresses, err)
+	}
+	if _, err := r.Lookup(context.Background(), "unknown"); err == nil {
+		t.Errorf("Expected the lookup error")
+	}
+}
+
+func TestDialAddressResolves(t *testing.T) {
+	defer func(r *dnsResolver) { backendResolver = r }(backendResolver)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	backendResolver = &dnsResolver{entries: make(map[string]dnsEntry)}
+	backendResolver.lookup = func(ctx context.Context, host string) ([]string, error) {
+		if host != "shadow.internal" {
+			t.Errorf("Expected 'shadow.internal', but received '%s'", host)
+		}
+		return []string{"127.0.0.1"}, nil
+	}
+	conn, err := dialAddress(context.Background(), &net.Dialer{Timeout: time.Second}, "tcp", net.JoinHostPort("shadow.internal", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestNewResolver(t *testing.T) {
+	if r, err := newResolver("", 0); r != nil || err != nil {
+		t.Errorf("Expected no resolver, but received '%v' and '%v'", r, err)
+	}
+	if _, err := newResolver("10.0.0.53, 10.0.0.54:5353", 0); err != nil {
+		t.Errorf("Expected valid servers, but received '%v'", err)
+	}
+	if _, err := newResolver("dns.internal", 0); err == nil {
+		t.Errorf("Expected an error for a host name")
+	}
+}
+
+func TestDNSCacheBounded(t *testing.T) {
+	r := &dnsResolver{ttl: time.Minute, entries: make(map[string]dnsEntry)}
+	r.lookup = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"192.0.2.1"}, nil
+	}
+	now := time.Now()
+	r.entries["expired"] = dnsEntry{expires: now.Add(-time.Second)}
+	for i := 0; len(r.entries) < dnsCacheLimit; i++ {
+		r.entries[fmt.Sprintf("host-%d", i)] = dnsEntry{expires: now.Add(time.Duration(i+1) * time.Second)}
+	}
+	r.Lookup(context.Background(), "new")
+	if _, ok := r.entries["expired"]; ok || len(r.entries) != dnsCacheLimit {
+		t.Errorf("Expected the expired entry to make room, but received '%d' entries", len(r.entries))
+	}
+	r.Lookup(context.Background(), "newer")
+	if _, ok := r.entries["host-0"]; ok || len(r.entries) != dnsCacheLimit {
+		t.Errorf("Expected the entry expiring first to make room, but received '%d' entries", len(r.entries))
+	}
+	if dropped := r.compact(now.Add(24 * time.Hour)); dropped != dnsCacheLimit || len(r.entries) != 0 {
+		t.Errorf("Expected all the entries dropped, but received '%d'", dropped)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Every mirrored request is a duplicate of the incoming one, so the
+// duplication has to hold for any request. DuplicateRequest and
+// DuplicateRequestStreaming guarantee, and the fuzz tests check, that:
+//
+//   - the original request is untouched, except for its body, which is
+//     replaced by one returning the same bytes,
+//   - the bodies of the original and the duplicate return the same bytes,
+//   - the duplicate has its own Header and URL, changing them, e.g. by an
+//     anonymization profile, doesn't change the original and vice versa.
+
+// DuplicateRequest returns a copy of the request, its body read into memory.
+// Bodyless requests are duplicated without buffering.
+func DuplicateRequest(request *http.Request) *http.Request {
+	var body io.ReadCloser = http.NoBody
+	if !isBodyless(request) {
+		var bodyBytes []byte
+		if request.Body != nil {
+			bodyBytes, _ = ioutil.ReadAll(request.Body)
+		}
+		request.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
+		body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
+	}
+	return duplicate(request, body)
+}
+
+// errDuplicateAborted is returned by the body of a streamed duplicate when
+// the original body was closed before its end.
+var errDuplicateAborted = errors.New("original request body closed before its end")
+
+// DuplicateRequestStreaming returns a copy of the request without reading the
+// body up front: the body of the duplicate returns what was read from the
+// original, waiting until the original is read further, or closed. It suits
+// large uploads, the production request isn't delayed by reading the body
+// first, nor by a slow duplicate.
+func DuplicateRequestStreaming(request *http.Request) *http.Request {
+	if isBodyless(request) {
+		return duplicate(request, http.NoBody)
+	}
+	buffer := &teeBuffer{}
+	buffer.cond = sync.NewCond(&buffer.mu)
+	request.Body = &teeSource{ReadCloser: request.Body, buffer: buffer}
+	return duplicate(request, &teeReader{buffer: buffer})
+}
+
+// abortStreamedDuplicates ends the bodies of the streamed duplicates of the
+// body, returning what the original returned so far, so that they do not wait
+// for reads that never come, e.g. if the request was answered from the cache.
+// net/http closes the body it passed to the handler, not the teeSource.
+func abortStreamedDuplicates(body io.ReadCloser) {
+	for source, ok := body.(*teeSource); ok; source, ok = source.ReadCloser.(*teeSource) {
+		source.buffer.finish(errDuplicateAborted)
+	}
+}
+
+// duplicate copies the request with the body, deep copying the mutable
+// Header and URL.
+func duplicate(request *http.Request, body io.ReadCloser) *http.Request {
+	var u *url.URL
+	if request.URL != nil {
+		copied := *request.URL
+		u = &copied
+	}
+	dup := &http.Request{
+		Method:        request.Method,
+		URL:           u,
+		RequestURI:    request.RequestURI,
+		Proto:         request.Proto,
+		ProtoMajor:    request.ProtoMajor,
+		ProtoMinor:    request.ProtoMinor,
+		Header:        request.Header.Clone(),
+		Body:          body,
+		Host:          request.Host,
+		ContentLength: request.ContentLength,
+		Close:         true,
+	}
+	if dup.Header == nil {
+		dup.Header = make(http.Header)
+	}
+	if order := headerOrder(request); order != nil {
+		dup = withHeaderOrder(dup, order)
+	}
+	return dup
+}
+
+// isBodyless reports whether the request has no body to duplicate.
+func isBodyless(request *http.Request) bool {
+	if request.Body == nil || request.Body == http.NoBody {
+		return true
+	}
+	return request.ContentLength == 0 && len(request.TransferEncoding) == 0
+}
+
+// teeBuffer holds what was read from the original body and not yet by the
+// duplicate, its only reader.
+type teeBuffer struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	data []byte
+	err  error // io.EOF, the read error or errDuplicateAborted once done
+}
+
+func (b *teeBuffer) finish(err error) {
+	b.mu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// teeSource is the original body, copying what is read to the buffer.
+type teeSource struct {
+	io.ReadCloser
+	buffer *teeBuffer
+}
+
+func (s *teeSource) Read(p []byte) (n int, err error) {
+	n, err = s.ReadCloser.Read(p)
+	b := s.buffer
+	b.mu.Lock()
+	b.data = append(b.data, p[:n]...)
+	if err != nil && b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	return
+}
+
+func (s *teeSource) Close() error {
+	s.buffer.finish(errDuplicateAborted)
+	return s.ReadCloser.Close()
+}
+
+// teeReader is the body of the duplicate, consuming the buffer.
+type teeReader struct {
+	buffer *teeBuffer
+}
+
+func (r *teeReader) Read(p []byte) (int, error) {
+	b := r.buffer
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for len(b.data) == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if len(b.data) > 0 {
+		n := copy(p, b.data)
+		b.data = b.data[n:]
+		if len(b.data) == 0 {
+			// releases what was read
+			b.data = nil
+		}
+		return n, nil
+	}
+	return 0, b.err
+}
+
+func (r *teeReader) Close() error {
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDuplicateBodylessRequest(t *testing.T) {
+	request := httptest.NewRequest("GET", "/search?q=1", nil)
+	original := request.Body
+	dup := DuplicateRequest(request)
+	if dup.Body != http.NoBody {
+		t.Errorf("Expected the duplicate to have no body, but received '%v'", dup.Body)
+	}
+	if request.Body != original {
+		t.Errorf("Expected the body of a bodyless request not to be replaced")
+	}
+}
+
+func TestDuplicateRequestBody(t *testing.T) {
+	request := httptest.NewRequest("POST", "/upload", strings.NewReader("hello"))
+	dup := DuplicateRequest(request)
+	for name, r := range map[string]*http.Request{"original": request, "duplicate": dup} {
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "hello" {
+			t.Errorf("Expected the %s body 'hello', but received '%s'", name, body)
+		}
+	}
+}
+
+func TestDuplicateRequestIsolatesHeaders(t *testing.T) {
+	request := httptest.NewRequest("GET", "/items?id=1", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	dup := DuplicateRequest(request)
+	dup.Header.Del("Authorization")
+	dup.URL.RawQuery = "id=2"
+	if request.Header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("Expected the original Authorization header, but received '%s'", request.Header.Get("Authorization"))
+	}
+	if request.URL.RawQuery != "id=1" {
+		t.Errorf("Expected the original query 'id=1', but received '%s'", request.URL.RawQuery)
+	}
+}
+
+func TestDuplicateRequestStreaming(t *testing.T) {
+	request := httptest.NewRequest("POST", "/upload", strings.NewReader("hello"))
+	dup := DuplicateRequestStreaming(request)
+	received := make(chan string)
+	go func() {
+		body, _ := ioutil.ReadAll(dup.Body)
+		received <- string(body)
+	}()
+	body, _ := ioutil.ReadAll(request.Body)
+	if string(body) != "hello" {
+		t.Errorf("Expected the original body 'hello', but received '%s'", body)
+	}
+	if body := <-received; body != "hello" {
+		t.Errorf("Expected the duplicate body 'hello', but received '%s'", body)
+	}
+}
+
+func TestDuplicateRequestStreamingAborted(t *testing.T) {
+	request := httptest.NewRequest("POST", "/upload", strings.NewReader("hello"))
+	dup := DuplicateRequestStreaming(request)
+	p := make([]byte, 2)
+	request.Body.Read(p)
+	request.Body.Close()
+	body, err := ioutil.ReadAll(dup.Body)
+	if string(body) != "he" || err != errDuplicateAborted {
+		t.Errorf("Expected 'he' and '%v', but received '%s' and '%v'", errDuplicateAborted, body, err)
+	}
+}
+
+func TestDuplicateRequestStreamingReleasesRead(t *testing.T) {
+	request := httptest.NewRequest("POST", "/upload", strings.NewReader("hello world"))
+	dup := DuplicateRequestStreaming(request)
+	p := make([]byte, 5)
+	request.Body.Read(p)
+	if n, _ := dup.Body.Read(p); n != 5 {
+		t.Errorf("Expected '5' bytes, but received '%d'", n)
+	}
+	if buffered := len(dup.Body.(*teeReader).buffer.data); buffered != 0 {
+		t.Errorf("Expected the bytes read by the duplicate to be released, but '%d' are held", buffered)
+	}
+}
+
+func TestAbortStreamedDuplicates(t *testing.T) {
+	request := httptest.NewRequest("POST", "/upload", strings.NewReader("hello"))
+	first := DuplicateRequestStreaming(request)
+	second := DuplicateRequestStreaming(request)
+	// the request is answered without reading its body
+	abortStreamedDuplicates(request.Body)
+	for _, dup := range []*http.Request{first, second} {
+		if body, err := ioutil.ReadAll(dup.Body); len(body) != 0 || err != errDuplicateAborted {
+			t.Errorf("Expected '' and '%v', but received '%s' and '%v'", errDuplicateAborted, body, err)
+		}
+	}
+}
+
+// fuzzRequest builds a request from the fuzzed parts, nil if they don't
+// form one.
+func fuzzRequest(method, target, name, value, body string) *http.Request {
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil
+	}
+	request := &http.Request{
+		Method:        method,
+		URL:           u,
+		RequestURI:    target,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{name: {value}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		Host:          "example.com",
+		ContentLength: int64(len(body)),
+	}
+	if body == "" {
+		request.Body = http.NoBody
+	}
+	return request
+}
+
+// checkDuplicate checks the invariants of the duplication documented in
+// duplicate.go.
+func checkDuplicate(t *testing.T, duplicateRequest func(*http.Request) *http.Request, method, target, name, value, body string) {
+	request := fuzzRequest(method, target, name, value, body)
+	if request == nil {
+		return
+	}
+	header, u := request.Header.Clone(), *request.URL
+	dup := duplicateRequest(request)
+	if dup.Method != request.Method || dup.URL.String() != request.URL.String() || dup.Host != request.Host ||
+		dup.RequestURI != request.RequestURI || !reflect.DeepEqual(dup.Header, request.Header) {
+		t.Fatalf("Expected a copy of '%v', but received '%v'", request, dup)
+	}
+	dup.Header.Add(name, "changed")
+	dup.Header.Set("X-Added", "1")
+	dup.URL.Path += "/changed"
+	dup.URL.RawQuery = "changed"
+	if !reflect.DeepEqual(request.Header, header) || *request.URL != u {
+		t.Fatalf("Expected the original to be untouched, but received '%v' '%v'", request.Header, request.URL)
+	}
+	original, err := ioutil.ReadAll(request.Body)
+	if err != nil || string(original) != body {
+		t.Fatalf("Expected the original body '%q', but received '%q' (%v)", body, original, err)
+	}
+	duplicated, err := ioutil.ReadAll(dup.Body)
+	if err != nil || string(duplicated) != body {
+		t.Fatalf("Expected the duplicate body '%q', but received '%q' (%v)", body, duplicated, err)
+	}
+}
+
+func addDuplicateSeeds(f *testing.F) {
+	f.Add("GET", "/search?q=1", "Accept", "*/*", "")
+	f.Add("POST", "/upload", "Content-Type", "text/plain", "hello")
+	f.Add("PUT", "/a%2Fb;c?x=%zz", "x-lower", "", "{\"a\":1}")
+	f.Add("DELETE", "*", "", "", "\x00\xff")
+}
+
+func FuzzDuplicateRequest(f *testing.F) {
+	addDuplicateSeeds(f)
+	f.Fuzz(func(t *testing.T, method, target, name, value, body string) {
+		checkDuplicate(t, DuplicateRequest, method, target, name, value, body)
+	})
+}
+
+func FuzzDuplicateRequestStreaming(f *testing.F) {
+	addDuplicateSeeds(f)
+	f.Fuzz(func(t *testing.T, method, target, name, value, body string) {
+		checkDuplicate(t, DuplicateRequestStreaming, method, target, name, value, body)
+	})
+}
+
+func BenchmarkDuplicateBodylessRequest(b *testing.B) {
+	request := httptest.NewRequest("GET", "/search?q=1", nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		DuplicateRequest(request)
+	}
+}
+
+func BenchmarkDuplicateRequest(b *testing.B) {
+	body := strings.Repeat("x", 4096)
+	for name, duplicateRequest := range map[string]func(*http.Request) *http.Request{
+		"buffered":  DuplicateRequest,
+		"streaming": DuplicateRequestStreaming,
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				request := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+				dup := duplicateRequest(request)
+				ioutil.ReadAll(request.Body)
+				ioutil.ReadAll(dup.Body)
+			}
+		})
+	}
+}
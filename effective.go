@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The admin endpoint /config returns the effective configuration of the
+// running instance: the flags, the environment variables teeproxy reads, the
+// -config file as loaded and the policies in effect after reloads and
+// runtime changes. Secrets are replaced by [redacted], unless given as
+// env:NAME or file:PATH references, which are shown as such.
+
+// secretFlags are redacted as a whole.
+var secretFlags = map[string]bool{
+	"sign.hmac.key":          true,
+	"b.oauth2.client-secret": true,
+	"redis.password":         true,
+	"flags.token":            true,
+	"anonymize.key":          true,
+	"admin.token.read":       true,
+	"admin.token.write":      true,
+	"verify.hmac.key":        true,
+	"b.authorization.token":  true,
+	"debug.token":            true,
+}
+
+// urlFlags are shown without the password of the URL, urlListFlags without
+// those of their comma separated URLs, secretURLFlags only with the scheme
+// and host, as their path is the credential, e.g. of a Slack incoming
+// webhook.
+var (
+	urlFlags       = map[string]bool{"a": true, "config": true, "redis": true, "capture": true, "capture.endpoint": true, "b.oauth2.token-url": true, "b.authorization.hook": true}
+	urlListFlags   = map[string]bool{"b.group": true, "webhook.fork": true}
+	secretURLFlags = map[string]bool{"alert.webhook": true}
+)
+
+// configEnvironment are the environment variables read by teeproxy.
+var configEnvironment = map[string]bool{
+	"AWS_ACCESS_KEY_ID":     false,
+	"AWS_SECRET_ACCESS_KEY": true,
+	"AWS_SESSION_TOKEN":     true,
+	"AWS_REGION":            false,
+	"GOMAXPROCS":            false,
+	"GOMEMLIMIT":            false,
+}
+
+// redactSecret redacts a secret value, keeping env: and file: references.
+func redactSecret(spec string) string {
+	if spec == "" || strings.HasPrefix(spec, "env:") || strings.HasPrefix(spec, "file:") {
+		return spec
+	}
+	return redacted
+}
+
+// redactURL removes the password of the URL, and with path its path and
+// query.
+func redactURL(value string, path bool) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		if strings.Contains(value, "@") {
+			return redacted
+		}
+		return value
+	}
+	if path {
+		u.User = nil
+		return u.Scheme + "://" + u.Host + "/" + redacted
+	}
+	return u.Redacted()
+}
+
+// redactURLList removes the passwords of the comma separated URLs.
+func redactURLList(value string) string {
+	urls := strings.Split(value, ",")
+	for i, u := range urls {
+		urls[i] = redactURL(strings.TrimSpace(u), false)
+	}
+	return strings.Join(urls, ",")
+}
+
+// redactURLs removes the passwords of the backend URLs.
+func redactURLs(urls []string) {
+	for i, value := range urls {
+		urls[i] = redactURL(value, false)
+	}
+}
+
+type effectivePolicy struct {
+	Name      string           `json:"name"`
+	Percent   float64          `json:"percent"`
+	Path      string           `json:"path,omitempty"`
+	Methods   string           `json:"methods,omitempty"`
+	Host      string           `json:"host,omitempty"`
+	Backends  []string         `json:"backends,omitempty"`
+	Groups    []effectiveGroup `json:"groups,omitempty"`
+	Anonymize string           `json:"anonymize,omitempty"`
+	Tenants   []string         `json:"tenants,omitempty"`
+}
+
+type effectiveGroup struct {
+	Name     string    `json:"name"`
+	Random   bool      `json:"random"`
+	Count    int       `json:"count,omitempty"`
+	Weights  []float64 `json:"weights,omitempty"`
+	Backends []string  `json:"backends"`
+}
+
+type effectiveListener struct {
+	Name     string            `json:"name"`
+	Listen   string            `json:"listen"`
+	Target   string            `json:"target"`
+	Policies []effectivePolicy `json:"policies"`
+}
+
+type effectiveConfig struct {
+	Flags       map[string]string      `json:"flags"`
+	Environment map[string]string      `json:"environment"`
+	File        *config                `json:"file,omitempty"`
+	FileError   string                 `json:"file_error,omitempty"`
+	Target      string                 `json:"target"`
+	Policies    []effectivePolicy      `json:"policies"`
+	Listeners   []effectiveListener    `json:"listeners,omitempty"`
+	Mirror      map[string]interface{} `json:"mirror"`
+}
+
+func describePolicies(policies []*policy) []effectivePolicy {
+	result := []effectivePolicy{}
+	for _, p := range policies {
+		percent := p.Percent
+		if value, ok := mirrorPercent(); ok && p.Adjustable {
+			percent = value
+		}
+		ep := effectivePolicy{Name: p.Name, Percent: percent,
+			Path: regexpString(p.Path), Methods: regexpString(p.Methods), Host: regexpString(p.Host)}
+		for _, b := range p.Backends {
+			ep.Backends = append(ep.Backends, b.AlternativeScheme+"://"+b.Alternative)
+		}
+		for _, g := range p.Groups {
+			eg := effectiveGroup{Name: g.Name, Random: g.Random, Count: g.Count, Weights: g.Weights}
+			for _, b := range g.Members {
+				eg.Backends = append(eg.Backends, b.AlternativeScheme+"://"+b.Alternative)
+			}
+			ep.Groups = append(ep.Groups, eg)
+		}
+		if p.Anonymize != nil {
+			ep.Anonymize = p.Anonymize.Name
+		}
+		for tenant := range p.Tenants {
+			ep.Tenants = append(ep.Tenants, tenant)
+		}
+		sort.Strings(ep.Tenants)
+		result = append(result, ep)
+	}
+	return result
+}
+
+func regexpString(re *regexp.Regexp) string {
+	if re == nil {
+		return ""
+	}
+	return re.String()
+}
+
+// effectiveConfiguration describes the configuration of the handler and the
+// listeners, redacted.
+func effectiveConfiguration(h *handler, instances []*instance) effectiveConfig {
+	c := effectiveConfig{
+		Flags:       make(map[string]string),
+		Environment: make(map[string]string),
+		Target:      h.TargetScheme + "://" + h.Target,
+		Policies:    describePolicies(h.Policies()),
+		Mirror:      map[string]interface{}{"paused": mirroringPaused(), "ramp": mirrorRamp(), "shedding": mirroringShed()},
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch {
+		case secretFlags[f.Name]:
+			value = redactSecret(value)
+		case secretURLFlags[f.Name] && value != "":
+			value = redactURL(value, true)
+		case urlFlags[f.Name] && value != "":
+			value = redactURL(value, false)
+		case urlListFlags[f.Name] && value != "":
+			value = redactURLList(value)
+		}
+		c.Flags[f.Name] = value
+	})
+	for name, secret := range configEnvironment {
+		if value, ok := os.LookupEnv(name); ok {
+			if secret {
+				value = redacted
+			}
+			c.Environment[name] = value
+		}
+	}
+	if value, ok := mirrorPercent(); ok {
+		c.Mirror["percent"] = value
+	}
+	if *configFile != "" {
+		file, err := loadConfig(*configFile)
+		if err != nil {
+			c.FileError = err.Error()
+		} else {
+			for i := range file.OAuth2 {
+				file.OAuth2[i].Backend = redactURL(file.OAuth2[i].Backend, false)
+				file.OAuth2[i].ClientSecret = redactSecret(file.OAuth2[i].ClientSecret)
+				file.OAuth2[i].TokenURL = redactURL(file.OAuth2[i].TokenURL, false)
+			}
+			for i := range file.Authorization {
+				file.Authorization[i].Backend = redactURL(file.Authorization[i].Backend, false)
+				file.Authorization[i].Token = redactSecret(file.Authorization[i].Token)
+				file.Authorization[i].Hook = redactURL(file.Authorization[i].Hook, false)
+			}
+			for i := range file.Uploads {
+				file.Uploads[i].Backend = redactURL(file.Uploads[i].Backend, false)
+			}
+			for i := range file.Bandwidth {
+				file.Bandwidth[i].Backend = redactURL(file.Bandwidth[i].Backend, false)
+			}
+			for i := range file.Redirects {
+				file.Redirects[i].Backend = redactURL(file.Redirects[i].Backend, false)
+			}
+			for i := range file.Listeners {
+				file.Listeners[i].Target = redactURL(file.Listeners[i].Target, false)
+				redactURLs(file.Listeners[i].Backends)
+			}
+			for _, pc := range file.Policies {
+				redactURLs(pc.Backends)
+				for _, gc := range pc.Groups {
+					redactURLs(gc.Backends)
+				}
+			}
+			c.File = file
+		}
+	}
+	for _, in := range instances {
+		c.Listeners = append(c.Listeners, effectiveListener{
+			Name:     in.config.Name,
+			Listen:   in.source.String(),
+			Target:   in.handler.TargetScheme + "://" + in.handler.Target,
+			Policies: describePolicies(in.handler.Policies()),
+		})
+	}
+	return c
+}
+
+// effectiveConfigHandler serves /config.
+func effectiveConfigHandler(h *handler, instances []*instance) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(effectiveConfiguration(h, instances))
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// The sinks write the exchanges either as JSON lines or as the protobuf
+// envelope defined in envelope.proto, both carry the envelope version.
+
+const envelopeVersion = 1
+
+func appendProtoVarint(b []byte, number int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoTag(b, number, protoVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, number int, data []byte) []byte {
+	b = appendProtoTag(b, number, protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendProtoBool(b []byte, number int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendProtoVarint(b, number, 1)
+}
+
+func appendProtoHeader(b []byte, number int, header http.Header) []byte {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		message := appendProtoString(nil, 1, name)
+		for _, value := range header[name] {
+			message = appendProtoString(message, 2, value)
+		}
+		b = appendProtoBytes(b, number, message)
+	}
+	return b
+}
+
+func appendProtoChunks(b []byte, number int, chunks []chunk) []byte {
+	for _, c := range chunks {
+		message := appendProtoVarint(nil, 1, uint64(c.Offset))
+		message = appendProtoBytes(message, 2, c.Data)
+		b = appendProtoBytes(b, number, message)
+	}
+	return b
+}
+
+// marshalExchange encodes the exchange as teeproxy.envelope.v1.Exchange.
+func marshalExchange(e *exchange) []byte {
+	b := appendProtoVarint(nil, 1, envelopeVersion)
+	if !e.Time.IsZero() {
+		b = appendProtoVarint(b, 2, uint64(e.Time.UnixNano()))
+	}
+	for i, s := range []string{e.Side, e.Backend, e.Method, e.URI, e.Proto, e.Host} {
+		if s != "" {
+			b = appendProtoString(b, 3+i, s)
+		}
+	}
+	b = appendProtoHeader(b, 9, e.Header)
+	b = appendProtoChunks(b, 10, e.RequestChunks)
+	b = appendProtoVarint(b, 11, uint64(e.Status))
+	b = appendProtoHeader(b, 12, e.ResponseHeader)
+	b = appendProtoChunks(b, 13, e.ResponseChunks)
+	for _, f := range e.Frames {
+		message := appendProtoVarint(nil, 1, uint64(f.Offset))
+		message = appendProtoBool(message, 2, f.FromClient)
+		message = appendProtoVarint(message, 3, uint64(f.Opcode))
+		message = appendProtoBool(message, 4, f.Final)
+		message = appendProtoVarint(message, 5, uint64(f.Length))
+		message = appendProtoBytes(message, 6, f.Data)
+		b = appendProtoBytes(b, 14, message)
+	}
+	b = appendProtoBool(b, 15, e.Truncated)
+	b = appendProtoVarint(b, 16, uint64(e.Duration))
+	for _, name := range e.HeaderOrder {
+		b = appendProtoString(b, 17, name)
+	}
+	if len(e.RequestMessages) > 0 {
+		b = appendProtoBytes(b, 18, e.RequestMessages)
+	}
+	if len(e.ResponseMessages) > 0 {
+		b = appendProtoBytes(b, 19, e.ResponseMessages)
+	}
+	return b
+}
+
+func unmarshalHeader(header *http.Header, data []byte) error {
+	fields, err := parseProto(data)
+	if err != nil {
+		return err
+	}
+	if *header == nil {
+		*header = make(http.Header)
+	}
+	var name string
+	var values []string
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			name = string(field.bytes)
+		case 2:
+			values = append(values, string(field.bytes))
+		}
+	}
+	(*header)[name] = values
+	return nil
+}
+
+func unmarshalChunk(data []byte) (c chunk, err error) {
+	fields, err := parseProto(data)
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			c.Offset = int64(field.varint)
+		case 2:
+			c.Data = field.bytes
+		}
+	}
+	return
+}
+
+func unmarshalFrame(data []byte) (f frame, err error) {
+	fields, err := parseProto(data)
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			f.Offset = int64(field.varint)
+		case 2:
+			f.FromClient = field.varint != 0
+		case 3:
+			f.Opcode = int(field.varint)
+		case 4:
+			f.Final = field.varint != 0
+		case 5:
+			f.Length = int64(field.varint)
+		case 6:
+			f.Data = field.bytes
+		}
+	}
+	return
+}
+
+// unmarshalExchange decodes a teeproxy.envelope.v1.Exchange, unknown fields
+// of newer minor revisions are skipped.
+func unmarshalExchange(data []byte) (*exchange, error) {
+	fields, err := parseProto(data)
+	if err != nil {
+		return nil, err
+	}
+	e := new(exchange)
+	texts := []*string{&e.Side, &e.Backend, &e.Method, &e.URI, &e.Proto, &e.Host}
+	for _, field := range fields {
+		switch n := field.number; {
+		case n == 1:
+			e.Version = int(field.varint)
+		case n == 2:
+			e.Time = time.Unix(0, int64(field.varint)).UTC()
+		case n >= 3 && n <= 8:
+			*texts[n-3] = string(field.bytes)
+		case n == 9:
+			err = unmarshalHeader(&e.Header, field.bytes)
+		case n == 10 || n == 13:
+			var c chunk
+			if c, err = unmarshalChunk(field.bytes); n == 10 {
+				e.RequestChunks = append(e.RequestChunks, c)
+			} else {
+				e.ResponseChunks = append(e.ResponseChunks, c)
+			}
+		case n == 11:
+			e.Status = int(field.varint)
+		case n == 12:
+			err = unmarshalHeader(&e.ResponseHeader, field.bytes)
+		case n == 14:
+			var f frame
+			f, err = unmarshalFrame(field.bytes)
+			e.Frames = append(e.Frames, f)
+		case n == 15:
+			e.Truncated = field.varint != 0
+		case n == 16:
+			e.Duration = int64(field.varint)
+		case n == 17:
+			e.HeaderOrder = append(e.HeaderOrder, string(field.bytes))
+		case n == 18:
+			e.RequestMessages = json.RawMessage(field.bytes)
+		case n == 19:
+			e.ResponseMessages = json.RawMessage(field.bytes)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if e.Version != envelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", e.Version)
+	}
+	return e, nil
+}
+
+// encodeExchange returns the exchange as a JSON line or as a length-delimited
+// protobuf envelope.
+func encodeExchange(e *exchange, format string) ([]byte, error) {
+	e.Version = envelopeVersion
+	if format == "protobuf" {
+		message := marshalExchange(e)
+		return append(binary.AppendUvarint(nil, uint64(len(message))), message...), nil
+	}
+	data, err := json.Marshal(e)
+	return append(data, '\n'), err
+}
+
+// exchangeDecoder reads the exchanges of a sink.
+type exchangeDecoder struct {
+	reader *bufio.Reader
+	format string
+}
+
+func newExchangeDecoder(r io.Reader, format string) *exchangeDecoder {
+	return &exchangeDecoder{reader: bufio.NewReaderSize(r, 1<<20), format: format}
+}
+
+// Decode returns the next exchange or io.EOF.
+func (d *exchangeDecoder) Decode() (*exchange, error) {
+	if d.format == "protobuf" {
+		length, err := binary.ReadUvarint(d.reader)
+		if err != nil {
+			return nil, err
+		}
+		message := make([]byte, length)
+		if _, err := io.ReadFull(d.reader, message); err != nil {
+			return nil, err
+		}
+		return unmarshalExchange(message)
+	}
+	line, err := d.reader.ReadBytes('\n')
+	if len(line) == 0 {
+		return nil, err
+	}
+	e := new(exchange)
+	if err := json.Unmarshal(line, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func validSinkFormat(format string) bool {
+	return format == "json" || format == "protobuf"
+}
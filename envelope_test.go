@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	original := &exchange{
+		Time:           time.Date(2024, 5, 1, 13, 15, 0, 42, time.UTC),
+		Side:           "b",
+		Backend:        "shadow:8081",
+		Method:         "POST",
+		URI:            "/orders?id=1",
+		Proto:          "HTTP/1.1",
+		Host:           "shop",
+		Header:         http.Header{"Content-Type": {"application/json"}, "X-Multi": {"1", "2"}},
+		RequestChunks:  []chunk{{Offset: 0, Data: []byte(`{"id":1}`)}},
+		Status:         201,
+		ResponseHeader: http.Header{"Location": {"/orders/1"}},
+		ResponseChunks: []chunk{{Offset: 1500, Data: []byte("created")}},
+		Frames:         []frame{{Offset: 10, FromClient: true, Opcode: 1, Final: true, Length: 2, Data: []byte("hi")}},
+		Truncated:      true,
+		Duration:       2000,
+	}
+	for _, format := range []string{"json", "protobuf"} {
+		var stream bytes.Buffer
+		for i := 0; i < 2; i++ {
+			data, err := encodeExchange(original, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream.Write(data)
+		}
+		decoder := newExchangeDecoder(&stream, format)
+		for i := 0; i < 2; i++ {
+			decoded, err := decoder.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, original) {
+				t.Errorf("Expected '%+v', but received '%+v' in %s", original, decoded, format)
+			}
+		}
+		if _, err := decoder.Decode(); err != io.EOF {
+			t.Errorf("Expected EOF, but received '%v' in %s", err, format)
+		}
+	}
+}
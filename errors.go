@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Request failures are classified so that they can be aggregated in the
+// teeproxy_request_errors_total metric and searched for in the log.
+
+var requestErrorsTotal = newCounterVec("teeproxy_request_errors_total",
+	"Number of failed requests to the backends by class, e.g. dns, connect-refused, tls, header-timeout, body-read or 5xx.",
+	"side", "backend", "class")
+
+// classifyError returns the class of a failed round trip.
+func classifyError(err error) string {
+	var dnsError *net.DNSError
+	var recordHeaderError tls.RecordHeaderError
+	var certificateError *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameError x509.HostnameError
+	var opError *net.OpError
+	var transformErr *transformError
+	switch {
+	case errors.As(err, &transformErr):
+		return "transform"
+	case errors.As(err, &dnsError):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connect-refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection-reset"
+	case errors.As(err, &recordHeaderError), errors.As(err, &certificateError),
+		errors.As(err, &unknownAuthority), errors.As(err, &hostnameError),
+		strings.Contains(err.Error(), "tls: "):
+		return "tls"
+	case strings.Contains(err.Error(), "awaiting response headers"):
+		return "header-timeout"
+	case errors.Is(err, context.DeadlineExceeded), isTimeout(err):
+		if errors.As(err, &opError) && opError.Op == "dial" {
+			return "connect-timeout"
+		}
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.As(err, &opError) && opError.Op == "dial":
+		return "connect"
+	}
+	return "other"
+}
+
+func isTimeout(err error) bool {
+	var netError net.Error
+	return errors.As(err, &netError) && netError.Timeout()
+}
+
+// countFailure records a failed request, or a 5xx response if err is nil.
+func countFailure(side string, request *http.Request, response *http.Response, err error) string {
+	class := ""
+	if err != nil {
+		class = classifyError(err)
+	} else if response != nil && response.StatusCode >= 500 {
+		class = "5xx"
+	}
+	if class != "" {
+		requestErrorsTotal.Inc(side, backendLabel(request), class)
+	}
+	return class
+}
+
+// errorRecordingBody records the error reading a response body.
+type errorRecordingBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *errorRecordingBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return
+}
+
+// countBodyFailure records a failure reading a response body.
+func countBodyFailure(side string, request *http.Request, err error) {
+	if err == nil {
+		return
+	}
+	requestErrorsTotal.Inc(side, backendLabel(request), "body-read")
+	log.Printf("Reading the response body of %s failed [body-read]: %s", request.URL.Host, err)
+}
+
+// When the production request fails, the client receives a problem details
+// response (RFC 9457) instead of an empty page, telling which attempts failed
+// and the id of the request to find them in the log:
+//
+//	{"type": "about:blank", "title": "Bad Gateway", "status": 502,
+//	 "detail": "all backends failed", "instance": "/path",
+//	 "request_id": "...", "errors": [{"target": "production", "class": "connect-refused"}]}
+
+var failedResponsesTotal = newCounterVec("teeproxy_failed_responses_total",
+	"Number of problem responses sent to the clients because all backends failed by status.", "status")
+
+// failedAttempt is a failed attempt to get a response for the client.
+type failedAttempt struct {
+	Target string `json:"target"`
+	Class  string `json:"class"`
+}
+
+type problemDetails struct {
+	Type      string          `json:"type"`
+	Title     string          `json:"title"`
+	Status    int             `json:"status"`
+	Detail    string          `json:"detail"`
+	Instance  string          `json:"instance"`
+	RequestID string          `json:"request_id"`
+	Errors    []failedAttempt `json:"errors"`
+}
+
+// requestID returns the X-Request-Id of the request, its trace id or a new
+// random id.
+func requestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	if id := traceID(req); id != "" {
+		return id
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// writeProblem answers a request for which all attempts failed, with 500 if
+// a transform of the request failed, 504 if they all timed out and 502
+// otherwise.
+func writeProblem(w http.ResponseWriter, req *http.Request, attempts []failedAttempt) {
+	status := http.StatusGatewayTimeout
+	detail := "all backends failed"
+	for _, attempt := range attempts {
+		if attempt.Class == "transform" {
+			status, detail = http.StatusInternalServerError, "transforming the request failed"
+			break
+		}
+		if !strings.HasSuffix(attempt.Class, "timeout") {
+			status = http.StatusBadGateway
+		}
+	}
+	instance := req.RequestURI
+	if instance == "" {
+		instance = req.URL.RequestURI()
+	}
+	problem := problemDetails{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  instance,
+		RequestID: requestID(req),
+		Errors:    attempts,
+	}
+	failedResponsesTotal.Inc(strconv.Itoa(status))
+	log.Printf("Answered %s %s with %d, request id %s: %s", req.Method, instance, status, problem.RequestID, detail)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Request-Id", problem.RequestID)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem)
+}
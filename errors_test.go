@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := listener.Addr().String()
+	listener.Close()
+
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer hanging.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plain.Close()
+
+	for _, test := range []struct {
+		url         string
+		expectation string
+	}{
+		{"http://" + refused + "/", "connect-refused"},
+		{hanging.URL, "header-timeout"},
+		{"https://" + plain.Listener.Addr().String() + "/", "tls"},
+		{"http://teeproxy.invalid/", "dns"},
+	} {
+		scheme, _ := SchemeAndHost(test.url)
+		request, _ := http.NewRequest("GET", test.url, nil)
+		_, err := getTransport(scheme, 50*time.Millisecond, true).RoundTrip(request)
+		if err == nil {
+			t.Errorf("Expected %s to fail", test.url)
+			continue
+		}
+		if class := classifyError(err); class != test.expectation {
+			t.Errorf("Expected '%s', but received '%s' for %s", test.expectation, class, err)
+		}
+	}
+}
+
+func TestProblemResponse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := listener.Addr().String()
+	listener.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler("http://" + refused)
+	req := httptest.NewRequest("GET", "/orders?id=1", nil)
+	req.Header.Set("X-Request-Id", "req-42")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusBadGateway, w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/problem+json" {
+		t.Errorf("Expected 'application/problem+json', but received '%s'", contentType)
+	}
+	var problem problemDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Status != http.StatusBadGateway || problem.Instance != "/orders?id=1" || problem.RequestID != "req-42" {
+		t.Errorf("Unexpected problem %+v", problem)
+	}
+	if len(problem.Errors) != 1 || problem.Errors[0] != (failedAttempt{Target: "production", Class: "connect-refused"}) {
+		t.Errorf("Unexpected errors %+v", problem.Errors)
+	}
+	if value := failedResponsesTotal.values[labelKey([]string{"502"})]; value < 1 {
+		t.Errorf("Expected the failed response to be counted, but received '%v'", value)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	if id := requestID(req); len(id) != 32 {
+		t.Errorf("Expected a random request id, but received '%s'", id)
+	}
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if id := requestID(req); id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected '4bf92f3577b34da6a3ce929d0e0e4736', but received '%s'", id)
+	}
+}
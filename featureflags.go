@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The mirroring can be driven by a feature flag service speaking the
+// OpenFeature Remote Evaluation Protocol (OFREP), e.g. flagd or the OFREP
+// endpoints of the commercial providers, instead of the local config:
+//
+//   - -flags.percent names a number flag evaluated every -flags.interval
+//     seconds, its value is set as the mirror percentage like
+//     /mirror/percent
+//   - -flags.tenants names a boolean flag evaluated per tenant of
+//     -tenant.key, with the tenant as targeting key, requests of tenants for
+//     whom it is false are not mirrored. The results are cached for
+//     -flags.interval seconds and evaluated in the background, at most
+//     flagEvaluationLimit at a time, until the first result the requests of
+//     a tenant are not mirrored.
+
+// flagSource is the source of the changes made by the flags in the log and
+// the audit log.
+const flagSource = "feature flags"
+
+// flaggedTenantLimit bounds the tenants whose flag is cached, when reached
+// the cache is cleared.
+const flaggedTenantLimit = 10000
+
+// flagEvaluationLimit bounds the tenants evaluated at a time, the others are
+// evaluated on a later request once one finished.
+const flagEvaluationLimit = 8
+
+var flagEvaluationsTotal = newCounterVec("teeproxy_flag_evaluations_total",
+	"Number of feature flag evaluations by flag and result, success or error.", "flag", "result")
+
+// ofrepClient evaluates flags with OFREP.
+type ofrepClient struct {
+	endpoint string
+	token    *secret
+	client   *http.Client
+}
+
+// ofrepEvaluation is the result of a flag evaluation.
+type ofrepEvaluation struct {
+	Key          string      `json:"key"`
+	Value        interface{} `json:"value"`
+	Reason       string      `json:"reason"`
+	Variant      string      `json:"variant"`
+	ErrorCode    string      `json:"errorCode"`
+	ErrorDetails string      `json:"errorDetails"`
+}
+
+// Evaluate evaluates the flag for the evaluation context.
+func (c *ofrepClient) Evaluate(key string, context map[string]string) (interface{}, error) {
+	payload, _ := json.Marshal(map[string]interface{}{"context": context})
+	req, err := http.NewRequest("POST", c.endpoint+"/ofrep/v1/evaluate/flags/"+url.PathEscape(key), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != nil {
+		token, err := c.token.Value()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := c.client.Do(req)
+	if err != nil {
+		flagEvaluationsTotal.Inc(key, "error")
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		flagEvaluationsTotal.Inc(key, "error")
+		return nil, err
+	}
+	var evaluation ofrepEvaluation
+	if err := json.Unmarshal(body, &evaluation); err != nil {
+		flagEvaluationsTotal.Inc(key, "error")
+		return nil, fmt.Errorf("evaluating %s: %s", key, response.Status)
+	}
+	if response.StatusCode != http.StatusOK || evaluation.ErrorCode != "" {
+		flagEvaluationsTotal.Inc(key, "error")
+		return nil, fmt.Errorf("evaluating %s: %s %s", key, evaluation.ErrorCode, evaluation.ErrorDetails)
+	}
+	flagEvaluationsTotal.Inc(key, "success")
+	return evaluation.Value, nil
+}
+
+type flaggedTenant struct {
+	mirrored  bool
+	evaluated time.Time
+}
+
+// tenantFlags caches the -flags.tenants flag per tenant.
+type tenantFlags struct {
+	client   *ofrepClient
+	key      string
+	interval time.Duration
+
+	mu         sync.Mutex
+	tenants    map[string]flaggedTenant
+	evaluating map[string]bool
+}
+
+// featureFlags is the OFREP client of -flags.ofrep and flagByTenants the
+// cache of -flags.tenants, nil without.
+var (
+	featureFlags  *ofrepClient
+	flagByTenants *tenantFlags
+)
+
+// Mirrors reports whether the requests of the tenant are mirrored, starting
+// the evaluation of the flag for the tenant if it is not cached or stale.
+func (f *tenantFlags) Mirrors(tenant string) bool {
+	if f == nil || tenant == "" {
+		return true
+	}
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cached, ok := f.tenants[tenant]
+	if (!ok || now.Sub(cached.evaluated) > f.interval) && !f.evaluating[tenant] && len(f.evaluating) < flagEvaluationLimit {
+		f.evaluating[tenant] = true
+		go f.evaluate(tenant)
+	}
+	return cached.mirrored
+}
+
+func (f *tenantFlags) evaluate(tenant string) {
+	value, err := f.client.Evaluate(f.key, map[string]string{"targetingKey": tenant, "tenant": tenant})
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.evaluating, tenant)
+	if err != nil {
+		log.Printf("Failed to evaluate the tenant flag: %s", err)
+		return
+	}
+	mirrored, ok := value.(bool)
+	if !ok {
+		log.Printf("Failed to evaluate the tenant flag: %s is %v, not a boolean", f.key, value)
+		return
+	}
+	if len(f.tenants) >= flaggedTenantLimit {
+		f.tenants = make(map[string]flaggedTenant)
+	}
+	f.tenants[tenant] = flaggedTenant{mirrored: mirrored, evaluated: time.Now()}
+}
+
+// evaluatePercentFlag sets the mirror percentage to the -flags.percent flag.
+func evaluatePercentFlag() error {
+	value, err := featureFlags.Evaluate(*flagPercent, map[string]string{"targetingKey": *listen})
+	if err != nil {
+		return err
+	}
+	percent, ok := value.(float64)
+	if !ok || percent < 0 || percent > 100 {
+		return fmt.Errorf("%s is %v, not a percentage", *flagPercent, value)
+	}
+	setMirrorPercent(percent, flagSource)
+	return nil
+}
+
+// startFeatureFlags evaluates the flags of -flags.ofrep.
+func startFeatureFlags() error {
+	if *flagProvider == "" {
+		return nil
+	}
+	if _, err := parseTarget(*flagProvider); err != nil {
+		return fmt.Errorf("-flags.ofrep: %v", err)
+	}
+	if *flagInterval <= 0 {
+		return fmt.Errorf("-flags.interval must be positive")
+	}
+	featureFlags = &ofrepClient{
+		endpoint: *flagProvider,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+	if *flagToken != "" {
+		featureFlags.token = newSecret(*flagToken)
+	}
+	interval := time.Duration(*flagInterval) * time.Second
+	if *flagTenants != "" {
+		flagByTenants = &tenantFlags{client: featureFlags, key: *flagTenants, interval: interval,
+			tenants: make(map[string]flaggedTenant), evaluating: make(map[string]bool)}
+	}
+	if *flagPercent != "" {
+		if err := evaluatePercentFlag(); err != nil {
+			log.Printf("Failed to evaluate the percentage flag: %s", err)
+		}
+		go func() {
+			for range time.Tick(interval) {
+				if err := evaluatePercentFlag(); err != nil {
+					log.Printf("Failed to evaluate the percentage flag: %s", err)
+				}
+			}
+		}()
+	}
+	log.Printf("Evaluating feature flags with %s", redactURL(*flagProvider, false))
+	return nil
+}
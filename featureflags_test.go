@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFeatureFlags(t *testing.T) {
+	defer func(v string) { *flagProvider = v }(*flagProvider)
+	defer func(v string) { *flagToken = v }(*flagToken)
+	defer func(v string) { *flagPercent = v }(*flagPercent)
+	defer func(v string) { *flagTenants = v }(*flagTenants)
+	defer func(v int) { *flagInterval = v }(*flagInterval)
+	defer func(v *ofrepClient, f *tenantFlags) { featureFlags, flagByTenants = v, f }(featureFlags, flagByTenants)
+	defer atomic.StoreUint64(&percentOverride, atomic.LoadUint64(&percentOverride))
+	atomic.StoreUint64(&percentOverride, math.Float64bits(-1))
+
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer flag-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"errorCode": "UNAUTHORIZED"})
+			return
+		}
+		var request struct {
+			Context map[string]string `json:"context"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		switch r.URL.Path {
+		case "/ofrep/v1/evaluate/flags/mirror-percent":
+			json.NewEncoder(w).Encode(map[string]interface{}{"key": "mirror-percent", "value": 25, "reason": "STATIC"})
+		case "/ofrep/v1/evaluate/flags/mirror-tenant":
+			json.NewEncoder(w).Encode(map[string]interface{}{"key": "mirror-tenant", "value": request.Context["targetingKey"] == "beta", "reason": "TARGETING_MATCH"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"errorCode": "FLAG_NOT_FOUND"})
+		}
+	}))
+	defer provider.Close()
+
+	*flagProvider = provider.URL
+	*flagToken = "flag-token"
+	*flagPercent = "mirror-percent"
+	*flagTenants = "mirror-tenant"
+	*flagInterval = 3600
+	if err := startFeatureFlags(); err != nil {
+		t.Fatal(err)
+	}
+	if percent, ok := mirrorPercent(); !ok || percent != 25 {
+		t.Errorf("Expected '25', but received '%v'", percent)
+	}
+
+	if !flagByTenants.Mirrors("") {
+		t.Errorf("Expected requests without tenant to be mirrored")
+	}
+	// unknown tenants are not mirrored until their flag is evaluated
+	for _, tenant := range []string{"beta", "other"} {
+		if flagByTenants.Mirrors(tenant) {
+			t.Errorf("Expected '%s' not to be mirrored before the evaluation", tenant)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !flagByTenants.Mirrors("beta") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !flagByTenants.Mirrors("beta") {
+		t.Errorf("Expected 'beta' to be mirrored")
+	}
+	if flagByTenants.Mirrors("other") {
+		t.Errorf("Expected 'other' not to be mirrored")
+	}
+
+	if _, err := featureFlags.Evaluate("missing", nil); err == nil {
+		t.Errorf("Expected an error for a missing flag")
+	}
+	if value := flagEvaluationsTotal.values[labelKey([]string{"missing", "error"})]; value != 1 {
+		t.Errorf("Expected '1', but received '%v'", value)
+	}
+}
+
+func TestTenantFlagsBoundEvaluations(t *testing.T) {
+	release := make(chan struct{})
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		json.NewEncoder(w).Encode(map[string]interface{}{"key": "mirror-tenant", "value": true})
+	}))
+	defer provider.Close()
+	defer close(release)
+
+	flags := &tenantFlags{client: &ofrepClient{endpoint: provider.URL, client: provider.Client()}, key: "mirror-tenant",
+		interval: time.Hour, tenants: make(map[string]flaggedTenant), evaluating: make(map[string]bool)}
+	for i := 0; i < 3*flagEvaluationLimit; i++ {
+		flags.Mirrors(fmt.Sprintf("tenant-%d", i))
+	}
+	flags.mu.Lock()
+	evaluating := len(flags.evaluating)
+	flags.mu.Unlock()
+	if evaluating != flagEvaluationLimit {
+		t.Errorf("Expected '%d' evaluations at a time, but received '%d'", flagEvaluationLimit, evaluating)
+	}
+}
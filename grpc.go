@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A minimal gRPC client for the grpc.health.v1 and server reflection
+// services, used to check gRPC backends before mirroring to them.
+
+const (
+	grpcHealthCheck          = "/grpc.health.v1.Health/Check"
+	grpcReflectionV1         = "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo"
+	grpcReflectionV1Alpha    = "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"
+	grpcStatusUnimplemented  = "12"
+	grpcServingStatusServing = 1
+)
+
+// getGrpcTransport returns a transport speaking HTTP/2, over TLS for https
+// and with prior knowledge (h2c) for http.
+func getGrpcTransport(scheme string, timeout time.Duration) *http.Transport {
+	protocols := new(http.Protocols)
+	transport := &http.Transport{
+		ResponseHeaderTimeout: timeout,
+		TLSHandshakeTimeout:   timeout,
+	}
+	if scheme == "https" {
+		protocols.SetHTTP2(true)
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: !*tlsVerifyBackends}
+		transport.ForceAttemptHTTP2 = true
+	} else {
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	transport.Protocols = protocols
+	return transport
+}
+
+// grpcCall sends the messages to a gRPC method and returns the response messages.
+func grpcCall(ctx context.Context, transport http.RoundTripper, scheme, host, method string, messages ...[]byte) ([][]byte, error) {
+	var body bytes.Buffer
+	for _, message := range messages {
+		var prefix [5]byte
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+		body.Write(prefix[:])
+		body.Write(message)
+	}
+	request, err := http.NewRequest("POST", scheme+"://"+host+method, &body)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned HTTP status %s", method, response.Status)
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	status := response.Header.Get("Grpc-Status")
+	if status == "" {
+		status = response.Trailer.Get("Grpc-Status")
+	}
+	if status != "0" {
+		return nil, &grpcError{method: method, status: status, message: response.Trailer.Get("Grpc-Message")}
+	}
+
+	var replies [][]byte
+	for len(data) >= 5 {
+		length := binary.BigEndian.Uint32(data[1:5])
+		if uint32(len(data)-5) < length {
+			return nil, io.ErrUnexpectedEOF
+		}
+		replies = append(replies, data[5:5+length])
+		data = data[5+length:]
+	}
+	return replies, nil
+}
+
+type grpcError struct {
+	method  string
+	status  string
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("%s failed with grpc-status %s %s", e.method, e.status, e.message)
+}
+
+// checkGrpcHealth calls grpc.health.v1.Health/Check for the service, the empty
+// name checks the overall server health.
+func checkGrpcHealth(ctx context.Context, transport http.RoundTripper, scheme, host, service string) error {
+	var request []byte
+	if service != "" {
+		request = appendProtoString(request, 1, service)
+	}
+	replies, err := grpcCall(ctx, transport, scheme, host, grpcHealthCheck, request)
+	if err != nil {
+		return err
+	}
+	if len(replies) != 1 {
+		return fmt.Errorf("health check returned %d messages", len(replies))
+	}
+	fields, err := parseProto(replies[0])
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if field.number == 1 && field.varint == grpcServingStatusServing {
+			return nil
+		}
+	}
+	return errors.New("health check did not report SERVING")
+}
+
+// grpcReflect sends a ServerReflectionRequest to the reflection service, v1
+// or else v1alpha, and returns the responses.
+func grpcReflect(ctx context.Context, transport http.RoundTripper, scheme, host string, request []byte) ([][]byte, error) {
+	replies, err := grpcCall(ctx, transport, scheme, host, grpcReflectionV1, request)
+	if e, ok := err.(*grpcError); ok && e.status == grpcStatusUnimplemented {
+		replies, err = grpcCall(ctx, transport, scheme, host, grpcReflectionV1Alpha, request)
+	}
+	return replies, err
+}
+
+// listGrpcServices asks the reflection service for the services provided.
+func listGrpcServices(ctx context.Context, transport http.RoundTripper, scheme, host string) ([]string, error) {
+	// ServerReflectionRequest with list_services (field 7) set
+	replies, err := grpcReflect(ctx, transport, scheme, host, appendProtoString(nil, 7, ""))
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	for _, reply := range replies {
+		fields, err := parseProto(reply)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range fields {
+			switch field.number {
+			case 6: // list_services_response
+				list, err := parseProto(field.bytes)
+				if err != nil {
+					return nil, err
+				}
+				for _, service := range list {
+					if service.number != 1 {
+						continue
+					}
+					name, err := parseProto(service.bytes)
+					if err != nil {
+						return nil, err
+					}
+					for _, n := range name {
+						if n.number == 1 {
+							services = append(services, string(n.bytes))
+						}
+					}
+				}
+			case 7: // error_response
+				return nil, errors.New("reflection request failed")
+			}
+		}
+	}
+	return services, nil
+}
+
+// checkGrpcBackend verifies that the backend is healthy and provides all
+// expected services.
+func checkGrpcBackend(transport http.RoundTripper, scheme, host string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := checkGrpcHealth(ctx, transport, scheme, host, *grpcHealthService); err != nil {
+		return err
+	}
+	if *grpcExpectedServices == "" {
+		return nil
+	}
+	services, err := listGrpcServices(ctx, transport, scheme, host)
+	if err != nil {
+		return err
+	}
+	provided := make(map[string]bool)
+	for _, service := range services {
+		provided[service] = true
+	}
+	for _, expected := range strings.Split(*grpcExpectedServices, ",") {
+		if expected = strings.TrimSpace(expected); expected != "" && !provided[expected] {
+			return fmt.Errorf("service %s is not provided", expected)
+		}
+	}
+	return nil
+}
+
+// watchGrpcBackend periodically checks the backend and only marks it ready
+// while the checks succeed.
+func watchGrpcBackend(alt *backend) {
+	timeout := time.Duration(*alternateTimeout) * time.Millisecond
+	interval := time.Duration(*grpcHealthInterval) * time.Millisecond
+	transport := getGrpcTransport(alt.AlternativeScheme, timeout)
+	for {
+		err := checkGrpcBackend(transport, alt.AlternativeScheme, alt.Alternative, timeout)
+		if ready := err == nil; ready != alt.Ready() {
+			if ready {
+				log.Printf("Alternate backend %s is ready, mirroring begins", alt.Alternative)
+			} else {
+				log.Printf("Alternate backend %s is not ready, mirroring stops: %s", alt.Alternative, err)
+			}
+			alt.setReady(ready)
+		} else if err != nil && *debug {
+			log.Printf("Alternate backend %s is still not ready: %s", alt.Alternative, err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newGrpcServer starts a TLS HTTP/2 server answering every call with the reply.
+func newGrpcServer(t *testing.T, reply []byte) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if r.URL.Path == grpcReflectionV1 {
+			w.Header().Set("Grpc-Status", grpcStatusUnimplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		var prefix [5]byte
+		binary.BigEndian.PutUint32(prefix[1:], uint32(len(reply)))
+		w.Write(prefix[:])
+		w.Write(reply)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGrpcHealthServing(t *testing.T) {
+	server := newGrpcServer(t, []byte{0x08, grpcServingStatusServing})
+	host := strings.TrimPrefix(server.URL, "https://")
+	transport := getGrpcTransport("https", time.Second)
+	if err := checkGrpcHealth(context.Background(), transport, "https", host, ""); err != nil {
+		t.Errorf("Expected the backend to be serving, but received '%s'", err)
+	}
+}
+
+func TestGrpcHealthNotServing(t *testing.T) {
+	server := newGrpcServer(t, []byte{0x08, 0x02})
+	host := strings.TrimPrefix(server.URL, "https://")
+	transport := getGrpcTransport("https", time.Second)
+	if err := checkGrpcHealth(context.Background(), transport, "https", host, ""); err == nil {
+		t.Errorf("Expected an error for a backend not serving")
+	}
+}
+
+func TestGrpcListServices(t *testing.T) {
+	service := appendProtoString(nil, 1, "helloworld.Greeter")
+	list := appendProtoString(nil, 1, string(service))
+	server := newGrpcServer(t, appendProtoString(nil, 6, string(list)))
+	host := strings.TrimPrefix(server.URL, "https://")
+	transport := getGrpcTransport("https", time.Second)
+	services, err := listGrpcServices(context.Background(), transport, "https", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0] != "helloworld.Greeter" {
+		t.Errorf("Expected '[helloworld.Greeter]', but received '%v'", services)
+	}
+}
@@ -0,0 +1,812 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The protobuf messages of gRPC requests and responses are opaque, so with
+// the descriptors of the services, from the -grpc.descriptors descriptor sets
+// (protoc --include_imports --descriptor_set_out) or fetched with
+// -grpc.reflection from the server reflection of the production target, they
+// are decoded to JSON: in the recordings as request_messages and
+// response_messages, and for the comparison with the grpc normalization, so
+// that the differences name the fields. The JSON follows the proto3 mapping
+// without the special forms of the well-known types, unknown fields are
+// keyed by their number. Compressed messages are not decoded. Only the
+// services the reflection lists are fetched, so that the paths of the clients
+// do not start fetches of services the target does not provide.
+
+// FieldDescriptorProto.Type values.
+const (
+	protoTypeDouble   = 1
+	protoTypeFloat    = 2
+	protoTypeInt64    = 3
+	protoTypeUint64   = 4
+	protoTypeInt32    = 5
+	protoTypeFixed64  = 6
+	protoTypeFixed32  = 7
+	protoTypeBool     = 8
+	protoTypeString   = 9
+	protoTypeGroup    = 10
+	protoTypeMessage  = 11
+	protoTypeBytes    = 12
+	protoTypeUint32   = 13
+	protoTypeEnum     = 14
+	protoTypeSfixed32 = 15
+	protoTypeSfixed64 = 16
+	protoTypeSint32   = 17
+	protoTypeSint64   = 18
+)
+
+// protoDecodeDepth bounds the nesting of the decoded messages.
+const protoDecodeDepth = 64
+
+// grpcReflectionRetry is the minimum time between two fetches of the
+// descriptors of a service, or of the list of the services.
+const grpcReflectionRetry = time.Minute
+
+var grpcDecodedTotal = newCounterVec("teeproxy_grpc_decoded_total",
+	"Number of gRPC bodies decoded to JSON by result, decoded, unknown-method or error.", "result")
+
+type protoFieldType struct {
+	jsonName string
+	kind     int
+	repeated bool
+	// typeName is the full name of the message or enum type
+	typeName string
+}
+
+type protoMessageType struct {
+	fields   map[int]*protoFieldType
+	mapEntry bool
+}
+
+type grpcMethod struct {
+	input, output string
+}
+
+// protoRegistry holds the message, enum and method descriptors.
+type protoRegistry struct {
+	mu       sync.RWMutex
+	files    map[string]bool
+	messages map[string]*protoMessageType
+	enums    map[string]map[int32]string
+	methods  map[string]grpcMethod
+
+	// reflect fetches the descriptors of a service, nil without reflection
+	reflect  func(service string) error
+	fetching map[string]time.Time
+	// list fetches the services of the target, only these are reflected
+	list     func() ([]string, error)
+	listed   map[string]bool
+	listedAt time.Time
+}
+
+// grpcDecoder decodes the gRPC messages, nil unless -grpc.descriptors or
+// -grpc.reflection is set.
+var grpcDecoder *protoRegistry
+
+func newProtoRegistry() *protoRegistry {
+	return &protoRegistry{
+		files:    make(map[string]bool),
+		messages: make(map[string]*protoMessageType),
+		enums:    make(map[string]map[int32]string),
+		methods:  make(map[string]grpcMethod),
+		fetching: make(map[string]time.Time),
+	}
+}
+
+// addDescriptorSet adds the files of a FileDescriptorSet.
+func (r *protoRegistry) addDescriptorSet(data []byte) error {
+	fields, err := parseProto(data)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if field.number == 1 {
+			if _, err := r.addFile(field.bytes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addFile adds the types and services of a FileDescriptorProto and returns
+// its dependencies.
+func (r *protoRegistry) addFile(data []byte) (dependencies []string, err error) {
+	fields, err := parseProto(data)
+	if err != nil {
+		return nil, err
+	}
+	var name, pkg string
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			name = string(field.bytes)
+		case 2:
+			pkg = string(field.bytes)
+		case 3:
+			dependencies = append(dependencies, string(field.bytes))
+		}
+	}
+	prefix := ""
+	if pkg != "" {
+		prefix = pkg + "."
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files[name] = true
+	for _, field := range fields {
+		switch field.number {
+		case 4:
+			err = r.addMessage(prefix, field.bytes)
+		case 5:
+			err = r.addEnum(prefix, field.bytes)
+		case 6:
+			err = r.addService(prefix, field.bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("descriptor %s: %v", name, err)
+		}
+	}
+	return dependencies, nil
+}
+
+// addMessage adds a DescriptorProto and its nested types.
+func (r *protoRegistry) addMessage(prefix string, data []byte) error {
+	fields, err := parseProto(data)
+	if err != nil {
+		return err
+	}
+	message := &protoMessageType{fields: make(map[int]*protoFieldType)}
+	var name string
+	for _, field := range fields {
+		if field.number == 1 {
+			name = prefix + string(field.bytes)
+		}
+	}
+	for _, field := range fields {
+		switch field.number {
+		case 2:
+			number, f, err := parseFieldDescriptor(field.bytes)
+			if err != nil {
+				return err
+			}
+			message.fields[number] = f
+		case 3:
+			err = r.addMessage(name+".", field.bytes)
+		case 4:
+			err = r.addEnum(name+".", field.bytes)
+		case 7:
+			var options []protoField
+			options, err = parseProto(field.bytes)
+			for _, option := range options {
+				if option.number == 7 && option.varint != 0 {
+					message.mapEntry = true
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	r.messages[name] = message
+	return nil
+}
+
+func parseFieldDescriptor(data []byte) (int, *protoFieldType, error) {
+	fields, err := parseProto(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	var name string
+	var number int
+	f := &protoFieldType{}
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			name = string(field.bytes)
+		case 3:
+			number = int(field.varint)
+		case 4:
+			f.repeated = field.varint == 3
+		case 5:
+			f.kind = int(field.varint)
+		case 6:
+			f.typeName = strings.TrimPrefix(string(field.bytes), ".")
+		case 10:
+			f.jsonName = string(field.bytes)
+		}
+	}
+	if f.jsonName == "" {
+		f.jsonName = lowerCamel(name)
+	}
+	return number, f, nil
+}
+
+// lowerCamel returns the proto3 JSON name of a field without json_name.
+func lowerCamel(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, c := range name {
+		switch {
+		case c == '_':
+			upper = true
+		case upper && c >= 'a' && c <= 'z':
+			b.WriteRune(c - 'a' + 'A')
+			upper = false
+		default:
+			b.WriteRune(c)
+			upper = false
+		}
+	}
+	return b.String()
+}
+
+func (r *protoRegistry) addEnum(prefix string, data []byte) error {
+	fields, err := parseProto(data)
+	if err != nil {
+		return err
+	}
+	var name string
+	values := make(map[int32]string)
+	for _, field := range fields {
+		switch field.number {
+		case 1:
+			name = prefix + string(field.bytes)
+		case 2:
+			value, err := parseProto(field.bytes)
+			if err != nil {
+				return err
+			}
+			var valueName string
+			var number int32
+			for _, v := range value {
+				switch v.number {
+				case 1:
+					valueName = string(v.bytes)
+				case 2:
+					number = int32(v.varint)
+				}
+			}
+			values[number] = valueName
+		}
+	}
+	r.enums[name] = values
+	return nil
+}
+
+func (r *protoRegistry) addService(prefix string, data []byte) error {
+	fields, err := parseProto(data)
+	if err != nil {
+		return err
+	}
+	var name string
+	for _, field := range fields {
+		if field.number == 1 {
+			name = prefix + string(field.bytes)
+		}
+	}
+	for _, field := range fields {
+		if field.number != 2 {
+			continue
+		}
+		method, err := parseProto(field.bytes)
+		if err != nil {
+			return err
+		}
+		var methodName string
+		var m grpcMethod
+		for _, f := range method {
+			switch f.number {
+			case 1:
+				methodName = string(f.bytes)
+			case 2:
+				m.input = strings.TrimPrefix(string(f.bytes), ".")
+			case 3:
+				m.output = strings.TrimPrefix(string(f.bytes), ".")
+			}
+		}
+		r.methods["/"+name+"/"+methodName] = m
+	}
+	return nil
+}
+
+// method returns the types of the method of the path, starting to fetch the
+// descriptors of its service with reflection if unknown.
+func (r *protoRegistry) method(path string) (grpcMethod, bool) {
+	r.mu.RLock()
+	m, ok := r.methods[path]
+	r.mu.RUnlock()
+	if ok || r.reflect == nil {
+		return m, ok
+	}
+	service := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	if service == "" {
+		return m, false
+	}
+	now := time.Now()
+	r.mu.Lock()
+	if !r.listed[service] && now.Sub(r.listedAt) > grpcReflectionRetry {
+		r.listedAt = now
+		go r.listServices()
+	}
+	if r.listed[service] && now.Sub(r.fetching[service]) > grpcReflectionRetry {
+		r.fetching[service] = now
+		go func() {
+			if err := r.reflect(service); err != nil {
+				log.Printf("Failed to fetch the descriptors of %s: %s", service, err)
+			}
+		}()
+	}
+	r.mu.Unlock()
+	return m, false
+}
+
+// listServices fetches the services of the target that can be reflected.
+func (r *protoRegistry) listServices() {
+	services, err := r.list()
+	if err != nil {
+		log.Printf("Failed to list the services: %s", err)
+		return
+	}
+	listed := make(map[string]bool)
+	for _, service := range services {
+		listed[service] = true
+	}
+	r.mu.Lock()
+	r.listed = listed
+	r.mu.Unlock()
+}
+
+// decodeMessage decodes a message of the type to JSON values.
+func (r *protoRegistry) decodeMessage(typeName string, data []byte, depth int) (map[string]interface{}, error) {
+	if depth > protoDecodeDepth {
+		return nil, errors.New("messages nested too deeply")
+	}
+	message := r.messages[typeName]
+	if message == nil {
+		return nil, fmt.Errorf("unknown message type %s", typeName)
+	}
+	fields, err := parseProto(data)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{})
+	for _, field := range fields {
+		f := message.fields[field.number]
+		if f == nil || f.kind == protoTypeGroup {
+			result[strconv.Itoa(field.number)] = unknownProtoValue(field)
+			continue
+		}
+		var values []interface{}
+		if f.repeated && field.wireType == protoBytes && isPackable(f.kind) {
+			if values, err = unpackProto(f, field.bytes, r.enums[f.typeName]); err != nil {
+				return nil, err
+			}
+		} else {
+			value, err := r.decodeValue(f, field, depth)
+			if err != nil {
+				return nil, err
+			}
+			values = []interface{}{value}
+		}
+		if entry := r.messages[f.typeName]; f.kind == protoTypeMessage && entry != nil && entry.mapEntry {
+			m, _ := result[f.jsonName].(map[string]interface{})
+			if m == nil {
+				m = make(map[string]interface{})
+				result[f.jsonName] = m
+			}
+			for _, value := range values {
+				pair, _ := value.(map[string]interface{})
+				m[fmt.Sprint(pair["key"])] = pair["value"]
+			}
+			continue
+		}
+		if f.repeated {
+			list, _ := result[f.jsonName].([]interface{})
+			result[f.jsonName] = append(list, values...)
+			continue
+		}
+		result[f.jsonName] = values[0]
+	}
+	return result, nil
+}
+
+// decodeValue decodes a field that is not packed.
+func (r *protoRegistry) decodeValue(f *protoFieldType, field protoField, depth int) (interface{}, error) {
+	switch f.kind {
+	case protoTypeMessage:
+		if field.wireType != protoBytes {
+			return unknownProtoValue(field), nil
+		}
+		return r.decodeMessage(f.typeName, field.bytes, depth+1)
+	case protoTypeString:
+		return string(field.bytes), nil
+	case protoTypeBytes:
+		return field.bytes, nil
+	}
+	if field.wireType == protoBytes {
+		return unknownProtoValue(field), nil
+	}
+	return protoScalar(f.kind, field.varint, r.enums[f.typeName]), nil
+}
+
+func isPackable(kind int) bool {
+	return kind != protoTypeString && kind != protoTypeBytes && kind != protoTypeMessage && kind != protoTypeGroup
+}
+
+// unpackProto decodes a packed repeated field.
+func unpackProto(f *protoFieldType, data []byte, enum map[int32]string) ([]interface{}, error) {
+	var values []interface{}
+	for len(data) > 0 {
+		var v uint64
+		switch f.kind {
+		case protoTypeDouble, protoTypeFixed64, protoTypeSfixed64:
+			if len(data) < 8 {
+				return nil, errProtoTruncated
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case protoTypeFloat, protoTypeFixed32, protoTypeSfixed32:
+			if len(data) < 4 {
+				return nil, errProtoTruncated
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			var n int
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return nil, errProtoTruncated
+			}
+			data = data[n:]
+		}
+		values = append(values, protoScalar(f.kind, v, enum))
+	}
+	return values, nil
+}
+
+// protoScalar converts a numeric field to its JSON value, 64 bit integers as
+// strings.
+func protoScalar(kind int, v uint64, enum map[int32]string) interface{} {
+	switch kind {
+	case protoTypeDouble:
+		return jsonFloat(math.Float64frombits(v))
+	case protoTypeFloat:
+		return jsonFloat(float64(math.Float32frombits(uint32(v))))
+	case protoTypeInt64, protoTypeSfixed64:
+		return strconv.FormatInt(int64(v), 10)
+	case protoTypeUint64, protoTypeFixed64:
+		return strconv.FormatUint(v, 10)
+	case protoTypeSint64:
+		return strconv.FormatInt(int64(v>>1)^-int64(v&1), 10)
+	case protoTypeInt32, protoTypeSfixed32:
+		return int32(v)
+	case protoTypeUint32, protoTypeFixed32:
+		return uint32(v)
+	case protoTypeSint32:
+		return int32(uint32(v)>>1) ^ -int32(v&1)
+	case protoTypeBool:
+		return v != 0
+	case protoTypeEnum:
+		if name, ok := enum[int32(v)]; ok {
+			return name
+		}
+		return int32(v)
+	}
+	return v
+}
+
+// jsonFloat returns the special floats as strings, as JSON has no literal
+// for them.
+func jsonFloat(f float64) interface{} {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return f
+}
+
+func unknownProtoValue(field protoField) interface{} {
+	if field.wireType == protoBytes {
+		return field.bytes
+	}
+	return field.varint
+}
+
+// isGrpcContent reports whether the media type is gRPC or binary gRPC-Web.
+func isGrpcContent(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "application/grpc") && !strings.HasPrefix(mediaType, "application/grpc-web-text")
+}
+
+// grpcFrames splits a gRPC body into its messages, skipping the trailers of
+// gRPC-Web.
+func grpcFrames(body []byte) ([][]byte, error) {
+	var messages [][]byte
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return nil, errProtoTruncated
+		}
+		flags, length := body[0], binary.BigEndian.Uint32(body[1:5])
+		if uint32(len(body)-5) < length {
+			return nil, errProtoTruncated
+		}
+		switch {
+		case flags&0x80 != 0:
+		case flags&1 != 0:
+			return nil, errors.New("compressed message")
+		default:
+			messages = append(messages, body[5:5+length])
+		}
+		body = body[5+length:]
+	}
+	return messages, nil
+}
+
+// decodeBody decodes the messages of a request or response body of the
+// method of the path as a JSON array.
+func (r *protoRegistry) decodeBody(path string, body []byte, request bool) (json.RawMessage, error) {
+	m, ok := r.method(path)
+	if !ok {
+		grpcDecodedTotal.Inc("unknown-method")
+		return nil, fmt.Errorf("unknown method %s", path)
+	}
+	typeName := m.output
+	if request {
+		typeName = m.input
+	}
+	frames, err := grpcFrames(body)
+	if err != nil {
+		grpcDecodedTotal.Inc("error")
+		return nil, err
+	}
+	messages := make([]interface{}, 0, len(frames))
+	r.mu.RLock()
+	for _, frame := range frames {
+		message, err := r.decodeMessage(typeName, frame, 0)
+		if err != nil {
+			r.mu.RUnlock()
+			grpcDecodedTotal.Inc("error")
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	r.mu.RUnlock()
+	decoded, err := json.Marshal(messages)
+	if err != nil {
+		grpcDecodedTotal.Inc("error")
+		return nil, err
+	}
+	grpcDecodedTotal.Inc("decoded")
+	return decoded, nil
+}
+
+// decodeExchange adds the decoded messages to a recorded gRPC exchange.
+func (r *protoRegistry) decodeExchange(e *exchange) {
+	if r == nil || e.Truncated || !isGrpcContent(mediaType(e.Header)) {
+		return
+	}
+	path := strings.SplitN(e.URI, "?", 2)[0]
+	join := func(chunks []chunk) []byte {
+		var body []byte
+		for _, c := range chunks {
+			body = append(body, c.Data...)
+		}
+		return body
+	}
+	if decoded, err := r.decodeBody(path, join(e.RequestChunks), true); err == nil {
+		e.RequestMessages = decoded
+	}
+	if isGrpcContent(mediaType(e.ResponseHeader)) {
+		if decoded, err := r.decodeBody(path, join(e.ResponseChunks), false); err == nil {
+			e.ResponseMessages = decoded
+		}
+	}
+}
+
+// normalizeGrpc replaces the messages of a gRPC body by their JSON, with the
+// keys sorted, or by the messages decoded in the recording.
+func normalizeGrpc(r *comparedResponse) {
+	if r.truncated || r.comparison == nil || !isGrpcContent(mediaType(r.header)) {
+		return
+	}
+	decoded := r.messages
+	if len(decoded) > 0 {
+		var value interface{}
+		if json.Unmarshal(decoded, &value) != nil {
+			return
+		}
+		decoded, _ = json.Marshal(value)
+	} else if grpcDecoder != nil {
+		var err error
+		path := strings.SplitN(r.comparison.uri, "?", 2)[0]
+		if decoded, err = grpcDecoder.decodeBody(path, r.body.Bytes(), false); err != nil {
+			return
+		}
+	} else {
+		return
+	}
+	r.body.Reset()
+	r.body.Write(decoded)
+	r.decoded = true
+}
+
+// jsonDifference returns the path of the first difference of two JSON
+// documents and the differing values.
+func jsonDifference(a, b []byte) (string, bool) {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return "", false
+	}
+	return firstDifference("", va, vb)
+}
+
+func firstDifference(path string, a, b interface{}) (string, bool) {
+	child := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(va)+len(vb))
+		for key := range va {
+			keys = append(keys, key)
+		}
+		for key := range vb {
+			if _, ok := va[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if difference, ok := firstDifference(child(key), va[key], vb[key]); ok {
+				return difference, true
+			}
+		}
+		return "", false
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(va) || i < len(vb); i++ {
+			var ea, eb interface{}
+			if i < len(va) {
+				ea = va[i]
+			}
+			if i < len(vb) {
+				eb = vb[i]
+			}
+			if difference, ok := firstDifference(child(strconv.Itoa(i)), ea, eb); ok {
+				return difference, true
+			}
+		}
+		return "", false
+	default:
+		if a == b {
+			return "", false
+		}
+	}
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return fmt.Sprintf("%s %s != %s", path, ja, jb), true
+}
+
+// fetchGrpcDescriptors fetches the descriptors of the file defining the
+// symbol, and of its dependencies, from the server reflection.
+func (r *protoRegistry) fetchGrpcDescriptors(ctx context.Context, reflect func(ctx context.Context, request []byte) ([][]byte, error), symbol string) error {
+	// ServerReflectionRequest with file_containing_symbol (field 4) set
+	request := appendProtoString(nil, 4, symbol)
+	var missing []string
+	for requests := 0; requests < 100; requests++ {
+		replies, err := reflect(ctx, request)
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			fields, err := parseProto(reply)
+			if err != nil {
+				return err
+			}
+			for _, field := range fields {
+				switch field.number {
+				case 4: // file_descriptor_response
+					files, err := parseProto(field.bytes)
+					if err != nil {
+						return err
+					}
+					for _, file := range files {
+						if file.number != 1 {
+							continue
+						}
+						dependencies, err := r.addFile(file.bytes)
+						if err != nil {
+							return err
+						}
+						missing = append(missing, dependencies...)
+					}
+				case 7: // error_response
+					return fmt.Errorf("reflection has no descriptor for %s", symbol)
+				}
+			}
+		}
+		request = nil
+		for request == nil && len(missing) > 0 {
+			dependency := missing[0]
+			missing = missing[1:]
+			r.mu.RLock()
+			known := r.files[dependency]
+			r.mu.RUnlock()
+			if !known {
+				// file_by_filename (field 3)
+				request = appendProtoString(nil, 3, dependency)
+			}
+		}
+		if request == nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// startGrpcDecoding loads the -grpc.descriptors and, with -grpc.reflection,
+// fetches the unknown services from the server reflection of the host,
+// unless empty.
+func startGrpcDecoding(scheme, host string) error {
+	if *grpcDescriptorSets == "" && (!*grpcReflection || host == "") {
+		return nil
+	}
+	registry := newProtoRegistry()
+	for _, name := range strings.Split(*grpcDescriptorSets, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err := registry.addDescriptorSet(data); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if *grpcReflection && host != "" {
+		timeout := time.Duration(*productionTimeout) * time.Millisecond
+		transport := getGrpcTransport(scheme, timeout)
+		reflect := func(ctx context.Context, request []byte) ([][]byte, error) {
+			return grpcReflect(ctx, transport, scheme, host, request)
+		}
+		registry.reflect = func(service string) error {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			return registry.fetchGrpcDescriptors(ctx, reflect, service)
+		}
+		registry.list = func() ([]string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			return listGrpcServices(ctx, transport, scheme, host)
+		}
+	}
+	grpcDecoder = registry
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFieldDescriptor(name string, number, label, kind int, typeName string) []byte {
+	b := appendProtoString(nil, 1, name)
+	b = appendProtoVarint(b, 3, uint64(number))
+	b = appendProtoVarint(b, 4, uint64(label))
+	b = appendProtoVarint(b, 5, uint64(kind))
+	if typeName != "" {
+		b = appendProtoString(b, 6, typeName)
+	}
+	return b
+}
+
+// testShopDescriptor describes
+//
+//	package shop;
+//	import "common.proto";
+//	message Item {
+//	  string name = 1; int64 count = 2; repeated int32 sizes = 3;
+//	  common.Color color = 4; map<string, int32> tags = 5; double price = 6;
+//	}
+//	service Shop { rpc Get(Item) returns (Item); }
+func testShopDescriptor() []byte {
+	entry := appendProtoString(nil, 1, "TagsEntry")
+	entry = appendProtoBytes(entry, 2, testFieldDescriptor("key", 1, 1, protoTypeString, ""))
+	entry = appendProtoBytes(entry, 2, testFieldDescriptor("value", 2, 1, protoTypeInt32, ""))
+	entry = appendProtoBytes(entry, 7, appendProtoBool(nil, 7, true))
+	item := appendProtoString(nil, 1, "Item")
+	item = appendProtoBytes(item, 2, testFieldDescriptor("name", 1, 1, protoTypeString, ""))
+	item = appendProtoBytes(item, 2, testFieldDescriptor("item_count", 2, 1, protoTypeInt64, ""))
+	item = appendProtoBytes(item, 2, testFieldDescriptor("sizes", 3, 3, protoTypeInt32, ""))
+	item = appendProtoBytes(item, 2, testFieldDescriptor("color", 4, 1, protoTypeEnum, ".common.Color"))
+	item = appendProtoBytes(item, 2, testFieldDescriptor("tags", 5, 3, protoTypeMessage, ".shop.Item.TagsEntry"))
+	item = appendProtoBytes(item, 2, testFieldDescriptor("price", 6, 1, protoTypeDouble, ""))
+	item = appendProtoBytes(item, 3, entry)
+	method := appendProtoString(nil, 1, "Get")
+	method = appendProtoString(method, 2, ".shop.Item")
+	method = appendProtoString(method, 3, ".shop.Item")
+	service := appendProtoString(nil, 1, "Shop")
+	service = appendProtoBytes(service, 2, method)
+	file := appendProtoString(nil, 1, "shop.proto")
+	file = appendProtoString(file, 2, "shop")
+	file = appendProtoString(file, 3, "common.proto")
+	file = appendProtoBytes(file, 4, item)
+	return appendProtoBytes(file, 6, service)
+}
+
+// testCommonDescriptor describes enum common.Color { RED = 0; BLUE = 1; }
+func testCommonDescriptor() []byte {
+	enum := appendProtoString(nil, 1, "Color")
+	enum = appendProtoBytes(enum, 2, appendProtoString(nil, 1, "RED"))
+	enum = appendProtoBytes(enum, 2, appendProtoVarint(appendProtoString(nil, 1, "BLUE"), 2, 1))
+	file := appendProtoString(nil, 1, "common.proto")
+	file = appendProtoString(file, 2, "common")
+	return appendProtoBytes(file, 5, enum)
+}
+
+func testShopRegistry(t *testing.T) *protoRegistry {
+	registry := newProtoRegistry()
+	set := appendProtoBytes(nil, 1, testCommonDescriptor())
+	set = appendProtoBytes(set, 1, testShopDescriptor())
+	if err := registry.addDescriptorSet(set); err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func testItem(count int64) []byte {
+	b := appendProtoString(nil, 1, "hat")
+	b = appendProtoVarint(b, 2, uint64(count))
+	b = appendProtoBytes(b, 3, []byte{1, 2})
+	b = appendProtoVarint(b, 4, 1)
+	entry := appendProtoString(nil, 1, "size")
+	entry = appendProtoVarint(entry, 2, 7)
+	b = appendProtoBytes(b, 5, entry)
+	b = appendProtoTag(b, 6, protoFixed64)
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(1.5))
+	return appendProtoVarint(b, 99, 3)
+}
+
+func grpcFrame(message []byte) []byte {
+	frame := []byte{0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+func TestGrpcDecodeBody(t *testing.T) {
+	registry := testShopRegistry(t)
+	decoded, err := registry.decodeBody("/shop.Shop/Get", grpcFrame(testItem(3)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"99":3,"color":"BLUE","itemCount":"3","name":"hat","price":1.5,"sizes":[1,2],"tags":{"size":7}}]`
+	if string(decoded) != expected {
+		t.Errorf("Expected '%s', but received '%s'", expected, decoded)
+	}
+	if _, err := registry.decodeBody("/shop.Shop/Put", grpcFrame(testItem(3)), true); err == nil {
+		t.Errorf("Expected an error for an unknown method")
+	}
+}
+
+func TestGrpcDecodeExchange(t *testing.T) {
+	e := &exchange{URI: "/shop.Shop/Get", Header: http.Header{"Content-Type": {"application/grpc"}},
+		RequestChunks:  []chunk{{Data: grpcFrame(testItem(3))}},
+		ResponseHeader: http.Header{"Content-Type": {"application/grpc+proto"}},
+		ResponseChunks: []chunk{{Data: grpcFrame(testItem(4))}, {Data: []byte{0x80, 0, 0, 0, 0}}}}
+	testShopRegistry(t).decodeExchange(e)
+	if !strings.Contains(string(e.RequestMessages), `"itemCount":"3"`) {
+		t.Errorf("Expected the decoded request, but received '%s'", e.RequestMessages)
+	}
+	if !strings.Contains(string(e.ResponseMessages), `"itemCount":"4"`) {
+		t.Errorf("Expected the decoded response, but received '%s'", e.ResponseMessages)
+	}
+	decoded, err := unmarshalExchange(marshalExchange(e))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded.ResponseMessages) != string(e.ResponseMessages) {
+		t.Errorf("Expected '%s', but received '%s'", e.ResponseMessages, decoded.ResponseMessages)
+	}
+}
+
+func TestGrpcReflectionFetchesDependencies(t *testing.T) {
+	registry := newProtoRegistry()
+	var requested []string
+	reflect := func(ctx context.Context, request []byte) ([][]byte, error) {
+		fields, err := parseProto(request)
+		if err != nil {
+			return nil, err
+		}
+		requested = append(requested, string(fields[0].bytes))
+		file := testShopDescriptor()
+		if fields[0].number == 3 {
+			file = testCommonDescriptor()
+		}
+		return [][]byte{appendProtoBytes(nil, 4, appendProtoBytes(nil, 1, file))}, nil
+	}
+	if err := registry.fetchGrpcDescriptors(context.Background(), reflect, "shop.Shop"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(requested, ",") != "shop.Shop,common.proto" {
+		t.Errorf("Expected 'shop.Shop,common.proto', but received '%s'", strings.Join(requested, ","))
+	}
+	decoded, err := registry.decodeBody("/shop.Shop/Get", grpcFrame(testItem(3)), false)
+	if err != nil || !strings.Contains(string(decoded), `"color":"BLUE"`) {
+		t.Errorf("Expected the enum name, but received '%s' (%v)", decoded, err)
+	}
+}
+
+func TestNormalizeGrpcNamesTheDifferingField(t *testing.T) {
+	defer func(d *protoRegistry) { grpcDecoder = d }(grpcDecoder)
+	grpcDecoder = testShopRegistry(t)
+	comparison := &responseComparison{method: "POST", uri: "/shop.Shop/Get"}
+	var responses []*comparedResponse
+	for _, count := range []int64{3, 4} {
+		r := &comparedResponse{comparison: comparison, status: 200,
+			header: http.Header{"Content-Type": {"application/grpc"}}}
+		r.body.Write(grpcFrame(testItem(count)))
+		normalizeGrpc(r)
+		responses = append(responses, r)
+	}
+	result := strings.Join(differences(responses[0], responses[1]), "; ")
+	expected := `body field 0.itemCount "3" != "4"`
+	if !strings.Contains(result, expected) {
+		t.Errorf("Expected '%s', but received '%s'", expected, result)
+	}
+}
+
+func TestGrpcReflectionOnlyListedServices(t *testing.T) {
+	registry := newProtoRegistry()
+	reflected := make(chan string, 10)
+	registry.reflect = func(service string) error {
+		reflected <- service
+		return nil
+	}
+	registry.list = func() ([]string, error) {
+		return []string{"shop.Shop"}, nil
+	}
+	registry.method("/shop.Shop/Get")
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		registry.mu.RLock()
+		listed := registry.listed["shop.Shop"]
+		registry.mu.RUnlock()
+		if listed {
+			break
+		}
+	}
+	for _, path := range []string{"/random1.X/Get", "/random2.Y/Get", "/shop.Shop/Get", "/shop.Shop/Put"} {
+		registry.method(path)
+	}
+	if service := <-reflected; service != "shop.Shop" {
+		t.Errorf("Expected 'shop.Shop', but received '%s'", service)
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if len(registry.fetching) != 1 || len(reflected) != 0 {
+		t.Errorf("Expected only 'shop.Shop' to be reflected, but received '%v'", registry.fetching)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// `teeproxy test` runs end-to-end scenarios against a proxy with in-process
+// stub backends A and B, asserting on the mirroring decisions, the header
+// handling and the comparisons. The proxy is configured by the other flags,
+// e.g. `teeproxy -compare test` includes the comparison, so that features
+// can be tried without curl. The scenarios also run with go test, new
+// features add theirs to harnessScenarios.
+
+// stubRequest is a request received by a stub backend.
+type stubRequest struct {
+	Method string
+	URI    string
+	Header http.Header
+	Body   []byte
+}
+
+// stubBackend is an in-process backend answering with its Handler, by
+// default 200 and the body "<name> ok", recording the requests it received
+// unless Discard is set.
+type stubBackend struct {
+	Name    string
+	Handler http.HandlerFunc
+	Discard bool
+
+	listener net.Listener
+	mu       sync.Mutex
+	requests []stubRequest
+	count    int
+}
+
+func newStubBackend(name string) (*stubBackend, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &stubBackend{Name: name, listener: listener}
+	go http.Serve(listener, s)
+	return s, nil
+}
+
+func (s *stubBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	s.count++
+	if !s.Discard {
+		s.requests = append(s.requests, stubRequest{Method: r.Method, URI: r.RequestURI, Header: r.Header.Clone(), Body: body})
+	}
+	handler := s.Handler
+	s.mu.Unlock()
+	if handler != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		handler(w, r)
+		return
+	}
+	fmt.Fprintf(w, "%s ok", s.Name)
+}
+
+// Address returns the host:port of the stub.
+func (s *stubBackend) Address() string {
+	return s.listener.Addr().String()
+}
+
+// Requests returns the requests received since the last Reset.
+func (s *stubBackend) Requests() []stubRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]stubRequest(nil), s.requests...)
+}
+
+// Count returns the number of requests received since the last Reset.
+func (s *stubBackend) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Reset forgets the received requests and restores the default handler.
+func (s *stubBackend) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+	s.count = 0
+	s.Handler = nil
+}
+
+func (s *stubBackend) Close() error {
+	return s.listener.Close()
+}
+
+// harness is a proxy mirroring all requests from the stub A to the stub B.
+type harness struct {
+	A, B    *stubBackend
+	Handler *handler
+
+	listener net.Listener
+	client   *http.Client
+}
+
+func newHarness() (*harness, error) {
+	normalizers, err := parseNormalizers(*compareNormalize)
+	if err != nil {
+		return nil, err
+	}
+	compareNormalizers = normalizers
+	a, err := newStubBackend("a")
+	if err != nil {
+		return nil, err
+	}
+	b, err := newStubBackend("b")
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		a.Close()
+		b.Close()
+		return nil, err
+	}
+	h := newHarnessHandler(a, b)
+	server := &http.Server{Handler: h}
+	if *preserveHeaders {
+		listener = rawHeadListener{Listener: listener}
+		server.ConnContext = rawHeadContext
+	}
+	go server.Serve(listener)
+	return &harness{A: a, B: b, Handler: h, listener: listener, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// newHarnessHandler returns a handler proxying to a and mirroring all
+// requests to b.
+func newHarnessHandler(a, b *stubBackend) *handler {
+	h := &handler{Target: a.Address(), Randomizer: *rand.New(newLockedSource(1))}
+	h.SetSchemes()
+	h.Transport = withOrderedHeaders(getTransport(h.TargetScheme, 5*time.Second, false))
+	alt := lookupBackend(b.Address())
+	h.Alternatives = []*backend{alt}
+	h.SetPolicies([]*policy{{Name: "harness", Percent: 100, Backends: h.Alternatives}})
+	return h
+}
+
+// URL returns the URL of the path on the proxy.
+func (h *harness) URL(path string) string {
+	return "http://" + h.listener.Addr().String() + path
+}
+
+// Do sends the request through the proxy and waits for its mirrored
+// requests, returning the response with its body read.
+func (h *harness) Do(req *http.Request) (*http.Response, []byte, error) {
+	response, err := h.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	mirrorsInFlight.Wait()
+	return response, body, err
+}
+
+// Get sends a GET request for the path through the proxy.
+func (h *harness) Get(path string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest("GET", h.URL(path), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h.Do(req)
+}
+
+func (h *harness) Close() {
+	h.listener.Close()
+	evictIdleConnections()
+	h.A.Close()
+	h.B.Close()
+}
+
+// errSkipScenario skips a scenario not applying to the flags.
+var errSkipScenario = errors.New("skipped")
+
+type harnessScenario struct {
+	Name string
+	Run  func(h *harness) error
+}
+
+var harnessScenarios = []harnessScenario{
+	{"mirrors the request to b", func(h *harness) error {
+		if _, _, err := h.Get("/items?id=1"); err != nil {
+			return err
+		}
+		a, b := h.A.Requests(), h.B.Requests()
+		if len(a) != 1 || len(b) != 1 {
+			return fmt.Errorf("expected a request to a and b, received %d and %d", len(a), len(b))
+		}
+		if b[0].URI != "/items?id=1" {
+			return fmt.Errorf("expected b to receive /items?id=1, received %s", b[0].URI)
+		}
+		return nil
+	}},
+	{"returns the response of a", func(h *harness) error {
+		h.A.Handler = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend", "a")
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, "created")
+		}
+		h.B.Handler = func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "b failed", http.StatusInternalServerError)
+		}
+		response, body, err := h.Get("/")
+		if err != nil {
+			return err
+		}
+		if response.StatusCode != http.StatusCreated || string(body) != "created" || response.Header.Get("X-Backend") != "a" {
+			return fmt.Errorf("expected 201 created from a, received %d %q", response.StatusCode, body)
+		}
+		return nil
+	}},
+	{"sends the request body to a and b", func(h *harness) error {
+		req, err := http.NewRequest("POST", h.URL("/orders"), strings.NewReader(`{"amount":10}`))
+		if err != nil {
+			return err
+		}
+		if _, _, err := h.Do(req); err != nil {
+			return err
+		}
+		a, b := h.A.Requests(), h.B.Requests()
+		if len(a) != 1 || len(b) != 1 || string(a[0].Body) != `{"amount":10}` || string(b[0].Body) != `{"amount":10}` {
+			return fmt.Errorf("expected the body at a and b, received %v and %v", a, b)
+		}
+		return nil
+	}},
+	{"removes hop-by-hop headers and adds Via", func(h *harness) error {
+		req, err := http.NewRequest("GET", h.URL("/"), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("X-End-To-End", "1")
+		if _, _, err := h.Do(req); err != nil {
+			return err
+		}
+		for _, r := range append(h.A.Requests(), h.B.Requests()...) {
+			if r.Header.Get("X-Hop") != "" || r.Header.Get("X-End-To-End") != "1" {
+				return fmt.Errorf("expected only the end-to-end header, received %v", r.Header)
+			}
+			if *viaPseudonym != "" && !strings.Contains(r.Header.Get("Via"), *viaPseudonym) {
+				return fmt.Errorf("expected Via %s, received %q", *viaPseudonym, r.Header.Get("Via"))
+			}
+		}
+		return nil
+	}},
+	{"compares the responses of a and b", func(h *harness) error {
+		if !*compareResponses {
+			return errSkipScenario
+		}
+		h.A.Handler = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"a":1,"b":2}`)
+		}
+		h.B.Handler = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"b":2, "a":1}`)
+		}
+		route := routes.Normalize("/harness/compare")
+		matches := comparisonsTotal.Value(route, "match")
+		if _, _, err := h.Get("/harness/compare"); err != nil {
+			return err
+		}
+		// the production side is compared after its body was sent
+		return eventually(func() bool { return comparisonsTotal.Value(route, "match") == matches+1 },
+			"expected the normalized responses to match")
+	}},
+}
+
+// eventually polls the condition for up to a second.
+func eventually(condition func() bool, message string) error {
+	for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			return errors.New(message)
+		}
+	}
+	return nil
+}
+
+// runHarness runs the scenarios, resetting the stubs before each, and
+// reports their results.
+func runHarness(scenarios []harnessScenario, report func(name string, err error)) {
+	h, err := newHarness()
+	if err != nil {
+		report("harness", err)
+		return
+	}
+	defer h.Close()
+	for _, scenario := range scenarios {
+		h.A.Reset()
+		h.B.Reset()
+		report(scenario.Name, scenario.Run(h))
+	}
+}
+
+// testCommand implements "teeproxy test", it exits with 1 if a scenario
+// failed.
+func testCommand() int {
+	failed := false
+	runHarness(harnessScenarios, func(name string, err error) {
+		switch err {
+		case nil:
+			fmt.Printf("| TEST | %s: ok\n", name)
+		case errSkipScenario:
+			fmt.Printf("| TEST | %s: skipped\n", name)
+		default:
+			fmt.Printf("| TEST | %s: FAIL %s\n", name, err)
+			failed = true
+		}
+	})
+	if failed {
+		fmt.Fprintln(os.Stderr, "FAIL")
+		return 1
+	}
+	return 0
+}
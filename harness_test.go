@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestHarnessScenarios(t *testing.T) {
+	defer func(compare bool) { *compareResponses = compare }(*compareResponses)
+	*compareResponses = true
+	runHarness(harnessScenarios, func(name string, err error) {
+		if err != nil && err != errSkipScenario {
+			t.Errorf("Scenario '%s' failed: %s", name, err)
+		}
+	})
+}
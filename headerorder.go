@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// net/http canonicalizes the names of the request headers and writes them
+// sorted. With -preserve-headers, the header lines of the HTTP/1.x clients are
+// read from the connection and forwarded, and recorded, in their original
+// order and casing, for legacy backends depending on it. Headers added by
+// teeproxy follow the ones of the client.
+
+// rawHeadWindow is how many of the last bytes read from a client connection
+// are kept to find the request head in.
+const rawHeadWindow = 64 << 10
+
+// rawHeadListener keeps the last bytes read from the accepted connections.
+type rawHeadListener struct {
+	net.Listener
+}
+
+func (l rawHeadListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &rawHeadConn{Conn: conn}, nil
+}
+
+type rawHeadConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	window []byte
+}
+
+func (c *rawHeadConn) Read(p []byte) (n int, err error) {
+	n, err = c.Conn.Read(p)
+	c.mu.Lock()
+	c.window = append(c.window, p[:n]...)
+	if len(c.window) > rawHeadWindow {
+		c.window = append(c.window[:0], c.window[len(c.window)-rawHeadWindow:]...)
+	}
+	c.mu.Unlock()
+	return
+}
+
+// headerOrder returns the header names of the request starting with the
+// request line, removing it and what precedes it from the window.
+func (c *rawHeadConn) headerOrder(requestLine string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	start := bytes.Index(c.window, []byte(requestLine+"\r\n"))
+	if start < 0 {
+		return nil
+	}
+	head := c.window[start+len(requestLine)+2:]
+	end := bytes.Index(head, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil
+	}
+	var order []string
+	for _, line := range strings.Split(string(head[:end]), "\r\n") {
+		if colon := strings.IndexByte(line, ':'); colon > 0 && line[0] != ' ' && line[0] != '\t' {
+			order = append(order, strings.TrimSpace(line[:colon]))
+		}
+	}
+	c.window = append(c.window[:0], head[end+4:]...)
+	return order
+}
+
+type rawHeadConnKey struct{}
+
+// restoreTLS fills in the TLS state of the requests read from a *tls.Conn
+// wrapped by rawHeadConn, the server only does it for a *tls.Conn itself.
+func restoreTLS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if c, ok := req.Context().Value(rawHeadConnKey{}).(*rawHeadConn); ok && req.TLS == nil {
+			if tlsConn, ok := c.Conn.(*tls.Conn); ok {
+				state := tlsConn.ConnectionState()
+				req.TLS = &state
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// rawHeadContext makes the connection available to captureHeaderOrder, it
+// is the ConnContext of the server.
+func rawHeadContext(ctx context.Context, conn net.Conn) context.Context {
+	if c, ok := conn.(*rawHeadConn); ok {
+		return context.WithValue(ctx, rawHeadConnKey{}, c)
+	}
+	return ctx
+}
+
+type headerOrderKey struct{}
+
+// withHeaderOrder returns the request carrying the names of its header lines
+// in their original order and casing.
+func withHeaderOrder(req *http.Request, order []string) *http.Request {
+	if len(order) == 0 {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), headerOrderKey{}, order))
+}
+
+// headerOrder returns the original header names of the request, nil if unknown.
+func headerOrder(req *http.Request) []string {
+	order, _ := req.Context().Value(headerOrderKey{}).([]string)
+	return order
+}
+
+// captureHeaderOrder reads the header order of the request from its client
+// connection.
+func captureHeaderOrder(req *http.Request) *http.Request {
+	c, ok := req.Context().Value(rawHeadConnKey{}).(*rawHeadConn)
+	if !ok || headerOrder(req) != nil || req.ProtoMajor != 1 {
+		return req
+	}
+	return withHeaderOrder(req, c.headerOrder(req.Method+" "+req.RequestURI+" "+req.Proto))
+}
+
+// orderedTransport writes the requests with a header order itself, on a new
+// connection, as http.Transport sorts the headers.
+type orderedTransport struct {
+	*http.Transport
+}
+
+// withOrderedHeaders wraps the transport to keep the header order of the
+// requests with -preserve-headers.
+func withOrderedHeaders(transport *http.Transport) http.RoundTripper {
+	if !*preserveHeaders {
+		return transport
+	}
+	return orderedTransport{Transport: transport}
+}
+
+func (t orderedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	order := headerOrder(req)
+	if order == nil {
+		return t.Transport.RoundTrip(req)
+	}
+	address := req.URL.Host
+	if req.URL.Port() == "" {
+		port := "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+		address = net.JoinHostPort(req.URL.Hostname(), port)
+	}
+	dial := t.DialContext
+	if req.URL.Scheme == "https" {
+		dial = t.DialTLSContext
+	}
+	conn, err := dial(req.Context(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if t.ResponseHeaderTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(t.ResponseHeaderTimeout))
+	}
+	writer := bufio.NewWriter(conn)
+	chunked := writeOrderedHead(writer, req, order)
+	if req.Body != nil && req.Body != http.NoBody {
+		var body io.Writer = writer
+		var chunks io.WriteCloser
+		if chunked {
+			chunks = httputil.NewChunkedWriter(writer)
+			body = chunks
+		}
+		_, err = io.Copy(body, req.Body)
+		req.Body.Close()
+		if err == nil && chunks != nil {
+			if err = chunks.Close(); err == nil {
+				_, err = writer.WriteString("\r\n")
+			}
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	response.Body = &connBody{ReadCloser: response.Body, conn: conn}
+	return response, nil
+}
+
+// connBody closes the connection of the response with its body.
+type connBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+// writeOrderedHead writes the request line and the headers, first the ones
+// of the order with their original casing, then the others sorted. It
+// reports whether the body is to be sent chunked.
+func writeOrderedHead(w io.Writer, req *http.Request, order []string) (chunked bool) {
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	hasBody := req.Body != nil && req.Body != http.NoBody
+	chunked = hasBody && req.ContentLength < 0
+	special := map[string]string{"Host": host, "Connection": ""}
+	if req.Close {
+		special["Connection"] = "close"
+	}
+	if chunked {
+		special["Transfer-Encoding"] = "chunked"
+	} else if hasBody || req.ContentLength > 0 {
+		special["Content-Length"] = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	remaining := make(map[string]int)
+	for _, name := range order {
+		remaining[http.CanonicalHeaderKey(name)]++
+	}
+	written := make(map[string]int)
+	for _, name := range order {
+		key := http.CanonicalHeaderKey(name)
+		remaining[key]--
+		if value, ok := special[key]; ok {
+			if value != "" && written[key] == 0 {
+				fmt.Fprintf(w, "%s: %s\r\n", name, value)
+			}
+			written[key]++
+			continue
+		}
+		values := req.Header[key]
+		i := written[key]
+		if i >= len(values) {
+			continue
+		}
+		// the last line of a name takes the values added since
+		end := i + 1
+		if remaining[key] == 0 {
+			end = len(values)
+		}
+		for _, value := range values[i:end] {
+			fmt.Fprintf(w, "%s: %s\r\n", name, value)
+		}
+		written[key] = end
+	}
+
+	var added []string
+	for key := range special {
+		if special[key] != "" && written[key] == 0 {
+			added = append(added, key)
+		}
+	}
+	for key := range req.Header {
+		if _, ok := special[key]; !ok && written[key] == 0 {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	for _, key := range added {
+		if value, ok := special[key]; ok {
+			fmt.Fprintf(w, "%s: %s\r\n", key, value)
+			continue
+		}
+		for _, value := range req.Header[key] {
+			fmt.Fprintf(w, "%s: %s\r\n", key, value)
+		}
+	}
+	io.WriteString(w, "\r\n")
+	return chunked
+}
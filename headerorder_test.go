@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPreserveHeaders(t *testing.T) {
+	defer func(preserve bool) { *preserveHeaders = preserve }(*preserveHeaders)
+	*preserveHeaders = true
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	heads := make(chan []string, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+			lines = append(lines, strings.TrimSuffix(line, "\r\n"))
+		}
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+		heads <- lines
+	}()
+
+	h := newTestHandler(backend.Addr().String())
+	h.Transport = withOrderedHeaders(getTransport("http", 0, false))
+	server := httptest.NewUnstartedServer(h)
+	server.Listener = rawHeadListener{Listener: server.Listener}
+	server.Config.ConnContext = rawHeadContext
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /orders?id=1 HTTP/1.1\r\nhost: shop\r\nX-zeta: 1\r\nx-Alpha: 2\r\nACCEPT: */*\r\nx-zeta: 3\r\n\r\n"))
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	lines := <-heads
+	expectation := []string{"GET /orders?id=1 HTTP/1.1", "host: shop", "X-zeta: 1", "x-Alpha: 2", "ACCEPT: */*", "x-zeta: 3"}
+	if len(lines) < len(expectation) || strings.Join(lines[:len(expectation)], "|") != strings.Join(expectation, "|") {
+		t.Errorf("Expected '%s', but received '%s'", strings.Join(expectation, "|"), strings.Join(lines, "|"))
+	}
+}
+
+func TestPreserveHeadersKeepsTLS(t *testing.T) {
+	defer func(preserve bool) { *preserveHeaders = preserve }(*preserveHeaders)
+	*preserveHeaders = true
+	// borrow the certificate and the client trusting it
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	config := &tls.Config{Certificates: tlsServer.TLS.Certificates}
+	client := tlsServer.Client()
+	tlsServer.Close()
+	defer client.CloseIdleConnections()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := newHTTPSource(listener)
+	go source.Serve(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, requestScheme(r))
+	}))
+	defer source.server.Close()
+
+	response, err := client.Get("https://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "https" {
+		t.Errorf("Expected '%s', but received '%s'", "https", body)
+	}
+}
+
+func TestWriteOrderedHead(t *testing.T) {
+	request := httptest.NewRequest("POST", "http://backend/items", strings.NewReader("body"))
+	request.Header = http.Header{"Content-Type": {"text/plain"}, "Via": {"1.1 teeproxy"}}
+	var head strings.Builder
+	writeOrderedHead(&head, request, []string{"content-length", "content-TYPE", "HOST"})
+	expectation := "POST /items HTTP/1.1\r\ncontent-length: 4\r\ncontent-TYPE: text/plain\r\nHOST: backend\r\nVia: 1.1 teeproxy\r\n\r\n"
+	if head.String() != expectation {
+		t.Errorf("Expected '%q', but received '%q'", expectation, head.String())
+	}
+}
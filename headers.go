@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// hopByHopHeaders are meaningful only for a single connection and must not be
+// forwarded by proxies (RFC 7230, section 6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers including the ones
+// listed in the Connection header.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// prepareRequestHeaders strips the hop-by-hop headers of an inbound request
+// and adds the Via header.
+func prepareRequestHeaders(request *http.Request) {
+	// keep announcing support of trailers like net/http/httputil.ReverseProxy
+	trailers := false
+	for _, value := range request.Header["Te"] {
+		if strings.Contains(strings.ToLower(value), "trailers") {
+			trailers = true
+		}
+	}
+	removeHopByHopHeaders(request.Header)
+	if trailers {
+		request.Header.Set("Te", "trailers")
+	}
+	addVia(request.Header, request.ProtoMajor, request.ProtoMinor)
+}
+
+// prepareResponseHeaders strips the hop-by-hop headers of a backend response
+// and adds the Via header.
+func prepareResponseHeaders(response *http.Response) {
+	removeHopByHopHeaders(response.Header)
+	addVia(response.Header, response.ProtoMajor, response.ProtoMinor)
+}
+
+// addVia identifies the proxy in the Via and X-Proxied-By headers as
+// configured by -via and -proxied-by.
+func addVia(header http.Header, major, minor int) {
+	if *proxiedBy {
+		header.Set("X-Proxied-By", "teeproxy/"+version)
+	}
+	if *viaPseudonym == "" {
+		return
+	}
+	if major == 0 && minor == 0 {
+		major, minor = 1, 1
+	}
+	via := fmt.Sprintf("%d.%d %s", major, minor, *viaPseudonym)
+	if previous := header.Get("Via"); previous != "" {
+		via = previous + ", " + via
+	}
+	header.Set("Via", via)
+}
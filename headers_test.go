@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	request, _ := http.NewRequest("GET", "http://localhost/", nil)
+	request.Header.Set("Connection", "keep-alive, X-Custom-Hop")
+	request.Header.Set("Keep-Alive", "timeout=5")
+	request.Header.Set("X-Custom-Hop", "1")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Te", "trailers, deflate")
+	request.Header.Set("X-End-To-End", "1")
+	prepareRequestHeaders(request)
+
+	for _, name := range []string{"Connection", "Keep-Alive", "X-Custom-Hop", "Upgrade"} {
+		if value := request.Header.Get(name); value != "" {
+			t.Errorf("Expected '%s' to be removed, but received '%s'", name, value)
+		}
+	}
+	for name, expectation := range map[string]string{
+		"Te":           "trailers",
+		"X-End-To-End": "1",
+		"Via":          "1.1 teeproxy",
+	} {
+		if value := request.Header.Get(name); value != expectation {
+			t.Errorf("Expected '%s: %s', but received '%s'", name, expectation, value)
+		}
+	}
+}
+
+func TestViaIsExtended(t *testing.T) {
+	response := &http.Response{ProtoMajor: 1, ProtoMinor: 0, Header: http.Header{"Via": {"1.1 cdn"}}}
+	prepareResponseHeaders(response)
+	if expectation := "1.1 cdn, 1.0 teeproxy"; response.Header.Get("Via") != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, response.Header.Get("Via"))
+	}
+}
+
+func TestProxiedBy(t *testing.T) {
+	defer func(via string, enabled bool) { *viaPseudonym, *proxiedBy = via, enabled }(*viaPseudonym, *proxiedBy)
+	*viaPseudonym = "edge-1"
+	*proxiedBy = true
+
+	response := &http.Response{ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}}
+	prepareResponseHeaders(response)
+	for name, expectation := range map[string]string{
+		"Via":          "1.1 edge-1",
+		"X-Proxied-By": "teeproxy/" + version,
+	} {
+		if value := response.Header.Get(name); value != expectation {
+			t.Errorf("Expected '%s: %s', but received '%s'", name, expectation, value)
+		}
+	}
+
+	*viaPseudonym = ""
+	response = &http.Response{ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}}
+	prepareResponseHeaders(response)
+	if value := response.Header.Get("Via"); value != "" {
+		t.Errorf("Expected no Via header, but received '%s'", value)
+	}
+}
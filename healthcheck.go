@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Load balancers probe the production target frequently, and their health
+// checks would dominate the mirrored traffic and the metrics. Requests with a
+// path of -healthcheck.paths or a User-Agent starting with one of
+// -healthcheck.agents are proxied to production only, and left out of the
+// request metrics unless -healthcheck.metrics is set.
+
+var healthChecksTotal = newCounterVec("teeproxy_health_checks_total",
+	"Number of health checks of load balancers recognized, not mirrored.")
+
+// healthCheckMatcher recognizes the health checks.
+type healthCheckMatcher struct {
+	paths  map[string]bool
+	agents []string
+}
+
+// healthChecks recognizes the health checks of -healthcheck.paths and
+// -healthcheck.agents, nil if both are empty.
+var healthChecks *healthCheckMatcher
+
+// newHealthCheckMatcher creates the matcher of the comma separated paths and
+// User-Agent prefixes, nil if there are none.
+func newHealthCheckMatcher(paths, agents string) *healthCheckMatcher {
+	m := &healthCheckMatcher{paths: make(map[string]bool)}
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			m.paths[path] = true
+		}
+	}
+	for _, agent := range strings.Split(agents, ",") {
+		if agent = strings.TrimSpace(agent); agent != "" {
+			m.agents = append(m.agents, agent)
+		}
+	}
+	if len(m.paths) == 0 && len(m.agents) == 0 {
+		return nil
+	}
+	return m
+}
+
+// Matches reports whether the request is a health check.
+func (m *healthCheckMatcher) Matches(req *http.Request) bool {
+	if m == nil {
+		return false
+	}
+	if m.paths[req.URL.Path] {
+		return true
+	}
+	userAgent := req.Header.Get("User-Agent")
+	for _, agent := range m.agents {
+		if strings.HasPrefix(userAgent, agent) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthChecks(t *testing.T) {
+	defer func(m *healthCheckMatcher) { healthChecks = m }(healthChecks)
+	healthChecks = newHealthCheckMatcher("/healthz, /ping", "kube-probe/,ELB-HealthChecker/")
+
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer production.Close()
+	var mirrored int32
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&mirrored, 1)
+	}))
+	defer alternate.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler(production.URL, alternate.URL+"/healthchecks")
+	checks := healthChecksTotal.values[labelKey(nil)]
+	for _, test := range []struct {
+		path, userAgent string
+	}{
+		{"/healthz", "curl/8.0"},
+		{"/", "kube-probe/1.29"},
+		{"/status", "ELB-HealthChecker/2.0"},
+		{"/orders", "Mozilla/5.0"},
+		{"/healthz/orders", "curl/8.0"},
+	} {
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Header.Set("User-Agent", test.userAgent)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected '200', but received '%d'", w.Code)
+		}
+	}
+	mirrorsInFlight.Wait()
+
+	if n := atomic.LoadInt32(&mirrored); n != 2 {
+		t.Errorf("Expected '2', but received '%d'", n)
+	}
+	if n := healthChecksTotal.values[labelKey(nil)] - checks; n != 3 {
+		t.Errorf("Expected '3', but received '%v'", n)
+	}
+	if newHealthCheckMatcher("", " ") != nil {
+		t.Errorf("Expected 'no matcher', but received one")
+	}
+}
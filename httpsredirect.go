@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+)
+
+// With -tls.redirect, teeproxy as the edge answers the plain HTTP requests
+// on an auxiliary listener with a 301 to the same host and URI on the TLS
+// listener of -l, so that no separate server is needed for the redirects.
+
+// httpsLocation returns the https URL of the request URI on the host, on
+// the port unless empty or 443.
+func httpsLocation(host, uri, port string) string {
+	if port != "" {
+		host = hostname(host)
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+			host = "[" + host + "]"
+		}
+	}
+	return "https://" + host + uri
+}
+
+// httpsRedirectHandler redirects the requests to the TLS listener on the
+// port.
+func httpsRedirectHandler(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "" {
+			http.Error(w, "missing Host header", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, httpsLocation(r.Host, r.URL.RequestURI(), port), http.StatusMovedPermanently)
+	})
+}
+
+// startHTTPSRedirect serves the redirects to the TLS listener of listen.
+func startHTTPSRedirect(addr, listen string) {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		fatalf("Invalid -l %s for -tls.redirect: %s", listen, err)
+	}
+	log.Printf("Redirecting plain HTTP at %s to port %s", addr, port)
+	go func() {
+		if err := http.ListenAndServe(addr, httpsRedirectHandler(port)); err != nil {
+			fatalf("Failed to serve redirects at %s: %s", addr, err)
+		}
+	}()
+}
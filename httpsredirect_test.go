@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	for _, test := range []struct {
+		port, url, location string
+	}{
+		{"443", "http://www.example.com/a%2Fb?q=1", "https://www.example.com/a%2Fb?q=1"},
+		{"8443", "http://www.example.com:8080/", "https://www.example.com:8443/"},
+		{"443", "http://[2001:db8::1]:8080/x", "https://[2001:db8::1]/x"},
+		{"8443", "http://[2001:db8::1]/x", "https://[2001:db8::1]:8443/x"},
+	} {
+		w := httptest.NewRecorder()
+		httpsRedirectHandler(test.port).ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != test.location {
+			t.Errorf("Expected '301 %s', but received '%d %s'", test.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
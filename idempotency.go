@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// With -b.idempotency-key, the mirrored write requests carry an
+// Idempotency-Key header, the same for all the duplicates of a request, so
+// that shadow backends supporting idempotency keys can deduplicate the
+// retries of a mirrored request. A key sent by the client is kept. The
+// deliveries of -webhook.fork use the id of the webhook, the same for all
+// their retries.
+
+const idempotencyHeader = "Idempotency-Key"
+
+// isWrite reports whether requests of the method change the state of the
+// backend.
+func isWrite(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// idempotencyKey returns the key of the mirrored duplicates of the request,
+// empty if they are not given one.
+func idempotencyKey(req *http.Request) string {
+	if !*alternateIdempotencyKey || !isWrite(req.Method) {
+		return ""
+	}
+	if key := req.Header.Get(idempotencyHeader); key != "" {
+		return key
+	}
+	key := make([]byte, 16)
+	rand.Read(key)
+	return hex.EncodeToString(key)
+}
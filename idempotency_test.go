@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	defer func(v bool) { *alternateIdempotencyKey = v }(*alternateIdempotencyKey)
+	*alternateIdempotencyKey = true
+
+	var mu sync.Mutex
+	var keys []string
+	record := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		keys = append(keys, r.Header.Get(idempotencyHeader))
+		mu.Unlock()
+	}
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get(idempotencyHeader); key != "" && key != "client" {
+			t.Errorf("Expected no key for production, but received '%s'", key)
+		}
+	}))
+	defer production.Close()
+	b1 := httptest.NewServer(http.HandlerFunc(record))
+	defer b1.Close()
+	b2 := httptest.NewServer(http.HandlerFunc(record))
+	defer b2.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler(strings.TrimPrefix(production.URL, "http://"),
+		strings.TrimPrefix(b1.URL, "http://"), strings.TrimPrefix(b2.URL, "http://"))
+	for _, test := range []struct {
+		method, client string
+		check          func(a, b string) bool
+	}{
+		{"POST", "", func(a, b string) bool { return len(a) == 32 && a == b }},
+		{"GET", "", func(a, b string) bool { return a == "" && b == "" }},
+		{"DELETE", "client", func(a, b string) bool { return a == "client" && b == "client" }},
+	} {
+		keys = nil
+		req := httptest.NewRequest(test.method, "/orders", nil)
+		if test.client != "" {
+			req.Header.Set(idempotencyHeader, test.client)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		mirrorsInFlight.Wait()
+		mu.Lock()
+		if len(keys) != 2 || !test.check(keys[0], keys[1]) {
+			t.Errorf("Unexpected keys of the mirrored %s requests '%v'", test.method, keys)
+		}
+		mu.Unlock()
+	}
+}
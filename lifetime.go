@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	runtimedebug "runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// For deployments running for months, teeproxy can drain and exit after
+// -max-lifetime seconds or -max-requests requests, like on SIGTERM, for its
+// supervisor to restart it. The lifetime is extended by up to 10% at random,
+// so that proxies started together do not restart together.
+//
+// With -compact.interval, the state kept between requests is compacted
+// periodically: the expired entries of the caches are dropped, the idle
+// connections closed and the freed memory returned to the operating system.
+
+// lifetimeJitter is the maximum fraction added to -max-lifetime.
+const lifetimeJitter = 0.1
+
+var compactedEntriesTotal = newCounterVec("teeproxy_compacted_entries_total",
+	"Number of expired entries dropped by the compaction of the idle state by state.", "state")
+
+// limitLifetime calls stop once -max-lifetime elapsed or -max-requests
+// requests were served by the returned handler.
+func limitLifetime(h http.Handler, stop func()) http.Handler {
+	if *maxLifetime > 0 {
+		lifetime := time.Duration(float64(*maxLifetime) * (1 + lifetimeJitter*rand.Float64()) * float64(time.Second))
+		time.AfterFunc(lifetime, func() {
+			log.Printf("Reached the maximum lifetime of %s, draining", lifetime.Round(time.Second))
+			stop()
+		})
+	}
+	if *maxRequests <= 0 {
+		return h
+	}
+	var served int64
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt64(&served, 1) == *maxRequests {
+			log.Printf("Reached the maximum of %d requests, draining", *maxRequests)
+			// the drain waits for this request
+			go stop()
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// compactIdleState drops the expired entries of the caches and closes the
+// idle connections.
+func compactIdleState(now time.Time) {
+	compactedEntriesTotal.Add(float64(fidelity.compact(now)), "fidelity")
+	compactedEntriesTotal.Add(float64(flagByTenants.compact(now)), "tenant-flags")
+	compactedEntriesTotal.Add(float64(gcpTokens.compact(now)), "metadata-tokens")
+	compactedEntriesTotal.Add(float64(backendResolver.compact(now)), "dns")
+	exchanged := 0
+	for _, b := range registeredBackends() {
+		exchanged += b.AuthorizationPolicy().compact(now)
+	}
+	compactedEntriesTotal.Add(float64(exchanged), "authorizations")
+	evictIdleConnections()
+	runtimedebug.FreeOSMemory()
+}
+
+// startCompaction compacts the idle state every -compact.interval seconds.
+func startCompaction() {
+	if *compactInterval <= 0 {
+		return
+	}
+	go func() {
+		for now := range time.Tick(time.Duration(*compactInterval) * time.Second) {
+			compactIdleState(now)
+		}
+	}()
+}
+
+// compact forgets the samples outside of -compare.window and the backends
+// without any, and returns the number of samples dropped.
+func (f *fidelityWindow) compact(now time.Time) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dropped := 0
+	for backend, samples := range f.samples {
+		kept := f.prune(samples, now)
+		dropped += len(samples) - len(kept)
+		if len(kept) == 0 {
+			delete(f.samples, backend)
+			continue
+		}
+		// copied to release the pruned samples
+		f.samples[backend] = append([]fidelitySample(nil), kept...)
+	}
+	return dropped
+}
+
+// compact forgets the tenants not evaluated for two intervals, which were not
+// seen for at least one, and returns their number.
+func (f *tenantFlags) compact(now time.Time) int {
+	if f == nil {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dropped := 0
+	for tenant, cached := range f.tenants {
+		if now.Sub(cached.evaluated) > 2*f.interval {
+			delete(f.tenants, tenant)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// compact forgets the expired tokens and returns their number.
+func (m *metadataTokens) compact(now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dropped := 0
+	for path, expires := range m.expires {
+		if now.After(expires) {
+			delete(m.tokens, path)
+			delete(m.expires, path)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// compact forgets the expired exchanged authorizations and returns their
+// number.
+func (p *authorizationPolicy) compact(now time.Time) int {
+	if p == nil || p.exchanged == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dropped := 0
+	for key, exchanged := range p.exchanged {
+		if !now.Before(exchanged.expires) {
+			delete(p.exchanged, key)
+			dropped++
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMaxRequests(t *testing.T) {
+	defer func(n int64) { *maxRequests = n }(*maxRequests)
+	*maxRequests = 2
+	stopped := make(chan bool, 3)
+	h := limitLifetime(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), func() { stopped <- true })
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected 'a stop after 2 requests', but received none")
+	}
+	select {
+	case <-stopped:
+		t.Errorf("Expected 'a single stop', but received another")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestCompactIdleState(t *testing.T) {
+	defer func(f *tenantFlags) { flagByTenants = f }(flagByTenants)
+	defer func(window int) { *compareWindow = window }(*compareWindow)
+	*compareWindow = 60
+	now := time.Now()
+
+	window := &fidelityWindow{samples: make(map[string][]fidelitySample)}
+	window.observe("old", fidelitySample{at: now.Add(-2 * time.Minute)})
+	window.observe("recent", fidelitySample{at: now})
+	if dropped := window.compact(now); dropped != 1 || len(window.samples) != 1 || len(window.samples["recent"]) != 1 {
+		t.Errorf("Expected '1 dropped, the recent sample left', but received '%d %v'", dropped, window.samples)
+	}
+
+	flags := &tenantFlags{interval: time.Minute, tenants: map[string]flaggedTenant{
+		"idle":   {mirrored: true, evaluated: now.Add(-3 * time.Minute)},
+		"active": {mirrored: true, evaluated: now.Add(-30 * time.Second)},
+	}}
+	if dropped := flags.compact(now); dropped != 1 || len(flags.tenants) != 1 || !flags.tenants["active"].mirrored {
+		t.Errorf("Expected 'the idle tenant dropped', but received '%d %v'", dropped, flags.tenants)
+	}
+
+	policy := &authorizationPolicy{mode: authorizationExchange, exchanged: map[string]exchangedAuthorization{
+		"expired": {value: "Bearer a", expires: now.Add(-time.Second)},
+		"valid":   {value: "Bearer b", expires: now.Add(time.Minute)},
+	}}
+	if dropped := policy.compact(now); dropped != 1 || len(policy.exchanged) != 1 {
+		t.Errorf("Expected 'the expired authorization dropped', but received '%d %v'", dropped, policy.exchanged)
+	}
+
+	flagByTenants = flags
+	flags.tenants["idle"] = flaggedTenant{evaluated: now.Add(-time.Hour)}
+	compactIdleState(now)
+	if value := compactedEntriesTotal.values[labelKey([]string{"tenant-flags"})]; value != 1 {
+		t.Errorf("Expected '1', but received '%v'", value)
+	}
+}
+
+func TestCompactionDuringReload(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			lookupBackend("http://compaction-" + strconv.Itoa(i) + ":8080")
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		compactIdleState(time.Now())
+	}
+	<-done
+}
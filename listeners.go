@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The listeners of the -config file are additional proxies in the same
+// process, each listening on its own address, forwarding to its own
+// production target and mirroring by its own policies. They share the flags,
+// e.g. the timeouts, TLS and logging, and the metrics and admin endpoints of
+// the process. The maintenance responses and cache rules apply to the main
+// listener of -l only.
+
+type listenerConfig struct {
+	Name string `json:"name"`
+	// Listen is the address, Target the production target of the listener.
+	Listen string `json:"listen"`
+	Target string `json:"target"`
+	// Backends receive Percent, 100 if omitted, of the requests.
+	Percent  *float64 `json:"percent"`
+	Backends []string `json:"backends"`
+	// Policies are mirrored in addition to the backends.
+	Policies []policyConfig `json:"policies"`
+}
+
+// buildListeners returns the validated listeners of the config.
+func (c *config) buildListeners() ([]listenerConfig, error) {
+	if err := validateListeners(c.Listeners); err != nil {
+		return nil, err
+	}
+	return c.Listeners, nil
+}
+
+// validateListeners checks the listeners of the config.
+func validateListeners(configs []listenerConfig) error {
+	names := make(map[string]bool)
+	for _, lc := range configs {
+		if lc.Name == "" {
+			return fmt.Errorf("listener %s has no name", lc.Listen)
+		}
+		if names[lc.Name] {
+			return fmt.Errorf("listener %q is defined twice", lc.Name)
+		}
+		names[lc.Name] = true
+		if lc.Listen == "" || lc.Target == "" {
+			return fmt.Errorf("listener %q needs listen and target", lc.Name)
+		}
+		if _, err := parseTarget(lc.Target); err != nil {
+			return fmt.Errorf("listener %q: %v", lc.Name, err)
+		}
+	}
+	return nil
+}
+
+// buildPolicies returns the policy of the backends of the listener, named
+// after it, followed by its policies, using the anonymization profiles.
+func (lc listenerConfig) buildPolicies(profiles map[string]*anonymizer) ([]*policy, error) {
+	var policies []*policy
+	if len(lc.Backends) > 0 {
+		p := &policy{Name: lc.Name, Percent: 100}
+		if lc.Percent != nil {
+			p.Percent = *lc.Percent
+		}
+		var err error
+		if p.Sampler, err = newSampler(*sampleStrategy); err != nil {
+			return nil, fmt.Errorf("listener %q: %v", lc.Name, err)
+		}
+		for _, url := range lc.Backends {
+			b, err := parseBackend(url)
+			if err != nil {
+				return nil, fmt.Errorf("listener %q: %v", lc.Name, err)
+			}
+			p.Backends = append(p.Backends, b)
+		}
+		policies = append(policies, p)
+	}
+	for _, pc := range lc.Policies {
+		p, err := pc.build(profiles)
+		if err != nil {
+			return nil, fmt.Errorf("listener %q: %v", lc.Name, err)
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// instance is the proxy of a listener.
+type instance struct {
+	config  listenerConfig
+	handler *handler
+	source  *httpSource
+}
+
+// startListeners starts a proxy for each listener.
+func startListeners(configs []listenerConfig, profiles map[string]*anonymizer) ([]*instance, error) {
+	var instances []*instance
+	for i, lc := range configs {
+		policies, err := lc.buildPolicies(profiles)
+		if err != nil {
+			closeListeners(instances)
+			return nil, err
+		}
+		listener, err := newListener(lc.Listen)
+		if err != nil {
+			closeListeners(instances)
+			return nil, fmt.Errorf("listener %q: %v", lc.Name, err)
+		}
+		h := &handler{
+			Target:       lc.Target,
+			Alternatives: registeredBackends(),
+			// each listener decides by its own sequence, derived from -seed
+			Randomizer: *rand.New(newLockedSource(decisionSeed + int64(i+1))),
+		}
+		h.SetSchemes()
+		h.SetPolicies(policies)
+		h.Transport = withRedirects(withProductionSigner(withOrderedHeaders(getTransport(h.TargetScheme, time.Duration(*productionTimeout)*time.Millisecond,
+			*closeConnections || *productionCloseConnections)), productionSigner), productionRedirectLimit)
+		in := &instance{config: lc, handler: h, source: newHTTPSource(listener)}
+		instances = append(instances, in)
+		log.Printf("Starting listener %s at %s sending to A: %s", lc.Name, lc.Listen, redactURL(lc.Target, false))
+		logPolicies(policies)
+		go func() {
+			if err := in.source.Serve(h); err != nil {
+				log.Printf("Listener %s failed: %s", in.config.Name, err)
+			}
+		}()
+	}
+	startBackends(registeredBackends())
+	return instances, nil
+}
+
+// reloadListeners sets the policies of the running listeners to the ones of
+// the configs, added, removed or moved listeners need a restart.
+func reloadListeners(instances []*instance, configs []listenerConfig, profiles map[string]*anonymizer, source string) error {
+	running := make(map[string]*instance)
+	for _, in := range instances {
+		running[in.config.Name] = in
+	}
+	policies := make(map[string][]*policy)
+	for _, lc := range configs {
+		in, ok := running[lc.Name]
+		if !ok {
+			log.Printf("Listener %s is added on restart only", lc.Name)
+			continue
+		}
+		delete(running, lc.Name)
+		if lc.Listen != in.config.Listen || lc.Target != in.config.Target {
+			log.Printf("The address and target of listener %s change on restart only", lc.Name)
+		}
+		p, err := lc.buildPolicies(profiles)
+		if err != nil {
+			return err
+		}
+		policies[lc.Name] = p
+	}
+	for name := range running {
+		log.Printf("Listener %s is removed on restart only", name)
+	}
+	for _, in := range instances {
+		if p, ok := policies[in.config.Name]; ok {
+			audit(source, "policies of listener "+in.config.Name, describePolicies(in.handler.Policies()), describePolicies(p))
+			in.handler.SetPolicies(p)
+			logPolicies(p)
+		}
+	}
+	startBackends(registeredBackends())
+	return nil
+}
+
+// closeListeners drains the in-flight requests of the listeners.
+func closeListeners(instances []*instance) {
+	for _, in := range instances {
+		if err := in.source.Close(); err != nil {
+			log.Printf("Failed to drain the in-flight requests of listener %s: %s", in.config.Name, err)
+		}
+	}
+}
+
+// newListener listens on the address, with TLS if -key is given.
+func newListener(address string) (net.Listener, error) {
+	if len(*tlsPrivateKey) == 0 {
+		return net.Listen("tcp", address)
+	}
+	cer, err := tls.LoadX509KeyPair(*tlsCertificate, *tlsPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate %s and private key %s: %v", *tlsCertificate, *tlsPrivateKey, err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cer}}
+	if *tlsClientCA != "" {
+		if config.ClientCAs, err = loadCertPool(*tlsClientCA); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if *tlsPlaintext == plaintextRefuse {
+		// the http.Server answers plain HTTP clients of a tls.Conn with 400
+		return tls.Listen("tcp", address, config)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newDetectingListener(listener, config, *tlsPlaintext), nil
+}
+
+// newHTTPSource serves the clients of the listener.
+func newHTTPSource(listener net.Listener) *httpSource {
+	server := &http.Server{}
+	setClientTimeouts(server)
+	if *preserveHeaders {
+		listener = rawHeadListener{Listener: listener}
+		server.ConnContext = rawHeadContext
+	}
+	if *closeConnections || *clientCloseConnections {
+		// Close connections to clients by setting the "Connection": "close" header in the response.
+		server.SetKeepAlivesEnabled(false)
+	}
+	return &httpSource{server: server, listener: listener}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestValidateListeners(t *testing.T) {
+	for _, configs := range [][]listenerConfig{
+		{{Listen: ":8001", Target: "localhost:9001"}},
+		{{Name: "shop", Target: "localhost:9001"}},
+		{{Name: "shop", Listen: ":8001", Target: "localhost:9001"}, {Name: "shop", Listen: ":8002", Target: "localhost:9002"}},
+	} {
+		if err := validateListeners(configs); err == nil {
+			t.Errorf("Expected an error for '%v'", configs)
+		}
+	}
+}
+
+func TestListeners(t *testing.T) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("shop"))
+	}))
+	defer production.Close()
+	var mirrored int32
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&mirrored, 1)
+	}))
+	defer alternate.Close()
+
+	instances, err := startListeners([]listenerConfig{
+		{Name: "shop", Listen: "127.0.0.1:0", Target: production.URL, Backends: []string{alternate.URL}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeListeners(instances)
+	response, err := http.Get("http://" + instances[0].source.String() + "/cart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	mirrorsInFlight.Wait()
+	if string(body) != "shop" {
+		t.Errorf("Expected 'shop', but received '%s'", body)
+	}
+	if atomic.LoadInt32(&mirrored) != 1 {
+		t.Errorf("Expected '1' mirrored request, but received '%d'", mirrored)
+	}
+
+	percent := 0.0
+	err = reloadListeners(instances, []listenerConfig{
+		{Name: "shop", Listen: "127.0.0.1:0", Target: production.URL, Percent: &percent, Backends: []string{alternate.URL}},
+	}, nil, "SIGHUP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies := instances[0].handler.Policies(); len(policies) != 1 || policies[0].Percent != 0 {
+		t.Errorf("Expected the reloaded policy at 0%%, but received '%v'", policies)
+	}
+	evictIdleConnections()
+}
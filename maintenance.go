@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+// maintenance is a static response returned by the proxy instead of
+// forwarding the matching requests to the production target, e.g. during
+// planned downtime.
+type maintenance struct {
+	Name    string
+	Path    *regexp.Regexp
+	Methods *regexp.Regexp
+	Host    *regexp.Regexp
+	Status  int
+	Body    string
+	Headers map[string]string
+	// Mirror keeps mirroring the matching requests to the alternate backends.
+	Mirror bool
+}
+
+// Matches reports whether the request fulfills all filters of the response.
+func (m *maintenance) Matches(req *http.Request) bool {
+	if m.Methods != nil && !m.Methods.MatchString(req.Method) {
+		return false
+	}
+	if m.Path != nil && !m.Path.MatchString(req.URL.Path) {
+		return false
+	}
+	if m.Host != nil && !m.Host.MatchString(req.Host) {
+		return false
+	}
+	return true
+}
+
+func (m *maintenance) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	for k, v := range m.Headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(m.Status)
+	if req.Method != "HEAD" {
+		w.Write([]byte(m.Body))
+	}
+	log.Printf("| A | \"%s %s %v\" %d (maintenance %s)", req.Method, req.URL.RequestURI(), req.Proto, m.Status, m.Name)
+}
+
+type maintenanceConfig struct {
+	Name string `json:"name"`
+	// Path, Methods and Host are regular expressions, all given must match.
+	Path    string `json:"path"`
+	Methods string `json:"methods"`
+	Host    string `json:"host"`
+	// Status is 503 if omitted.
+	Status  int               `json:"status"`
+	Body    string            `json:"body"`
+	Headers map[string]string `json:"headers"`
+	Mirror  bool              `json:"mirror"`
+}
+
+func (mc maintenanceConfig) build() (*maintenance, error) {
+	m := &maintenance{Name: mc.Name, Status: mc.Status, Body: mc.Body, Headers: mc.Headers, Mirror: mc.Mirror}
+	if m.Status == 0 {
+		m.Status = http.StatusServiceUnavailable
+	}
+	if m.Status < 100 || m.Status > 999 {
+		return nil, fmt.Errorf("maintenance %q: invalid status %d", mc.Name, mc.Status)
+	}
+	var err error
+	if m.Path, err = compileOptional("path", mc.Path); err != nil {
+		return nil, fmt.Errorf("maintenance %q: %v", mc.Name, err)
+	}
+	if m.Methods, err = compileOptional("methods", mc.Methods); err != nil {
+		return nil, fmt.Errorf("maintenance %q: %v", mc.Name, err)
+	}
+	if m.Host, err = compileOptional("host", mc.Host); err != nil {
+		return nil, fmt.Errorf("maintenance %q: %v", mc.Name, err)
+	}
+	return m, nil
+}
+
+// buildMaintenance creates the maintenance responses of the config.
+func (c *config) buildMaintenance() (responses []*maintenance, err error) {
+	for _, mc := range c.Maintenance {
+		m, err := mc.build()
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, m)
+	}
+	return responses, nil
+}
+
+func logMaintenance(responses []*maintenance) {
+	for _, m := range responses {
+		log.Printf("Maintenance %s answers the matching requests with status %d, mirroring: %v", m.Name, m.Status, m.Mirror)
+	}
+}
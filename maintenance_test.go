@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	c, err := loadConfig(writeConfig(t, `{
+		"maintenance": [
+			{"name": "checkout", "path": "^/checkout", "mirror": true,
+			 "headers": {"Retry-After": "600"}, "body": "down for maintenance"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses, err := c.buildMaintenance()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwarded := false
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = true
+	}))
+	defer production.Close()
+	mirrored := make(chan string, 1)
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.URL.Path
+	}))
+	defer alternate.Close()
+
+	h := newTestHandler(production.URL, alternate.URL)
+	h.SetMaintenance(responses)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/checkout/cart", strings.NewReader("{}")))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") != "600" || w.Body.String() != "down for maintenance" {
+		t.Errorf("Expected the maintenance response, but received '%s' '%s'", w.Header().Get("Retry-After"), w.Body)
+	}
+	if forwarded {
+		t.Errorf("Expected the request not to be forwarded to the production target")
+	}
+	select {
+	case path := <-mirrored:
+		if path != "/checkout/cart" {
+			t.Errorf("Expected '/checkout/cart', but received '%s'", path)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the request to be mirrored")
+	}
+}
+
+func TestMaintenanceWebSocket(t *testing.T) {
+	c, err := loadConfig(writeConfig(t, `{"maintenance": [{"name": "chat", "path": "^/chat"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses, err := c.buildMaintenance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded := false
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = true
+	}))
+	defer production.Close()
+
+	h := newTestHandler(production.URL)
+	h.SetMaintenance(responses)
+	req := httptest.NewRequest("GET", "/chat", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable || forwarded {
+		t.Errorf("Expected '%d' without forwarding the upgrade, but received '%d' forwarded %v", http.StatusServiceUnavailable, w.Code, forwarded)
+	}
+}
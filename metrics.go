@@ -0,0 +1,438 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A tiny metrics registry exposed in the Prometheus text format.
+//
+// Only counters and histograms with string labels and gauges computed at
+// scrape time, optionally by a label, are supported, which is all teeproxy
+// needs to report per backend and per route statistics.
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// openMetricsWriter is implemented by the metrics whose OpenMetrics
+// exposition differs from the Prometheus text format.
+type openMetricsWriter interface {
+	writeOpenMetrics(w io.Writer)
+}
+
+var (
+	metricsMutex    sync.Mutex
+	metricsRegistry []metric
+)
+
+func registerMetric(m metric) {
+	metricsMutex.Lock()
+	metricsRegistry = append(metricsRegistry, m)
+	metricsMutex.Unlock()
+}
+
+// latencyBuckets are the default histogram buckets in seconds.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// sizeBuckets are the histogram buckets for body sizes in bytes.
+var sizeBuckets = []float64{0, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	registerMetric(c)
+	return c
+}
+
+// Add increases the counter identified by the label values.
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// Inc increases the counter identified by the label values by one.
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns the counter identified by the label values.
+func (c *counterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelKey(labelValues)]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatFloat(c.values[key]))
+	}
+}
+
+// writeOpenMetrics names the family without the _total suffix of the samples.
+func (c *counterVec) writeOpenMetrics(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	family := strings.TrimSuffix(c.name, "_total")
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", family, c.help, family)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s_total%s %s\n", family, formatLabels(c.labels, key, ""), formatFloat(c.values[key]))
+	}
+}
+
+// gaugeFunc reports the value returned by a function at scrape time.
+type gaugeFunc struct {
+	name     string
+	help     string
+	function func() float64
+}
+
+func newGaugeFunc(name, help string, function func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, function: function}
+	registerMetric(g)
+	return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.function()))
+}
+
+// gaugeVecFunc reports the values by label value returned by a function at
+// scrape time.
+type gaugeVecFunc struct {
+	name     string
+	help     string
+	label    string
+	function func() map[string]float64
+}
+
+func newGaugeVecFunc(name, help, label string, function func() map[string]float64) *gaugeVecFunc {
+	g := &gaugeVecFunc{name: name, help: help, label: label, function: function}
+	registerMetric(g)
+	return g
+}
+
+func (g *gaugeVecFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	values := g.function()
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels([]string{g.label}, key, ""), formatFloat(values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+	// exemplars holds the latest traced observation per bucket, the last
+	// one being +Inf, nil until the first traced observation
+	exemplars []*exemplar
+}
+
+// exemplar links a bucket to the trace of an observation in it.
+type exemplar struct {
+	traceID string
+	value   float64
+	time    time.Time
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+	registerMetric(h)
+	return h
+}
+
+// Observe records a value in the histogram identified by the label values.
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.ObserveWithTrace(v, "", labelValues...)
+}
+
+// ObserveWithTrace records a value and, if the trace id is not empty, keeps
+// it as the exemplar of the bucket of the value.
+func (h *histogramVec) ObserveWithTrace(v float64, traceID string, labelValues ...string) {
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+	if traceID == "" {
+		return
+	}
+	if hist.exemplars == nil {
+		hist.exemplars = make([]*exemplar, len(h.buckets)+1)
+	}
+	bucket := sort.SearchFloat64s(h.buckets, v)
+	hist.exemplars[bucket] = &exemplar{traceID: traceID, value: v, time: time.Now()}
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.writeSamples(w, false)
+}
+
+// writeOpenMetrics adds the exemplars to the buckets.
+func (h *histogramVec) writeOpenMetrics(w io.Writer) {
+	h.writeSamples(w, true)
+}
+
+func (h *histogramVec) writeSamples(w io.Writer, exemplars bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hist := h.values[key]
+		for i, bound := range h.buckets {
+			le := `le="` + formatFloat(bound) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d%s\n", h.name, formatLabels(h.labels, key, le), hist.counts[i], hist.exemplar(i, exemplars))
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d%s\n", h.name, formatLabels(h.labels, key, `le="+Inf"`), hist.count, hist.exemplar(len(h.buckets), exemplars))
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), hist.count)
+	}
+}
+
+// exemplar formats the exemplar of the bucket for the OpenMetrics exposition.
+func (hist *histogram) exemplar(bucket int, enabled bool) string {
+	if !enabled || hist.exemplars == nil || hist.exemplars[bucket] == nil {
+		return ""
+	}
+	e := hist.exemplars[bucket]
+	return fmt.Sprintf(" # {trace_id=%s} %s %.3f", strconv.Quote(e.traceID), formatFloat(e.value), float64(e.time.UnixNano())/1e9)
+}
+
+// labelIndex returns the position of the label in the label values.
+func labelIndex(labels []string, label string) int {
+	for i, name := range labels {
+		if name == label {
+			return i
+		}
+	}
+	return -1
+}
+
+// labelMatches reports whether the value of the label at index in the key is
+// one of the values.
+func labelMatches(key string, index int, values map[string]bool) bool {
+	parts := strings.Split(key, labelSeparator)
+	return index < len(parts) && values[parts[index]]
+}
+
+// Delete removes the series whose label has one of the values.
+func (c *counterVec) Delete(label string, values map[string]bool) {
+	index := labelIndex(c.labels, label)
+	if index < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.values {
+		if labelMatches(key, index, values) {
+			delete(c.values, key)
+		}
+	}
+}
+
+// Delete removes the series whose label has one of the values.
+func (h *histogramVec) Delete(label string, values map[string]bool) {
+	index := labelIndex(h.labels, label)
+	if index < 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key := range h.values {
+		if labelMatches(key, index, values) {
+			delete(h.values, key)
+		}
+	}
+}
+
+// label values are joined with a separator that can not appear in valid UTF-8
+const labelSeparator = "\xff"
+
+func labelKey(values []string) string {
+	return strings.Join(values, labelSeparator)
+}
+
+func formatLabels(names []string, key string, extra string) string {
+	var pairs []string
+	if len(names) > 0 {
+		values := strings.Split(key, labelSeparator)
+		for i, name := range names {
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+			pairs = append(pairs, name+"="+strconv.Quote(value))
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricsHandler writes all registered metrics, in the OpenMetrics format
+// with the exemplars of the latency histograms if the scraper accepts it.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	}
+	metricsMutex.Lock()
+	metrics := append([]metric(nil), metricsRegistry...)
+	metricsMutex.Unlock()
+	for _, m := range metrics {
+		if writer, ok := m.(openMetricsWriter); ok && openMetrics {
+			writer.writeOpenMetrics(w)
+		} else {
+			m.write(w)
+		}
+	}
+	if openMetrics {
+		fmt.Fprint(w, "# EOF\n")
+	}
+}
+
+// traceID returns the trace id of the W3C traceparent header of the request,
+// "" if there is none.
+func traceID(request *http.Request) string {
+	parts := strings.Split(request.Header.Get("Traceparent"), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || strings.Trim(parts[1], "0") == "" {
+		return ""
+	}
+	for _, c := range parts[1] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return ""
+		}
+	}
+	return parts[1]
+}
+
+// Metrics reported by the proxy.
+var (
+	requestsTotal = newCounterVec("teeproxy_requests_total",
+		"Number of requests sent to the backends.", "side", "backend", "route", "code")
+	requestDuration = newHistogramVec("teeproxy_request_duration_seconds",
+		"Latency of the requests sent to the backends.", latencyBuckets, "side", "backend", "route")
+	requestBytesTotal = newCounterVec("teeproxy_request_bytes_total",
+		"Request body bytes sent to the backends.", "side", "backend")
+	responseBytesTotal = newCounterVec("teeproxy_response_bytes_total",
+		"Response body bytes received from the backends.", "side", "backend")
+	requestSize = newHistogramVec("teeproxy_request_size_bytes",
+		"Size of the request bodies sent to the backends.", sizeBuckets, "side", "backend")
+	responseSize = newHistogramVec("teeproxy_response_size_bytes",
+		"Size of the response bodies received from the backends.", sizeBuckets, "side", "backend")
+)
+
+// observeRequest records the outcome of a request sent to a backend, the
+// trace id of the request becomes the exemplar of its latency. The route is
+// reported as other if outside of the top -metrics.routes.
+func observeRequest(side, backend, route, traceID string, response *http.Response, seconds float64) {
+	code := "error"
+	if response != nil {
+		code = strconv.Itoa(response.StatusCode)
+	}
+	route = metricRoutes.Label(route, side == "a")
+	requestsTotal.Inc(side, backend, route, code)
+	requestDuration.ObserveWithTrace(seconds, traceID, side, backend, route)
+}
+
+// observeSizes records the body sizes of a request and its response.
+func observeSizes(side, backend string, requestBytes, responseBytes int64) {
+	requestBytesTotal.Add(float64(requestBytes), side, backend)
+	responseBytesTotal.Add(float64(responseBytes), side, backend)
+	requestSize.Observe(float64(requestBytes), side, backend)
+	responseSize.Observe(float64(responseBytes), side, backend)
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingBody) Read(p []byte) (n int, err error) {
+	n, err = c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return
+}
+
+func (c *countingBody) count() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.n)
+}
+
+// countBody replaces the request body with one counting the bytes sent.
+func countBody(request *http.Request) *countingBody {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil
+	}
+	body := &countingBody{ReadCloser: request.Body}
+	request.Body = body
+	return body
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCounterExposition(t *testing.T) {
+	c := &counterVec{name: "test_total", help: "Test.", labels: []string{"side", "code"}, values: make(map[string]float64)}
+	c.Inc("a", "200")
+	c.Add(2, "a", "200")
+	c.Inc("b", "error")
+	var out bytes.Buffer
+	c.write(&out)
+	expectation := `# HELP test_total Test.
+# TYPE test_total counter
+test_total{side="a",code="200"} 3
+test_total{side="b",code="error"} 1
+`
+	if out.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, out.String())
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	h := &histogramVec{name: "test_seconds", help: "Test.", labels: []string{"side"}, buckets: []float64{0.1, 1}, values: make(map[string]*histogram)}
+	h.Observe(0.05, "a")
+	h.Observe(0.5, "a")
+	h.Observe(5, "a")
+	var out bytes.Buffer
+	h.write(&out)
+	for _, line := range []string{
+		`test_seconds_bucket{side="a",le="0.1"} 1`,
+		`test_seconds_bucket{side="a",le="1"} 2`,
+		`test_seconds_bucket{side="a",le="+Inf"} 3`,
+		`test_seconds_sum{side="a"} 5.55`,
+		`test_seconds_count{side="a"} 3`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Expected '%s' in '%s'", line, out.String())
+		}
+	}
+}
+
+func TestCountBody(t *testing.T) {
+	request, _ := http.NewRequest("POST", "http://localhost/upload", strings.NewReader("hello"))
+	body := countBody(request)
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(request.Body)
+	if body.count() != 5 {
+		t.Errorf("Expected '5', but received '%d'", body.count())
+	}
+}
+
+func TestExemplars(t *testing.T) {
+	h := &histogramVec{name: "test_seconds", help: "Test.", labels: []string{"side"}, buckets: []float64{0.1, 1}, values: make(map[string]*histogram)}
+	h.ObserveWithTrace(0.5, "4bf92f3577b34da6a3ce929d0e0e4736", "a")
+	h.Observe(0.05, "a")
+	var out bytes.Buffer
+	h.write(&out)
+	if strings.Contains(out.String(), "trace_id") {
+		t.Errorf("Expected no exemplars in the Prometheus text format, but received '%s'", out.String())
+	}
+	out.Reset()
+	h.writeOpenMetrics(&out)
+	if expectation := `test_seconds_bucket{side="a",le="1"} 2 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} 0.5 `; !strings.Contains(out.String(), expectation) {
+		t.Errorf("Expected '%s' in '%s'", expectation, out.String())
+	}
+	if expectation := `test_seconds_bucket{side="a",le="0.1"} 1` + "\n"; !strings.Contains(out.String(), expectation) {
+		t.Errorf("Expected '%s' in '%s'", expectation, out.String())
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	for header, expectation := range map[string]string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": "",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01": "",
+		"invalid": "",
+	} {
+		request, _ := http.NewRequest("GET", "http://localhost/", nil)
+		request.Header.Set("Traceparent", header)
+		if id := traceID(request); id != expectation {
+			t.Errorf("Expected '%s', but received '%s'", expectation, id)
+		}
+	}
+}
+
+func TestOpenMetricsCounter(t *testing.T) {
+	c := &counterVec{name: "test_total", help: "Test.", values: make(map[string]float64)}
+	c.Inc()
+	var out bytes.Buffer
+	c.writeOpenMetrics(&out)
+	if expectation := "# HELP test Test.\n# TYPE test counter\ntest_total 1\n"; out.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, out.String())
+	}
+}
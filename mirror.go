@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// paused is set while mirroring is paused, production traffic is proxied as usual.
+var paused int32
+
+func mirroringPaused() bool {
+	return atomic.LoadInt32(&paused) == 1
+}
+
+// setMirroringPaused pauses or resumes mirroring and reports whether the state changed.
+func setMirroringPaused(pause bool, source string) bool {
+	var value int32
+	if pause {
+		value = 1
+	}
+	if atomic.SwapInt32(&paused, value) == value {
+		return false
+	}
+	if pause {
+		log.Printf("Mirroring paused by %s", source)
+	} else {
+		log.Printf("Mirroring resumed by %s", source)
+	}
+	shareState(source, "paused", strconv.FormatBool(pause))
+	audit(source, "paused", !pause, pause)
+	return true
+}
+
+// percentOverride replaces the -p percentage of the default policy at runtime,
+// ramp scales the percentage of all policies, e.g. while a rollout is staged.
+// Both are stored as float64 bits, a negative override means unset.
+var (
+	percentOverride = math.Float64bits(-1)
+	ramp            = math.Float64bits(100)
+)
+
+// mirrorPercent returns the runtime percentage of the default policy.
+func mirrorPercent() (float64, bool) {
+	value := math.Float64frombits(atomic.LoadUint64(&percentOverride))
+	return value, value >= 0
+}
+
+// mirrorRamp returns the percentage applied to the sampling of all policies.
+func mirrorRamp() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&ramp))
+}
+
+func setMirrorPercent(value float64, source string) bool {
+	return setRuntimeValue(&percentOverride, "percent", value, source)
+}
+
+func setMirrorRamp(value float64, source string) bool {
+	return setRuntimeValue(&ramp, "ramp", value, source)
+}
+
+// setRuntimeValue stores a percentage and reports whether it changed.
+func setRuntimeValue(address *uint64, name string, value float64, source string) bool {
+	previous := atomic.SwapUint64(address, math.Float64bits(value))
+	if previous == math.Float64bits(value) {
+		return false
+	}
+	log.Printf("Mirroring %s set to %v by %s", name, value, source)
+	shareState(source, name, formatFloat(value))
+	audit(source, name, auditPercent(math.Float64frombits(previous)), auditPercent(value))
+	return true
+}
+
+// auditPercent returns nil for an unset percentage.
+func auditPercent(value float64) interface{} {
+	if value < 0 {
+		return nil
+	}
+	return value
+}
+
+var (
+	shedMutex   sync.Mutex
+	shedReasons = make(map[string]bool)
+	shedding    int32
+)
+
+var mirrorShedTotal = newCounterVec("teeproxy_mirror_shed_total",
+	"Number of requests not mirrored because mirroring work is shed.")
+
+// mirroringShed reports whether mirroring is shed to protect the proxy.
+func mirroringShed() bool {
+	return atomic.LoadInt32(&shedding) == 1
+}
+
+// setMirroringShed starts or stops shedding mirroring work for the reason,
+// mirroring is shed as long as there is any reason.
+func setMirroringShed(reason string, shed bool) {
+	shedMutex.Lock()
+	defer shedMutex.Unlock()
+	if shedReasons[reason] == shed {
+		return
+	}
+	if shed {
+		shedReasons[reason] = true
+		log.Printf("Shedding mirroring work, %s pressure is high", reason)
+	} else {
+		delete(shedReasons, reason)
+		log.Printf("Stopped shedding mirroring work for %s pressure", reason)
+	}
+	if len(shedReasons) > 0 {
+		atomic.StoreInt32(&shedding, 1)
+	} else {
+		atomic.StoreInt32(&shedding, 0)
+	}
+}
+
+func init() {
+	adminMux.HandleFunc("/mirror", mirrorStatusHandler)
+	adminMux.HandleFunc("/mirror/pause", mirrorPauseHandler(true))
+	adminMux.HandleFunc("/mirror/resume", mirrorPauseHandler(false))
+	adminMux.HandleFunc("/mirror/percent", mirrorValueHandler(setMirrorPercent, -1))
+	adminMux.HandleFunc("/mirror/ramp", mirrorValueHandler(setMirrorRamp, 100))
+}
+
+func mirrorStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{
+		"paused": mirroringPaused(),
+	}
+	if value, ok := mirrorPercent(); ok {
+		status["percent"] = value
+	}
+	if value := mirrorRamp(); value != 100 {
+		status["ramp"] = value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func mirrorPauseHandler(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		setMirroringPaused(pause, adminSource(r))
+		mirrorStatusHandler(w, r)
+	}
+}
+
+// mirrorValueHandler sets a runtime percentage from the value parameter,
+// e.g. POST /mirror/ramp?value=25, DELETE restores the initial value.
+func mirrorValueHandler(set func(float64, string) bool, initial float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "DELETE" {
+			set(initial, adminSource(r))
+			mirrorStatusHandler(w, r)
+			return
+		}
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		value, err := strconv.ParseFloat(r.FormValue("value"), 64)
+		if err != nil || value < 0 || value > 100 {
+			http.Error(w, "value must be a percentage between 0 and 100", http.StatusBadRequest)
+			return
+		}
+		set(value, adminSource(r))
+		mirrorStatusHandler(w, r)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPauseAndResumeMirroring(t *testing.T) {
+	defer setMirroringPaused(false, "test")
+
+	recorder := httptest.NewRecorder()
+	adminMux.ServeHTTP(recorder, httptest.NewRequest("GET", "/mirror/pause", nil))
+	if recorder.Code != http.StatusMethodNotAllowed || mirroringPaused() {
+		t.Errorf("Expected GET to be rejected, but received '%d'", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	adminMux.ServeHTTP(recorder, httptest.NewRequest("POST", "/mirror/pause", nil))
+	if expectation := "{\"paused\":true}\n"; recorder.Body.String() != expectation || !mirroringPaused() {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	adminMux.ServeHTTP(recorder, httptest.NewRequest("POST", "/mirror/resume", nil))
+	if expectation := "{\"paused\":false}\n"; recorder.Body.String() != expectation || mirroringPaused() {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+}
+
+func TestMirrorRamp(t *testing.T) {
+	defer setMirrorRamp(100, "test")
+
+	recorder := httptest.NewRecorder()
+	adminMux.ServeHTTP(recorder, httptest.NewRequest("POST", "/mirror/ramp?value=0", nil))
+	if expectation := "{\"paused\":false,\"ramp\":0}\n"; recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+	p := &policy{Percent: 100}
+	if p.Sample(httptest.NewRequest("GET", "/", nil), nil) {
+		t.Errorf("Expected no request to be sampled at ramp 0")
+	}
+
+	recorder = httptest.NewRecorder()
+	adminMux.ServeHTTP(recorder, httptest.NewRequest("POST", "/mirror/ramp?value=200", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusBadRequest, recorder.Code)
+	}
+}
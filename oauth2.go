@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An OAuth2 client credentials flow can be configured per alternate backend.
+// teeproxy fetches a token, refreshes it before it expires and sends it as
+// the Authorization header of the mirrored requests, replacing the token of
+// the client which is only valid for production.
+
+type oauth2Config struct {
+	// Backend is the URL of the alternate backend, as in the policies.
+	Backend      string   `json:"backend"`
+	TokenURL     string   `json:"token_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+	// Audience is sent as the audience parameter if set, e.g. for Auth0.
+	Audience string `json:"audience"`
+}
+
+// oauth2RefreshMargin is how long before its expiry a token is refreshed.
+const oauth2RefreshMargin = 30 * time.Second
+
+var oauth2TokenRequestsTotal = newCounterVec("teeproxy_oauth2_token_requests_total",
+	"Number of OAuth2 token requests for the alternate backends.", "backend", "result")
+
+type tokenSource struct {
+	config    oauth2Config
+	secret    *secret
+	client    *http.Client
+	backend   string
+	mu        sync.Mutex
+	token     string
+	tokenType string
+	expires   time.Time
+}
+
+func newTokenSource(config oauth2Config, backend string) (*tokenSource, error) {
+	if config.TokenURL == "" || config.ClientID == "" {
+		return nil, fmt.Errorf("oauth2 for %s requires token_url and client_id", backend)
+	}
+	if _, err := url.Parse(config.TokenURL); err != nil {
+		return nil, fmt.Errorf("oauth2 for %s: invalid token_url: %v", backend, err)
+	}
+	secret := newSecret(config.ClientSecret)
+	if _, err := secret.Value(); err != nil {
+		return nil, fmt.Errorf("oauth2 for %s: client_secret: %v", backend, err)
+	}
+	return &tokenSource{
+		config:  config,
+		secret:  secret,
+		backend: backend,
+		client:  &http.Client{Timeout: time.Duration(*alternateTimeout) * time.Millisecond},
+	}, nil
+}
+
+// Authorization returns the Authorization header value, fetching a new
+// token if the current one expires soon.
+func (s *tokenSource) Authorization() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Now().Add(oauth2RefreshMargin).Before(s.expires) {
+		return s.tokenType + " " + s.token, nil
+	}
+	if err := s.fetch(); err != nil {
+		oauth2TokenRequestsTotal.Inc(s.backend, "error")
+		return "", err
+	}
+	oauth2TokenRequestsTotal.Inc(s.backend, "success")
+	return s.tokenType + " " + s.token, nil
+}
+
+func (s *tokenSource) fetch() error {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.config.Scopes, " "))
+	}
+	if s.config.Audience != "" {
+		form.Set("audience", s.config.Audience)
+	}
+	request, err := http.NewRequest("POST", s.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	clientSecret, err := s.secret.Value()
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(url.QueryEscape(s.config.ClientID), url.QueryEscape(clientSecret))
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request returned %s: %s", response.Status, body)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return fmt.Errorf("invalid token response: %v", err)
+	}
+	if token.AccessToken == "" {
+		return fmt.Errorf("token response without access_token")
+	}
+	s.token = token.AccessToken
+	s.tokenType = "Bearer"
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		s.tokenType = token.TokenType
+	}
+	s.expires = time.Now().Add(time.Hour)
+	if token.ExpiresIn > 0 {
+		s.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return nil
+}
+
+// oauth2Transport sets the token of the backend on its requests.
+type oauth2Transport struct {
+	http.RoundTripper
+	backend *backend
+}
+
+func (t *oauth2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	source := t.backend.TokenSource()
+	if source == nil || redirectedAway(req) {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	authorization, err := source.Authorization()
+	if err != nil {
+		return nil, fmt.Errorf("fetching the OAuth2 token: %v", err)
+	}
+	authorized := req.Clone(req.Context())
+	authorized.Header.Set("Authorization", authorization)
+	return t.RoundTripper.RoundTrip(authorized)
+}
+
+// buildTokenSources builds the OAuth2 flows of the backends, the -b.oauth2
+// flags apply to the -b backends and the config file to the backends listed.
+// The returned func sets them on the backends.
+func buildTokenSources(configs []oauth2Config, altServers []*backend) (func(), error) {
+	sources := make(map[*backend]*tokenSource)
+	if *alternateOAuth2TokenURL != "" {
+		config := oauth2Config{
+			TokenURL:     *alternateOAuth2TokenURL,
+			ClientID:     *alternateOAuth2Client,
+			ClientSecret: *alternateOAuth2Secret,
+		}
+		if *alternateOAuth2Scopes != "" {
+			config.Scopes = strings.Split(*alternateOAuth2Scopes, ",")
+		}
+		for _, b := range altServers {
+			source, err := newTokenSource(config, b.Alternative)
+			if err != nil {
+				return nil, err
+			}
+			sources[b] = source
+		}
+	}
+	for _, config := range configs {
+		b, err := parseBackend(config.Backend)
+		if err != nil {
+			return nil, err
+		}
+		source, err := newTokenSource(config, b.Alternative)
+		if err != nil {
+			return nil, err
+		}
+		sources[b] = source
+	}
+	return func() {
+		for _, b := range registeredBackends() {
+			b.setTokenSource(sources[b])
+		}
+	}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOAuth2Token(t *testing.T) {
+	tokenRequests := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		id, secret, _ := r.BasicAuth()
+		if id != "teeproxy" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" ||
+			r.FormValue("scope") != "orders.read orders.write" {
+			http.Error(w, "invalid_client", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"bearer","expires_in":3600}`, tokenRequests)
+	}))
+	defer tokenServer.Close()
+
+	var authorization string
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer alternate.Close()
+
+	alt := lookupBackend(alternate.URL)
+	setTokenSources, err := buildTokenSources([]oauth2Config{{
+		Backend:      alternate.URL,
+		TokenURL:     tokenServer.URL,
+		ClientID:     "teeproxy",
+		ClientSecret: "secret",
+		Scopes:       []string{"orders.read", "orders.write"},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTokenSources()
+	defer alt.setTokenSource(nil)
+
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("GET", alternate.URL+"/orders", nil)
+		request.Header.Set("Authorization", "Bearer production")
+		response, err := alt.Transport().RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if authorization != "Bearer token-1" {
+			t.Errorf("Expected '%s', but received '%s'", "Bearer token-1", authorization)
+		}
+		if request.Header.Get("Authorization") != "Bearer production" {
+			t.Errorf("Expected the original request to be unchanged")
+		}
+	}
+	if tokenRequests != 1 {
+		t.Errorf("Expected the token to be cached, but received %d token requests", tokenRequests)
+	}
+
+	alt.TokenSource().secret = newSecret("wrong")
+	alt.TokenSource().token = ""
+	request, _ := http.NewRequest("GET", alternate.URL+"/orders", nil)
+	if _, err := alt.Transport().RoundTrip(request); err == nil {
+		t.Errorf("Expected an error when the token request fails")
+	}
+}
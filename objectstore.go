@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The capture sink uploads batches of mirrored exchanges as JSON lines to S3
+// or, through its S3 compatible API with HMAC keys, to GCS. The credentials
+// are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+// Given an http(s) URL, the batches are posted to a collector instead, for
+// analytics consumers preferring batches over a request per exchange.
+
+// captureSink receives the captured mirrored exchanges, nil if disabled.
+var captureSink exchangeSink
+
+type objectSink struct {
+	endpoint    *url.URL
+	bucket      string
+	prefix      string
+	region      string
+	credentials awsCredentials
+	batch       int
+	compress    bool
+	format      string
+	client      *http.Client
+	// collector is set if the batches are posted to the endpoint.
+	collector bool
+
+	mu       sync.Mutex
+	buffer   bytes.Buffer
+	writer   io.Writer
+	gzip     *gzip.Writer
+	count    int
+	sequence int
+}
+
+// newObjectSink parses s3://bucket/prefix, gs://bucket/prefix or the http(s)
+// URL of a collector.
+func newObjectSink(location string) (*objectSink, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	s := &objectSink{
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		region:   *captureRegion,
+		batch:    *captureBatch,
+		compress: *captureGzip,
+		format:   *captureFormat,
+		client:   &http.Client{Timeout: time.Minute},
+		credentials: awsCredentials{
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		},
+	}
+	if !validSinkFormat(s.format) {
+		return nil, fmt.Errorf("invalid -capture.format %s, expected json or protobuf", s.format)
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		s.endpoint = u
+		s.collector = true
+		s.reset()
+		return s, nil
+	}
+	if s.bucket == "" {
+		return nil, fmt.Errorf("missing bucket in %s", location)
+	}
+	endpoint := *captureEndpoint
+	switch u.Scheme {
+	case "s3":
+		if s.region == "" {
+			s.region = os.Getenv("AWS_REGION")
+		}
+		if s.region == "" {
+			s.region = "us-east-1"
+		}
+		if endpoint == "" {
+			endpoint = "https://s3." + s.region + ".amazonaws.com"
+		}
+	case "gs":
+		if s.region == "" {
+			s.region = "auto"
+		}
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s, expected s3, gs, http or https", u.Scheme)
+	}
+	if s.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, err
+	}
+	if s.credentials.AccessKey == "" || s.credentials.SecretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	s.reset()
+	return s, nil
+}
+
+func (s *objectSink) reset() {
+	s.buffer.Reset()
+	s.count = 0
+	s.writer = &s.buffer
+	if s.compress {
+		s.gzip = gzip.NewWriter(&s.buffer)
+		s.writer = s.gzip
+	}
+}
+
+func (s *objectSink) Write(e *exchange) error {
+	data, err := encodeExchange(e, s.format)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writer.Write(data)
+	s.count++
+	if s.count >= s.batch {
+		return s.upload()
+	}
+	return nil
+}
+
+// Flush uploads an incomplete batch.
+func (s *objectSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		return nil
+	}
+	return s.upload()
+}
+
+func (s *objectSink) Close() error {
+	return s.Flush()
+}
+
+// objectName returns e.g. prefix/2024/05/01/13/20240501T131500Z-host-3.ndjson.gz,
+// the extension is .pb for protobuf envelopes.
+func (s *objectSink) objectName(now time.Time) string {
+	hostname, _ := os.Hostname()
+	s.sequence++
+	extension := "ndjson"
+	if s.format == "protobuf" {
+		extension = "pb"
+	}
+	name := fmt.Sprintf("%s/%s-%s-%d.%s", now.Format("2006/01/02/15"), now.Format("20060102T150405Z"), hostname, s.sequence, extension)
+	if s.compress {
+		name += ".gz"
+	}
+	if s.prefix != "" {
+		name = s.prefix + "/" + name
+	}
+	return name
+}
+
+// upload puts the batch into the bucket, it is dropped on failure.
+func (s *objectSink) upload() error {
+	count := s.count
+	if s.gzip != nil {
+		s.gzip.Close()
+	}
+	body := append([]byte(nil), s.buffer.Bytes()...)
+	s.reset()
+
+	now := time.Now().UTC()
+	object := *s.endpoint
+	method := "POST"
+	if !s.collector {
+		object.Path = strings.TrimSuffix(object.Path, "/") + "/" + s.bucket + "/" + s.objectName(now)
+		method = "PUT"
+	}
+	req, err := http.NewRequest(method, object.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if s.format == "protobuf" {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	} else {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if s.compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.collector {
+		req.Header.Set("X-Teeproxy-Batch-Size", strconv.Itoa(count))
+	} else {
+		signV4(req, sha256Hex(body), s.credentials, s.region, "s3", now)
+	}
+	response, err := s.client.Do(req)
+	if err == nil {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		response.Body.Close()
+		if response.StatusCode/100 != 2 {
+			err = fmt.Errorf("%s: %s", response.Status, message)
+		}
+	}
+	if err != nil {
+		recordingsDropped.Add(float64(count), "capture")
+		return fmt.Errorf("uploading %d exchanges to %s failed: %v", count, object.Path, err)
+	}
+	return nil
+}
+
+// startCapture uploads the mirrored exchanges to -capture.
+func startCapture() {
+	sink, err := newObjectSink(*captureURL)
+	if err != nil {
+		fatalf("Invalid -capture %s: %s", *captureURL, err)
+	}
+	anonymized, err := withAnonymizer(sink, *captureAnonymize)
+	if err != nil {
+		fatalf("Invalid -capture.anonymize: %s", err)
+	}
+	captureSink = newAsyncSink("capture", anonymized, 10*sink.batch)
+	go func() {
+		for range time.Tick(time.Duration(*captureInterval) * time.Second) {
+			if err := sink.Flush(); err != nil {
+				log.Printf("Failed to capture: %s", err)
+			}
+		}
+	}()
+	log.Printf("Capturing %v%% of the mirrored exchanges to %s", *capturePercent, *captureURL)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestObjectSink(t *testing.T) {
+	var paths []string
+	var lines int
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+			http.Error(w, "unsigned", http.StatusForbidden)
+			return
+		}
+		paths = append(paths, r.URL.Path)
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for scanner := bufio.NewScanner(reader); scanner.Scan(); {
+			lines++
+		}
+	}))
+	defer store.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer func(endpoint string, batch int) { *captureEndpoint, *captureBatch = endpoint, batch }(*captureEndpoint, *captureBatch)
+	*captureEndpoint = store.URL
+	*captureBatch = 2
+
+	sink, err := newObjectSink("s3://shadow-captures/teeproxy/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sink.Write(&exchange{Method: "GET", URI: "/"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || lines != 3 {
+		t.Fatalf("Expected '2' objects with '3' lines, but received '%d' and '%d'", len(paths), lines)
+	}
+	if !strings.HasPrefix(paths[0], "/shadow-captures/teeproxy/") || !strings.HasSuffix(paths[0], "-1.ndjson.gz") {
+		t.Errorf("Expected an object in /shadow-captures/teeproxy/, but received '%s'", paths[0])
+	}
+}
+
+func TestCollectorSink(t *testing.T) {
+	var batches []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			http.Error(w, "unexpected batch", http.StatusBadRequest)
+			return
+		}
+		batches = append(batches, r.Header.Get("X-Teeproxy-Batch-Size"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer collector.Close()
+	defer func(batch int, compress bool) { *captureBatch, *captureGzip = batch, compress }(*captureBatch, *captureGzip)
+	*captureBatch = 2
+	*captureGzip = false
+
+	sink, err := newObjectSink(collector.URL + "/ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sink.Write(&exchange{Method: "GET", URI: "/"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(batches, ",") != "2,1" {
+		t.Errorf("Expected '2,1', but received '%s'", strings.Join(batches, ","))
+	}
+}
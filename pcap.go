@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// A reader of the HTTP/1 requests in pcap captures, e.g. of tcpdump, for the
+// pcap source. TCP streams are reassembled by sequence number, packets
+// missing from the capture truncate the stream.
+
+const (
+	pcapLinkNull     = 0
+	pcapLinkEthernet = 1
+	pcapLinkRaw      = 101
+	pcapLinkLinuxSLL = 113
+)
+
+// tcpFlow identifies a direction of a TCP connection.
+type tcpFlow struct {
+	src, dst string
+}
+
+type tcpSegment struct {
+	seq     uint32
+	time    time.Time
+	payload []byte
+}
+
+// readPcapFile returns the requests captured in the file ordered by time.
+func readPcapFile(filename string) ([]*exchange, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	flows, err := readPcap(bufio.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", filename, err)
+	}
+	var exchanges []*exchange
+	for _, segments := range flows {
+		exchanges = append(exchanges, parseFlowRequests(segments)...)
+	}
+	sort.SliceStable(exchanges, func(i, j int) bool { return exchanges[i].Time.Before(exchanges[j].Time) })
+	return exchanges, nil
+}
+
+// readPcap collects the TCP segments with payload by flow.
+func readPcap(r io.Reader) (map[tcpFlow][]tcpSegment, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	nanoseconds := false
+	switch magic := binary.LittleEndian.Uint32(header[:4]); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+		nanoseconds = magic == 0xa1b23c4d
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+		nanoseconds = magic == 0x4d3cb2a1
+	default:
+		return nil, errors.New("not a pcap file, pcapng is not supported")
+	}
+	linkType := order.Uint32(header[20:24]) & 0xfffffff
+
+	flows := make(map[tcpFlow][]tcpSegment)
+	var record [16]byte
+	for {
+		if _, err := io.ReadFull(r, record[:]); err == io.EOF {
+			return flows, nil
+		} else if err != nil {
+			return nil, err
+		}
+		seconds, fraction := order.Uint32(record[0:4]), order.Uint32(record[4:8])
+		if !nanoseconds {
+			fraction *= 1000
+		}
+		packet := make([]byte, order.Uint32(record[8:12]))
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return nil, err
+		}
+		flow, segment, ok := parsePacket(linkType, packet)
+		if ok && len(segment.payload) > 0 {
+			segment.time = time.Unix(int64(seconds), int64(fraction))
+			flows[flow] = append(flows[flow], segment)
+		}
+	}
+}
+
+// parsePacket extracts the TCP segment of a link layer packet.
+func parsePacket(linkType uint32, packet []byte) (flow tcpFlow, segment tcpSegment, ok bool) {
+	var ipPacket []byte
+	switch linkType {
+	case pcapLinkNull:
+		if len(packet) < 4 {
+			return
+		}
+		ipPacket = packet[4:]
+	case pcapLinkEthernet:
+		if len(packet) < 14 {
+			return
+		}
+		etherType, offset := binary.BigEndian.Uint16(packet[12:14]), 14
+		if etherType == 0x8100 && len(packet) >= 18 {
+			// VLAN tag
+			etherType, offset = binary.BigEndian.Uint16(packet[16:18]), 18
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return
+		}
+		ipPacket = packet[offset:]
+	case pcapLinkRaw:
+		ipPacket = packet
+	case pcapLinkLinuxSLL:
+		if len(packet) < 16 {
+			return
+		}
+		ipPacket = packet[16:]
+	default:
+		return
+	}
+	if len(ipPacket) < 1 {
+		return
+	}
+	var src, dst net.IP
+	var tcp []byte
+	switch ipPacket[0] >> 4 {
+	case 4:
+		headerLength := int(ipPacket[0]&0x0f) * 4
+		if len(ipPacket) < 20 || headerLength < 20 || len(ipPacket) < headerLength || ipPacket[9] != 6 {
+			return
+		}
+		end := int(binary.BigEndian.Uint16(ipPacket[2:4]))
+		if end < headerLength || end > len(ipPacket) {
+			end = len(ipPacket)
+		}
+		src, dst, tcp = net.IP(ipPacket[12:16]), net.IP(ipPacket[16:20]), ipPacket[headerLength:end]
+	case 6:
+		// extension headers are not supported
+		if len(ipPacket) < 40 || ipPacket[6] != 6 {
+			return
+		}
+		end := 40 + int(binary.BigEndian.Uint16(ipPacket[4:6]))
+		if end > len(ipPacket) {
+			end = len(ipPacket)
+		}
+		src, dst, tcp = net.IP(ipPacket[8:24]), net.IP(ipPacket[24:40]), ipPacket[40:end]
+	default:
+		return
+	}
+	if len(tcp) < 20 {
+		return
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || len(tcp) < dataOffset {
+		return
+	}
+	flow.src = net.JoinHostPort(src.String(), fmt.Sprint(binary.BigEndian.Uint16(tcp[0:2])))
+	flow.dst = net.JoinHostPort(dst.String(), fmt.Sprint(binary.BigEndian.Uint16(tcp[2:4])))
+	segment.seq = binary.BigEndian.Uint32(tcp[4:8])
+	segment.payload = append([]byte(nil), tcp[dataOffset:]...)
+	return flow, segment, true
+}
+
+// parseFlowRequests reassembles the stream of a flow and reads its requests,
+// flows of responses or other protocols yield none.
+func parseFlowRequests(segments []tcpSegment) []*exchange {
+	first := segments[0].seq
+	for _, s := range segments {
+		if int32(s.seq-first) < 0 {
+			first = s.seq
+		}
+	}
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].seq-first < segments[j].seq-first })
+	var stream []byte
+	// offsets holds the stream offset at which each segment begins
+	var offsets []int
+	var times []time.Time
+	for _, s := range segments {
+		position := int(s.seq - first)
+		if position > len(stream) {
+			// missing segment
+			break
+		}
+		if position+len(s.payload) <= len(stream) {
+			// retransmission
+			continue
+		}
+		offsets = append(offsets, len(stream))
+		times = append(times, s.time)
+		stream = append(stream, s.payload[len(stream)-position:]...)
+	}
+
+	var exchanges []*exchange
+	unread := bytes.NewReader(stream)
+	reader := bufio.NewReader(unread)
+	for {
+		consumed := len(stream) - unread.Len() - reader.Buffered()
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return exchanges
+		}
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			return exchanges
+		}
+		i := sort.SearchInts(offsets, consumed+1) - 1
+		if i < 0 {
+			i = 0
+		}
+		e := &exchange{
+			Time:   times[i],
+			Side:   "a",
+			Method: request.Method,
+			URI:    request.RequestURI,
+			Proto:  request.Proto,
+			Host:   request.Host,
+			Header: request.Header,
+		}
+		if len(body) > 0 {
+			e.RequestChunks = []chunk{{Data: body}}
+		}
+		exchanges = append(exchanges, e)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+)
+
+// policy decides which requests are mirrored to which alternate backends.
+//
+// Every policy is evaluated independently for each request, a request matched
+// and sampled by several policies is mirrored at most once to each backend.
+type policy struct {
+	Name     string
+	Path     *regexp.Regexp
+	Methods  *regexp.Regexp
+	Host     *regexp.Regexp
+	Percent  float64
+	Backends []*backend
+	Groups   []*backendGroup
+	// Adjustable policies take their percentage from /mirror/percent if set.
+	Adjustable bool
+	// Anonymize is applied to the mirrored requests if set.
+	Anonymize *anonymizer
+	// Tenants limits the policy to the requests of these tenants if set.
+	Tenants map[string]bool
+	// Sampler decides which matched requests are mirrored.
+	Sampler Sampler
+}
+
+// Matches reports whether the request fulfills all filters of the policy.
+func (p *policy) Matches(req *http.Request) bool {
+	if p.Methods != nil && !p.Methods.MatchString(req.Method) {
+		return false
+	}
+	if p.Path != nil && !p.Path.MatchString(req.URL.Path) {
+		return false
+	}
+	if p.Host != nil && !p.Host.MatchString(req.Host) {
+		return false
+	}
+	return true
+}
+
+// MatchesTenant reports whether the policy applies to the tenant.
+func (p *policy) MatchesTenant(tenant string) bool {
+	return p.Tenants == nil || p.Tenants[tenant]
+}
+
+// Sample decides whether a matched request is mirrored by the Sampler of the
+// policy, percentage or consistent by -sample.key if none is set.
+func (p *policy) Sample(req *http.Request, randomizer *rand.Rand) bool {
+	percent := p.Percent
+	if value, ok := mirrorPercent(); ok && p.Adjustable {
+		percent = value
+	}
+	percent *= mirrorRamp() / 100
+	sampled := percent > 0 && p.sampler().Sample(req, percent, randomizer)
+	countSample(p.Name, sampled)
+	return sampled
+}
+
+func (p *policy) sampler() Sampler {
+	if p.Sampler != nil {
+		return p.Sampler
+	}
+	return consistentSampler{}
+}
+
+// Select returns the backends a sampled request is mirrored to: all backends
+// of the policy and the chosen members of each group.
+func (p *policy) Select(randomizer *rand.Rand) []*backend {
+	if len(p.Groups) == 0 {
+		return p.Backends
+	}
+	selected := append([]*backend(nil), p.Backends...)
+	for _, group := range p.Groups {
+		selected = append(selected, group.Choose(randomizer)...)
+	}
+	return selected
+}
+
+// backendGroup is a set of backends of which each request is mirrored to
+// exactly Count, one by default, e.g. the shards of a shadow cluster or the
+// candidate implementations of an experiment.
+type backendGroup struct {
+	Name    string
+	Random  bool
+	Members []*backend
+	// Count is the number of members each request is mirrored to.
+	Count int
+	// Weights of the members for the random selection, equal if nil.
+	Weights []float64
+
+	next uint32
+}
+
+// Pick selects a ready member either round-robin or at random.
+func (g *backendGroup) Pick(randomizer *rand.Rand) *backend {
+	if chosen := g.choose(randomizer, 1); len(chosen) > 0 {
+		return chosen[0]
+	}
+	return nil
+}
+
+// Choose selects Count ready members, fewer if not enough are ready.
+func (g *backendGroup) Choose(randomizer *rand.Rand) []*backend {
+	count := g.Count
+	if count < 1 {
+		count = 1
+	}
+	return g.choose(randomizer, count)
+}
+
+// choose selects the next count ready members round-robin, or draws them
+// at random by their weights without replacement.
+func (g *backendGroup) choose(randomizer *rand.Rand, count int) []*backend {
+	var chosen []*backend
+	if !g.Random {
+		start := int(atomic.AddUint32(&g.next, 1)-1) % len(g.Members)
+		for i := 0; i < len(g.Members) && len(chosen) < count; i++ {
+			if member := g.Members[(start+i)%len(g.Members)]; member.Ready() {
+				chosen = append(chosen, member)
+			}
+		}
+		return chosen
+	}
+	var candidates []*backend
+	var weights []float64
+	total := 0.0
+	for i, member := range g.Members {
+		if member.Ready() {
+			weight := 1.0
+			if g.Weights != nil {
+				weight = g.Weights[i]
+			}
+			candidates = append(candidates, member)
+			weights = append(weights, weight)
+			total += weight
+		}
+	}
+	for len(chosen) < count && len(candidates) > 0 {
+		draw := randomizer.Float64() * total
+		i := 0
+		for ; i < len(candidates)-1 && draw >= weights[i]; i++ {
+			draw -= weights[i]
+		}
+		chosen = append(chosen, candidates[i])
+		total -= weights[i]
+		candidates = append(candidates[:i], candidates[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+	}
+	return chosen
+}
+
+// newBackendGroup creates a group of the backend URLs selecting its members
+// with "round-robin" or "random".
+func newBackendGroup(name string, selection string, urls []string) (*backendGroup, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("group %q has no backends", name)
+	}
+	g := &backendGroup{Name: name}
+	switch selection {
+	case "", "round-robin":
+	case "random":
+		g.Random = true
+	default:
+		return nil, fmt.Errorf("group %q: unknown selection %q, expected round-robin or random", name, selection)
+	}
+	for _, url := range urls {
+		b, err := parseBackend(url)
+		if err != nil {
+			return nil, fmt.Errorf("group %q: %v", name, err)
+		}
+		g.Members = append(g.Members, b)
+	}
+	return g, nil
+}
+
+// setChoice mirrors each request to count members of the group, drawn at
+// random by the weights if given, one per member.
+func (g *backendGroup) setChoice(count int, weights []float64) error {
+	if count < 0 || count > len(g.Members) {
+		return fmt.Errorf("group %q: count %d out of range, expected 1 to %d", g.Name, count, len(g.Members))
+	}
+	g.Count = count
+	if weights == nil {
+		return nil
+	}
+	if !g.Random {
+		return fmt.Errorf("group %q: weights require the random selection", g.Name)
+	}
+	if len(weights) != len(g.Members) {
+		return fmt.Errorf("group %q: %d weights for %d backends", g.Name, len(weights), len(g.Members))
+	}
+	for _, weight := range weights {
+		if weight <= 0 {
+			return fmt.Errorf("group %q: weight %v is not positive", g.Name, weight)
+		}
+	}
+	g.Weights = weights
+	return nil
+}
+
+// backends holds every alternate backend by its URL, so that policies mirroring
+// to the same URL share its state. A reload adds backends while e.g. the
+// compaction ranges over them, they are read as a snapshot.
+var (
+	backendsMutex sync.Mutex
+	backends      = make(map[string]*backend)
+	allBackends   []*backend
+)
+
+// registeredBackends returns a snapshot of every alternate backend.
+func registeredBackends() []*backend {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	return append([]*backend(nil), allBackends...)
+}
+
+// parseBackend validates the backend URL or template and returns its
+// backend, the URLs of the flags and the config file are checked before
+// they are looked up.
+func parseBackend(value string) (*backend, error) {
+	if isTargetTemplate(value) {
+		if _, _, _, err := parseTargetTemplate(value); err != nil {
+			return nil, err
+		}
+	} else if _, err := parseBackendTarget(value); err != nil {
+		return nil, err
+	}
+	return lookupBackend(value), nil
+}
+
+// lookupBackend returns the backend for the URL, creating it on first use.
+func lookupBackend(value string) *backend {
+	scheme, endpoint := SchemeAndHost(value)
+	var template *targetTemplate
+	if isTargetTemplate(value) {
+		if s, e, t, err := parseTargetTemplate(value); err == nil {
+			scheme, endpoint, template = s, e, t
+		}
+	}
+	key := scheme + "://" + endpoint
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	if b, ok := backends[key]; ok {
+		return b
+	}
+	b := &backend{AlternativeScheme: scheme, Alternative: endpoint, template: template}
+	if t, err := parseBackendTarget(value); err == nil {
+		b.User = t.User
+	}
+	backends[key] = b
+	allBackends = append(allBackends, b)
+	return b
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math/rand"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestGroupRoundRobin(t *testing.T) {
+	group, err := newBackendGroup("shards", "round-robin", []string{"http://shard1", "http://shard2", "http://shard3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	randomizer := rand.New(rand.NewSource(1))
+	group.Members[1].setReady(false)
+	defer group.Members[1].setReady(true)
+
+	var picked []string
+	for i := 0; i < 4; i++ {
+		picked = append(picked, group.Pick(randomizer).Alternative)
+	}
+	expectation := []string{"shard1", "shard3", "shard3", "shard1"}
+	for i := range expectation {
+		if picked[i] != expectation[i] {
+			t.Errorf("Expected '%v', but received '%v'", expectation, picked)
+			break
+		}
+	}
+}
+
+func TestPolicySelectsOneMemberPerGroup(t *testing.T) {
+	group, err := newBackendGroup("shards", "random", []string{"http://shard1", "http://shard2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &policy{Backends: []*backend{lookupBackend("http://all")}, Groups: []*backendGroup{group}}
+	randomizer := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		if selected := p.Select(randomizer); len(selected) != 2 || selected[0].Alternative != "all" {
+			t.Errorf("Expected 'all' and one shard, but received '%v'", arrayAlternatives(selected).String())
+		}
+	}
+}
+
+func TestGroupChoosesKMembers(t *testing.T) {
+	group, err := newBackendGroup("candidates", "random", []string{"http://candidate1", "http://candidate2", "http://candidate3", "http://candidate4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := group.setChoice(2, []float64{6, 2, 1, 1}); err != nil {
+		t.Fatal(err)
+	}
+	randomizer := rand.New(rand.NewSource(1))
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		chosen := group.Choose(randomizer)
+		if len(chosen) != 2 || chosen[0] == chosen[1] {
+			t.Fatalf("Expected two distinct candidates, but received '%v'", arrayAlternatives(chosen).String())
+		}
+		for _, member := range chosen {
+			counts[member.Alternative]++
+		}
+	}
+	if counts["candidate1"] < counts["candidate2"] || counts["candidate2"] < counts["candidate3"] {
+		t.Errorf("Expected the candidates chosen by weight, but received '%v'", counts)
+	}
+
+	group.Members[0].setReady(false)
+	defer group.Members[0].setReady(true)
+	for i := 0; i < 100; i++ {
+		for _, member := range group.Choose(randomizer) {
+			if member.Alternative == "candidate1" {
+				t.Fatalf("Expected no unready candidate to be chosen")
+			}
+		}
+	}
+}
+
+func TestGroupRoundRobinChoosesKMembers(t *testing.T) {
+	group, err := newBackendGroup("candidates", "round-robin", []string{"http://rr1", "http://rr2", "http://rr3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := group.setChoice(2, nil); err != nil {
+		t.Fatal(err)
+	}
+	randomizer := rand.New(rand.NewSource(1))
+	var picked []string
+	for i := 0; i < 3; i++ {
+		picked = append(picked, arrayAlternatives(group.Choose(randomizer)).String())
+	}
+	expectation := []string{"http://rr1, http://rr2", "http://rr2, http://rr3", "http://rr3, http://rr1"}
+	for i := range expectation {
+		if picked[i] != expectation[i] {
+			t.Errorf("Expected '%v', but received '%v'", expectation, picked)
+			break
+		}
+	}
+}
+
+func TestGroupInvalidChoice(t *testing.T) {
+	for _, tc := range []struct {
+		selection string
+		count     int
+		weights   []float64
+	}{
+		{"random", 3, nil},
+		{"random", 1, []float64{1}},
+		{"random", 1, []float64{1, 0}},
+		{"round-robin", 1, []float64{1, 1}},
+	} {
+		group, err := newBackendGroup("shards", tc.selection, []string{"http://shard1", "http://shard2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := group.setChoice(tc.count, tc.weights); err == nil {
+			t.Errorf("Expected an error for count %d and weights %v", tc.count, tc.weights)
+		}
+	}
+}
+
+func TestGroupInvalidSelection(t *testing.T) {
+	if _, err := newBackendGroup("shards", "weighted", []string{"http://shard1"}); err == nil {
+		t.Errorf("Expected an error for an unknown selection")
+	}
+}
+
+func TestConsistentSampling(t *testing.T) {
+	defer func(source string) { *sampleKeySource = source }(*sampleKeySource)
+	*sampleKeySource = "header:X-User-Id"
+	defer sampleSalt.Store("")
+	sampleSalt.Store("fleet")
+
+	p := &policy{Name: "consistent", Percent: 30}
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User-Id", strconv.Itoa(i))
+		first := p.Sample(req, rand.New(rand.NewSource(int64(i))))
+		if second := p.Sample(req, rand.New(rand.NewSource(int64(-i)))); first != second {
+			t.Fatalf("Expected user %d to be sampled consistently", i)
+		}
+		if first {
+			sampled++
+		}
+	}
+	if sampled < 2800 || sampled > 3200 {
+		t.Errorf("Expected about '3000' sampled users, but received '%d'", sampled)
+	}
+}
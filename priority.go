@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+// Requests are classified into the priority classes high, normal (default)
+// and low. With -mirror.workers, the mirrored requests are queued per class
+// and the workers always take the highest class first, so that under load
+// the low priority mirrors are dropped when their queue is full while the
+// traffic that matters keeps being mirrored.
+
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+)
+
+var priorityNames = []string{"high", "normal", "low"}
+
+// priorityRule assigns the matching requests to a class.
+type priorityRule struct {
+	Class   int
+	Path    *regexp.Regexp
+	Methods *regexp.Regexp
+	Host    *regexp.Regexp
+}
+
+// Matches reports whether the request fulfills all filters of the rule.
+func (r *priorityRule) Matches(req *http.Request) bool {
+	if r.Methods != nil && !r.Methods.MatchString(req.Method) {
+		return false
+	}
+	if r.Path != nil && !r.Path.MatchString(req.URL.Path) {
+		return false
+	}
+	if r.Host != nil && !r.Host.MatchString(req.Host) {
+		return false
+	}
+	return true
+}
+
+type priorityConfig struct {
+	// Class is high, normal or low.
+	Class string `json:"class"`
+	// Path, Methods and Host are regular expressions, all given must match.
+	Path    string `json:"path"`
+	Methods string `json:"methods"`
+	Host    string `json:"host"`
+}
+
+func (pc priorityConfig) build() (*priorityRule, error) {
+	r := &priorityRule{Class: -1}
+	for class, name := range priorityNames {
+		if pc.Class == name {
+			r.Class = class
+		}
+	}
+	if r.Class < 0 {
+		return nil, fmt.Errorf("unknown priority class %q, expected high, normal or low", pc.Class)
+	}
+	var err error
+	if r.Path, err = compileOptional("path", pc.Path); err != nil {
+		return nil, fmt.Errorf("priority %q: %v", pc.Class, err)
+	}
+	if r.Methods, err = compileOptional("methods", pc.Methods); err != nil {
+		return nil, fmt.Errorf("priority %q: %v", pc.Class, err)
+	}
+	if r.Host, err = compileOptional("host", pc.Host); err != nil {
+		return nil, fmt.Errorf("priority %q: %v", pc.Class, err)
+	}
+	return r, nil
+}
+
+// buildPriorities creates the priority rules of the config.
+func (c *config) buildPriorities() (rules []*priorityRule, err error) {
+	for _, pc := range c.Priorities {
+		r, err := pc.build()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// mirrorTask is a mirrored request waiting for a worker.
+type mirrorTask struct {
+	request    *http.Request
+	alt        *backend
+	route      string
+	slow       *slowRequest
+	comparison *statusComparison
+	responses  *responseComparison
+	trace      *debugTrace
+}
+
+func (t *mirrorTask) run() {
+	defer mirrorsInFlight.Done()
+	handleAlternativeRequest(t.request, t.alt, t.route, t.slow, t.comparison, t.responses, t.trace)
+}
+
+var mirrorDropped = newCounterVec("teeproxy_mirror_dropped_total",
+	"Number of mirrored requests dropped because the queue of their priority class was full.", "class")
+
+// mirrorsInFlight counts the mirrored requests dispatched and not completed,
+// the offline sources wait for them before exiting.
+var mirrorsInFlight sync.WaitGroup
+
+// mirrorQueues holds a queue per priority class, nil if mirrored requests
+// are sent right away.
+var mirrorQueues []chan *mirrorTask
+
+// startMirrorWorkers starts the -mirror.workers taking the queued mirrored
+// requests by priority.
+func startMirrorWorkers() {
+	if *mirrorWorkers <= 0 {
+		return
+	}
+	mirrorQueues = make([]chan *mirrorTask, len(priorityNames))
+	for class := range mirrorQueues {
+		mirrorQueues[class] = make(chan *mirrorTask, *mirrorQueue)
+	}
+	for i := 0; i < *mirrorWorkers; i++ {
+		go mirrorWorker(mirrorQueues[priorityHigh], mirrorQueues[priorityNormal], mirrorQueues[priorityLow])
+	}
+	log.Printf("Sending the mirrored requests with %d workers, queueing up to %d requests per priority class", *mirrorWorkers, *mirrorQueue)
+}
+
+func mirrorWorker(high, normal, low chan *mirrorTask) {
+	for {
+		select {
+		case task := <-high:
+			task.run()
+			continue
+		default:
+		}
+		select {
+		case task := <-high:
+			task.run()
+			continue
+		case task := <-normal:
+			task.run()
+			continue
+		default:
+		}
+		select {
+		case task := <-high:
+			task.run()
+		case task := <-normal:
+			task.run()
+		case task := <-low:
+			task.run()
+		}
+	}
+}
+
+// dispatchMirror sends a mirrored request right away or queues it for the
+// workers, dropping it if the queue of its class is full. With -mirror.delay
+// the request is held in the delay buffer first.
+func dispatchMirror(class int, task *mirrorTask) {
+	mirrorsInFlight.Add(1)
+	if delayedMirrors != nil {
+		delayMirror(class, task)
+		return
+	}
+	sendMirror(class, task)
+}
+
+// sendMirror sends a dispatched request or queues it for the workers.
+func sendMirror(class int, task *mirrorTask) {
+	if mirrorQueues == nil {
+		go task.run()
+		return
+	}
+	select {
+	case mirrorQueues[class] <- task:
+	default:
+		mirrorsInFlight.Done()
+		mirrorDropped.Inc(priorityNames[class])
+		if *debug {
+			log.Printf("Dropped mirroring %s %s to %s, the %s priority queue is full",
+				task.request.Method, task.request.URL.RequestURI(), task.alt.Alternative, priorityNames[class])
+		}
+	}
+}
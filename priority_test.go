@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPriority(t *testing.T) {
+	h := newTestHandler("http://localhost")
+	var rules []*priorityRule
+	for _, pc := range []priorityConfig{
+		{Class: "high", Path: "^/checkout", Methods: "POST"},
+		{Class: "low", Path: "^/static/"},
+	} {
+		r, err := pc.build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	h.SetPriorities(rules)
+	for _, test := range []struct {
+		method, path string
+		class        string
+	}{
+		{"POST", "/checkout/pay", "high"},
+		{"GET", "/checkout/pay", "normal"},
+		{"GET", "/static/app.js", "low"},
+		{"GET", "/", "normal"},
+	} {
+		class := priorityNames[h.Priority(httptest.NewRequest(test.method, test.path, nil))]
+		if class != test.class {
+			t.Errorf("Expected '%s' for %s %s, but received '%s'", test.class, test.method, test.path, class)
+		}
+	}
+	if _, err := (priorityConfig{Class: "urgent"}).build(); err == nil {
+		t.Errorf("Expected an error for an unknown class")
+	}
+}
+
+func TestMirrorQueueDropsWhenFull(t *testing.T) {
+	defer func(queues []chan *mirrorTask) { mirrorQueues = queues }(mirrorQueues)
+	// no workers take from the queues, each holds a single task
+	mirrorQueues = []chan *mirrorTask{make(chan *mirrorTask, 1), make(chan *mirrorTask, 1), make(chan *mirrorTask, 1)}
+	request := httptest.NewRequest("GET", "/", nil)
+	alt := &backend{Alternative: "localhost:1"}
+	dispatchMirror(priorityLow, &mirrorTask{request: request, alt: alt})
+	dispatchMirror(priorityLow, &mirrorTask{request: request, alt: alt})
+	dispatchMirror(priorityHigh, &mirrorTask{request: request, alt: alt})
+	if len(mirrorQueues[priorityLow]) != 1 || len(mirrorQueues[priorityHigh]) != 1 {
+		t.Errorf("Expected one queued task per class, but received %d high and %d low",
+			len(mirrorQueues[priorityHigh]), len(mirrorQueues[priorityLow]))
+	}
+	for _, queue := range mirrorQueues {
+		for len(queue) > 0 {
+			<-queue
+			mirrorsInFlight.Done()
+		}
+	}
+	if dropped := mirrorDropped.values[labelKey([]string{"low"})]; dropped < 1 {
+		t.Errorf("Expected a dropped low priority mirror, but received '%v'", dropped)
+	}
+}
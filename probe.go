@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// hostPort adds the default port of the scheme to a host without port.
+func hostPort(scheme, host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if scheme == "https" {
+		return net.JoinHostPort(host, "443")
+	}
+	return net.JoinHostPort(host, "80")
+}
+
+// probeBackend checks that a connection (and TLS handshake for https) to the
+// backend can be established.
+func probeBackend(scheme, host string, timeout time.Duration) error {
+	conn, err := dialBackend(scheme, host, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostPort(t *testing.T) {
+	for input, expectation := range map[string]string{
+		"http localhost":      "localhost:80",
+		"https localhost":     "localhost:443",
+		"http localhost:8080": "localhost:8080",
+		"https [2001:db8::1]": "[2001:db8::1]:443",
+	} {
+		parts := strings.SplitN(input, " ", 2)
+		if address := hostPort(parts[0], parts[1]); address != expectation {
+			t.Errorf("Expected '%s', but received '%s'", expectation, address)
+		}
+	}
+}
+
+func TestProbeBackend(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	host := strings.TrimPrefix(server.URL, "http://")
+	if err := probeBackend("http", host, time.Second); err != nil {
+		t.Errorf("Expected the backend to be reachable, but received '%s'", err)
+	}
+	server.Close()
+	if err := probeBackend("http", host, time.Second); err == nil {
+		t.Errorf("Expected an error for an unreachable backend")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Minimal protobuf wire format helpers, enough to talk to the gRPC health
+// and reflection services without generated code.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+type protoField struct {
+	number   int
+	wireType int
+	varint   uint64
+	bytes    []byte
+}
+
+func appendProtoTag(b []byte, number int, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(number)<<3|uint64(wireType))
+}
+
+func appendProtoString(b []byte, number int, s string) []byte {
+	b = appendProtoTag(b, number, protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+var errProtoTruncated = errors.New("truncated protobuf message")
+
+// parseProto splits a message into its fields.
+func parseProto(b []byte) (fields []protoField, err error) {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errProtoTruncated
+		}
+		b = b[n:]
+		field := protoField{number: int(tag >> 3), wireType: int(tag & 7)}
+		switch field.wireType {
+		case protoVarint:
+			field.varint, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errProtoTruncated
+			}
+			b = b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return nil, errProtoTruncated
+			}
+			field.varint = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case protoBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return nil, errProtoTruncated
+			}
+			field.bytes = b[n : n+int(length)]
+			b = b[n+int(length):]
+		case protoFixed32:
+			if len(b) < 4 {
+				return nil, errProtoTruncated
+			}
+			field.varint = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return nil, errors.New("unsupported protobuf wire type")
+		}
+		fields = append(fields, field)
+	}
+	return
+}
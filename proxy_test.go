@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestHandler creates a handler proxying to the target and mirroring to the alternatives.
+func newTestHandler(target string, alternatives ...string) *handler {
+	h := &handler{Target: target, Randomizer: *rand.New(rand.NewSource(1))}
+	h.SetSchemes()
+	h.Transport = getTransport(h.TargetScheme, time.Second, false)
+	p := &policy{Name: "default", Percent: 100}
+	for _, alt := range alternatives {
+		p.Backends = append(p.Backends, lookupBackend(alt))
+	}
+	h.Alternatives = p.Backends
+	h.SetPolicies([]*policy{p})
+	return h
+}
+
+func TestMirrorHeader(t *testing.T) {
+	defer func(header string) { *mirrorHeader = header }(*mirrorHeader)
+	*mirrorHeader = "X-Teeproxy-Mirrored"
+
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer production.Close()
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer alternate.Close()
+
+	h := newTestHandler(production.URL, alternate.URL)
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if expectation := alternate.Listener.Addr().String(); recorder.Header().Get(*mirrorHeader) != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Header().Get(*mirrorHeader))
+	}
+
+	setMirroringPaused(true, "test")
+	defer setMirroringPaused(false, "test")
+	recorder = httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if expectation := "none"; recorder.Header().Get(*mirrorHeader) != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Header().Get(*mirrorHeader))
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The random mirroring decisions, sampling, backend selection, warm-up and
+// recording, are drawn from sources seeded with -seed, so that a run with a
+// fixed seed and the same sequence of requests decides the same. The
+// deterministic sampling strategy goes further and decides by a hash of the
+// seed and the request, independently of the order of the requests.
+
+// lockedSource makes a rand.Source safe for concurrent requests.
+type lockedSource struct {
+	mu     sync.Mutex
+	source rand.Source64
+}
+
+func newLockedSource(seed int64) *lockedSource {
+	return &lockedSource{source: rand.NewSource(seed).(rand.Source64)}
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.source.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.source.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.source.Seed(seed)
+}
+
+// decisionSeed is the seed of the run, -seed or the start time.
+var decisionSeed = time.Now().UnixNano()
+
+// recordRandomizer samples the recorded and captured exchanges.
+var recordRandomizer = rand.New(newLockedSource(decisionSeed))
+
+// seedDecisions sets the seed of the run, returning the randomizer of the
+// handler.
+func seedDecisions(seed int64) *rand.Rand {
+	if seed != 0 {
+		decisionSeed = seed
+	}
+	log.Printf("Seeding the mirroring decisions with %d, -seed %d reproduces them", decisionSeed, decisionSeed)
+	recordRandomizer = rand.New(newLockedSource(decisionSeed))
+	return rand.New(newLockedSource(decisionSeed))
+}
+
+// deterministicSampler samples the percentage by a hash of the seed, the
+// method, the URI and the -sample.key of the request.
+type deterministicSampler struct{}
+
+func (deterministicSampler) Sample(req *http.Request, percent float64, randomizer *rand.Rand) bool {
+	if percent >= 100 {
+		return true
+	}
+	key := strconv.FormatInt(decisionSeed, 10) + " " + req.Method + " " + req.URL.RequestURI() + " " + sampleKey(req)
+	return percentile(key) < percent
+}
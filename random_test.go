@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSeedDecisions(t *testing.T) {
+	defer func(seed int64) { decisionSeed = seed }(decisionSeed)
+	first, second := seedDecisions(42), seedDecisions(42)
+	for i := 0; i < 10; i++ {
+		if a, b := first.Float64(), second.Float64(); a != b {
+			t.Fatalf("Expected the same decisions with the same seed, but received '%v' and '%v'", a, b)
+		}
+	}
+}
+
+func TestDeterministicSampler(t *testing.T) {
+	defer func(seed int64) { decisionSeed = seed }(decisionSeed)
+	decide := func(seed int64) (decisions string) {
+		seedDecisions(seed)
+		for i := 0; i < 40; i++ {
+			req := httptest.NewRequest("GET", fmt.Sprintf("/items/%d", i), nil)
+			if (deterministicSampler{}).Sample(req, 50, nil) {
+				decisions += "1"
+			} else {
+				decisions += "0"
+			}
+		}
+		return
+	}
+	if a, b := decide(7), decide(7); a != b {
+		t.Errorf("Expected '%s', but received '%s'", a, b)
+	}
+	if a, b := decide(7), decide(8); a == b {
+		t.Errorf("Expected other decisions with another seed, but received '%s' twice", a)
+	}
+}
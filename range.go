@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Partial content differs between backends, e.g. a production target behind
+// a CDN and an origin-only shadow, which floods the comparisons. With
+// -b.range strip, Range and If-Range are removed from the mirrored requests,
+// so that the -b backends answer with full responses, which are not compared
+// to a production 206. With -b.range skip, Range requests are not mirrored.
+
+const (
+	rangeForward = "forward"
+	rangeStrip   = "strip"
+	rangeSkip    = "skip"
+)
+
+var rangeRequestsTotal = newCounterVec("teeproxy_range_requests_total",
+	"Number of Range requests not mirrored as is by action, strip or skip.", "action")
+
+func checkRangePolicy(policy string) error {
+	if policy != rangeForward && policy != rangeStrip && policy != rangeSkip {
+		return fmt.Errorf("unknown range policy %q, expected forward, strip or skip", policy)
+	}
+	return nil
+}
+
+// isRange reports whether the request asks for partial content.
+func isRange(req *http.Request) bool {
+	return req.Header.Get("Range") != ""
+}
+
+// stripRangeHeaders removes the range of the mirrored request.
+func stripRangeHeaders(req *http.Request) {
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+	rangeRequestsTotal.Inc(rangeStrip)
+}
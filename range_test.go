@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRangePolicy(t *testing.T) {
+	defer func(policy string) { *alternateRange = policy }(*alternateRange)
+	defer func(compare bool) { *compareResponses = compare }(*compareResponses)
+	*compareResponses = true
+	defer func(n []normalizer) { compareNormalizers = n }(compareNormalizers)
+	compareNormalizers, _ = parseNormalizers(*compareNormalize)
+
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "digits.txt", time.Time{}, strings.NewReader("0123456789"))
+	}
+	a := httptest.NewServer(http.HandlerFunc(serve))
+	defer a.Close()
+	var mu sync.Mutex
+	var ranges []string
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		serve(w, r)
+	}))
+	defer b.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler(strings.TrimPrefix(a.URL, "http://"), strings.TrimPrefix(b.URL, "http://"))
+	for _, test := range []struct {
+		policy   string
+		mirrored []string
+	}{
+		{rangeForward, []string{"bytes=2-4"}},
+		{rangeStrip, []string{""}},
+		{rangeSkip, nil},
+	} {
+		*alternateRange = test.policy
+		ranges = nil
+		req := httptest.NewRequest("GET", "/range/"+test.policy, nil)
+		req.Header.Set("Range", "bytes=2-4")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		mirrorsInFlight.Wait()
+		if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+			t.Errorf("Expected '206 234', but received '%d %s'", w.Code, w.Body.String())
+		}
+		mu.Lock()
+		if strings.Join(ranges, ",") != strings.Join(test.mirrored, ",") || len(ranges) != len(test.mirrored) {
+			t.Errorf("Expected '%v' mirrored with %s, but received '%v'", test.mirrored, test.policy, ranges)
+		}
+		mu.Unlock()
+	}
+	if mismatches := comparisonsTotal.values[labelKey([]string{"/range/strip", "mismatch"})]; mismatches != 0 {
+		t.Errorf("Expected '0' mismatches, but received '%v'", mismatches)
+	}
+	if skipped := comparisonsTotal.values[labelKey([]string{"/range/strip", "skipped"})]; skipped != 1 {
+		t.Errorf("Expected '1' skipped comparison, but received '%v'", skipped)
+	}
+	if err := checkRangePolicy("drop"); err == nil {
+		t.Errorf("Expected an error for an unknown range policy")
+	}
+}
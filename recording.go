@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recording writes the production exchanges to a sink, one JSON object per
+// line, so that they can be replayed later with `teeproxy replay`. Bodies are
+// recorded as chunks with their offset from the start of the exchange, so
+// streamed (chunked, SSE) bodies keep their timing, and WebSocket sessions
+// are recorded frame by frame.
+
+// exchange is a recorded request and its response.
+type exchange struct {
+	// Version of the envelope, see envelope.proto.
+	Version int         `json:"version"`
+	Time    time.Time   `json:"time"`
+	Side    string      `json:"side"`
+	Backend string      `json:"backend"`
+	Method  string      `json:"method"`
+	URI     string      `json:"uri"`
+	Proto   string      `json:"proto"`
+	Host    string      `json:"host"`
+	Header  http.Header `json:"header"`
+	// HeaderOrder lists the header names as sent by the client with
+	// -preserve-headers, one per header line.
+	HeaderOrder []string `json:"header_order,omitempty"`
+	// RequestChunks is the request body as read by the proxy.
+	RequestChunks []chunk `json:"request_chunks,omitempty"`
+
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	// ResponseChunks is the response body as received from the backend.
+	ResponseChunks []chunk `json:"response_chunks,omitempty"`
+	// Frames of a WebSocket session after the 101 response.
+	Frames []frame `json:"frames,omitempty"`
+	// Truncated is set if a body exceeded -record.max-body.
+	Truncated bool  `json:"truncated,omitempty"`
+	Duration  int64 `json:"duration_us"`
+	// RequestMessages and ResponseMessages are the messages of a gRPC
+	// exchange decoded to JSON arrays, see -grpc.descriptors.
+	RequestMessages  json.RawMessage `json:"request_messages,omitempty"`
+	ResponseMessages json.RawMessage `json:"response_messages,omitempty"`
+}
+
+// chunk is a part of a body read at Offset microseconds into the exchange.
+type chunk struct {
+	Offset int64  `json:"offset_us"`
+	Data   []byte `json:"data"`
+}
+
+// frame is a WebSocket frame sent at Offset microseconds into the exchange.
+type frame struct {
+	Offset     int64  `json:"offset_us"`
+	FromClient bool   `json:"from_client"`
+	Opcode     int    `json:"opcode"`
+	Final      bool   `json:"final"`
+	Length     int64  `json:"length"`
+	Data       []byte `json:"data,omitempty"`
+}
+
+// exchangeSink stores recorded exchanges.
+type exchangeSink interface {
+	Write(e *exchange) error
+	Close() error
+}
+
+// fileSink appends the exchanges as JSON lines or protobuf envelopes to a file.
+type fileSink struct {
+	file   *os.File
+	writer *bufio.Writer
+	format string
+}
+
+func newFileSink(filename, format string) (*fileSink, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{file: file, writer: bufio.NewWriter(file), format: format}, nil
+}
+
+// createFileSink writes the exchanges to a new file only the user can read,
+// failing if the file exists.
+func createFileSink(filename, format string) (*fileSink, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{file: file, writer: bufio.NewWriter(file), format: format}, nil
+}
+
+func (s *fileSink) Write(e *exchange) error {
+	data, err := encodeExchange(e, s.format)
+	if err == nil {
+		s.writer.Write(data)
+		err = s.writer.Flush()
+	}
+	if err != nil {
+		recordingsDropped.Inc("record")
+	}
+	return err
+}
+
+func (s *fileSink) Close() error {
+	s.writer.Flush()
+	return s.file.Close()
+}
+
+// segmentSink writes the exchanges to a store in segments of up to
+// recordSegmentSize exchanges, named by time so that they sort in order.
+type segmentSink struct {
+	store    blobStore
+	format   string
+	hostname string
+
+	mu       sync.Mutex
+	buffer   bytes.Buffer
+	count    int
+	sequence int
+}
+
+// recordSegmentSize is the number of exchanges per segment, incomplete
+// segments are written every recordSegmentInterval.
+const (
+	recordSegmentSize     = 1000
+	recordSegmentInterval = 10 * time.Second
+)
+
+func newSegmentSink(store blobStore, format string) *segmentSink {
+	hostname, _ := os.Hostname()
+	return &segmentSink{store: store, format: format, hostname: hostname}
+}
+
+func (s *segmentSink) Write(e *exchange) error {
+	data, err := encodeExchange(e, s.format)
+	if err != nil {
+		recordingsDropped.Inc("record")
+		return err
+	}
+	s.mu.Lock()
+	s.buffer.Write(data)
+	s.count++
+	full := s.count >= recordSegmentSize
+	s.mu.Unlock()
+	if full {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Flush writes the exchanges of the incomplete segment.
+func (s *segmentSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		return nil
+	}
+	extension := "ndjson"
+	if s.format == "protobuf" {
+		extension = "pb"
+	}
+	s.sequence++
+	key := fmt.Sprintf("%s-%s-%d.%s", time.Now().UTC().Format("20060102T150405.000000Z"), s.hostname, s.sequence, extension)
+	err := s.store.Put(key, append([]byte(nil), s.buffer.Bytes()...))
+	if err != nil {
+		recordingsDropped.Add(float64(s.count), "record")
+	}
+	s.buffer.Reset()
+	s.count = 0
+	return err
+}
+
+func (s *segmentSink) Close() error {
+	return s.Flush()
+}
+
+// openRecording opens a recording file or store for reading.
+func openRecording(name string) (io.ReadCloser, error) {
+	if !isStoreLocation(name) {
+		return os.Open(name)
+	}
+	store, err := openStore(name)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := storeReader(store)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(reader), nil
+}
+
+// asyncSink moves writing to a sink off the request path, exchanges are
+// dropped when its queue is full.
+type asyncSink struct {
+	name      string
+	sink      exchangeSink
+	exchanges chan *exchange
+	done      chan struct{}
+}
+
+var recordingsDropped = newCounterVec("teeproxy_recordings_dropped_total",
+	"Number of recorded exchanges dropped because the sink could not keep up or failed.", "sink")
+
+func newAsyncSink(name string, sink exchangeSink, size int) *asyncSink {
+	s := &asyncSink{name: name, sink: sink, exchanges: make(chan *exchange, size), done: make(chan struct{})}
+	go s.run()
+	return s
+}
+
+func (s *asyncSink) run() {
+	defer close(s.done)
+	for e := range s.exchanges {
+		if err := s.sink.Write(e); err != nil {
+			log.Printf("Failed to write to the %s sink: %s", s.name, err)
+		}
+	}
+}
+
+func (s *asyncSink) Write(e *exchange) error {
+	select {
+	case s.exchanges <- e:
+	default:
+		recordingsDropped.Inc(s.name)
+	}
+	return nil
+}
+
+// Close writes the queued exchanges and closes the sink.
+func (s *asyncSink) Close() error {
+	close(s.exchanges)
+	<-s.done
+	return s.sink.Close()
+}
+
+// recordSink receives the recorded production exchanges, nil if disabled.
+var recordSink exchangeSink
+
+// stopRecording writes the queued exchanges before exiting.
+func stopRecording() {
+	if recordSink != nil {
+		recordSink.Close()
+	}
+	if captureSink != nil {
+		captureSink.Close()
+	}
+	if analyzeSink != nil {
+		analyzeSink.Close()
+	}
+}
+
+// startRecording opens the -record file.
+func startRecording() {
+	if !validSinkFormat(*recordFormat) {
+		fatalf("Invalid -record.format %s, expected json or protobuf", *recordFormat)
+	}
+	var sink exchangeSink
+	if isStoreLocation(*recordFile) {
+		store, err := openStore(*recordFile)
+		if err != nil {
+			fatalf("Failed to open recording %s: %s", *recordFile, err)
+		}
+		segments := newSegmentSink(store, *recordFormat)
+		go func() {
+			for range time.Tick(recordSegmentInterval) {
+				if err := segments.Flush(); err != nil {
+					log.Printf("Failed to write to the record sink: %s", err)
+				}
+			}
+		}()
+		sink = segments
+	} else {
+		file, err := newFileSink(*recordFile, *recordFormat)
+		if err != nil {
+			fatalf("Failed to open recording %s: %s", *recordFile, err)
+		}
+		sink = file
+	}
+	anonymized, err := withAnonymizer(sink, *recordAnonymize)
+	if err != nil {
+		fatalf("Invalid -record.anonymize: %s", err)
+	}
+	recordSink = newAsyncSink("record", anonymized, 1024)
+	log.Printf("Recording %v%% of the production exchanges to %s", *recordPercent, *recordFile)
+}
+
+// recording collects an exchange while it is proxied.
+type recording struct {
+	sink  exchangeSink
+	start time.Time
+	limit int64
+
+	mu       sync.Mutex
+	exchange exchange
+	recorded int64
+}
+
+// newRecording starts recording the request to the sink if sampled at the
+// percentage, nil otherwise.
+func newRecording(sink exchangeSink, percent float64, side string, req *http.Request, backend string) *recording {
+	if sink == nil || percent < 100 && recordRandomizer.Float64()*100 >= percent {
+		return nil
+	}
+	now := time.Now()
+	return &recording{
+		sink:  sink,
+		start: now,
+		limit: int64(*recordMaxBody),
+		exchange: exchange{
+			Time:    now.UTC(),
+			Side:    side,
+			Backend: backend,
+			Method:  req.Method,
+			URI:     req.URL.RequestURI(),
+			Proto:   req.Proto,
+			Host:    req.Host,
+			Header:  req.Header.Clone(),
+
+			HeaderOrder: headerOrder(req),
+		},
+	}
+}
+
+func (r *recording) offset() int64 {
+	return time.Since(r.start).Microseconds()
+}
+
+// take returns the part of data still fitting into the limit.
+func (r *recording) take(data []byte) []byte {
+	if remaining := r.limit - r.recorded; int64(len(data)) > remaining {
+		r.exchange.Truncated = true
+		data = data[:remaining]
+	}
+	r.recorded += int64(len(data))
+	return append([]byte(nil), data...)
+}
+
+func (r *recording) addChunk(chunks *[]chunk, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if data = r.take(data); len(data) > 0 {
+		*chunks = append(*chunks, chunk{Offset: r.offset(), Data: data})
+	}
+}
+
+func (r *recording) addFrame(f frame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f.Offset = r.offset()
+	f.Data = r.take(f.Data)
+	r.exchange.Frames = append(r.exchange.Frames, f)
+}
+
+// recordingBody records the chunks read from a body.
+type recordingBody struct {
+	io.ReadCloser
+	recording *recording
+	chunks    *[]chunk
+}
+
+func (b *recordingBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if n > 0 {
+		b.recording.addChunk(b.chunks, p[:n])
+	}
+	return
+}
+
+// recordRequestBody replaces the request body with one being recorded.
+func (r *recording) recordRequestBody(req *http.Request) {
+	if r == nil || req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	req.Body = &recordingBody{ReadCloser: req.Body, recording: r, chunks: &r.exchange.RequestChunks}
+}
+
+// recordResponse records the response and returns its body being recorded.
+func (r *recording) recordResponse(resp *http.Response, body io.ReadCloser) io.ReadCloser {
+	if r == nil {
+		return body
+	}
+	r.exchange.Status = resp.StatusCode
+	r.exchange.ResponseHeader = resp.Header.Clone()
+	return &recordingBody{ReadCloser: body, recording: r, chunks: &r.exchange.ResponseChunks}
+}
+
+// finish sends the exchange to the sink.
+func (r *recording) finish() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.exchange.Duration = r.offset()
+	e := r.exchange
+	r.mu.Unlock()
+	grpcDecoder.decodeExchange(&e)
+	r.sink.Write(&e)
+}
+
+// flushWriter flushes every write, so that streamed responses like server
+// sent events reach the client without delay.
+type flushWriter struct {
+	w          io.Writer
+	controller *http.ResponseController
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err == nil {
+		f.controller.Flush()
+	}
+	return n, err
+}
+
+// isStreaming reports whether the response body is streamed, i.e. sent in
+// chunks of unknown total length.
+func isStreaming(resp *http.Response) bool {
+	return resp.ContentLength < 0 || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink keeps the recorded exchanges for the tests.
+type memorySink struct {
+	mu        sync.Mutex
+	exchanges []*exchange
+}
+
+func (s *memorySink) Write(e *exchange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exchanges = append(s.exchanges, e)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func (s *memorySink) wait(t *testing.T) *exchange {
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		if len(s.exchanges) > 0 {
+			defer s.mu.Unlock()
+			return s.exchanges[0]
+		}
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Expected the exchange to be recorded")
+	return nil
+}
+
+func TestRecordStreamedResponse(t *testing.T) {
+	sink := &memorySink{}
+	defer func(s exchangeSink) { recordSink = s }(recordSink)
+	recordSink = sink
+
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer production.Close()
+
+	w := httptest.NewRecorder()
+	newTestHandler(production.URL).ServeHTTP(w, httptest.NewRequest("GET", "/events", nil))
+	if expectation := "data: 0\n\ndata: 1\n\ndata: 2\n\n"; w.Body.String() != expectation {
+		t.Errorf("Expected '%q', but received '%q'", expectation, w.Body.String())
+	}
+	if !w.Flushed {
+		t.Errorf("Expected the streamed response to be flushed")
+	}
+
+	e := sink.wait(t)
+	if len(e.ResponseChunks) != 3 {
+		t.Fatalf("Expected '3' chunks, but received '%d'", len(e.ResponseChunks))
+	}
+	if e.ResponseChunks[2].Offset-e.ResponseChunks[0].Offset < 30000 {
+		t.Errorf("Expected the chunks to keep their timing, but received offsets %d and %d", e.ResponseChunks[0].Offset, e.ResponseChunks[2].Offset)
+	}
+}
+
+func TestRecordWebSocket(t *testing.T) {
+	sink := &memorySink{}
+	defer func(s exchangeSink) { recordSink = s }(recordSink)
+	recordSink = sink
+
+	// the production target echoes one text frame
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buffer, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		header := make([]byte, 6)
+		buffer.Read(header[:2])
+		buffer.Read(header[2:])
+		payload := make([]byte, header[1]&0x7f)
+		buffer.Read(payload)
+		for i := range payload {
+			payload[i] ^= header[2+i%4]
+		}
+		conn.Write(appendFrame(nil, frame{Final: true, Opcode: 1, Data: payload}, false, [4]byte{}))
+	}))
+	defer production.Close()
+	proxy := httptest.NewServer(newTestHandler(production.URL))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /chat HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected '101', but received '%d'", response.StatusCode)
+	}
+	conn.Write(appendFrame(nil, frame{Final: true, Opcode: 1, Data: []byte("hello")}, true, [4]byte{1, 2, 3, 4}))
+	echo := make([]byte, 7)
+	if _, err := reader.Read(echo); err != nil || string(echo[2:]) != "hello" {
+		t.Errorf("Expected 'hello', but received '%q'", echo)
+	}
+	conn.Close()
+
+	e := sink.wait(t)
+	if len(e.Frames) != 2 {
+		t.Fatalf("Expected '2' frames, but received '%d'", len(e.Frames))
+	}
+	for i, fromClient := range []bool{true, false} {
+		if f := e.Frames[i]; f.FromClient != fromClient || string(f.Data) != "hello" || f.Opcode != 1 {
+			t.Errorf("Expected frame 'hello' from client %v, but received '%+v'", fromClient, f)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var received []string
+	var mutex sync.Mutex
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		received = append(received, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		mutex.Unlock()
+	}))
+	defer target.Close()
+
+	filename := filepath.Join(t.TempDir(), "recording.ndjson")
+	now := time.Now()
+	var lines []string
+	for _, e := range []exchange{
+		{Time: now, Method: "POST", URI: "/upload", Host: "proxy", Status: 200,
+			RequestChunks: []chunk{{Offset: 0, Data: []byte("part1,")}, {Offset: 1000, Data: []byte("part2")}}},
+		{Time: now.Add(time.Millisecond), Method: "GET", URI: "/items?page=2", Host: "proxy", Status: 200},
+	} {
+		data, _ := json.Marshal(e)
+		lines = append(lines, string(data))
+	}
+	if err := ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(target string) { *targetProduction = target }(*targetProduction)
+	*targetProduction = target.URL
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	code := replayCommand(filename)
+	os.Stdout = stdout
+	if code != 0 {
+		t.Errorf("Expected '0', but received '%d'", code)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	sort.Strings(received)
+	expectation := "[GET /items?page=2  POST /upload part1,part2]"
+	if fmt.Sprint(received) != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, received)
+	}
+}
+
+func TestCreateFileSinkRefusesExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.ndjson")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createFileSink(path, "json"); err == nil {
+		t.Errorf("Expected an error for an existing file")
+	}
+}
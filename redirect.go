@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// By default the redirects of the backends are returned to the client as
+// they are. With -a.redirects.follow, -b.redirects.follow or the redirects of
+// the config file, teeproxy follows up to that many hops itself, so that
+// internal hostnames of the backends do not reach the clients. A 303, and a
+// 301 or 302 answering a POST, is followed with a GET, the other redirects
+// of requests with a body are returned, as their body cannot be sent again.
+// With -a.redirects.rewrite, a Location pointing to the production target
+// is rewritten to the host the client requested.
+
+var redirectsFollowed = newCounterVec("teeproxy_redirects_followed_total",
+	"Number of redirects followed by teeproxy instead of returning them, by backend.", "backend")
+
+type redirectConfig struct {
+	// Backend is the URL of the alternate backend, as in the policies.
+	Backend string `json:"backend"`
+	// Follow is the number of redirects followed, 0 returns them.
+	Follow int `json:"follow"`
+}
+
+// redirectTransport follows up to limit() redirects.
+type redirectTransport struct {
+	http.RoundTripper
+	limit func() int
+}
+
+func withRedirects(transport http.RoundTripper, limit func() int) http.RoundTripper {
+	return &redirectTransport{RoundTripper: transport, limit: limit}
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backend := backendLabel(req)
+	response, err := t.RoundTripper.RoundTrip(req)
+	for hops := 0; err == nil && hops < t.limit(); hops++ {
+		next := redirectRequest(req, response)
+		if next == nil {
+			break
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+		response.Body.Close()
+		redirectsFollowed.Inc(backend)
+		req = next
+		response, err = t.RoundTripper.RoundTrip(req)
+	}
+	return response, err
+}
+
+func productionRedirectLimit() int {
+	return *productionRedirects
+}
+
+// redirectRequest returns the request following the redirect, nil if the
+// response is no redirect to follow.
+func redirectRequest(req *http.Request, response *http.Response) *http.Request {
+	switch response.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil
+	}
+	location := response.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	target, err := req.URL.Parse(location)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+		return nil
+	}
+	method := req.Method
+	if response.StatusCode == http.StatusSeeOther && method != "HEAD" ||
+		(response.StatusCode == http.StatusMovedPermanently || response.StatusCode == http.StatusFound) && method == "POST" {
+		method = "GET"
+	}
+	next := req.Clone(req.Context())
+	next.Method = method
+	next.URL = target
+	next.RequestURI = ""
+	if method != req.Method {
+		next.Body = nil
+		next.GetBody = nil
+		next.ContentLength = 0
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+		next.Header.Del("Content-Encoding")
+	} else if !isBodyless(req) {
+		if req.GetBody == nil {
+			return nil
+		}
+		if next.Body, err = req.GetBody(); err != nil {
+			return nil
+		}
+	}
+	if target.Host != req.URL.Host {
+		// the credentials are for the backend
+		next.Host = target.Host
+		next.Header.Del("Authorization")
+		next.Header.Del("Cookie")
+		next = next.WithContext(context.WithValue(next.Context(), redirectedAwayKey{}, true))
+	}
+	return next
+}
+
+type redirectedAwayKey struct{}
+
+// redirectedAway reports whether the request follows a redirect to another
+// host, which the signing and the OAuth2 token of the backend are not for.
+func redirectedAway(req *http.Request) bool {
+	away, _ := req.Context().Value(redirectedAwayKey{}).(bool)
+	return away
+}
+
+// requestScheme is the scheme the client connected with.
+func requestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// buildRedirectLimits builds the redirects followed per backend,
+// -b.redirects.follow applies to the -b backends and the config file to the
+// backends listed. The returned func sets them on the backends.
+func buildRedirectLimits(configs []redirectConfig, altServers []*backend) (func(), error) {
+	limits := make(map[*backend]int)
+	for _, b := range altServers {
+		limits[b] = *alternateRedirects
+	}
+	for _, config := range configs {
+		if config.Follow < 0 {
+			return nil, fmt.Errorf("redirects followed by %s must not be negative", config.Backend)
+		}
+		b, err := parseBackend(config.Backend)
+		if err != nil {
+			return nil, err
+		}
+		limits[b] = config.Follow
+	}
+	return func() {
+		for _, b := range registeredBackends() {
+			b.setRedirectLimit(limits[b])
+		}
+	}, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func redirectingServer() *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/old":
+			http.Redirect(w, r, server.URL+"/new?x=1", http.StatusMovedPermanently)
+		case "/submit":
+			http.Redirect(w, r, "/new", http.StatusSeeOther)
+		default:
+			fmt.Fprintf(w, "%s %s", r.Method, r.URL.RequestURI())
+		}
+	}))
+	return server
+}
+
+func TestFollowRedirects(t *testing.T) {
+	defer func(v int) { *productionRedirects = v }(*productionRedirects)
+	*productionRedirects = 2
+	server := redirectingServer()
+	defer server.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler(strings.TrimPrefix(server.URL, "http://"))
+	h.Transport = withRedirects(h.Transport, productionRedirectLimit)
+	for _, test := range []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{"GET", "/old", http.StatusOK, "GET /new?x=1"},
+		{"POST", "/submit", http.StatusOK, "GET /new"},
+		{"GET", "/loop", http.StatusFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader("")))
+		if w.Code != test.status || test.body != "" && w.Body.String() != test.body {
+			t.Errorf("Expected '%d %s', but received '%d %s'", test.status, test.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	defer func(r *hostRewriter) { responseHosts = r }(responseHosts)
+	responseHosts = newHostRewriter("", "", true)
+	server := redirectingServer()
+	defer server.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler(strings.TrimPrefix(server.URL, "http://"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com/old", nil))
+	if location := w.Header().Get("Location"); location != "http://www.example.com/new?x=1" {
+		t.Errorf("Expected '%s', but received '%s'", "http://www.example.com/new?x=1", location)
+	}
+
+	for location, expectation := range map[string]string{
+		"https://other.example.com/new": "https://other.example.com/new",
+		"http://backend:8080/new":       "http://public.example.com/new",
+		"http://app.internal/new":       "http://public.example.com/new",
+		"/relative":                     "/relative",
+	} {
+		header := http.Header{"Location": {location}}
+		newHostRewriter("app.internal", "public.example.com", true).Rewrite(header, httptest.NewRequest("GET", "/", nil), "www.example.com", "backend:8080/production")
+		if rewritten := header.Get("Location"); rewritten != expectation {
+			t.Errorf("Expected '%s', but received '%s'", expectation, rewritten)
+		}
+	}
+}
+
+func TestRedirectLimits(t *testing.T) {
+	b := lookupBackend("http://localhost:9094")
+	setRedirectLimits, err := buildRedirectLimits([]redirectConfig{{Backend: "http://localhost:9094", Follow: 3}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRedirectLimits()
+	if limit := b.RedirectLimit(); limit != 3 {
+		t.Errorf("Expected '3', but received '%d'", limit)
+	}
+	if _, err := buildRedirectLimits([]redirectConfig{{Backend: "http://localhost:9094", Follow: -1}}, nil); err == nil {
+		t.Errorf("Expected an error for a negative limit")
+	}
+	if limit := b.RedirectLimit(); limit != 3 {
+		t.Errorf("Expected the limit to be kept after a failed build, but received '%d'", limit)
+	}
+	b.setRedirectLimit(0)
+}
+
+func TestCrossHostRedirectDropsCredentials(t *testing.T) {
+	foreign := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("Authorization"), r.Header.Get("X-Signature"))
+	}))
+	defer foreign.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/away" {
+			http.Redirect(w, r, foreign.URL+"/landed", http.StatusFound)
+			return
+		}
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("Authorization"), r.Header.Get("X-Signature"))
+	}))
+	defer server.Close()
+	defer evictIdleConnections()
+
+	transport := withRedirects(withSigner(http.DefaultTransport, &signer{HMACKey: newSecret("key"), HMACHeader: "X-Signature"}),
+		func() int { return 1 })
+	for path, signed := range map[string]bool{"/here": true, "/away": false} {
+		req := httptest.NewRequest("GET", server.URL+path, nil)
+		req.RequestURI = ""
+		req.Header.Set("Authorization", "Bearer backend")
+		response, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		parts := strings.SplitN(string(body), "|", 2)
+		if (parts[0] != "") != signed || (parts[1] != "") != signed {
+			t.Errorf("Expected the credentials to be sent '%v' for %s, but received '%s'", signed, path, body)
+		}
+	}
+}
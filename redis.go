@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal Redis client speaking RESP, used to share the runtime state of
+// mirroring (pause, percentage and ramp) between the replicas of a fleet.
+
+type redisClient struct {
+	addr     string
+	password *secret
+	db       int
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// newRedisClient parses host:port or redis://[:password@]host:port[/db],
+// -redis.password replacing the password of the URL.
+func newRedisClient(address string, timeout time.Duration) (*redisClient, error) {
+	c := &redisClient{addr: address, timeout: timeout}
+	if *redisPassword != "" {
+		c.password = newSecret(*redisPassword)
+	}
+	if !strings.Contains(address, "://") {
+		return c, nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		// the url.Error would repeat the address with its password
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("invalid URL: %v", err)
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+	c.addr = u.Host
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil && c.password == nil {
+		password, _ := u.User.Password()
+		c.password = newSecret(password)
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %s", db)
+		}
+	}
+	return c, nil
+}
+
+// Do sends a command and returns its reply, a string, int64, nil,
+// []interface{} or redisError.
+func (c *redisClient) Do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+func (c *redisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	password, err := c.password.Value()
+	if err != nil {
+		conn.Close()
+		c.conn = nil
+		return err
+	}
+	if password != "" {
+		if _, err = c.do("AUTH", password); err != nil {
+			conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	if c.db != 0 {
+		if _, err = c.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.reader)
+}
+
+var errRedisProtocol = errors.New("redis: protocol error")
+
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errRedisProtocol
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, errRedisProtocol
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		elements := make([]interface{}, count)
+		for i := range elements {
+			if elements[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return elements, nil
+	}
+	return nil, errRedisProtocol
+}
+
+// sharedState is the Redis client of -redis, nil if the state is local.
+var sharedState *redisClient
+
+const sharedStateSource = "redis"
+
+// shareState stores a changed runtime value in the hash -redis.key so that
+// the other replicas apply it too.
+func shareState(source, field, value string) {
+	if sharedState == nil || source == sharedStateSource {
+		return
+	}
+	if _, err := sharedState.Do("HSET", *redisKey, field, value); err != nil {
+		log.Printf("Failed to share the mirroring %s: %s", field, err)
+	}
+}
+
+// loadSharedState applies the runtime values stored by any replica.
+func loadSharedState() error {
+	reply, err := sharedState.Do("HGETALL", *redisKey)
+	if err != nil {
+		return err
+	}
+	fields, _ := reply.([]interface{})
+	for i := 0; i+1 < len(fields); i += 2 {
+		field, _ := fields[i].(string)
+		value, _ := fields[i+1].(string)
+		applySharedState(field, value)
+	}
+	return nil
+}
+
+func applySharedState(field, value string) {
+	switch field {
+	case "paused":
+		if pause, err := strconv.ParseBool(value); err == nil {
+			setMirroringPaused(pause, sharedStateSource)
+		}
+	case "percent", "ramp":
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return
+		}
+		if field == "percent" {
+			setMirrorPercent(v, sharedStateSource)
+		} else {
+			setMirrorRamp(v, sharedStateSource)
+		}
+	}
+}
+
+// startSharedState connects to -redis and polls the shared runtime state.
+func startSharedState() {
+	interval := time.Duration(*redisInterval) * time.Millisecond
+	client, err := newRedisClient(*redisAddress, interval)
+	if err != nil {
+		fatalf("Invalid -redis %s: %s", redactURL(*redisAddress, false), err)
+	}
+	sharedState = client
+	if err := loadSharedState(); err != nil {
+		log.Printf("Failed to load the shared mirroring state: %s", err)
+	}
+	log.Printf("Sharing the mirroring state in %s key %s", client.addr, *redisKey)
+	go func() {
+		failing := false
+		for range time.Tick(interval) {
+			err := loadSharedState()
+			if err != nil && !failing {
+				log.Printf("Failed to load the shared mirroring state: %s", err)
+			}
+			failing = err != nil
+		}
+	}()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves HSET, HGET, HDEL, HKEYS and HGETALL of a single hash.
+func fakeRedis(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	hash := make(map[string]string)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			for {
+				reply, err := readRedisReply(reader)
+				if err != nil {
+					conn.Close()
+					break
+				}
+				var args []string
+				for _, arg := range reply.([]interface{}) {
+					args = append(args, arg.(string))
+				}
+				switch strings.ToUpper(args[0]) {
+				case "HSET":
+					hash[args[2]] = args[3]
+					fmt.Fprint(conn, ":1\r\n")
+				case "HGET":
+					if v, ok := hash[args[2]]; ok {
+						fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+					} else {
+						fmt.Fprint(conn, "$-1\r\n")
+					}
+				case "HDEL":
+					delete(hash, args[2])
+					fmt.Fprint(conn, ":1\r\n")
+				case "HKEYS":
+					fmt.Fprintf(conn, "*%d\r\n", len(hash))
+					for k := range hash {
+						fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(k), k)
+					}
+				case "HGETALL":
+					fmt.Fprintf(conn, "*%d\r\n", 2*len(hash))
+					for k, v := range hash {
+						fmt.Fprintf(conn, "$%d\r\n%s\r\n$%d\r\n%s\r\n", len(k), k, len(v), v)
+					}
+				default:
+					fmt.Fprint(conn, "-ERR unknown command\r\n")
+				}
+			}
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestSharedState(t *testing.T) {
+	client, err := newRedisClient(fakeRedis(t), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(c *redisClient) { sharedState = c }(sharedState)
+	sharedState = client
+	defer setMirrorRamp(100, "test")
+	defer setMirroringPaused(false, "test")
+
+	setMirrorRamp(25, "test")
+	if _, err := client.Do("HSET", *redisKey, "paused", "true"); err != nil {
+		t.Fatal(err)
+	}
+	setMirrorRamp(100, sharedStateSource)
+	if err := loadSharedState(); err != nil {
+		t.Fatal(err)
+	}
+	if !mirroringPaused() || mirrorRamp() != 25 {
+		t.Errorf("Expected paused mirroring with ramp '25', but received '%v' and '%v'", mirroringPaused(), mirrorRamp())
+	}
+
+	if _, err := client.Do("PING"); err == nil || err.Error() != "redis: ERR unknown command" {
+		t.Errorf("Expected the error reply, but received '%v'", err)
+	}
+}
+
+func TestRedisURL(t *testing.T) {
+	client, err := newRedisClient("redis://:secret@cache/2", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, _ := client.password.Value()
+	if client.addr != "cache:6379" || password != "secret" || client.db != 2 {
+		t.Errorf("Expected 'cache:6379' 'secret' '2', but received '%s' '%s' '%d'", client.addr, password, client.db)
+	}
+}
+
+func TestRedisURLErrorsHidePassword(t *testing.T) {
+	for _, address := range []string{"redis://:secret@cache:port/2", "rediss://:secret@cache/2", "redis://:secret@cache/db"} {
+		if _, err := newRedisClient(address, time.Second); err == nil || strings.Contains(err.Error(), "secret") {
+			t.Errorf("Expected an error without the password for %s, but received '%v'", address, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -config and the files it includes can be remote, so that a fleet of
+// proxies is managed centrally:
+//
+//	http(s)://host/path     fetched with GET
+//	s3://bucket/key         fetched from S3, signed with the AWS credentials
+//	consul://host:port/key  the raw value of the Consul KV key, with
+//	                        $CONSUL_HTTP_TOKEN and over HTTPS if $CONSUL_HTTP_SSL
+//
+// The remote files are fetched once and kept, so that every part of the
+// configuration is built from the same version. On SIGHUP and every
+// -config.poll seconds they are fetched again and a change is applied like a
+// reload. A failed fetch keeps the last version.
+
+var configFetchesTotal = newCounterVec("teeproxy_config_fetches_total",
+	"Number of fetches of the remote config files by result, unchanged, changed or error.", "result")
+
+// s3ConfigEndpoint returns the S3 endpoint of the region, replaced by the
+// tests.
+var s3ConfigEndpoint = func(region string) string {
+	return "https://s3." + region + ".amazonaws.com"
+}
+
+// isRemoteConfig reports whether the config file is fetched remotely.
+func isRemoteConfig(name string) bool {
+	for _, scheme := range []string{"http://", "https://", "s3://", "consul://"} {
+		if strings.HasPrefix(name, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// includedConfig resolves an include of the config file, relative to the
+// including file unless absolute.
+func includedConfig(including, include string) string {
+	if isRemoteConfig(include) {
+		return include
+	}
+	if isRemoteConfig(including) {
+		u, err := url.Parse(including)
+		if err != nil {
+			return include
+		}
+		if path.IsAbs(include) {
+			u.Path = include
+		} else {
+			u.Path = path.Join(path.Dir(u.Path), include)
+		}
+		u.RawPath = ""
+		return u.String()
+	}
+	if filepath.IsAbs(include) {
+		return include
+	}
+	return filepath.Join(filepath.Dir(including), include)
+}
+
+// remoteConfigs holds the last fetched version of the remote config files.
+var remoteConfigs = struct {
+	sync.Mutex
+	contents map[string][]byte
+}{contents: make(map[string][]byte)}
+
+// readConfig returns the content of a local or remote config file.
+func readConfig(name string) ([]byte, error) {
+	if !isRemoteConfig(name) {
+		return ioutil.ReadFile(name)
+	}
+	remoteConfigs.Lock()
+	content, ok := remoteConfigs.contents[name]
+	remoteConfigs.Unlock()
+	if ok {
+		return content, nil
+	}
+	content, err := fetchConfig(name)
+	if err != nil {
+		configFetchesTotal.Inc("error")
+		return nil, err
+	}
+	configFetchesTotal.Inc("changed")
+	remoteConfigs.Lock()
+	remoteConfigs.contents[name] = content
+	remoteConfigs.Unlock()
+	return content, nil
+}
+
+// fetchConfig downloads a remote config file.
+func fetchConfig(name string) ([]byte, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	var req *http.Request
+	switch u.Scheme {
+	case "s3":
+		credentials := awsCredentials{
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if credentials.AccessKey == "" || credentials.SecretKey == "" {
+			return nil, fmt.Errorf("fetching %s: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set", name)
+		}
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		if req, err = http.NewRequest("GET", s3ConfigEndpoint(region)+"/"+u.Host+u.EscapedPath(), nil); err != nil {
+			return nil, err
+		}
+		signV4(req, sha256Hex(nil), credentials, region, "s3", time.Now())
+	case "consul":
+		scheme := "http"
+		if os.Getenv("CONSUL_HTTP_SSL") == "true" {
+			scheme = "https"
+		}
+		if req, err = http.NewRequest("GET", scheme+"://"+u.Host+"/v1/kv"+u.EscapedPath()+"?raw", nil); err != nil {
+			return nil, err
+		}
+		if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+			req.Header.Set("X-Consul-Token", token)
+		}
+	default:
+		if req, err = http.NewRequest("GET", name, nil); err != nil {
+			return nil, err
+		}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			req.SetBasicAuth(u.User.Username(), password)
+		}
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", redactURL(name, false), err)
+	}
+	defer response.Body.Close()
+	content, err := ioutil.ReadAll(io.LimitReader(response.Body, 16<<20))
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", redactURL(name, false), err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", redactURL(name, false), response.Status)
+	}
+	return content, nil
+}
+
+// pollRemoteConfigs fetches the remote config files again and reports whether
+// any changed.
+func pollRemoteConfigs() bool {
+	remoteConfigs.Lock()
+	var names []string
+	for name := range remoteConfigs.contents {
+		names = append(names, name)
+	}
+	remoteConfigs.Unlock()
+	changed := false
+	for _, name := range names {
+		content, err := fetchConfig(name)
+		if err != nil {
+			configFetchesTotal.Inc("error")
+			log.Printf("Failed to poll the config: %s", err)
+			continue
+		}
+		remoteConfigs.Lock()
+		if bytes.Equal(remoteConfigs.contents[name], content) {
+			remoteConfigs.Unlock()
+			configFetchesTotal.Inc("unchanged")
+			continue
+		}
+		remoteConfigs.contents[name] = content
+		remoteConfigs.Unlock()
+		configFetchesTotal.Inc("changed")
+		log.Printf("Config %s changed", redactURL(name, false))
+		changed = true
+	}
+	return changed
+}
+
+// startConfigPolling reloads whenever a remote config file changes.
+func startConfigPolling(reload func(source string)) {
+	if !isRemoteConfig(*configFile) || *configPoll <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(*configPoll) * time.Second) {
+			if pollRemoteConfigs() {
+				reload("remote config")
+			}
+		}
+	}()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRemoteConfig(t *testing.T) {
+	var mu sync.Mutex
+	files := map[string]string{
+		"/configs/teeproxy.json":     `{"include": ["shared/rules.json"], "policies": [{"name": "search", "percent": 10, "backends": ["http://shadow:8080"]}]}`,
+		"/configs/shared/rules.json": `{"anonymization": [{"name": "shared", "strip_headers": ["Cookie"]}]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+	defer evictIdleConnections()
+
+	c, err := loadConfig(server.URL + "/configs/teeproxy.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Policies) != 1 || *c.Policies[0].Percent != 10 || len(c.Anonymization) != 1 {
+		t.Errorf("Expected the remote policy and the included profile, but received '%+v'", c)
+	}
+	if pollRemoteConfigs() {
+		t.Errorf("Expected no change")
+	}
+
+	mu.Lock()
+	files["/configs/teeproxy.json"] = strings.Replace(files["/configs/teeproxy.json"], `"percent": 10`, `"percent": 20`, 1)
+	mu.Unlock()
+	if c, err = loadConfig(server.URL + "/configs/teeproxy.json"); err != nil || *c.Policies[0].Percent != 10 {
+		t.Errorf("Expected the fetched version to be kept until polled")
+	}
+	if !pollRemoteConfigs() {
+		t.Errorf("Expected a change")
+	}
+	if c, err = loadConfig(server.URL + "/configs/teeproxy.json"); err != nil || *c.Policies[0].Percent != 20 {
+		t.Errorf("Expected the changed version after polling")
+	}
+
+	mu.Lock()
+	delete(files, "/configs/teeproxy.json")
+	mu.Unlock()
+	if pollRemoteConfigs() {
+		t.Errorf("Expected a failed fetch to keep the last version")
+	}
+	if _, err := loadConfig(server.URL + "/configs/missing.json"); err == nil {
+		t.Errorf("Expected an error for a missing remote config")
+	}
+}
+
+func TestRemoteConfigSources(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("CONSUL_HTTP_TOKEN", "consul-token")
+	requests := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	defer evictIdleConnections()
+	defer func(endpoint func(string) string) { s3ConfigEndpoint = endpoint }(s3ConfigEndpoint)
+	s3ConfigEndpoint = func(string) string { return server.URL }
+
+	if _, err := fetchConfig("s3://fleet-configs/teeproxy/prod.json"); err != nil {
+		t.Fatal(err)
+	}
+	r := <-requests
+	if r.URL.Path != "/fleet-configs/teeproxy/prod.json" || !strings.Contains(r.Header.Get("Authorization"), "/s3/aws4_request") {
+		t.Errorf("Expected a signed GET of the object, but received '%s' with '%s'", r.URL.Path, r.Header.Get("Authorization"))
+	}
+	if _, err := fetchConfig("consul://" + strings.TrimPrefix(server.URL, "http://") + "/teeproxy/prod"); err != nil {
+		t.Fatal(err)
+	}
+	r = <-requests
+	if r.URL.RequestURI() != "/v1/kv/teeproxy/prod?raw" || r.Header.Get("X-Consul-Token") != "consul-token" {
+		t.Errorf("Expected the raw value of the key, but received '%s' with '%s'", r.URL.RequestURI(), r.Header.Get("X-Consul-Token"))
+	}
+	if included := includedConfig("s3://fleet-configs/teeproxy/prod.json", "../shared/rules.json"); included != "s3://fleet-configs/shared/rules.json" {
+		t.Errorf("Expected '%s', but received '%s'", "s3://fleet-configs/shared/rules.json", included)
+	}
+}
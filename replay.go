@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// `teeproxy -a <target> replay <recording>` sends the recorded exchanges to
+// the target with their original timing, scaled by -replay.speed. Streamed
+// request bodies are sent chunk by chunk and WebSocket sessions frame by
+// frame at their recorded offsets.
+
+func replayCommand(filename string) int {
+	file, err := openRecording(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer file.Close()
+
+	scheme, target := SchemeAndHost(*targetProduction)
+	transport := withOrderedHeaders(getTransport(scheme, time.Duration(*productionTimeout)*time.Millisecond, false))
+	decoder := newExchangeDecoder(file, *recordFormat)
+	var replays sync.WaitGroup
+	var first time.Time
+	start := time.Now()
+	failed := false
+	var failedMutex sync.Mutex
+	for {
+		e, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s: %s\n", filename, err)
+			failedMutex.Lock()
+			failed = true
+			failedMutex.Unlock()
+			break
+		}
+		if first.IsZero() {
+			first = e.Time
+		}
+		if *replaySpeed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(e.Time.Sub(first)) / *replaySpeed))))
+		}
+		replays.Add(1)
+		go func() {
+			defer replays.Done()
+			var status int
+			var err error
+			if len(e.Frames) > 0 {
+				status, err = replayWebSocket(e, scheme, target)
+			} else {
+				status, err = replayRequest(e, scheme, target, transport)
+			}
+			if err != nil {
+				fmt.Printf("| REPLAY | \"%s %s\" failed: %s\n", e.Method, e.URI, err)
+				failedMutex.Lock()
+				failed = true
+				failedMutex.Unlock()
+				return
+			}
+			fmt.Printf("| REPLAY | \"%s %s\" recorded %d, received %d\n", e.Method, e.URI, e.Status, status)
+		}()
+	}
+	replays.Wait()
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// replayDelay waits until the offset of the exchange started at start.
+func replayDelay(start time.Time, offset int64) {
+	if *replaySpeed > 0 {
+		time.Sleep(time.Until(start.Add(time.Duration(float64(offset) * float64(time.Microsecond) / *replaySpeed))))
+	}
+}
+
+// chunkReader returns the recorded chunks at their original offsets.
+func chunkReader(start time.Time, chunks []chunk) io.Reader {
+	reader, writer := io.Pipe()
+	go func() {
+		for _, c := range chunks {
+			replayDelay(start, c.Offset)
+			if _, err := writer.Write(c.Data); err != nil {
+				return
+			}
+		}
+		writer.Close()
+	}()
+	return reader
+}
+
+func replayRequest(e *exchange, scheme, target string, transport http.RoundTripper) (int, error) {
+	start := time.Now()
+	var body io.Reader
+	if len(e.RequestChunks) > 0 {
+		body = chunkReader(start, e.RequestChunks)
+	}
+	request, err := http.NewRequest(e.Method, scheme+"://"+target+e.URI, body)
+	if err != nil {
+		return 0, err
+	}
+	if e.Header != nil {
+		request.Header = e.Header.Clone()
+	}
+	request.Host = e.Host
+	request = withHeaderOrder(request, e.HeaderOrder)
+	if len(e.RequestChunks) > 0 && !e.Truncated {
+		for _, c := range e.RequestChunks {
+			request.ContentLength += int64(len(c.Data))
+		}
+	} else {
+		request.ContentLength = -1
+	}
+	if body == nil {
+		request.ContentLength = 0
+	}
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	return response.StatusCode, nil
+}
+
+// replayWebSocket opens a WebSocket session and sends the recorded client
+// frames, the frames of the target are read and discarded.
+func replayWebSocket(e *exchange, scheme, target string) (int, error) {
+	start := time.Now()
+	conn, err := dialBackend(scheme, target, time.Duration(*productionTimeout)*time.Millisecond)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	request, err := http.NewRequest(e.Method, scheme+"://"+target+e.URI, nil)
+	if err != nil {
+		return 0, err
+	}
+	if e.Header != nil {
+		request.Header = e.Header.Clone()
+	}
+	request.Host = e.Host
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	request.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(nonce[:]))
+	if err := request.Write(conn); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return 0, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return response.StatusCode, nil
+	}
+	go io.Copy(ioutil.Discard, reader)
+
+	for _, f := range e.Frames {
+		if !f.FromClient {
+			continue
+		}
+		replayDelay(start, f.Offset)
+		if int64(len(f.Data)) < f.Length {
+			// the payload was not recorded completely
+			f.Data = append(f.Data, bytes.Repeat([]byte{0}, int(f.Length)-len(f.Data))...)
+		}
+		var key [4]byte
+		rand.Read(key[:])
+		if _, err := conn.Write(appendFrame(nil, f, true, key)); err != nil {
+			return response.StatusCode, err
+		}
+	}
+	replayDelay(start, e.Duration)
+	return response.StatusCode, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	runtimedebug "runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cgroupCPULimit returns the CPU quota of the container in CPUs, or 0 if
+// there is no limit.
+func cgroupCPULimit() float64 {
+	// cgroup v2: "max 100000" or "200000 100000"
+	if data, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 && fields[0] != "max" {
+			quota, err1 := strconv.ParseFloat(fields[0], 64)
+			period, err2 := strconv.ParseFloat(fields[1], 64)
+			if err1 == nil && err2 == nil && period > 0 {
+				return quota / period
+			}
+		}
+		return 0
+	}
+	// cgroup v1
+	quotaData, err1 := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	periodData, err2 := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+	quota, err1 := strconv.ParseFloat(strings.TrimSpace(string(quotaData)), 64)
+	period, err2 := strconv.ParseFloat(strings.TrimSpace(string(periodData)), 64)
+	if err1 != nil || err2 != nil || quota <= 0 || period <= 0 {
+		return 0
+	}
+	return quota / period
+}
+
+// maxProcs returns GOMAXPROCS for the CPU limit of the container.
+func maxProcs(limit float64, cpus int) int {
+	if limit <= 0 {
+		return cpus
+	}
+	procs := int(math.Ceil(limit))
+	if procs < 1 {
+		procs = 1
+	}
+	if procs > cpus {
+		procs = cpus
+	}
+	return procs
+}
+
+// setMaxProcs sets GOMAXPROCS to the CPU quota of the container unless the
+// GOMAXPROCS environment variable is set.
+func setMaxProcs() {
+	if os.Getenv("GOMAXPROCS") != "" {
+		return
+	}
+	procs := maxProcs(cgroupCPULimit(), runtime.NumCPU())
+	runtime.GOMAXPROCS(procs)
+	if *debug {
+		log.Printf("Using GOMAXPROCS=%d", procs)
+	}
+}
+
+// setMemoryLimit applies -memory-limit as soft memory limit of the runtime
+// and watches the heap, shedding mirroring work under memory pressure.
+func setMemoryLimit() {
+	if *memoryLimit <= 0 {
+		return
+	}
+	limit := int64(*memoryLimit) << 20
+	runtimedebug.SetMemoryLimit(limit)
+	if *memoryShed > 0 {
+		go watchMemory(uint64(float64(limit) * *memoryShed))
+	}
+}
+
+func watchMemory(threshold uint64) {
+	samples := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	for {
+		metrics.Read(samples)
+		if samples[0].Value.Kind() == metrics.KindUint64 {
+			setMirroringShed("memory", samples[0].Value.Uint64() > threshold)
+		}
+		time.Sleep(time.Second)
+	}
+}
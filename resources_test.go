@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMaxProcs(t *testing.T) {
+	for _, test := range []struct {
+		limit       float64
+		cpus        int
+		expectation int
+	}{
+		{0, 8, 8},
+		{0.5, 8, 1},
+		{2, 8, 2},
+		{2.5, 8, 3},
+		{16, 8, 8},
+	} {
+		if procs := maxProcs(test.limit, test.cpus); procs != test.expectation {
+			t.Errorf("Expected '%d', but received '%d'", test.expectation, procs)
+		}
+	}
+}
+
+func TestMirroringShed(t *testing.T) {
+	setMirroringShed("memory", true)
+	setMirroringShed("goroutines", true)
+	setMirroringShed("memory", false)
+	if !mirroringShed() {
+		t.Errorf("Expected mirroring to be shed while a reason remains")
+	}
+	setMirroringShed("goroutines", false)
+	if mirroringShed() {
+		t.Errorf("Expected mirroring not to be shed without reasons")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+)
+
+// The length of a forwarded response is taken from the response as read by
+// the transport, not from the header copied from the backend: responses to
+// HEAD keep the Content-Length of the resource without a body, chunked and
+// decompressed bodies are sent without Content-Length, and a body shorter
+// than announced aborts the connection to the client instead of appearing
+// complete. A 204 or 304 has no body, one announced by a broken backend is
+// not forwarded, with -a.bodyless-status error the client gets a 502
+// instead. Either way the connection it was received on is closed, as the
+// unread body would be taken for the next response.
+
+const (
+	bodylessStrip = "strip"
+	bodylessError = "error"
+)
+
+var bodylessBodiesTotal = newCounterVec("teeproxy_bodyless_status_bodies_total",
+	"Number of 204 and 304 responses of the production target announcing a body.", "status")
+
+func checkBodylessPolicy(policy string) error {
+	if policy != bodylessStrip && policy != bodylessError {
+		return fmt.Errorf("unknown policy %q, expected strip or error", policy)
+	}
+	return nil
+}
+
+// bodyAllowed reports whether the response may have a body, RFC 9110
+// section 6.4.1.
+func bodyAllowed(method string, status int) bool {
+	return method != "HEAD" && status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// announcesBody reports whether a 204 or 304 response announced a body,
+// a Content-Length is allowed on a 304 as the length of the resource.
+func announcesBody(response *http.Response) bool {
+	if len(response.TransferEncoding) > 0 {
+		return true
+	}
+	length := response.Header.Get("Content-Length")
+	return response.StatusCode == http.StatusNoContent && length != "" && length != "0"
+}
+
+// responseConn is the connection a response was received on.
+type responseConn struct {
+	conn net.Conn
+}
+
+// traceConn returns the request recording the connection its response is
+// received on, the last one if redirects are followed.
+func traceConn(request *http.Request) (*http.Request, *responseConn) {
+	c := &responseConn{}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { c.conn = info.Conn },
+	}
+	return request.WithContext(httptrace.WithClientTrace(request.Context(), trace)), c
+}
+
+// checkBodyless reports whether the response of the production target can
+// be forwarded, closing the connection it was received on if it announced
+// a body it must not have. HTTP/2 frames the body, its connection is kept.
+func checkBodyless(request *http.Request, response *http.Response, c *responseConn) bool {
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusNotModified || !announcesBody(response) {
+		return true
+	}
+	bodylessBodiesTotal.Inc(strconv.Itoa(response.StatusCode))
+	log.Printf("| A | \"%s %s\" %d announced a body, it is not forwarded", request.Method, request.URL.RequestURI(), response.StatusCode)
+	if c.conn != nil && response.ProtoMajor < 2 {
+		c.conn.Close()
+	}
+	return *bodylessStatus != bodylessError
+}
+
+// setContentLength sets the Content-Length forwarded to the client.
+func setContentLength(header http.Header, request *http.Request, response *http.Response) {
+	switch {
+	case request.Method == "HEAD":
+		// the length of the resource the GET would return
+	case !bodyAllowed(request.Method, response.StatusCode):
+		header.Del("Content-Length")
+	case response.ContentLength >= 0:
+		header.Set("Content-Length", strconv.FormatInt(response.ContentLength, 10))
+	default:
+		header.Del("Content-Length")
+	}
+}
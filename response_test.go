@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// rawBackend answers every request with the raw response.
+func rawBackend(t *testing.T, response string) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					if _, err := http.ReadRequest(reader); err != nil {
+						return
+					}
+					if _, err := conn.Write([]byte(response)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+func TestForwardedLength(t *testing.T) {
+	defer evictIdleConnections()
+	for _, test := range []struct {
+		method, response string
+		status           int
+		length, body     string
+	}{
+		{"HEAD", "HTTP/1.1 200 OK\r\nContent-Length: 42\r\n\r\n", 200, "42", ""},
+		{"GET", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", 200, "", "hello"},
+		{"GET", "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", 200, "5", "hello"},
+		{"OPTIONS", "HTTP/1.1 204 No Content\r\nAllow: GET, OPTIONS\r\n\r\n", 204, "", ""},
+		{"GET", "HTTP/1.1 204 No Content\r\nContent-Length: 5\r\n\r\nhello", 204, "", ""},
+	} {
+		address, stop := rawBackend(t, test.response)
+		h := newTestHandler(address)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(test.method, "/", nil))
+		stop()
+		if w.Code != test.status || w.Header().Get("Content-Length") != test.length || w.Body.String() != test.body {
+			t.Errorf("Expected '%d %s %s', but received '%d %s %s'", test.status, test.length, test.body,
+				w.Code, w.Header().Get("Content-Length"), w.Body.String())
+		}
+	}
+}
+
+func TestBodylessStatusError(t *testing.T) {
+	defer func(policy string) { *bodylessStatus = policy }(*bodylessStatus)
+	*bodylessStatus = bodylessError
+	defer evictIdleConnections()
+	address, stop := rawBackend(t, "HTTP/1.1 204 No Content\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+	defer stop()
+
+	h := newTestHandler(address)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusBadGateway, w.Code)
+	}
+	if count := bodylessBodiesTotal.values[labelKey([]string{"204"})]; count == 0 {
+		t.Errorf("Expected the body of the 204 counted")
+	}
+	if err := checkBodylessPolicy("keep"); err == nil || !strings.Contains(err.Error(), "strip or error") {
+		t.Errorf("Expected an error for an unknown policy, but received '%v'", err)
+	}
+}
+
+func TestBodylessClosesOnlyItsConnection(t *testing.T) {
+	defer evictIdleConnections()
+	var connections int32
+	other := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	other.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	other.Start()
+	defer other.Close()
+	address, stop := rawBackend(t, "HTTP/1.1 204 No Content\r\nContent-Length: 5\r\n\r\nhello")
+	defer stop()
+
+	healthy := newTestHandler(other.URL)
+	broken := newTestHandler(address)
+	healthy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	broken.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	w := httptest.NewRecorder()
+	broken.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusNoContent, w.Code)
+	}
+	healthy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if count := atomic.LoadInt32(&connections); count != 1 {
+		t.Errorf("Expected the idle connection of the other target to be kept, but received '%d' connections", count)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Backends often answer with their internal names, e.g. a Location of
+// http://app.internal:8080/login or a cookie set for Domain=app.internal.
+// With -rewrite.hosts, these names are rewritten in the Location and
+// Set-Cookie headers of the production responses to the public host,
+// -rewrite.public-host or the host the client requested. With
+// -a.redirects.rewrite, a Location pointing to the production target itself
+// is rewritten the same way.
+
+// hostRewriter rewrites the internal hosts of the responses.
+type hostRewriter struct {
+	// internal holds the lower case host names, without port
+	internal map[string]bool
+	public   string
+	// target rewrites a Location pointing to the production target
+	target bool
+}
+
+// newHostRewriter returns nil without internal hosts, unless the target is
+// rewritten.
+func newHostRewriter(hosts, public string, target bool) *hostRewriter {
+	r := &hostRewriter{internal: make(map[string]bool), public: public, target: target}
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			r.internal[strings.ToLower(hostname(host))] = true
+		}
+	}
+	if len(r.internal) == 0 && !target {
+		return nil
+	}
+	return r
+}
+
+// hostname removes the port of the host and the brackets of an IPv6
+// literal.
+func hostname(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// Rewrite rewrites the response headers of the production target for the
+// client of the request.
+func (r *hostRewriter) Rewrite(header http.Header, req *http.Request, clientHost, target string) {
+	if r == nil {
+		return
+	}
+	public := r.public
+	if public == "" {
+		public = clientHost
+	}
+	if location := header.Get("Location"); location != "" {
+		if u, err := url.Parse(location); err == nil && (r.internal[strings.ToLower(u.Hostname())] ||
+			r.target && u.Host != "" && strings.EqualFold(u.Host, endpointHost(target))) {
+			u.Scheme = requestScheme(req)
+			u.Host = public
+			header.Set("Location", u.String())
+		}
+	}
+	cookies := header["Set-Cookie"]
+	for i, cookie := range cookies {
+		cookies[i] = r.rewriteDomain(cookie, hostname(public))
+	}
+}
+
+// rewriteDomain replaces an internal Domain attribute of the Set-Cookie
+// value, keeping the other attributes as they are.
+func (r *hostRewriter) rewriteDomain(cookie, domain string) string {
+	parts := strings.Split(cookie, ";")
+	for i, part := range parts {
+		attribute := strings.TrimSpace(part)
+		if len(attribute) < 7 || !strings.EqualFold(attribute[:7], "domain=") {
+			continue
+		}
+		if r.internal[strings.ToLower(strings.TrimPrefix(attribute[7:], "."))] {
+			parts[i] = " Domain=" + domain
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// responseHosts rewrites the hosts of -rewrite.hosts and the production
+// target with -a.redirects.rewrite, set in main.
+var responseHosts *hostRewriter
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHostRewriter(t *testing.T) {
+	r := newHostRewriter("app.internal:8080, auth.internal", "", false)
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, test := range []struct {
+		header     http.Header
+		location   string
+		setCookies string
+	}{
+		{http.Header{"Location": {"http://app.internal:8080/login?next=%2F"}}, "http://www.example.com/login?next=%2F", ""},
+		{http.Header{"Location": {"https://other.example.com/"}}, "https://other.example.com/", ""},
+		{http.Header{"Location": {"/relative"}}, "/relative", ""},
+		{http.Header{"Set-Cookie": {"session=1; Path=/; domain=.auth.internal; HttpOnly", "id=2; Domain=example.org"}}, "",
+			"session=1; Path=/; Domain=www.example.com; HttpOnly|id=2; Domain=example.org"},
+	} {
+		r.Rewrite(test.header, req, "www.example.com", "backend:8080")
+		if location := test.header.Get("Location"); location != test.location {
+			t.Errorf("Expected '%s', but received '%s'", test.location, location)
+		}
+		if cookies := strings.Join(test.header["Set-Cookie"], "|"); cookies != test.setCookies {
+			t.Errorf("Expected '%s', but received '%s'", test.setCookies, cookies)
+		}
+	}
+	if r := newHostRewriter(" ", "", false); r != nil {
+		t.Errorf("Expected no rewriter without hosts")
+	}
+}
+
+func TestRewriteResponseHosts(t *testing.T) {
+	defer func(r *hostRewriter) { responseHosts = r }(responseHosts)
+	responseHosts = newHostRewriter("app.internal", "public.example.com:8443", false)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "1", Domain: "app.internal"})
+		http.Redirect(w, r, "http://app.internal/home", http.StatusFound)
+	}))
+	defer server.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler(strings.TrimPrefix(server.URL, "http://"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if location := w.Header().Get("Location"); location != "http://public.example.com:8443/home" {
+		t.Errorf("Expected '%s', but received '%s'", "http://public.example.com:8443/home", location)
+	}
+	if cookie := w.Header().Get("Set-Cookie"); cookie != "session=1; Domain=public.example.com" {
+		t.Errorf("Expected '%s', but received '%s'", "session=1; Domain=public.example.com", cookie)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The request counts and latency histograms of teeproxy_requests_total and
+// teeproxy_request_duration_seconds are labeled by route, for every side and
+// backend. With -metrics.routes, only the busiest routes keep their own
+// series, so that the cardinality stays bounded: every -metrics.routes.interval
+// the routes are ranked by their requests since the last ranking, the top N
+// are reported by their route template and the others as route "other", and
+// the series of the routes leaving the top N are dropped. Until the first
+// ranking, the first N routes seen are reported.
+
+// otherRoute is the route label of the requests of the routes outside the
+// top N.
+const otherRoute = "other"
+
+// routeCandidates bounds the routes counted per limited route between two
+// rankings, the requests of further routes are not counted.
+const routeCandidates = 10
+
+// routeRanking ranks the routes by requests.
+type routeRanking struct {
+	limit int
+
+	mu     sync.Mutex
+	counts map[string]uint64
+	top    map[string]bool
+}
+
+// metricRoutes ranks the routes of the request metrics, nil unless
+// -metrics.routes is set.
+var metricRoutes *routeRanking
+
+func newRouteRanking(limit int) *routeRanking {
+	return &routeRanking{limit: limit, counts: make(map[string]uint64), top: make(map[string]bool)}
+}
+
+// Label returns the route label of a request of the route, counting it for
+// the ranking if count is set, as the production requests are.
+func (r *routeRanking) Label(route string, count bool) string {
+	if r == nil {
+		return route
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.counts[route]; count && (ok || len(r.counts) < r.limit*routeCandidates) {
+		r.counts[route]++
+	}
+	if r.top[route] {
+		return route
+	}
+	if len(r.top) < r.limit {
+		r.top[route] = true
+		return route
+	}
+	return otherRoute
+}
+
+// Rank makes the busiest routes since the last ranking the top N and
+// returns the routes leaving it.
+func (r *routeRanking) Rank() (dropped map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	routes := make([]string, 0, len(r.counts))
+	for route := range r.counts {
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if r.counts[routes[i]] != r.counts[routes[j]] {
+			return r.counts[routes[i]] > r.counts[routes[j]]
+		}
+		return routes[i] < routes[j]
+	})
+	if len(routes) > r.limit {
+		routes = routes[:r.limit]
+	}
+	top := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		top[route] = true
+	}
+	dropped = make(map[string]bool)
+	for route := range r.top {
+		if !top[route] {
+			dropped[route] = true
+		}
+	}
+	r.top = top
+	r.counts = make(map[string]uint64)
+	return dropped
+}
+
+// rankRoutes ranks the routes and drops the series of the routes leaving
+// the top N.
+func rankRoutes() {
+	dropped := metricRoutes.Rank()
+	if len(dropped) == 0 {
+		return
+	}
+	requestsTotal.Delete("route", dropped)
+	requestDuration.Delete("route", dropped)
+}
+
+// startRouteRanking ranks the routes every -metrics.routes.interval seconds.
+func startRouteRanking() {
+	if metricRoutes == nil || *metricsRoutesInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Duration(*metricsRoutesInterval) * time.Second) {
+			rankRoutes()
+		}
+	}()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRouteRanking(t *testing.T) {
+	ranking := newRouteRanking(2)
+	for _, route := range []string{"/ranking/a", "/ranking/b", "/ranking/c", "/ranking/c", "/ranking/c"} {
+		ranking.Label(route, true)
+	}
+	if label := ranking.Label("/ranking/c", false); label != otherRoute {
+		t.Errorf("Expected '%s' before the ranking, but received '%s'", otherRoute, label)
+	}
+	ranking.Label("/ranking/b", true)
+	dropped := ranking.Rank()
+	if len(dropped) != 1 || !dropped["/ranking/a"] {
+		t.Errorf("Expected '/ranking/a' to be dropped, but received '%v'", dropped)
+	}
+	for route, expected := range map[string]string{"/ranking/a": otherRoute, "/ranking/b": "/ranking/b", "/ranking/c": "/ranking/c"} {
+		if label := ranking.Label(route, false); label != expected {
+			t.Errorf("Expected '%s' for %s, but received '%s'", expected, route, label)
+		}
+	}
+}
+
+func TestRouteRankingDropsSeries(t *testing.T) {
+	defer func(r *routeRanking) { metricRoutes = r }(metricRoutes)
+	metricRoutes = newRouteRanking(1)
+	observeRequest("a", "ranked:1", "/ranked/first", "", nil, 0.1)
+	observeRequest("b", "ranked:2", "/ranked/second", "", nil, 0.1)
+	for i := 0; i < 2; i++ {
+		observeRequest("a", "ranked:1", "/ranked/second", "", nil, 0.1)
+	}
+	if v := requestsTotal.Value("a", "ranked:1", otherRoute, "error"); v != 2 {
+		t.Errorf("Expected '2' requests of other routes, but received '%v'", v)
+	}
+	rankRoutes()
+	if v := requestsTotal.Value("a", "ranked:1", "/ranked/first", "error"); v != 0 {
+		t.Errorf("Expected the series of the dropped route to be removed, but received '%v'", v)
+	}
+	observeRequest("b", "ranked:2", "/ranked/second", "", nil, 0.1)
+	var out strings.Builder
+	requestDuration.write(&out)
+	if !strings.Contains(out.String(), `backend="ranked:2",route="/ranked/second"`) {
+		t.Errorf("Expected the histogram of the top route, but received '%s'", out.String())
+	}
+	if strings.Contains(out.String(), `route="/ranked/first"`) {
+		t.Errorf("Expected no histogram of the dropped route")
+	}
+}
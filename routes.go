@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// routeNormalizer maps concrete request paths onto route templates such as
+// /users/{id}, so metrics stay bounded for high-cardinality paths.
+type routeNormalizer struct {
+	templates []routeTemplate
+	rules     []routeRule
+}
+
+type routeTemplate struct {
+	template string
+	segments []string
+}
+
+type routeRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// defaultRouteRules replace numeric and uuid-like path segments.
+var defaultRouteRules = []string{
+	`/[0-9]+(/|$)=/{id}$1`,
+	`/[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}(/|$)=/{uuid}$1`,
+	`/[0-9a-fA-F]{24,}(/|$)=/{hash}$1`,
+}
+
+func newRouteTemplate(template string) routeTemplate {
+	return routeTemplate{template: template, segments: strings.Split(strings.Trim(template, "/"), "/")}
+}
+
+// match reports whether the path fits the template, where a segment
+// written as {name} matches any single path segment.
+func (t routeTemplate) match(segments []string) bool {
+	if len(segments) != len(t.segments) {
+		return false
+	}
+	for i, segment := range t.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			continue
+		}
+		if segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// AddTemplate registers a route template like /users/{id}/orders.
+func (n *routeNormalizer) AddTemplate(template string) {
+	n.templates = append(n.templates, newRouteTemplate(template))
+	// prefer the templates with the most literal segments
+	sort.SliceStable(n.templates, func(i, j int) bool {
+		return literalSegments(n.templates[i]) > literalSegments(n.templates[j])
+	})
+}
+
+func literalSegments(t routeTemplate) (count int) {
+	for _, segment := range t.segments {
+		if !strings.HasPrefix(segment, "{") {
+			count++
+		}
+	}
+	return
+}
+
+// AddRule registers a normalization rule in the form regex=replacement.
+func (n *routeNormalizer) AddRule(rule string) error {
+	pos := strings.LastIndex(rule, "=")
+	if pos == -1 {
+		return fmt.Errorf("route rule %q is not in the form regex=replacement", rule)
+	}
+	pattern, err := regexp.Compile(rule[:pos])
+	if err != nil {
+		return err
+	}
+	n.rules = append(n.rules, routeRule{pattern: pattern, replacement: rule[pos+1:]})
+	return nil
+}
+
+// LoadOpenAPI registers the paths of a JSON OpenAPI (or Swagger) spec as templates.
+func (n *routeNormalizer) LoadOpenAPI(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var spec struct {
+		BasePath string                     `json:"basePath"`
+		Paths    map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("parsing OpenAPI spec %s: %v", filename, err)
+	}
+	for path := range spec.Paths {
+		n.AddTemplate(strings.TrimSuffix(spec.BasePath, "/") + path)
+	}
+	return nil
+}
+
+// Normalize returns the route template for the path.
+func (n *routeNormalizer) Normalize(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, t := range n.templates {
+		if t.match(segments) {
+			return t.template
+		}
+	}
+	for _, rule := range n.rules {
+		// applied twice so that adjacent segments sharing a slash are replaced too
+		path = rule.pattern.ReplaceAllString(path, rule.replacement)
+		path = rule.pattern.ReplaceAllString(path, rule.replacement)
+	}
+	return path
+}
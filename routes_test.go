@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRouteTemplates(t *testing.T) {
+	var n routeNormalizer
+	n.AddTemplate("/users/{id}")
+	n.AddTemplate("/users/me")
+	n.AddTemplate("/users/{id}/orders/{orderId}")
+	for path, expectation := range map[string]string{
+		"/users/42":           "/users/{id}",
+		"/users/me":           "/users/me",
+		"/users/42/orders/7":  "/users/{id}/orders/{orderId}",
+		"/users/42/orders/7/": "/users/{id}/orders/{orderId}",
+	} {
+		if route := n.Normalize(path); route != expectation {
+			t.Errorf("Expected '%s', but received '%s'", expectation, route)
+		}
+	}
+}
+
+func TestDefaultRouteRules(t *testing.T) {
+	var n routeNormalizer
+	for _, rule := range defaultRouteRules {
+		if err := n.AddRule(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, expectation := range map[string]string{
+		"/static/app.js":  "/static/app.js",
+		"/items/12/34/56": "/items/{id}/{id}/{id}",
+		"/v2/items/12":    "/v2/items/{id}",
+		"/orders/123e4567-e89b-12d3-a456-426614174000/lines": "/orders/{uuid}/lines",
+	} {
+		if route := n.Normalize(path); route != expectation {
+			t.Errorf("Expected '%s', but received '%s'", expectation, route)
+		}
+	}
+}
+
+func TestInvalidRouteRule(t *testing.T) {
+	var n routeNormalizer
+	if err := n.AddRule("no-replacement"); err == nil {
+		t.Errorf("Expected an error for a rule without replacement")
+	}
+}
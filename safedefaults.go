@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"time"
+)
+
+// -safe-defaults changes the defaults of the flags to the settings
+// recommended in production, so that a new deployment does not have to find
+// them one by one: the certificates of the backends are verified, slow and
+// idle clients time out, the mirrored requests are sent by a bounded number of
+// workers, only safe methods are mirrored, the health checks of the usual
+// paths are not mirrored and the in-flight requests have longer to drain on
+// shutdown. The flags given explicitly keep their value, and without
+// -safe-defaults the defaults are unchanged.
+
+// safeDefaults are the flags set by -safe-defaults, in order.
+var safeDefaults = []struct{ name, value string }{
+	{"tls.verify-backends", "true"},
+	{"client.header-timeout", "10000"},
+	{"client.idle-timeout", "120000"},
+	{"mirror.workers", "64"},
+	{"b.methods", "^(GET|HEAD|OPTIONS)$"},
+	{"healthcheck.paths", "/healthz,/readyz,/livez"},
+	{"shutdown.timeout", "25000"},
+}
+
+// applySafeDefaults sets the flags of -safe-defaults not given explicitly.
+func applySafeDefaults() error {
+	if !*safeDefaultsPreset {
+		return nil
+	}
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for _, d := range safeDefaults {
+		if explicit[d.name] {
+			continue
+		}
+		if err := flag.Set(d.name, d.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setClientTimeouts applies -client.header-timeout and -client.idle-timeout
+// to the server of a listener.
+func setClientTimeouts(server *http.Server) {
+	server.ReadHeaderTimeout = time.Duration(*clientHeaderTimeout) * time.Millisecond
+	server.IdleTimeout = time.Duration(*clientIdleTimeout) * time.Millisecond
+}
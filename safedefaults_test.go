@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestApplySafeDefaults(t *testing.T) {
+	saved := make(map[string]string)
+	for _, d := range safeDefaults {
+		saved[d.name] = flag.Lookup(d.name).Value.String()
+	}
+	defer func() {
+		for name, value := range saved {
+			flag.Set(name, value)
+		}
+	}()
+	defer func(preset bool) { *safeDefaultsPreset = preset }(*safeDefaultsPreset)
+
+	if err := applySafeDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if *mirrorWorkers != 0 {
+		t.Errorf("Expected the defaults without -safe-defaults, but received '%d' workers", *mirrorWorkers)
+	}
+	*safeDefaultsPreset = true
+	flag.Set("b.methods", "^GET$")
+	if err := applySafeDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if *alternateMethods != "^GET$" {
+		t.Errorf("Expected the explicit '^GET$', but received '%s'", *alternateMethods)
+	}
+	if !*tlsVerifyBackends || *mirrorWorkers != 64 || *shutdownTimeout != 25000 {
+		t.Errorf("Expected the safe defaults, but received verify '%v', '%d' workers and '%d' ms to drain",
+			*tlsVerifyBackends, *mirrorWorkers, *shutdownTimeout)
+	}
+	source := newHTTPSource(nil)
+	if source.server.ReadHeaderTimeout != 10*time.Second || source.server.IdleTimeout != 2*time.Minute {
+		t.Errorf("Expected the client timeouts, but received '%s' and '%s'", source.server.ReadHeaderTimeout, source.server.IdleTimeout)
+	}
+	if newTLSClientConfig().InsecureSkipVerify {
+		t.Errorf("Expected the certificates of the backends to be verified")
+	}
+}
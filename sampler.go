@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sampler decides whether a request matched by a policy is mirrored. The
+// percent given is the effective percentage of the policy, after the runtime
+// override and ramp. Each policy has its own Sampler, so strategies may keep
+// state per policy.
+type Sampler interface {
+	Sample(req *http.Request, percent float64, randomizer *rand.Rand) bool
+}
+
+// samplingStrategies lists the strategies of -sample.strategy.
+var samplingStrategies = []string{"percentage", "consistent", "rate-limited", "adaptive", "scripted", "deterministic"}
+
+// newSampler creates the Sampler of the strategy, "" selects consistent with
+// -sample.key and percentage otherwise.
+func newSampler(strategy string) (Sampler, error) {
+	switch strategy {
+	case "":
+		if *sampleKeySource != "" {
+			return consistentSampler{}, nil
+		}
+		return percentageSampler{}, nil
+	case "percentage":
+		return percentageSampler{}, nil
+	case "consistent":
+		return consistentSampler{}, nil
+	case "deterministic":
+		return deterministicSampler{}, nil
+	case "rate-limited":
+		if *sampleRate <= 0 {
+			return nil, fmt.Errorf("the rate-limited strategy requires -sample.rate")
+		}
+		return &rateLimitedSampler{rate: *sampleRate, tokens: *sampleRate}, nil
+	case "adaptive":
+		if *sampleRate <= 0 {
+			return nil, fmt.Errorf("the adaptive strategy requires -sample.rate")
+		}
+		return &adaptiveSampler{target: *sampleRate, probability: 1}, nil
+	case "scripted":
+		schedule, err := parseSampleSchedule(*sampleScript)
+		if err != nil {
+			return nil, err
+		}
+		return &scriptedSampler{schedule: schedule}, nil
+	}
+	return nil, fmt.Errorf("unknown sampling strategy %q, expected %s", strategy, strings.Join(samplingStrategies, ", "))
+}
+
+// percentageSampler mirrors the percentage of the requests at random.
+type percentageSampler struct{}
+
+func (percentageSampler) Sample(req *http.Request, percent float64, randomizer *rand.Rand) bool {
+	return percent >= 100 || randomizer.Float64()*100 < percent
+}
+
+// consistentSampler mirrors the requests whose -sample.key hashes below the
+// percentage, requests without key are sampled at random.
+type consistentSampler struct{}
+
+func (consistentSampler) Sample(req *http.Request, percent float64, randomizer *rand.Rand) bool {
+	if percent >= 100 {
+		return true
+	}
+	if key := sampleKey(req); key != "" {
+		return percentile(key) < percent
+	}
+	return randomizer.Float64()*100 < percent
+}
+
+// rateLimitedSampler samples the percentage, but mirrors at most -sample.rate
+// requests per second using a token bucket holding one second of requests.
+type rateLimitedSampler struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func (s *rateLimitedSampler) Sample(req *http.Request, percent float64, randomizer *rand.Rand) bool {
+	if !(consistentSampler{}).Sample(req, percent, randomizer) {
+		return false
+	}
+	return s.take(time.Now())
+}
+
+func (s *rateLimitedSampler) take(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.last.IsZero() {
+		s.tokens += now.Sub(s.last).Seconds() * s.rate
+		if s.tokens > s.rate {
+			s.tokens = s.rate
+		}
+	}
+	s.last = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// adaptiveSampler adjusts the probability every second so that about
+// -sample.rate of the matched requests per second are mirrored, the
+// percentage of the policy being the upper limit.
+type adaptiveSampler struct {
+	target float64
+
+	mu          sync.Mutex
+	windowStart time.Time
+	seen        int
+	probability float64
+}
+
+func (s *adaptiveSampler) Sample(req *http.Request, percent float64, randomizer *rand.Rand) bool {
+	probability := s.observe(time.Now())
+	return randomizer.Float64()*100 < percent*probability
+}
+
+// observe counts a matched request and returns the current probability.
+func (s *adaptiveSampler) observe(now time.Time) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.windowStart.IsZero() {
+		s.windowStart = now
+	}
+	s.seen++
+	if elapsed := now.Sub(s.windowStart).Seconds(); elapsed >= 1 {
+		s.probability = 1
+		if rate := float64(s.seen) / elapsed; rate > s.target {
+			s.probability = s.target / rate
+		}
+		s.windowStart = now
+		s.seen = 0
+	}
+	return s.probability
+}
+
+// sampleStep is an entry of the -sample.script schedule.
+type sampleStep struct {
+	// minute of the day the step begins
+	minute int
+	// percent of the policy percentage mirrored
+	percent float64
+}
+
+// parseSampleSchedule parses a comma separated list of HH:MM=percent steps.
+func parseSampleSchedule(script string) ([]sampleStep, error) {
+	if script == "" {
+		return nil, fmt.Errorf("the scripted strategy requires -sample.script")
+	}
+	var schedule []sampleStep
+	for _, entry := range strings.Split(script, ",") {
+		at, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid -sample.script step %q, expected HH:MM=percent", entry)
+		}
+		start, err := time.Parse("15:04", at)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -sample.script time %q, expected HH:MM", at)
+		}
+		percent, err := strconv.ParseFloat(value, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid -sample.script percentage %q, expected 0 to 100", value)
+		}
+		schedule = append(schedule, sampleStep{minute: start.Hour()*60 + start.Minute(), percent: percent})
+	}
+	sort.Slice(schedule, func(i, j int) bool { return schedule[i].minute < schedule[j].minute })
+	return schedule, nil
+}
+
+// scriptedSampler follows a daily schedule scaling the percentage of the
+// policy, e.g. to mirror more outside of the business hours.
+type scriptedSampler struct {
+	schedule []sampleStep
+}
+
+// Percent returns the scheduled percentage at the local time, the last step
+// of the day continues until the first one.
+func (s *scriptedSampler) Percent(now time.Time) float64 {
+	minute := now.Hour()*60 + now.Minute()
+	current := s.schedule[len(s.schedule)-1]
+	for _, step := range s.schedule {
+		if step.minute <= minute {
+			current = step
+		}
+	}
+	return current.percent
+}
+
+func (s *scriptedSampler) Sample(req *http.Request, percent float64, randomizer *rand.Rand) bool {
+	return (consistentSampler{}).Sample(req, percent*s.Percent(time.Now())/100, randomizer)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math/rand"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedSampler(t *testing.T) {
+	s := &rateLimitedSampler{rate: 2, tokens: 2}
+	now := time.Now()
+	for i, expectation := range []bool{true, true, false} {
+		if taken := s.take(now); taken != expectation {
+			t.Errorf("Expected '%v' for request %d, but received '%v'", expectation, i, taken)
+		}
+	}
+	if !s.take(now.Add(500 * time.Millisecond)) {
+		t.Errorf("Expected a token after half a second")
+	}
+}
+
+func TestAdaptiveSampler(t *testing.T) {
+	s := &adaptiveSampler{target: 10, probability: 1}
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		s.observe(start.Add(time.Duration(i) * 10 * time.Millisecond))
+	}
+	if probability := s.observe(start.Add(time.Second)); probability < 0.09 || probability > 0.11 {
+		t.Errorf("Expected a probability of '0.1', but received '%v'", probability)
+	}
+}
+
+func TestScriptedSampler(t *testing.T) {
+	schedule, err := parseSampleSchedule("20:00=100, 08:00=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &scriptedSampler{schedule: schedule}
+	for clock, expectation := range map[string]float64{
+		"03:00": 100,
+		"08:00": 10,
+		"12:30": 10,
+		"21:00": 100,
+	} {
+		now, _ := time.Parse("15:04", clock)
+		if percent := s.Percent(now); percent != expectation {
+			t.Errorf("Expected '%v' at %s, but received '%v'", expectation, clock, percent)
+		}
+	}
+	for _, script := range []string{"", "8=10", "08:00=200", "25:00=10"} {
+		if _, err := parseSampleSchedule(script); err == nil {
+			t.Errorf("Expected '%s' to be invalid", script)
+		}
+	}
+}
+
+func TestNewSampler(t *testing.T) {
+	randomizer := rand.New(rand.NewSource(1))
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, strategy := range []string{"", "percentage", "consistent"} {
+		s, err := newSampler(strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !s.Sample(req, 100, randomizer) || s.Sample(req, 0, randomizer) {
+			t.Errorf("Expected strategy '%s' to sample 100%% and nothing of 0%%", strategy)
+		}
+	}
+	for _, strategy := range []string{"rate-limited", "adaptive", "scripted", "unknown"} {
+		if _, err := newSampler(strategy); err == nil {
+			t.Errorf("Expected an error for '%s' without its flags", strategy)
+		}
+	}
+}
+
+func BenchmarkSamplers(b *testing.B) {
+	randomizer := rand.New(rand.NewSource(1))
+	req := httptest.NewRequest("GET", "/items?id=1", nil)
+	req.Header.Set("X-Request-Id", "0af7651916cd43dd")
+	for _, strategy := range []string{"percentage", "consistent", "deterministic"} {
+		s, err := newSampler(strategy)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(strategy, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s.Sample(req, 50, randomizer)
+			}
+		})
+	}
+}
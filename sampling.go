@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Consistent sampling decides by a hash of a request key, e.g. a user id
+// header, instead of at random. All replicas using the same salt mirror the
+// same users, and a user sampled at a percentage stays sampled at higher ones.
+
+// sampleSalt holds the salt string, set from -sample.salt or shared in Redis.
+var sampleSalt atomic.Value
+
+func init() {
+	sampleSalt.Store("")
+}
+
+// sampleKey returns the value identifying the user of the request as
+// configured by -sample.key, or "" to sample the request at random.
+func sampleKey(req *http.Request) string {
+	kind, name, _ := strings.Cut(*sampleKeySource, ":")
+	switch kind {
+	case "header":
+		return req.Header.Get(name)
+	case "cookie":
+		if cookie, err := req.Cookie(name); err == nil {
+			return cookie.Value
+		}
+	case "query":
+		return req.URL.Query().Get(name)
+	case "ip":
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			return host
+		}
+		return req.RemoteAddr
+	}
+	return ""
+}
+
+// percentile maps the salted key evenly to [0, 100).
+func percentile(key string) float64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(sampleSalt.Load().(string)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(key))
+	return float64(hash.Sum64()%1000000) / 10000
+}
+
+func validSampleKey(source string) bool {
+	kind, name, _ := strings.Cut(source, ":")
+	switch kind {
+	case "":
+		return true
+	case "ip":
+		return name == ""
+	case "header", "cookie", "query":
+		return name != ""
+	}
+	return false
+}
+
+var samplingTotal = newCounterVec("teeproxy_sampling_total",
+	"Sampling decisions of the matched requests by policy.", "policy", "decision")
+
+// samplingCounts accumulates the decisions not yet added to the fleet
+// counters in Redis.
+var (
+	samplingMutex  sync.Mutex
+	samplingCounts = make(map[string]int64)
+)
+
+func countSample(policy string, mirrored bool) {
+	decision := "skipped"
+	if mirrored {
+		decision = "mirrored"
+	}
+	samplingTotal.Inc(policy, decision)
+	if sharedState == nil {
+		return
+	}
+	samplingMutex.Lock()
+	samplingCounts[policy+":"+decision]++
+	samplingMutex.Unlock()
+}
+
+// samplingKey is the Redis hash of the fleet sampling counters.
+func samplingKey() string {
+	return *redisKey + ":sampling"
+}
+
+// flushSamplingCounts adds the local decisions to the fleet counters.
+func flushSamplingCounts() {
+	samplingMutex.Lock()
+	counts := samplingCounts
+	samplingCounts = make(map[string]int64)
+	samplingMutex.Unlock()
+	for field, count := range counts {
+		if _, err := sharedState.Do("HINCRBY", samplingKey(), field, strconv.FormatInt(count, 10)); err != nil {
+			log.Printf("Failed to share the sampling counters: %s", err)
+			return
+		}
+	}
+}
+
+// shareSampleSalt uses the salt stored in Redis, storing a random one first
+// if no replica did yet, so that all replicas sample the same users.
+func shareSampleSalt() error {
+	var random [16]byte
+	rand.Read(random[:])
+	if _, err := sharedState.Do("HSETNX", *redisKey, "salt", hex.EncodeToString(random[:])); err != nil {
+		return err
+	}
+	reply, err := sharedState.Do("HGET", *redisKey, "salt")
+	if err != nil {
+		return err
+	}
+	salt, _ := reply.(string)
+	sampleSalt.Store(salt)
+	return nil
+}
+
+// startSharedSampling shares the salt and the sampling counters in Redis.
+func startSharedSampling() {
+	if *sampleSaltValue == "" && *sampleKeySource != "" {
+		if err := shareSampleSalt(); err != nil {
+			fatalf("Failed to share the sampling salt: %s", err)
+		}
+	}
+	go func() {
+		for range time.Tick(time.Duration(*redisInterval) * time.Millisecond) {
+			flushSamplingCounts()
+		}
+	}()
+}
+
+func init() {
+	adminMux.HandleFunc("/mirror/sampling", samplingHandler)
+}
+
+// samplingHandler reports the mirrored percentage per policy, of the whole
+// fleet with -redis and of this replica otherwise.
+func samplingHandler(w http.ResponseWriter, r *http.Request) {
+	counts := make(map[string]float64)
+	if sharedState != nil {
+		reply, err := sharedState.Do("HGETALL", samplingKey())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		fields, _ := reply.([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			field, _ := fields[i].(string)
+			value, _ := fields[i+1].(string)
+			counts[field], _ = strconv.ParseFloat(value, 64)
+		}
+	} else {
+		samplingTotal.mu.Lock()
+		for key, value := range samplingTotal.values {
+			counts[strings.Replace(key, labelSeparator, ":", 1)] = value
+		}
+		samplingTotal.mu.Unlock()
+	}
+
+	type sampling struct {
+		Mirrored float64 `json:"mirrored"`
+		Skipped  float64 `json:"skipped"`
+		Percent  float64 `json:"percent"`
+	}
+	policies := make(map[string]*sampling)
+	for field, count := range counts {
+		i := strings.LastIndex(field, ":")
+		if i < 0 {
+			continue
+		}
+		s, ok := policies[field[:i]]
+		if !ok {
+			s = &sampling{}
+			policies[field[:i]] = s
+		}
+		if field[i+1:] == "mirrored" {
+			s.Mirrored = count
+		} else {
+			s.Skipped = count
+		}
+	}
+	for _, s := range policies {
+		if total := s.Mirrored + s.Skipped; total > 0 {
+			s.Percent = 100 * s.Mirrored / total
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policies)
+}
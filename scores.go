@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With -compare, the comparisons of the last -compare.window seconds are
+// summarized per alternate backend into fidelity scores: the rate of
+// responses matching production, the percentiles of the latency difference
+// to production and the difference of the error rates, 5xx or failed. The
+// admin endpoint /scores returns them, so that the result of an experiment
+// is a number rather than a pile of | DIFF | lines.
+
+// fidelitySampleLimit bounds the comparisons remembered per backend, when
+// reached the oldest are forgotten first.
+const fidelitySampleLimit = 10000
+
+type fidelitySample struct {
+	at     time.Time
+	match  bool
+	errorA bool
+	errorB bool
+	// delta is the latency of the backend minus the production latency,
+	// timed if both responded
+	delta time.Duration
+	timed bool
+}
+
+// fidelityScores are the scores of a backend, as served by /scores.
+type fidelityScores struct {
+	Compared   int     `json:"compared"`
+	MatchRate  float64 `json:"match_rate"`
+	ErrorRateA float64 `json:"error_rate_a"`
+	ErrorRateB float64 `json:"error_rate_b"`
+	ErrorDelta float64 `json:"error_delta"`
+	// LatencyDelta holds the p50, p90 and p99 of the latency differences in
+	// milliseconds, positive if the backend is slower.
+	LatencyDelta map[string]float64 `json:"latency_delta_ms,omitempty"`
+}
+
+type fidelityWindow struct {
+	mu      sync.Mutex
+	samples map[string][]fidelitySample
+}
+
+var fidelity = &fidelityWindow{samples: make(map[string][]fidelitySample)}
+
+func init() {
+	adminMux.HandleFunc("/scores", scoresHandler)
+	newGaugeVecFunc("teeproxy_fidelity_match_rate", "Rate of the mirrored responses matching the production response within -compare.window by backend.", "backend", func() map[string]float64 {
+		values := make(map[string]float64)
+		for backend, scores := range fidelity.Scores(time.Now()) {
+			values[backend] = scores.MatchRate
+		}
+		return values
+	})
+}
+
+// observe records the comparison of a mirrored response of the backend.
+func (f *fidelityWindow) observe(backend string, sample fidelitySample) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	samples := f.prune(f.samples[backend], sample.at)
+	if len(samples) >= fidelitySampleLimit {
+		samples = samples[1:]
+	}
+	f.samples[backend] = append(samples, sample)
+}
+
+// prune forgets the samples older than -compare.window.
+func (f *fidelityWindow) prune(samples []fidelitySample, now time.Time) []fidelitySample {
+	window := time.Duration(*compareWindow) * time.Second
+	i := 0
+	for i < len(samples) && now.Sub(samples[i].at) > window {
+		i++
+	}
+	return samples[i:]
+}
+
+// Scores summarizes the comparisons of the window per backend.
+func (f *fidelityWindow) Scores(now time.Time) map[string]fidelityScores {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := make(map[string]fidelityScores)
+	for backend, samples := range f.samples {
+		samples = f.prune(samples, now)
+		if len(samples) == 0 {
+			delete(f.samples, backend)
+			continue
+		}
+		f.samples[backend] = samples
+		result[backend] = summarizeFidelity(samples)
+	}
+	return result
+}
+
+func summarizeFidelity(samples []fidelitySample) fidelityScores {
+	var matches, errorsA, errorsB int
+	var deltas []time.Duration
+	for _, s := range samples {
+		if s.match {
+			matches++
+		}
+		if s.errorA {
+			errorsA++
+		}
+		if s.errorB {
+			errorsB++
+		}
+		if s.timed {
+			deltas = append(deltas, s.delta)
+		}
+	}
+	total := float64(len(samples))
+	scores := fidelityScores{
+		Compared:   len(samples),
+		MatchRate:  float64(matches) / total,
+		ErrorRateA: float64(errorsA) / total,
+		ErrorRateB: float64(errorsB) / total,
+	}
+	scores.ErrorDelta = scores.ErrorRateB - scores.ErrorRateA
+	if len(deltas) > 0 {
+		sort.Slice(deltas, func(i, j int) bool { return deltas[i] < deltas[j] })
+		scores.LatencyDelta = make(map[string]float64)
+		for name, p := range map[string]float64{"p50": 50, "p90": 90, "p99": 99} {
+			scores.LatencyDelta[name] = float64(deltas[int(p/100*float64(len(deltas)-1))]) / float64(time.Millisecond)
+		}
+	}
+	return scores
+}
+
+// failed reports whether the compared response counts as an error.
+func (r *comparedResponse) failed() bool {
+	return r.status == 0 || r.status >= 500
+}
+
+// scoresHandler serves /scores.
+func scoresHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(map[string]interface{}{
+		"window":   *compareWindow,
+		"backends": fidelity.Scores(time.Now()),
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFidelityScores(t *testing.T) {
+	f := &fidelityWindow{samples: make(map[string][]fidelitySample)}
+	now := time.Now()
+	f.observe("shadow:8080", fidelitySample{at: now.Add(-time.Hour), match: true})
+	for i := 0; i < 10; i++ {
+		f.observe("shadow:8080", fidelitySample{at: now, match: i < 7, errorB: i == 9, delta: time.Duration(i) * time.Millisecond, timed: i != 9})
+	}
+	scores, ok := f.Scores(now)["shadow:8080"]
+	if !ok {
+		t.Fatalf("Expected scores for 'shadow:8080'")
+	}
+	if scores.Compared != 10 || scores.MatchRate != 0.7 {
+		t.Errorf("Expected '10' comparisons with a match rate of '0.7', but received '%d' and '%v'", scores.Compared, scores.MatchRate)
+	}
+	if scores.ErrorDelta != 0.1 {
+		t.Errorf("Expected '%v', but received '%v'", 0.1, scores.ErrorDelta)
+	}
+	if scores.LatencyDelta["p50"] != 4 || scores.LatencyDelta["p99"] != 7 {
+		t.Errorf("Expected a p50 of '4' and a p99 of '7', but received '%v'", scores.LatencyDelta)
+	}
+	if _, ok := f.Scores(now.Add(time.Hour))["shadow:8080"]; ok {
+		t.Errorf("Expected the scores to expire with the window")
+	}
+}
+
+func TestScoresHandler(t *testing.T) {
+	defer func(compare bool) { *compareResponses = compare }(*compareResponses)
+	*compareResponses = true
+	c := &responseComparison{route: "scores"}
+	production := &comparedResponse{comparison: c, side: "a", status: 200, latency: 10 * time.Millisecond}
+	alternate := &comparedResponse{comparison: c, side: "b", backend: "scored:8080", status: 500, latency: 25 * time.Millisecond}
+	c.production = production
+	c.compare(alternate)
+
+	w := httptest.NewRecorder()
+	scoresHandler(w, httptest.NewRequest("GET", "/scores", nil))
+	var result struct {
+		Backends map[string]fidelityScores
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	scores := result.Backends["scored:8080"]
+	if scores.Compared != 1 || scores.MatchRate != 0 || scores.ErrorDelta != 1 || scores.LatencyDelta["p50"] != 15 {
+		t.Errorf("Expected a mismatch 15ms slower with an error, but received '%+v'", scores)
+	}
+}
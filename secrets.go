@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secrets like keys, passwords and client secrets can be given as env:NAME,
+// read from the environment variable, or as file:PATH, read from the file
+// and re-read when it changes, so that they appear neither in the process
+// listing nor in the shell history, and rotated secrets are picked up
+// without a restart. Other values are used literally.
+
+// secretCheckInterval is how often a secret file is checked for changes.
+const secretCheckInterval = time.Second
+
+type secret struct {
+	spec string
+
+	mu      sync.Mutex
+	value   string
+	modTime time.Time
+	size    int64
+	checked time.Time
+}
+
+func newSecret(spec string) *secret {
+	return &secret{spec: spec}
+}
+
+// Value returns the current value of the secret. If a secret file becomes
+// unreadable, its last value is kept.
+func (s *secret) Value() (string, error) {
+	if s == nil {
+		return "", nil
+	}
+	if name := strings.TrimPrefix(s.spec, "env:"); name != s.spec {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	}
+	path := strings.TrimPrefix(s.spec, "file:")
+	if path == s.spec {
+		return s.spec, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if !s.checked.IsZero() && now.Sub(s.checked) < secretCheckInterval {
+		return s.value, nil
+	}
+	s.checked = now
+	info, err := os.Stat(path)
+	if err == nil && info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return s.value, nil
+	}
+	var content []byte
+	if err == nil {
+		content, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		if s.modTime.IsZero() {
+			s.checked = time.Time{}
+			return "", fmt.Errorf("reading secret: %v", err)
+		}
+		log.Printf("Failed to reload the secret %s, keeping the last value: %s", path, err)
+		return s.value, nil
+	}
+	if !s.modTime.IsZero() {
+		log.Printf("Reloaded the secret %s", path)
+	}
+	s.value = strings.TrimRight(string(content), "\r\n")
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	return s.value, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecret(t *testing.T) {
+	t.Setenv("TEEPROXY_TEST_SECRET", "from-env")
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		spec, value string
+	}{
+		{"literal", "literal"},
+		{"env:TEEPROXY_TEST_SECRET", "from-env"},
+		{"file:" + path, "from-file"},
+	} {
+		value, err := newSecret(test.spec).Value()
+		if err != nil || value != test.value {
+			t.Errorf("Expected '%s', but received '%s' (%v)", test.value, value, err)
+		}
+	}
+	if _, err := newSecret("env:TEEPROXY_TEST_UNSET").Value(); err == nil {
+		t.Errorf("Expected an error for an unset variable")
+	}
+	if _, err := newSecret("file:" + path + ".missing").Value(); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
+
+func TestSecretFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := newSecret("file:" + path)
+	if value, _ := s.Value(); value != "old" {
+		t.Errorf("Expected '%s', but received '%s'", "old", value)
+	}
+	if err := ioutil.WriteFile(path, []byte("rotated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the file is checked once per interval
+	s.checked = time.Now().Add(-secretCheckInterval)
+	if value, _ := s.Value(); value != "rotated" {
+		t.Errorf("Expected '%s', but received '%s'", "rotated", value)
+	}
+	os.Remove(path)
+	s.checked = time.Now().Add(-secretCheckInterval)
+	if value, err := s.Value(); value != "rotated" || err != nil {
+		t.Errorf("Expected the last value to be kept, but received '%s' (%v)", value, err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// selfTestCheck is the result of a single self-test check.
+type selfTestCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type selfTestResult struct {
+	Status string          `json:"status"`
+	Checks []selfTestCheck `json:"checks"`
+}
+
+var (
+	configErrorMutex sync.Mutex
+	configError      error
+)
+
+// setConfigError remembers whether the last (re)load of the config failed.
+func setConfigError(err error) {
+	configErrorMutex.Lock()
+	configError = err
+	configErrorMutex.Unlock()
+}
+
+func newCheck(name string, err error, failing string) selfTestCheck {
+	if err != nil {
+		return selfTestCheck{Name: name, Status: failing, Error: err.Error()}
+	}
+	return selfTestCheck{Name: name, Status: "ok"}
+}
+
+// localAddress returns an address to connect to a listen address like :8888.
+func localAddress(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || host == "0.0.0.0" || host == "::" {
+		return net.JoinHostPort("localhost", port)
+	}
+	return addr
+}
+
+// selfTest verifies the listener, the config and the backend reachability.
+// Unreachable alternate backends are reported as "warn" without failing the
+// self-test, since they do not affect production traffic.
+func (h *handler) selfTest() selfTestResult {
+	result := selfTestResult{Status: "ok"}
+	timeout := time.Duration(*productionTimeout) * time.Millisecond
+
+	conn, err := net.DialTimeout("tcp", localAddress(*listen), timeout)
+	if err == nil {
+		conn.Close()
+	}
+	result.Checks = append(result.Checks, newCheck("listener", err, "fail"))
+
+	configErrorMutex.Lock()
+	err = configError
+	configErrorMutex.Unlock()
+	if err == nil && *configFile != "" {
+		_, err = loadConfig(*configFile)
+	}
+	result.Checks = append(result.Checks, newCheck("config", err, "fail"))
+
+	err = probeBackend(h.TargetScheme, h.Target, timeout)
+	result.Checks = append(result.Checks, newCheck("a "+h.TargetScheme+"://"+h.Target, err, "fail"))
+
+	timeout = time.Duration(*alternateTimeout) * time.Millisecond
+	for _, alt := range policyBackends(h.Policies()) {
+		if alt.template != nil {
+			continue
+		}
+		err = probeBackend(alt.AlternativeScheme, alt.Alternative, timeout)
+		result.Checks = append(result.Checks, newCheck("b "+alt.AlternativeScheme+"://"+alt.Alternative, err, "warn"))
+	}
+
+	for _, check := range result.Checks {
+		if check.Status == "fail" {
+			result.Status = "fail"
+		}
+	}
+	return result
+}
+
+// policyBackends returns the backends the policies mirror to, including the
+// members of their groups, each once.
+func policyBackends(policies []*policy) []*backend {
+	var backends []*backend
+	seen := make(map[*backend]bool)
+	add := func(members []*backend) {
+		for _, b := range members {
+			if !seen[b] {
+				seen[b] = true
+				backends = append(backends, b)
+			}
+		}
+	}
+	for _, p := range policies {
+		add(p.Backends)
+		for _, g := range p.Groups {
+			add(g.Members)
+		}
+	}
+	return backends
+}
+
+// selfTestHandler serves the self-test result, with status 503 if it failed.
+func (h *handler) selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	result := h.selfTest()
+	w.Header().Set("Content-Type", "application/json")
+	if result.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// selfTestCommand implements "teeproxy selftest -admin addr", it queries the
+// self-test endpoint of a running teeproxy and exits with 1 if it failed.
+func selfTestCommand() int {
+	if *adminListen == "" {
+		fmt.Fprintln(os.Stderr, "selftest requires the -admin address of the running teeproxy")
+		return 2
+	}
+	client := &http.Client{Timeout: time.Duration(*productionTimeout+*alternateTimeout)*time.Millisecond + 5*time.Second}
+	scheme := "http"
+	if *adminCertificate != "" {
+		// the instance is local, its certificate is not issued for localhost
+		scheme = "https"
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	request, err := http.NewRequest("GET", scheme+"://"+localAddress(*adminListen)+"/selftest", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "{\"status\":\"fail\",\"error\":%q}\n", err.Error())
+		return 1
+	}
+	token := *adminReadToken
+	if token == "" {
+		token = *adminWriteToken
+	}
+	if token != "" {
+		value, err := newSecret(token).Value()
+		if err != nil {
+			fmt.Fprintf(os.Stdout, "{\"status\":\"fail\",\"error\":%q}\n", err.Error())
+			return 1
+		}
+		request.Header.Set("Authorization", "Bearer "+value)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "{\"status\":\"fail\",\"error\":%q}\n", err.Error())
+		return 1
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	os.Stdout.Write(body)
+	if response.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
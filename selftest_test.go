@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelfTestProbesPolicyBackends(t *testing.T) {
+	h := newTestHandler("http://127.0.0.1:1", "http://127.0.0.1:2")
+	member := lookupBackend("http://127.0.0.1:3")
+	group := &backendGroup{Name: "canary", Members: []*backend{member, h.Alternatives[0]}, Count: 1}
+	h.SetPolicies(append(h.Policies(), &policy{Name: "canary", Percent: 100, Groups: []*backendGroup{group}}))
+
+	var probed []string
+	for _, check := range h.selfTest().Checks {
+		if strings.HasPrefix(check.Name, "b ") {
+			probed = append(probed, check.Name)
+		}
+	}
+	if expectation := "b http://127.0.0.1:2,b http://127.0.0.1:3"; strings.Join(probed, ",") != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, strings.Join(probed, ","))
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// In -mirror.sequential mode the duplicated requests are held until the
+// production target answered and only mirrored if it accepted the request,
+// so the shadow stack does not receive the traffic production rejects. With
+// -mirror.on-status other statuses can be selected, e.g. to mirror only the
+// requests production failed to the shadow as a debugging replay target.
+
+var mirrorSkippedTotal = newCounterVec("teeproxy_mirror_skipped_total",
+	"Number of mirrored requests not sent in sequential mode because of the production status.", "status")
+
+// statusRule matches the production statuses from min to max, or the
+// failed requests with status 0.
+type statusRule struct {
+	min, max int
+}
+
+// mirrorStatuses are the statuses of -mirror.on-status, nil for below 400.
+var mirrorStatuses []statusRule
+
+// parseStatusRules parses a comma separated list of status classes like 5xx,
+// codes like 404, ranges like 500-504 and error for failed requests.
+func parseStatusRules(list string) ([]statusRule, error) {
+	var rules []statusRule
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "error":
+			rules = append(rules, statusRule{0, 0})
+			continue
+		case len(entry) == 3 && strings.HasSuffix(entry, "xx") && entry[0] >= '1' && entry[0] <= '5':
+			class := int(entry[0]-'0') * 100
+			rules = append(rules, statusRule{class, class + 99})
+			continue
+		}
+		first, last, isRange := strings.Cut(entry, "-")
+		min, err := strconv.Atoi(first)
+		max := min
+		if err == nil && isRange {
+			max, err = strconv.Atoi(last)
+		}
+		if err != nil || min < 100 || max > 599 || min > max {
+			return nil, fmt.Errorf("invalid status %q, expected e.g. 5xx, 404, 500-504 or error", entry)
+		}
+		rules = append(rules, statusRule{min, max})
+	}
+	return rules, nil
+}
+
+// mirrorAccepted reports whether the requests are mirrored after the
+// production target answered with the status, 0 if the request failed.
+func mirrorAccepted(status int) bool {
+	if mirrorStatuses == nil {
+		return status != 0 && status < 400
+	}
+	for _, rule := range mirrorStatuses {
+		if rule.min <= status && status <= rule.max {
+			return true
+		}
+	}
+	return false
+}
+
+// heldMirrors are the mirrored requests of a request in sequential mode.
+type heldMirrors struct {
+	priority int
+	tasks    []*mirrorTask
+}
+
+// release dispatches the held requests if the production status is
+// accepted, it reports whether they were dispatched.
+func (m *heldMirrors) release(status int) bool {
+	if len(m.tasks) == 0 {
+		return true
+	}
+	tasks := m.tasks
+	m.tasks = nil
+	if !mirrorAccepted(status) {
+		label := "error"
+		if status != 0 {
+			label = strconv.Itoa(status)
+		}
+		mirrorSkippedTotal.Add(float64(len(tasks)), label)
+		return false
+	}
+	for _, task := range tasks {
+		dispatchMirror(m.priority, task)
+	}
+	return true
+}
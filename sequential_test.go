@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSequentialMirroring(t *testing.T) {
+	defer func(sequential bool) { *mirrorSequential = sequential }(*mirrorSequential)
+	*mirrorSequential = true
+
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rejected" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer production.Close()
+	mirroredPaths := make(chan string, 2)
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirroredPaths <- r.URL.Path
+	}))
+	defer alternate.Close()
+
+	h := newTestHandler(production.URL, alternate.URL)
+	for _, path := range []string{"/rejected", "/accepted"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	mirrorsInFlight.Wait()
+	close(mirroredPaths)
+	var mirrored []string
+	for path := range mirroredPaths {
+		mirrored = append(mirrored, path)
+	}
+	if len(mirrored) != 1 || mirrored[0] != "/accepted" {
+		t.Errorf("Expected '[/accepted]', but received '%v'", mirrored)
+	}
+}
+
+func TestMirrorOnStatus(t *testing.T) {
+	defer func(rules []statusRule) { mirrorStatuses = rules }(mirrorStatuses)
+	var err error
+	if mirrorStatuses, err = parseStatusRules("5xx, 404, 420-429, error"); err != nil {
+		t.Fatal(err)
+	}
+	for status, expectation := range map[int]bool{
+		0:   true,
+		200: false,
+		404: true,
+		403: false,
+		425: true,
+		500: true,
+		503: true,
+	} {
+		if accepted := mirrorAccepted(status); accepted != expectation {
+			t.Errorf("Expected '%v' for %d, but received '%v'", expectation, status, accepted)
+		}
+	}
+	for _, list := range []string{"6xx", "abc", "500-400", "99", ""} {
+		if _, err := parseStatusRules(list); err == nil {
+			t.Errorf("Expected '%s' to be invalid", list)
+		}
+	}
+}
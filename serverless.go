@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Alternate backends can be serverless functions without an HTTP front:
+//
+//	lambda://<function>[/<qualifier>]      AWS Lambda, invoked through its API
+//	gcf://<project>/<region>/<function>    Google Cloud Functions, called through its API
+//	cloudrun://<host>[/<base path>]        Google Cloud Run, with an ID token
+//
+// Lambda and Cloud Functions receive the mirrored request serialized as an
+// API Gateway HTTP API (payload format 2.0) event, and their result is turned
+// back into a response for the comparisons, a function error into a 502.
+// Lambda is signed with the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN credentials in -sign.region, $AWS_REGION or us-east-1.
+// Cloud Functions and Cloud Run authenticate with the tokens of the service
+// account of the metadata server, $GCE_METADATA_HOST if set. Cloud Run takes
+// the ID token in X-Serverless-Authorization, so the Authorization of the
+// client is forwarded as for any other backend.
+
+const (
+	lambdaScheme   = "lambda"
+	gcfScheme      = "gcf"
+	cloudRunScheme = "cloudrun"
+)
+
+var invocationsTotal = newCounterVec("teeproxy_invocations_total",
+	"Number of invocations of serverless backends by result, success, function-error or failed.", "backend", "result")
+
+// The API endpoints, replaced by the tests.
+var (
+	lambdaEndpoint = func(region string) string {
+		return "https://lambda." + region + ".amazonaws.com"
+	}
+	cloudFunctionsEndpoint = "https://cloudfunctions.googleapis.com"
+)
+
+// isServerless reports whether the scheme invokes a serverless backend.
+func isServerless(scheme string) bool {
+	return scheme == lambdaScheme || scheme == gcfScheme || scheme == cloudRunScheme
+}
+
+// parseBackendTarget parses the URL of an alternate backend, which may be a
+// serverless one.
+func parseBackendTarget(value string) (target, error) {
+	scheme, rest, _ := strings.Cut(value, "://")
+	if !isServerless(scheme) {
+		return parseTarget(value)
+	}
+	t, err := parseTarget("https://" + rest)
+	if err != nil {
+		return target{}, fmt.Errorf("%s backend: %v", scheme, err)
+	}
+	t.Scheme = scheme
+	segments := 0
+	if _, path, ok := strings.Cut(t.Endpoint, "/"); ok {
+		segments = len(strings.Split(path, "/"))
+	}
+	switch {
+	case scheme == lambdaScheme && segments > 1:
+		return target{}, fmt.Errorf("lambda backend %q: expected lambda://<function>[/<qualifier>]", t.Endpoint)
+	case scheme == gcfScheme && segments != 2:
+		return target{}, fmt.Errorf("gcf backend %q: expected gcf://<project>/<region>/<function>", t.Endpoint)
+	}
+	return t, nil
+}
+
+// invocationEvent is the request serialized as an API Gateway HTTP API event.
+type invocationEvent struct {
+	Version         string            `json:"version"`
+	RouteKey        string            `json:"routeKey"`
+	RawPath         string            `json:"rawPath"`
+	RawQueryString  string            `json:"rawQueryString"`
+	Cookies         []string          `json:"cookies,omitempty"`
+	Headers         map[string]string `json:"headers"`
+	RequestContext  invocationContext `json:"requestContext"`
+	Body            string            `json:"body,omitempty"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+}
+
+type invocationContext struct {
+	DomainName string `json:"domainName"`
+	HTTP       struct {
+		Method    string `json:"method"`
+		Path      string `json:"path"`
+		Protocol  string `json:"protocol"`
+		SourceIP  string `json:"sourceIp"`
+		UserAgent string `json:"userAgent"`
+	} `json:"http"`
+	RequestID string `json:"requestId"`
+	TimeEpoch int64  `json:"timeEpoch"`
+}
+
+// invocationResult is the response of a function in the API Gateway format.
+type invocationResult struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+	Cookies           []string            `json:"cookies"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// newInvocationEvent serializes the request, its path without the base path
+// of the backend.
+func newInvocationEvent(req *http.Request, basePath string) ([]byte, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	path := strings.TrimPrefix(req.URL.EscapedPath(), basePath)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	event := invocationEvent{
+		Version:        "2.0",
+		RouteKey:       "$default",
+		RawPath:        path,
+		RawQueryString: req.URL.RawQuery,
+		Headers:        make(map[string]string),
+	}
+	for name, values := range req.Header {
+		if name == "Cookie" {
+			for _, value := range values {
+				event.Cookies = append(event.Cookies, strings.Split(value, "; ")...)
+			}
+			continue
+		}
+		event.Headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	event.RequestContext.DomainName = req.Host
+	event.RequestContext.HTTP.Method = req.Method
+	event.RequestContext.HTTP.Path = path
+	event.RequestContext.HTTP.Protocol = req.Proto
+	event.RequestContext.HTTP.SourceIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+	event.RequestContext.HTTP.UserAgent = req.UserAgent()
+	event.RequestContext.RequestID = traceID(req)
+	event.RequestContext.TimeEpoch = time.Now().UnixNano() / int64(time.Millisecond)
+	if utf8.Valid(body) {
+		event.Body = string(body)
+	} else {
+		event.Body = base64.StdEncoding.EncodeToString(body)
+		event.IsBase64Encoded = true
+	}
+	return json.Marshal(event)
+}
+
+// invocationResponse turns the result of a function into a response, like
+// API Gateway a result without statusCode is a 200 with the result as JSON
+// body.
+func invocationResponse(req *http.Request, payload []byte) *http.Response {
+	response := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+	var result invocationResult
+	if json.Unmarshal(payload, &result) != nil || result.StatusCode == 0 {
+		response.Header.Set("Content-Type", "application/json")
+		response.Body = ioutil.NopCloser(bytes.NewReader(payload))
+		response.ContentLength = int64(len(payload))
+		return response
+	}
+	response.StatusCode = result.StatusCode
+	response.Status = strconv.Itoa(result.StatusCode) + " " + http.StatusText(result.StatusCode)
+	for name, values := range result.MultiValueHeaders {
+		for _, value := range values {
+			response.Header.Add(name, value)
+		}
+	}
+	for name, value := range result.Headers {
+		response.Header.Set(name, value)
+	}
+	for _, cookie := range result.Cookies {
+		response.Header.Add("Set-Cookie", cookie)
+	}
+	body := []byte(result.Body)
+	if result.IsBase64Encoded {
+		if decoded, err := base64.StdEncoding.DecodeString(result.Body); err == nil {
+			body = decoded
+		}
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+	response.ContentLength = int64(len(body))
+	return response
+}
+
+// functionError answers a failed invocation with 502 and the error.
+func functionError(req *http.Request, message []byte) *http.Response {
+	return &http.Response{
+		Status:        "502 Bad Gateway",
+		StatusCode:    http.StatusBadGateway,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(message)),
+		ContentLength: int64(len(message)),
+		Request:       req,
+	}
+}
+
+// invocationTransport invokes the serverless backend instead of sending the
+// request.
+type invocationTransport struct {
+	http.RoundTripper
+	backend *backend
+}
+
+// withInvocation invokes the serverless backends through the transport.
+func withInvocation(rt http.RoundTripper, b *backend) http.RoundTripper {
+	if !isServerless(b.AlternativeScheme) {
+		return rt
+	}
+	return &invocationTransport{RoundTripper: rt, backend: b}
+}
+
+func (t *invocationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var response *http.Response
+	var failed bool
+	var err error
+	switch t.backend.AlternativeScheme {
+	case lambdaScheme:
+		response, failed, err = t.invokeLambda(req)
+	case gcfScheme:
+		response, failed, err = t.callFunction(req)
+	default:
+		response, err = t.callCloudRun(req)
+	}
+	switch {
+	case err != nil:
+		invocationsTotal.Inc(t.backend.Alternative, "failed")
+	case failed:
+		invocationsTotal.Inc(t.backend.Alternative, "function-error")
+	default:
+		invocationsTotal.Inc(t.backend.Alternative, "success")
+	}
+	return response, err
+}
+
+// basePath returns the path of the backend endpoint, the qualifier of a
+// Lambda or the region and name of a Cloud Function.
+func (t *invocationTransport) basePath() string {
+	if _, path, ok := strings.Cut(t.backend.Alternative, "/"); ok {
+		return "/" + path
+	}
+	return ""
+}
+
+// readResult reads the body of an API response, closing it.
+func readResult(response *http.Response) ([]byte, error) {
+	defer response.Body.Close()
+	return ioutil.ReadAll(io.LimitReader(response.Body, 6<<20))
+}
+
+func (t *invocationTransport) invokeLambda(req *http.Request) (response *http.Response, failed bool, err error) {
+	credentials := awsCredentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.AccessKey == "" || credentials.SecretKey == "" {
+		return nil, false, fmt.Errorf("invoking lambda %s: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set", t.backend.Alternative)
+	}
+	region := *signRegion
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	event, err := newInvocationEvent(req, t.basePath())
+	if err != nil {
+		return nil, false, err
+	}
+	function, qualifier, _ := strings.Cut(t.backend.Alternative, "/")
+	invocation, err := http.NewRequestWithContext(req.Context(), "POST",
+		lambdaEndpoint(region)+"/2015-03-31/functions/"+function+"/invocations", bytes.NewReader(event))
+	if err != nil {
+		return nil, false, err
+	}
+	if qualifier != "" {
+		invocation.URL.RawQuery = "Qualifier=" + qualifier
+	}
+	invocation.Header.Set("Content-Type", "application/json")
+	signV4(invocation, sha256Hex(event), credentials, region, "lambda", time.Now())
+	response, err = t.RoundTripper.RoundTrip(invocation)
+	if err != nil {
+		return nil, false, err
+	}
+	if response.StatusCode != http.StatusOK {
+		// errors of the Lambda API, e.g. throttling, are passed on as is
+		return response, false, nil
+	}
+	payload, err := readResult(response)
+	if err != nil {
+		return nil, false, err
+	}
+	if response.Header.Get("X-Amz-Function-Error") != "" {
+		return functionError(req, payload), true, nil
+	}
+	return invocationResponse(req, payload), false, nil
+}
+
+func (t *invocationTransport) callFunction(req *http.Request) (response *http.Response, failed bool, err error) {
+	event, err := newInvocationEvent(req, t.basePath())
+	if err != nil {
+		return nil, false, err
+	}
+	call, _ := json.Marshal(map[string]string{"data": string(event)})
+	parts := strings.Split(t.backend.Alternative, "/")
+	invocation, err := http.NewRequestWithContext(req.Context(), "POST",
+		cloudFunctionsEndpoint+"/v1/projects/"+parts[0]+"/locations/"+parts[1]+"/functions/"+parts[2]+":call", bytes.NewReader(call))
+	if err != nil {
+		return nil, false, err
+	}
+	token, err := gcpTokens.Get("token")
+	if err != nil {
+		return nil, false, fmt.Errorf("fetching the access token: %v", err)
+	}
+	invocation.Header.Set("Authorization", "Bearer "+token)
+	invocation.Header.Set("Content-Type", "application/json")
+	response, err = t.RoundTripper.RoundTrip(invocation)
+	if err != nil {
+		return nil, false, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return response, false, nil
+	}
+	payload, err := readResult(response)
+	if err != nil {
+		return nil, false, err
+	}
+	var result struct {
+		Result string `json:"result"`
+		Error  string `json:"error"`
+	}
+	if err := json.Unmarshal(payload, &result); err != nil {
+		return nil, false, fmt.Errorf("invalid call response: %v", err)
+	}
+	if result.Error != "" {
+		message, _ := json.Marshal(map[string]string{"error": result.Error})
+		return functionError(req, message), true, nil
+	}
+	return invocationResponse(req, []byte(result.Result)), false, nil
+}
+
+func (t *invocationTransport) callCloudRun(req *http.Request) (*http.Response, error) {
+	audience := "https://" + endpointHost(t.backend.Alternative)
+	token, err := gcpTokens.Get("identity?audience=" + audience)
+	if err != nil {
+		return nil, fmt.Errorf("fetching the ID token: %v", err)
+	}
+	call := req.Clone(req.Context())
+	call.URL.Scheme = "https"
+	call.Header.Set("X-Serverless-Authorization", "Bearer "+token)
+	return t.RoundTripper.RoundTrip(call)
+}
+
+// metadataTokens caches the tokens of the service account from the metadata
+// server by their path. A token is fetched once for all the callers waiting
+// for it, without blocking the callers of the other paths.
+type metadataTokens struct {
+	client *http.Client
+
+	mu       sync.Mutex
+	tokens   map[string]string
+	expires  map[string]time.Time
+	fetching map[string]*metadataFetch
+}
+
+// metadataFetch is a token request in flight.
+type metadataFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+var gcpTokens = newMetadataTokens()
+
+func newMetadataTokens() *metadataTokens {
+	return &metadataTokens{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		tokens:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+		fetching: make(map[string]*metadataFetch),
+	}
+}
+
+// Get returns the token of the default service account, "token" for an
+// access token or "identity?audience=..." for an ID token.
+func (m *metadataTokens) Get(path string) (string, error) {
+	m.mu.Lock()
+	if token, ok := m.tokens[path]; ok && time.Now().Add(oauth2RefreshMargin).Before(m.expires[path]) {
+		m.mu.Unlock()
+		return token, nil
+	}
+	f, waiting := m.fetching[path]
+	if !waiting {
+		f = &metadataFetch{done: make(chan struct{})}
+		m.fetching[path] = f
+	}
+	m.mu.Unlock()
+	if waiting {
+		<-f.done
+		return f.token, f.err
+	}
+	token, expires, err := m.fetch(path)
+	m.mu.Lock()
+	delete(m.fetching, path)
+	if err == nil {
+		m.tokens[path], m.expires[path] = token, expires
+	}
+	m.mu.Unlock()
+	f.token, f.err = token, err
+	close(f.done)
+	return token, err
+}
+
+func (m *metadataTokens) fetch(path string) (string, time.Time, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+	request, err := http.NewRequest("GET", "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/"+path, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	request.Header.Set("Metadata-Flavor", "Google")
+	response, err := m.client.Do(request)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	body, err := readResult(response)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("metadata server returned %s: %s", response.Status, body)
+	}
+	// ID tokens are returned as is and valid for an hour
+	token, expires := string(body), time.Now().Add(time.Hour)
+	if path == "token" {
+		var access struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int64  `json:"expires_in"`
+		}
+		if err := json.Unmarshal(body, &access); err != nil || access.AccessToken == "" {
+			return "", time.Time{}, fmt.Errorf("invalid token response: %s", body)
+		}
+		token, expires = access.AccessToken, time.Now().Add(time.Duration(access.ExpiresIn)*time.Second)
+	}
+	return token, expires, nil
+}
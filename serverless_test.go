@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInvocationEvent(t *testing.T) {
+	req := httptest.NewRequest("POST", "lambda://checkout/live/orders/1?expand=items", strings.NewReader("\xff\xfe"))
+	req.Header.Set("Cookie", "session=abc; theme=dark")
+	req.Header.Set("X-Tenant", "acme")
+	payload, err := newInvocationEvent(req, "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event invocationEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.RawPath != "/orders/1" || event.RawQueryString != "expand=items" || event.RequestContext.HTTP.Method != "POST" {
+		t.Errorf("Expected 'POST /orders/1?expand=items', but received '%s %s?%s'", event.RequestContext.HTTP.Method, event.RawPath, event.RawQueryString)
+	}
+	if len(event.Cookies) != 2 || event.Headers["x-tenant"] != "acme" || event.Headers["cookie"] != "" {
+		t.Errorf("Expected the cookies apart from the headers, but received '%v' and '%v'", event.Cookies, event.Headers)
+	}
+	if !event.IsBase64Encoded || event.Body != "//4=" {
+		t.Errorf("Expected '%s', but received '%s'", "//4=", event.Body)
+	}
+}
+
+func TestInvocationResponse(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	response := invocationResponse(req, []byte(`{"statusCode": 201, "headers": {"content-type": "text/plain"}, "cookies": ["a=1"], "body": "created"}`))
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != 201 || response.Header.Get("Content-Type") != "text/plain" || response.Header.Get("Set-Cookie") != "a=1" || string(body) != "created" {
+		t.Errorf("Expected '201 created', but received '%d %s' with '%v'", response.StatusCode, body, response.Header)
+	}
+	response = invocationResponse(req, []byte(`{"id": 1}`))
+	if body, _ := ioutil.ReadAll(response.Body); response.StatusCode != 200 || string(body) != `{"id": 1}` {
+		t.Errorf("Expected '200 {\"id\": 1}', but received '%d %s'", response.StatusCode, body)
+	}
+}
+
+func TestParseBackendTarget(t *testing.T) {
+	for value, valid := range map[string]bool{
+		"lambda://checkout":            true,
+		"lambda://checkout/live":       true,
+		"lambda://checkout/live/v2":    false,
+		"gcf://project/europe-west1/f": true,
+		"gcf://project/f":              false,
+		"cloudrun://svc-abc.a.run.app": true,
+		"ftp://host":                   false,
+	} {
+		if _, err := parseBackendTarget(value); (err == nil) != valid {
+			t.Errorf("Expected valid '%v' for '%s', but received '%v'", valid, value, err)
+		}
+	}
+}
+
+func TestLambdaBackend(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "eu-west-1")
+	defer evictIdleConnections()
+
+	var mu sync.Mutex
+	var invocations []*http.Request
+	var events []invocationEvent
+	lambda := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event invocationEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		invocations = append(invocations, r)
+		events = append(events, event)
+		mu.Unlock()
+		if event.RawPath == "/fail" {
+			w.Header().Set("X-Amz-Function-Error", "Unhandled")
+			w.Write([]byte(`{"errorMessage": "boom"}`))
+			return
+		}
+		w.Write([]byte(`{"statusCode": 200, "body": "ok"}`))
+	}))
+	defer lambda.Close()
+	defer func(endpoint func(string) string) { lambdaEndpoint = endpoint }(lambdaEndpoint)
+	var region string
+	lambdaEndpoint = func(r string) string {
+		region = r
+		return lambda.URL
+	}
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer production.Close()
+
+	h := newTestHandler(strings.TrimPrefix(production.URL, "http://"), "lambda://checkout/live")
+	for _, path := range []string{"/orders/1", "/fail"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	mirrorsInFlight.Wait()
+
+	if len(invocations) != 2 {
+		t.Fatalf("Expected '2' invocations, but received '%d'", len(invocations))
+	}
+	invocation := invocations[0]
+	if invocation.URL.RequestURI() != "/2015-03-31/functions/checkout/invocations?Qualifier=live" || region != "eu-west-1" {
+		t.Errorf("Expected the invocation of checkout:live in eu-west-1, but received '%s' in '%s'", invocation.URL.RequestURI(), region)
+	}
+	if !strings.Contains(invocation.Header.Get("Authorization"), "/eu-west-1/lambda/aws4_request") {
+		t.Errorf("Expected a lambda signature, but received '%s'", invocation.Header.Get("Authorization"))
+	}
+	if events[0].RawPath != "/orders/1" {
+		t.Errorf("Expected '%s', but received '%s'", "/orders/1", events[0].RawPath)
+	}
+	for result, expectation := range map[string]float64{"success": 1, "function-error": 1} {
+		if value := invocationsTotal.values[labelKey([]string{"checkout/live", result})]; value != expectation {
+			t.Errorf("Expected '%v' %s invocations, but received '%v'", expectation, result, value)
+		}
+	}
+}
+
+func TestCloudFunctionBackend(t *testing.T) {
+	defer evictIdleConnections()
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" || r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"access_token": "ya29.token", "expires_in": 3599}`))
+	}))
+	defer metadata.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(metadata.URL, "http://"))
+
+	var call *http.Request
+	var data string
+	functions := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Data string }
+		json.NewDecoder(r.Body).Decode(&body)
+		call, data = r, body.Data
+		w.Write([]byte(`{"executionId": "1", "result": "{\"statusCode\": 204}"}`))
+	}))
+	defer functions.Close()
+	defer func(endpoint string) { cloudFunctionsEndpoint = endpoint }(cloudFunctionsEndpoint)
+	cloudFunctionsEndpoint = functions.URL
+
+	b := lookupBackend("gcf://shadow-project/europe-west1/search")
+	req := httptest.NewRequest("GET", "/search?q=teeproxy", nil)
+	setRequestTarget(req, b.Alternative, b.AlternativeScheme)
+	response, err := b.Transport().RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 204 {
+		t.Errorf("Expected '%d', but received '%d'", 204, response.StatusCode)
+	}
+	if call.URL.Path != "/v1/projects/shadow-project/locations/europe-west1/functions/search:call" || call.Header.Get("Authorization") != "Bearer ya29.token" {
+		t.Errorf("Expected an authorized call of search, but received '%s' with '%s'", call.URL.Path, call.Header.Get("Authorization"))
+	}
+	var event invocationEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil || event.RawPath != "/search" || event.RawQueryString != "q=teeproxy" {
+		t.Errorf("Expected the serialized request of '/search?q=teeproxy', but received '%s'", data)
+	}
+}
+
+func TestMetadataTokensFetchOutsideLock(t *testing.T) {
+	release := make(chan struct{})
+	var slowRequests int32
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("audience") == "https://slow" {
+			atomic.AddInt32(&slowRequests, 1)
+			<-release
+		}
+		w.Write([]byte("id-token"))
+	}))
+	defer metadata.Close()
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(metadata.URL, "http://"))
+
+	tokens := newMetadataTokens()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := tokens.Get("identity?audience=https://slow"); err != nil || token != "id-token" {
+				t.Errorf("Expected 'id-token', but received '%s' (%v)", token, err)
+			}
+		}()
+	}
+	for atomic.LoadInt32(&slowRequests) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := tokens.Get("identity?audience=https://fast")
+		fetched <- err
+	}()
+	select {
+	case err := <-fetched:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the token of another audience not to wait for the slow one")
+	}
+	close(release)
+	wg.Wait()
+	if count := atomic.LoadInt32(&slowRequests); count != 1 {
+		t.Errorf("Expected '1' request for the waiting callers, but received '%d'", count)
+	}
+}
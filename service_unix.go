@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// runService returns false, teeproxy runs as a service only on Windows. On
+// Unix use a supervisor like systemd together with -pidfile.
+func runService(serve func(), stop func()) bool {
+	return false
+}
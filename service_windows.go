@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Running as a Windows service using the service control manager API of
+// advapi32.dll directly.
+
+var runAsService = flag.Bool("service", false, "run as a Windows service started by the service control manager")
+
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped     = 1
+	serviceStopPending = 3
+	serviceRunning     = 4
+
+	serviceAcceptStop     = 1
+	serviceAcceptShutdown = 4
+
+	serviceControlStop     = 1
+	serviceControlShutdown = 5
+)
+
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+type serviceTableEntry struct {
+	ServiceName *uint16
+	ServiceProc uintptr
+}
+
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+type windowsService struct {
+	name    *uint16
+	handle  uintptr
+	serve   func()
+	stop    func()
+	stopped chan struct{}
+	once    sync.Once
+}
+
+var service *windowsService
+
+// runService runs teeproxy as a Windows service if -service is set, it returns
+// once the service was stopped and drained, for the recordings and the log to
+// be flushed like after serving in the foreground.
+func runService(serve func(), stop func()) bool {
+	if !*runAsService {
+		return false
+	}
+	name, _ := syscall.UTF16PtrFromString("teeproxy")
+	service = &windowsService{name: name, serve: serve, stop: stop, stopped: make(chan struct{})}
+	table := []serviceTableEntry{
+		{ServiceName: name, ServiceProc: syscall.NewCallback(serviceMain)},
+		{},
+	}
+	if r, _, err := procStartServiceCtrlDispatcher.Call(uintptr(unsafe.Pointer(&table[0]))); r == 0 {
+		fatalf("Failed to run as Windows service: %s", err)
+	}
+	return true
+}
+
+func serviceMain(argc uint32, argv **uint16) uintptr {
+	handle, _, err := procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(service.name)), syscall.NewCallback(serviceHandler), 0)
+	if handle == 0 {
+		log.Printf("Failed to register the service control handler: %s", err)
+		return 0
+	}
+	service.handle = handle
+	service.setStatus(serviceRunning, serviceAcceptStop|serviceAcceptShutdown)
+	go service.serve()
+	<-service.stopped
+	service.setStatus(serviceStopped, 0)
+	return 0
+}
+
+func serviceHandler(control uint32, eventType uint32, eventData uintptr, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		service.setStatus(serviceStopPending, 0)
+		go service.once.Do(func() {
+			service.stop()
+			close(service.stopped)
+		})
+	}
+	return 0
+}
+
+func (s *windowsService) setStatus(state uint32, accepts uint32) {
+	status := serviceStatus{
+		ServiceType:      serviceWin32OwnProcess,
+		CurrentState:     state,
+		ControlsAccepted: accepts,
+	}
+	procSetServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&status)))
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals toggles mirroring on SIGUSR1, reloads on SIGHUP and shuts
+// down gracefully on SIGINT and SIGTERM.
+func handleSignals(stop func(), reload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGUSR1:
+				setMirroringPaused(!mirroringPaused(), "SIGUSR1")
+			case syscall.SIGHUP:
+				reload()
+			default:
+				go stop()
+			}
+		}
+	}()
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+)
+
+// handleSignals shuts down gracefully on Ctrl+C. There is no SIGUSR1 and
+// SIGHUP on Windows, use the admin endpoints to pause mirroring instead.
+func handleSignals(stop func(), reload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		for range signals {
+			go stop()
+		}
+	}()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requests to backends fronted by an API gateway can be signed with AWS
+// Signature Version 4, the credentials taken from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or with an HMAC-SHA256 of the
+// timestamp, method, URI and body in a header.
+
+type signer struct {
+	// SigV4 signs for the AWS Service, HMAC otherwise.
+	SigV4       bool
+	Service     string
+	Region      string
+	Credentials awsCredentials
+
+	HMACKey    *secret
+	HMACHeader string
+}
+
+// parseSigner creates the signer of -a.sign or -b.sign, sigv4:<service> or
+// hmac, nil if empty.
+func parseSigner(spec string) (*signer, error) {
+	kind, service, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "":
+		return nil, nil
+	case "sigv4":
+		if service == "" {
+			return nil, fmt.Errorf("sigv4 requires the service, e.g. sigv4:execute-api")
+		}
+		s := &signer{SigV4: true, Service: service, Region: *signRegion, Credentials: awsCredentials{
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}}
+		if s.Region == "" {
+			s.Region = os.Getenv("AWS_REGION")
+		}
+		if s.Region == "" {
+			s.Region = "us-east-1"
+		}
+		if s.Credentials.AccessKey == "" || s.Credentials.SecretKey == "" {
+			return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+		}
+		return s, nil
+	case "hmac":
+		if *signHMACKey == "" {
+			return nil, fmt.Errorf("hmac requires -sign.hmac.key")
+		}
+		s := &signer{HMACKey: newSecret(*signHMACKey), HMACHeader: *signHMACHeader}
+		if _, err := s.HMACKey.Value(); err != nil {
+			return nil, fmt.Errorf("-sign.hmac.key: %v", err)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown signing %q, expected sigv4:<service> or hmac", spec)
+}
+
+// Sign adds the signature headers to the request, buffering its body to
+// hash it.
+func (s *signer) Sign(req *http.Request, now time.Time) error {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return err
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(body)), nil }
+		req.ContentLength = int64(len(body))
+	}
+	payloadHash := sha256Hex(body)
+	if s.SigV4 {
+		signV4(req, payloadHash, s.Credentials, s.Region, s.Service, now)
+		return nil
+	}
+	key, err := s.HMACKey.Value()
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set(s.HMACHeader, "t="+timestamp+",v1="+hmacSignature(key, timestamp, req.Method, req.URL.RequestURI(), payloadHash))
+	return nil
+}
+
+// hmacSignature returns the hex HMAC-SHA256 of the timestamp, method, URI and
+// body hash.
+func hmacSignature(key, timestamp, method, uri, payloadHash string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", timestamp, method, uri, payloadHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signingTransport signs the requests before sending them.
+type signingTransport struct {
+	http.RoundTripper
+	signer *signer
+	// production applies -a.transform-failure if the signing fails
+	production bool
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if redirectedAway(req) {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	sign := func(signed *http.Request) error {
+		return t.signer.Sign(signed, time.Now())
+	}
+	if t.production {
+		signed, err := transformProduction("signing", req, sign)
+		if err != nil {
+			return nil, err
+		}
+		return t.RoundTripper.RoundTrip(signed)
+	}
+	signed := req.Clone(req.Context())
+	if err := sign(signed); err != nil {
+		return nil, err
+	}
+	return t.RoundTripper.RoundTrip(signed)
+}
+
+// withSigner wraps the transport to sign the requests if the signer is set.
+func withSigner(transport http.RoundTripper, s *signer) http.RoundTripper {
+	if s == nil {
+		return transport
+	}
+	return &signingTransport{RoundTripper: transport, signer: s}
+}
+
+// withProductionSigner wraps the production transport to sign the requests
+// of -a.sign, a failure handled by -a.transform-failure.
+func withProductionSigner(transport http.RoundTripper, s *signer) http.RoundTripper {
+	if s == nil {
+		return transport
+	}
+	return &signingTransport{RoundTripper: transport, signer: s, production: true}
+}
+
+// productionSigner and alternateSigner sign the requests of -a.sign and -b.sign.
+var productionSigner, alternateSigner *signer
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACSigning(t *testing.T) {
+	defer func(key string) { *signHMACKey = key }(*signHMACKey)
+	*signHMACKey = "secret"
+	s, err := parseSigner("hmac")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Signature")
+	}))
+	defer server.Close()
+	transport := withSigner(getTransport("http", time.Second, false), s)
+	request, _ := http.NewRequest("POST", server.URL+"/orders?id=1", strings.NewReader("body"))
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if request.Header.Get("X-Signature") != "" {
+		t.Errorf("Expected the original request to be unchanged")
+	}
+
+	timestamp := strings.TrimPrefix(strings.Split(signature, ",")[0], "t=")
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(timestamp + "\nPOST\n/orders?id=1\n" + sha256Hex([]byte("body"))))
+	if expectation := "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil)); signature != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, signature)
+	}
+}
+
+func TestSigV4Signing(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "")
+	s, err := parseSigner("sigv4:execute-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, _ := http.NewRequest("GET", "https://api.example.com/items", nil)
+	if err := s.Sign(request, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if authorization := request.Header.Get("Authorization"); !strings.HasPrefix(authorization,
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240101/us-east-1/execute-api/aws4_request") {
+		t.Errorf("Expected a SigV4 authorization, but received '%s'", authorization)
+	}
+	for _, spec := range []string{"sigv4", "rsa"} {
+		if _, err := parseSigner(spec); err == nil {
+			t.Errorf("Expected '%s' to be invalid", spec)
+		}
+	}
+}
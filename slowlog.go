@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var slowRequestCounter uint64
+
+// slowRequest collects the outcomes of the mirrored requests, so they can be
+// logged together with a slow production request.
+type slowRequest struct {
+	id uint64
+
+	mu       sync.Mutex
+	slow     bool
+	outcomes []string
+}
+
+func newSlowRequest() *slowRequest {
+	if *slowLog <= 0 || !*slowLogMirrors {
+		return nil
+	}
+	return &slowRequest{id: atomic.AddUint64(&slowRequestCounter, 1)}
+}
+
+// addOutcome records how a mirrored request did, it is logged right away if
+// the production request already turned out to be slow.
+func (s *slowRequest) addOutcome(backend string, response *http.Response, elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+	status := "failed"
+	if response != nil {
+		status = response.Status
+	}
+	outcome := fmt.Sprintf("| SLOW B | #%d %s %s in %v", s.id, backend, status, elapsed)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.slow {
+		log.Print(outcome)
+	} else {
+		s.outcomes = append(s.outcomes, outcome)
+	}
+}
+
+func (s *slowRequest) markSlow() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slow = true
+	for _, outcome := range s.outcomes {
+		log.Print(outcome)
+	}
+	s.outcomes = nil
+}
+
+// logSlowRequest logs the details of a production request that exceeded the
+// -slowlog threshold.
+func logSlowRequest(s *slowRequest, request *http.Request, route string, response *http.Response, elapsed time.Duration) {
+	if *slowLog <= 0 || elapsed < time.Duration(*slowLog)*time.Millisecond {
+		return
+	}
+	status := "failed"
+	if response != nil {
+		status = response.Status
+	}
+	var id string
+	if s != nil {
+		id = fmt.Sprintf("#%d ", s.id)
+	}
+	log.Printf("| SLOW A | %s\"%s %s %v\" %s in %v route=%s host=%s remote=%s headers=%s",
+		id, request.Method, request.URL.RequestURI(), request.Proto, status, elapsed,
+		route, request.Host, request.RemoteAddr, formatHeaders(request.Header))
+	s.markSlow()
+}
+
+// formatHeaders formats the headers sorted by name in a single line.
+func formatHeaders(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var fields []string
+	for _, name := range names {
+		fields = append(fields, fmt.Sprintf("%s=%q", name, strings.Join(header[name], ", ")))
+	}
+	return "[" + strings.Join(fields, " ") + "]"
+}
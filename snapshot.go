@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// POST /record/snapshot?seconds=N&requests=M records the production exchanges
+// of the next N seconds, or the next M requests, whichever comes first, to a
+// new file in -snapshot.dir, so that a traffic sample can be taken during an
+// incident without restarting with -record. The file is written in the
+// -record.format with the -record.anonymize profile and its path returned
+// right away. GET /record/snapshot returns the state of the last snapshot.
+
+// snapshotGrace is how long a snapshot waits for the exchanges in flight
+// when it ends before closing its file.
+const snapshotGrace = 30 * time.Second
+
+// snapshot records the production exchanges for a while.
+type snapshot struct {
+	Path     string    `json:"path"`
+	Until    time.Time `json:"until"`
+	Requests int       `json:"requests,omitempty"`
+
+	sink exchangeSink
+
+	mu       sync.Mutex
+	admitted int
+	recorded int
+	pending  int
+	ended    bool
+	closed   bool
+}
+
+// currentSnapshot holds the last *snapshot.
+var currentSnapshot atomic.Value
+
+func init() {
+	adminMux.HandleFunc("/record/snapshot", snapshotHandler)
+}
+
+// snapshotSink returns the sink of the running snapshot if it takes the
+// request, nil otherwise.
+func snapshotSink() exchangeSink {
+	s, _ := currentSnapshot.Load().(*snapshot)
+	if s == nil || !s.admit(time.Now()) {
+		return nil
+	}
+	return s
+}
+
+// admit reports whether the snapshot records another exchange.
+func (s *snapshot) admit(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended || !now.Before(s.Until) || s.Requests > 0 && s.admitted >= s.Requests {
+		return false
+	}
+	s.admitted++
+	s.pending++
+	return true
+}
+
+func (s *snapshot) Write(e *exchange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		recordingsDropped.Inc("snapshot")
+		return nil
+	}
+	s.recorded++
+	s.pending--
+	err := s.sink.Write(e)
+	if s.pending == 0 && (s.ended || s.Requests > 0 && s.admitted >= s.Requests) {
+		s.closeLocked()
+	}
+	return err
+}
+
+// end stops admitting exchanges and closes the file once the exchanges in
+// flight are written, or after snapshotGrace.
+func (s *snapshot) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+	if s.pending == 0 {
+		s.closeLocked()
+		return
+	}
+	time.AfterFunc(snapshotGrace, func() { s.Close() })
+}
+
+func (s *snapshot) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked()
+	return nil
+}
+
+func (s *snapshot) closeLocked() {
+	if s.closed {
+		return
+	}
+	s.ended = true
+	s.closed = true
+	if err := s.sink.Close(); err != nil {
+		log.Printf("Failed to close the snapshot %s: %s", s.Path, err)
+	}
+	log.Printf("Snapshot %s recorded %d exchanges", s.Path, s.recorded)
+}
+
+// status returns the state of the snapshot as served by /record/snapshot.
+func (s *snapshot) status() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"path":     s.Path,
+		"until":    s.Until,
+		"requests": s.Requests,
+		"recorded": s.recorded,
+		"active":   !s.closed,
+	}
+}
+
+// startSnapshot creates the file of a snapshot of the given seconds and
+// requests, 0 for no request limit.
+func startSnapshot(seconds, requests int, now time.Time) (*snapshot, error) {
+	dir := *snapshotDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	extension := ".ndjson"
+	if *recordFormat == "protobuf" {
+		extension = ".pb"
+	}
+	path := filepath.Join(dir, "teeproxy-snapshot-"+now.UTC().Format("20060102T150405.000")+extension)
+	// the exchanges are not anonymized by default, and the temporary
+	// directory is shared
+	file, err := createFileSink(path, *recordFormat)
+	if err != nil {
+		return nil, err
+	}
+	anonymized, err := withAnonymizer(file, *recordAnonymize)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s := &snapshot{
+		Path:     path,
+		Until:    now.Add(time.Duration(seconds) * time.Second),
+		Requests: requests,
+		sink:     newAsyncSink("snapshot", anonymized, 1024),
+	}
+	time.AfterFunc(s.Until.Sub(now), s.end)
+	return s, nil
+}
+
+// snapshotHandler serves /record/snapshot.
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	last, _ := currentSnapshot.Load().(*snapshot)
+	if r.Method == "GET" || r.Method == "HEAD" {
+		if last == nil {
+			http.Error(w, "no snapshot taken", http.StatusNotFound)
+			return
+		}
+		writeSnapshotStatus(w, http.StatusOK, last)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	seconds, requests := *snapshotMaxSeconds, 0
+	var err error
+	if value := r.FormValue("seconds"); value != "" {
+		if seconds, err = strconv.Atoi(value); err != nil || seconds <= 0 || seconds > *snapshotMaxSeconds {
+			http.Error(w, fmt.Sprintf("seconds must be between 1 and %d", *snapshotMaxSeconds), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.FormValue("requests"); value != "" {
+		if requests, err = strconv.Atoi(value); err != nil || requests <= 0 {
+			http.Error(w, "requests must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	if last != nil && last.status()["active"] == true {
+		http.Error(w, "a snapshot is being taken, see GET /record/snapshot", http.StatusConflict)
+		return
+	}
+	s, err := startSnapshot(seconds, requests, time.Now())
+	if err != nil {
+		log.Printf("Failed to start a snapshot: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	currentSnapshot.Store(s)
+	log.Printf("Snapshot of %d seconds and %d requests to %s started by %s", seconds, requests, s.Path, adminSource(r))
+	audit(adminSource(r), "snapshot", nil, s.Path)
+	writeSnapshotStatus(w, http.StatusCreated, s)
+}
+
+func writeSnapshotStatus(w http.ResponseWriter, code int, s *snapshot) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(s.status())
+}
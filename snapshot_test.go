@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	defer func(v string) { *snapshotDir = v }(*snapshotDir)
+	*snapshotDir = t.TempDir()
+	defer currentSnapshot.Store((*snapshot)(nil))
+	defer evictIdleConnections()
+
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer production.Close()
+	h := newTestHandler(production.URL)
+
+	for query, expectation := range map[string]int{
+		"seconds=0":      http.StatusBadRequest,
+		"seconds=100000": http.StatusBadRequest,
+		"requests=x":     http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		adminMux.ServeHTTP(w, httptest.NewRequest("POST", "/record/snapshot?"+query, nil))
+		if w.Code != expectation {
+			t.Errorf("Expected '%d' for %s, but received '%d'", expectation, query, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	adminMux.ServeHTTP(w, httptest.NewRequest("POST", "/record/snapshot?seconds=60&requests=2", nil))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected '%d', but received '%d' %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var status struct {
+		Path     string `json:"path"`
+		Recorded int    `json:"recorded"`
+		Active   bool   `json:"active"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if !status.Active || status.Path == "" {
+		t.Errorf("Unexpected status %s", w.Body.String())
+	}
+	if info, err := os.Stat(status.Path); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected a file only the user can read, but received '%v'", info.Mode())
+	}
+
+	w = httptest.NewRecorder()
+	adminMux.ServeHTTP(w, httptest.NewRequest("POST", "/record/snapshot", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusConflict, w.Code)
+	}
+
+	for _, path := range []string{"/one", "/two", "/three"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	w = httptest.NewRecorder()
+	adminMux.ServeHTTP(w, httptest.NewRequest("GET", "/record/snapshot", nil))
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status.Active || status.Recorded != 2 {
+		t.Errorf("Expected the snapshot to end after 2 requests, but received %s", w.Body.String())
+	}
+	// the file is complete once the status is inactive
+	data, err := ioutil.ReadFile(status.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("Expected '2' exchanges, but received '%d'", len(lines))
+	}
+	var e exchange
+	if err := json.Unmarshal(lines[1], &e); err != nil || e.URI != "/two" {
+		t.Errorf("Expected '/two', but received '%s' %v", e.URI, err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Source feeds inbound requests into the fan-out of the handler. Besides the
+// live HTTP listener, recorded files, a Redis list and pcap captures run the
+// same mirroring and comparison pipeline offline.
+type Source interface {
+	// Serve passes the requests to the handler until the source is closed or,
+	// for offline sources, exhausted and all mirrored requests completed.
+	Serve(h http.Handler) error
+	// Close stops the source, waiting up to -shutdown.timeout for the
+	// in-flight requests.
+	Close() error
+	String() string
+}
+
+// newSource creates the source of -source: file:<path>, redis:<list> or
+// pcap:<path>.
+func newSource(spec string) (Source, error) {
+	kind, location, _ := strings.Cut(spec, ":")
+	if location == "" {
+		return nil, fmt.Errorf("invalid source %q, expected file:<path>, redis:<list> or pcap:<path>", spec)
+	}
+	if *sourceConcurrency <= 0 {
+		return nil, fmt.Errorf("-source.concurrency must be positive")
+	}
+	switch kind {
+	case "file":
+		file, err := openRecording(location)
+		if err != nil {
+			return nil, err
+		}
+		decoder := newExchangeDecoder(file, *recordFormat)
+		return &exchangeSource{name: spec, next: decoder.Decode, paced: true, closer: file}, nil
+	case "redis":
+		if *redisAddress == "" {
+			return nil, fmt.Errorf("the redis source requires -redis")
+		}
+		client, err := newRedisClient(*redisAddress, redisListTimeout+time.Duration(*productionTimeout)*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+		source := &exchangeSource{name: spec}
+		source.next = func() (*exchange, error) { return popExchange(client, location, &source.closed) }
+		return source, nil
+	case "pcap":
+		exchanges, err := readPcapFile(location)
+		if err != nil {
+			return nil, err
+		}
+		source := &exchangeSource{name: spec, paced: true}
+		source.next = func() (*exchange, error) {
+			if len(exchanges) == 0 {
+				return nil, io.EOF
+			}
+			e := exchanges[0]
+			exchanges = exchanges[1:]
+			return e, nil
+		}
+		return source, nil
+	}
+	return nil, fmt.Errorf("unknown source %q, expected file:<path>, redis:<list> or pcap:<path>", spec)
+}
+
+// httpSource serves the requests of the clients on the listener.
+type httpSource struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+func (s *httpSource) Serve(h http.Handler) error {
+	s.server.Handler = h
+	if *preserveHeaders {
+		s.server.Handler = restoreTLS(h)
+	}
+	if err := s.server.Serve(s.listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (s *httpSource) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*shutdownTimeout)*time.Millisecond)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+func (s *httpSource) String() string {
+	return s.listener.Addr().String()
+}
+
+// exchangeSource passes recorded exchanges to the handler, the production
+// responses are discarded.
+type exchangeSource struct {
+	name string
+	next func() (*exchange, error)
+	// paced sources keep the recorded timing scaled by -replay.speed
+	paced  bool
+	closer io.Closer
+	closed int32
+}
+
+func (s *exchangeSource) Serve(h http.Handler) error {
+	var requests sync.WaitGroup
+	// slots bounds the requests in flight, e.g. with -replay.speed 0
+	slots := make(chan struct{}, *sourceConcurrency)
+	var first time.Time
+	start := time.Now()
+	var err error
+	for atomic.LoadInt32(&s.closed) == 0 {
+		var e *exchange
+		if e, err = s.next(); err != nil {
+			break
+		}
+		if e == nil || e.Side == "b" || len(e.Frames) > 0 {
+			// nothing received, a mirrored exchange or a WebSocket session
+			continue
+		}
+		if first.IsZero() {
+			first = e.Time
+		}
+		if s.paced && *replaySpeed > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(e.Time.Sub(first)) / *replaySpeed))))
+		}
+		request, err := sourceRequest(e)
+		if err != nil {
+			log.Printf("Skipping \"%s %s\" of %s: %s", e.Method, e.URI, s.name, err)
+			continue
+		}
+		slots <- struct{}{}
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			defer func() { <-slots }()
+			h.ServeHTTP(&discardResponse{header: make(http.Header)}, request)
+		}()
+	}
+	requests.Wait()
+	mirrorsInFlight.Wait()
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+func (s *exchangeSource) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+func (s *exchangeSource) String() string {
+	return s.name
+}
+
+// sourceRequest creates the inbound request of a recorded exchange.
+func sourceRequest(e *exchange) (*http.Request, error) {
+	var body bytes.Buffer
+	for _, c := range e.RequestChunks {
+		body.Write(c.Data)
+	}
+	request, err := http.NewRequest(e.Method, e.URI, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	if body.Len() == 0 {
+		request.Body = http.NoBody
+	}
+	request.RequestURI = e.URI
+	request.Host = e.Host
+	if e.Header != nil {
+		request.Header = e.Header.Clone()
+	}
+	if major, minor, ok := http.ParseHTTPVersion(e.Proto); ok {
+		request.Proto, request.ProtoMajor, request.ProtoMinor = e.Proto, major, minor
+	}
+	return withHeaderOrder(request, e.HeaderOrder), nil
+}
+
+// discardResponse is the ResponseWriter of the offline sources.
+type discardResponse struct {
+	header http.Header
+	status int
+}
+
+func (r *discardResponse) Header() http.Header { return r.header }
+
+func (r *discardResponse) WriteHeader(status int) { r.status = status }
+
+func (r *discardResponse) Write(p []byte) (int, error) { return len(p), nil }
+
+// redisListTimeout is how long BLPOP waits for an exchange on the list.
+const redisListTimeout = time.Second
+
+// popExchange takes the next exchange pushed to the Redis list in the
+// -record.format, it returns nil if none arrived in time.
+func popExchange(client *redisClient, list string, closed *int32) (*exchange, error) {
+	reply, err := client.Do("BLPOP", list, fmt.Sprint(redisListTimeout.Seconds()))
+	if err != nil {
+		if atomic.LoadInt32(closed) != 0 {
+			return nil, io.EOF
+		}
+		log.Printf("Failed to read the source list %s: %s", list, err)
+		time.Sleep(redisListTimeout)
+		return nil, nil
+	}
+	values, _ := reply.([]interface{})
+	if len(values) != 2 {
+		return nil, nil
+	}
+	data, _ := values[1].(string)
+	e := new(exchange)
+	if *recordFormat == "protobuf" {
+		e, err = unmarshalExchange([]byte(data))
+	} else {
+		err = json.Unmarshal([]byte(data), e)
+	}
+	if err != nil {
+		log.Printf("Skipping an invalid exchange of the source list %s: %s", list, err)
+		return nil, nil
+	}
+	return e, nil
+}
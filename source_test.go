@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFileSource(t *testing.T) {
+	defer func(speed float64) { *replaySpeed = speed }(*replaySpeed)
+	*replaySpeed = 0
+
+	var mutex sync.Mutex
+	var received []string
+	backend := func(side string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			mutex.Lock()
+			received = append(received, side+" "+r.Method+" "+r.URL.RequestURI()+" "+string(body))
+			mutex.Unlock()
+		}))
+	}
+	production, alternate := backend("A"), backend("B")
+	defer production.Close()
+	defer alternate.Close()
+
+	filename := filepath.Join(t.TempDir(), "recording.ndjson")
+	var data []byte
+	for _, e := range []*exchange{
+		{Time: time.Now(), Side: "a", Method: "GET", URI: "/users?id=1", Proto: "HTTP/1.1", Host: "example.com"},
+		{Time: time.Now(), Side: "a", Method: "POST", URI: "/users", Proto: "HTTP/1.1", Host: "example.com",
+			Header: http.Header{"Content-Type": {"text/plain"}}, RequestChunks: []chunk{{Data: []byte("new")}}},
+		{Time: time.Now(), Side: "b", Method: "GET", URI: "/mirrored", Proto: "HTTP/1.1"},
+	} {
+		line, err := encodeExchange(e, "json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, line...)
+	}
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := newSource("file:" + filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	if err := source.Serve(newTestHandler(production.URL, alternate.URL)); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(received)
+	expected := []string{"A GET /users?id=1 ", "A POST /users new", "B GET /users?id=1 ", "B POST /users new"}
+	if len(received) != len(expected) {
+		t.Fatalf("Expected '%v', but received '%v'", expected, received)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Errorf("Expected '%s', but received '%s'", expected[i], received[i])
+		}
+	}
+}
+
+func TestFileSourceConcurrency(t *testing.T) {
+	defer func(speed float64, concurrency int) { *replaySpeed, *sourceConcurrency = speed, concurrency }(*replaySpeed, *sourceConcurrency)
+	*replaySpeed, *sourceConcurrency = 0, 2
+
+	var inFlight, most int32
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			seen := atomic.LoadInt32(&most)
+			if current <= seen || atomic.CompareAndSwapInt32(&most, seen, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer production.Close()
+	defer evictIdleConnections()
+
+	filename := filepath.Join(t.TempDir(), "recording.ndjson")
+	var data []byte
+	for i := 0; i < 10; i++ {
+		line, err := encodeExchange(&exchange{Time: time.Now(), Side: "a", Method: "GET", URI: "/", Proto: "HTTP/1.1"}, "json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, line...)
+	}
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	source, err := newSource("file:" + filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	if err := source.Serve(newTestHandler(production.URL)); err != nil {
+		t.Fatal(err)
+	}
+	if most := atomic.LoadInt32(&most); most > 2 {
+		t.Errorf("Expected at most '2' requests at a time, but received '%d'", most)
+	}
+}
+
+// pcapPacket frames a TCP segment from 10.0.0.1:40000 to 10.0.0.2:80 in
+// Ethernet and IPv4.
+func pcapPacket(seq uint32, payload string) []byte {
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:2], 40000)
+	binary.BigEndian.PutUint16(tcp[2:4], 80)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	tcp[12] = 5 << 4
+	tcp = append(tcp, payload...)
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(tcp)))
+	ip[9] = 6
+	copy(ip[12:16], []byte{10, 0, 0, 1})
+	copy(ip[16:20], []byte{10, 0, 0, 2})
+	ethernet := make([]byte, 14)
+	binary.BigEndian.PutUint16(ethernet[12:14], 0x0800)
+	return append(append(ethernet, ip...), tcp...)
+}
+
+func TestReadPcap(t *testing.T) {
+	var capture bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint32(header[20:24], pcapLinkEthernet)
+	capture.Write(header)
+	first := "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\nPOST /b HTTP/1.1\r\nHost: exa"
+	second := "mple.com\r\nContent-Length: 4\r\n\r\nbody"
+	for i, packet := range [][]byte{
+		// out of order and retransmitted
+		pcapPacket(1000+uint32(len(first)), second),
+		pcapPacket(1000, first),
+		pcapPacket(1000, first),
+	} {
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:4], uint32(1700000000+i))
+		binary.LittleEndian.PutUint32(record[8:12], uint32(len(packet)))
+		binary.LittleEndian.PutUint32(record[12:16], uint32(len(packet)))
+		capture.Write(record)
+		capture.Write(packet)
+	}
+	filename := filepath.Join(t.TempDir(), "capture.pcap")
+	if err := os.WriteFile(filename, capture.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	exchanges, err := readPcapFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exchanges) != 2 {
+		t.Fatalf("Expected '2' requests, but received '%d'", len(exchanges))
+	}
+	if e := exchanges[0]; e.Method != "GET" || e.URI != "/a" || e.Host != "example.com" {
+		t.Errorf("Expected 'GET /a', but received '%s %s'", e.Method, e.URI)
+	}
+	if e := exchanges[1]; e.Method != "POST" || e.URI != "/b" || len(e.RequestChunks) != 1 || string(e.RequestChunks[0].Data) != "body" {
+		t.Errorf("Expected 'POST /b' with body, but received '%s %s'", e.Method, e.URI)
+	}
+}
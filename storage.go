@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The state teeproxy keeps, the webhooks not delivered yet and the
+// recordings, is written to a store, so that deployments on ephemeral
+// containers can keep it outside of the container:
+//
+//	<dir> or file:<dir>  files in a local directory
+//	s3://bucket/prefix   objects in S3, signed with the AWS credentials of the
+//	                     environment, $AWS_ENDPOINT_URL for S3 compatible stores
+//	redis:<hash>         fields of a hash on the -redis server
+
+// errNotStored is returned by Get for a missing key.
+var errNotStored = errors.New("not stored")
+
+// blobStore keeps values by key.
+type blobStore interface {
+	Put(key string, value []byte) error
+	// Get returns errNotStored if the key is missing.
+	Get(key string) ([]byte, error)
+	// Delete succeeds if the key is missing.
+	Delete(key string) error
+	// List returns the keys in lexical order.
+	List() ([]string, error)
+	String() string
+}
+
+// isStoreLocation reports whether the name is a remote store rather than a
+// local path.
+func isStoreLocation(name string) bool {
+	return strings.HasPrefix(name, "s3://") || strings.HasPrefix(name, "redis:")
+}
+
+// openStore opens the store of the location.
+func openStore(location string) (blobStore, error) {
+	switch {
+	case strings.HasPrefix(location, "s3://"):
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing bucket in %s", location)
+		}
+		return newS3Store(u.Host, strings.Trim(u.Path, "/"))
+	case strings.HasPrefix(location, "redis:"):
+		hash := strings.TrimPrefix(location, "redis:")
+		if hash == "" {
+			return nil, fmt.Errorf("missing hash in %s", location)
+		}
+		if *redisAddress == "" {
+			return nil, fmt.Errorf("the redis store requires -redis")
+		}
+		client, err := newRedisClient(*redisAddress, time.Duration(*redisInterval)*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+		return &redisStore{client: client, hash: hash}, nil
+	}
+	dir := strings.TrimPrefix(location, "file:")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &dirStore{dir: dir}, nil
+}
+
+// dirStore keeps the values as files of a directory.
+type dirStore struct {
+	dir string
+}
+
+func (s *dirStore) Put(key string, value []byte) error {
+	path := filepath.Join(s.dir, key)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, value, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *dirStore) Get(key string) ([]byte, error) {
+	value, err := ioutil.ReadFile(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return nil, errNotStored
+	}
+	return value, err
+}
+
+func (s *dirStore) Delete(key string) error {
+	if err := os.Remove(filepath.Join(s.dir, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *dirStore) List() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			keys = append(keys, entry.Name())
+		}
+	}
+	return keys, nil
+}
+
+func (s *dirStore) String() string {
+	return s.dir
+}
+
+// s3Store keeps the values as objects below a prefix of a bucket.
+type s3Store struct {
+	bucket      string
+	prefix      string
+	region      string
+	endpoint    string
+	credentials awsCredentials
+	client      *http.Client
+}
+
+func newS3Store(bucket, prefix string) (*s3Store, error) {
+	s := &s3Store{
+		bucket:   bucket,
+		prefix:   prefix,
+		region:   os.Getenv("AWS_REGION"),
+		endpoint: strings.TrimSuffix(os.Getenv("AWS_ENDPOINT_URL"), "/"),
+		credentials: awsCredentials{
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		},
+		client: &http.Client{Timeout: time.Minute},
+	}
+	if s.credentials.AccessKey == "" || s.credentials.SecretKey == "" {
+		return nil, fmt.Errorf("the s3 store requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.endpoint == "" {
+		s.endpoint = s3ConfigEndpoint(s.region)
+	}
+	return s, nil
+}
+
+func (s *s3Store) object(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+// do sends a signed request for the object, or the bucket if the key is
+// empty, and returns the body of a 2xx response.
+func (s *s3Store) do(method, key string, query url.Values, body []byte) ([]byte, error) {
+	u := s.endpoint + "/" + s.bucket + "/"
+	if key != "" {
+		u += (&url.URL{Path: s.object(key)}).EscapedPath()
+	}
+	if len(query) > 0 {
+		u += "?" + strings.Replace(query.Encode(), "+", "%20", -1)
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	signV4(req, sha256Hex(body), s.credentials, s.region, "s3", time.Now())
+	response, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNotFound && key != "" {
+		return nil, errNotStored
+	}
+	if response.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s", method, s.object(key), response.Status)
+	}
+	return content, nil
+}
+
+func (s *s3Store) Put(key string, value []byte) error {
+	_, err := s.do("PUT", key, nil, value)
+	return err
+}
+
+func (s *s3Store) Get(key string) ([]byte, error) {
+	return s.do("GET", key, nil, nil)
+}
+
+func (s *s3Store) Delete(key string) error {
+	_, err := s.do("DELETE", key, nil, nil)
+	if err == errNotStored {
+		return nil
+	}
+	return err
+}
+
+func (s *s3Store) List() ([]string, error) {
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		content, err := s.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(content, &result); err != nil {
+			return nil, fmt.Errorf("listing %s: %v", s, err)
+		}
+		for _, object := range result.Contents {
+			if key := strings.TrimPrefix(object.Key, prefix); key != "" && !strings.Contains(key, "/") {
+				keys = append(keys, key)
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *s3Store) String() string {
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+// redisStore keeps the values as fields of a hash.
+type redisStore struct {
+	client *redisClient
+	hash   string
+}
+
+func (s *redisStore) Put(key string, value []byte) error {
+	_, err := s.client.Do("HSET", s.hash, key, string(value))
+	return err
+}
+
+func (s *redisStore) Get(key string) ([]byte, error) {
+	reply, err := s.client.Do("HGET", s.hash, key)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, errNotStored
+	}
+	return []byte(value), nil
+}
+
+func (s *redisStore) Delete(key string) error {
+	_, err := s.client.Do("HDEL", s.hash, key)
+	return err
+}
+
+func (s *redisStore) List() ([]string, error) {
+	reply, err := s.client.Do("HKEYS", s.hash)
+	if err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]interface{})
+	keys := make([]string, 0, len(values))
+	for _, value := range values {
+		if key, ok := value.(string); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *redisStore) String() string {
+	return "redis:" + s.hash
+}
+
+// storeReader returns the concatenated values of the store in key order,
+// e.g. the segments of a recording.
+func storeReader(store blobStore) (io.Reader, error) {
+	keys, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	readers := make([]io.Reader, 0, len(keys))
+	for _, key := range keys {
+		value, err := store.Get(key)
+		if err == errNotStored {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, bytes.NewReader(value))
+	}
+	return io.MultiReader(readers...), nil
+}
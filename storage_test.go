@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 serves PUT, GET, DELETE and ListObjectsV2 of a single bucket.
+func fakeS3(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch {
+		case r.Method == "GET" && key == "":
+			var result struct {
+				XMLName  xml.Name `xml:"ListBucketResult"`
+				Contents []struct{ Key string }
+			}
+			for name := range objects {
+				if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+					result.Contents = append(result.Contents, struct{ Key string }{name})
+				}
+			}
+			xml.NewEncoder(w).Encode(result)
+		case r.Method == "PUT":
+			objects[key], _ = ioutil.ReadAll(r.Body)
+		case r.Method == "GET":
+			value, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(value)
+		case r.Method == "DELETE":
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestStores(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_ENDPOINT_URL", fakeS3(t).URL)
+	defer func(v string) { *redisAddress = v }(*redisAddress)
+	*redisAddress = fakeRedis(t)
+
+	for _, location := range []string{t.TempDir(), "file:" + t.TempDir(), "s3://bucket/state", "redis:teeproxy:state"} {
+		store, err := openStore(location)
+		if err != nil {
+			t.Fatalf("%s: %s", location, err)
+		}
+		if _, err := store.Get("missing"); err != errNotStored {
+			t.Errorf("%s: Expected errNotStored, but received '%v'", location, err)
+		}
+		for _, key := range []string{"b.json", "a.json", "c.json"} {
+			if err := store.Put(key, []byte("value of "+key)); err != nil {
+				t.Fatalf("%s: %s", location, err)
+			}
+		}
+		if err := store.Delete("c.json"); err != nil {
+			t.Errorf("%s: %s", location, err)
+		}
+		if err := store.Delete("missing"); err != nil {
+			t.Errorf("%s: Expected deleting a missing key to succeed, but received '%v'", location, err)
+		}
+		keys, err := store.List()
+		if err != nil || !sort.StringsAreSorted(keys) || strings.Join(keys, ",") != "a.json,b.json" {
+			t.Errorf("%s: Expected 'a.json,b.json', but received '%v' %v", location, keys, err)
+		}
+		if value, err := store.Get("b.json"); err != nil || string(value) != "value of b.json" {
+			t.Errorf("%s: Expected 'value of b.json', but received '%s' %v", location, value, err)
+		}
+	}
+}
+
+func TestRecordingSegments(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_ENDPOINT_URL", fakeS3(t).URL)
+
+	store, err := openStore("s3://bucket/recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := newSegmentSink(store, "json")
+	for _, uri := range []string{"/one", "/two", "/three"} {
+		sink.Write(&exchange{Time: time.Now(), Method: "GET", URI: uri})
+		if uri == "/two" {
+			sink.Flush()
+		}
+	}
+	sink.Close()
+
+	reader, err := openRecording("s3://bucket/recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := newExchangeDecoder(reader, "json")
+	var uris []string
+	for {
+		e, err := decoder.Decode()
+		if err != nil {
+			break
+		}
+		uris = append(uris, e.URI)
+	}
+	if strings.Join(uris, ",") != "/one,/two,/three" {
+		t.Errorf("Expected '/one,/two,/three', but received '%v'", uris)
+	}
+}
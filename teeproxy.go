@@ -2,8 +2,8 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -11,94 +11,310 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"regexp"
-	"runtime"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 // Console flags
 var (
-	listen                = flag.String("l", ":8888", "port to accept requests")
-	targetProduction      = flag.String("a", "localhost:8080", "where production traffic goes. http://localhost:8080/production")
-	debug                 = flag.Bool("debug", false, "more logging, showing ignored output")
-	productionTimeout     = flag.Int("a.timeout", 2500, "timeout in milliseconds for production traffic")
-	alternateTimeout      = flag.Int("b.timeout", 1000, "timeout in milliseconds for alternate site traffic")
-	productionHostRewrite = flag.Bool("a.rewrite", false, "rewrite the host header when proxying production traffic")
-	alternateHostRewrite  = flag.Bool("b.rewrite", false, "rewrite the host header when proxying alternate site traffic")
-	alternateMethods      = flag.String("b.methods", "", "forward only the given HTTP methods matched by regex")
-	percent               = flag.Float64("p", 100.0, "float64 percentage of traffic to send to testing")
-	tlsPrivateKey         = flag.String("key.file", "", "path to the TLS private key file")
-	tlsCertificate        = flag.String("cert.file", "", "path to the TLS certificate file")
-	forwardClientIP       = flag.Bool("forward-client-ip", false, "enable forwarding of the client IP to the backend using the 'X-Forwarded-For' and 'Forwarded' headers")
-	closeConnections      = flag.Bool("close-connections", false, "close connections to the clients and backends")
-
-	alternateMethodsRegex *regexp.Regexp
+	listen                     = flag.String("l", ":8888", "port to accept requests")
+	targetProduction           = flag.String("a", "localhost:8080", "where production traffic goes. http://localhost:8080/production")
+	debug                      = flag.Bool("debug", false, "more logging, showing ignored output")
+	productionTimeout          = flag.Int("a.timeout", 2500, "timeout in milliseconds for production traffic")
+	alternateTimeout           = flag.Int("b.timeout", 1000, "timeout in milliseconds for alternate site traffic")
+	productionHostRewrite      = flag.Bool("a.rewrite", false, "rewrite the host header when proxying production traffic")
+	productionRedirects        = flag.Int("a.redirects.follow", 0, "number of redirects of the production target followed instead of returning them to the client")
+	productionRedirectRewrite  = flag.Bool("a.redirects.rewrite", false, "rewrite the Location headers pointing to the production target to the -rewrite.public-host or the host the client requested")
+	rewriteHosts               = flag.String("rewrite.hosts", "", "comma separated internal host names of the backends rewritten to the public host in the Location and Set-Cookie Domain of the production responses, disabled if empty")
+	rewritePublicHost          = flag.String("rewrite.public-host", "", "public host the -rewrite.hosts are rewritten to, the host the client requested if empty")
+	bodylessStatus             = flag.String("a.bodyless-status", "strip", "how 204 and 304 responses of the production target announcing a body are forwarded: strip forwards them without the body, error answers 502")
+	alternateRedirects         = flag.Int("b.redirects.follow", 0, "number of redirects of the -b backends followed")
+	alternateHostRewrite       = flag.Bool("b.rewrite", false, "rewrite the host header when proxying alternate site traffic")
+	alternateMethods           = flag.String("b.methods", "", "forward only the given HTTP methods matched by regex")
+	percent                    = flag.Float64("p", 100.0, "float64 percentage of traffic to send to testing")
+	tlsPrivateKey              = flag.String("key.file", "", "path to the TLS private key file")
+	tlsCertificate             = flag.String("cert.file", "", "path to the TLS certificate file")
+	tlsPlaintext               = flag.String("tls.plaintext", "refuse", "with -key.file, how plain HTTP clients of the listener are handled: refuse answers 400, redirect answers 301 to https, serve proxies them on the same port")
+	tlsRedirect                = flag.String("tls.redirect", "", "address of a plain HTTP listener answering 301 to the same URL on the TLS listener of -l, requires -key.file, disabled if empty")
+	tlsClientCA                = flag.String("tls.client-ca", "", "CA certificates verifying the client certificates presented to the TLS listener, not requested if empty")
+	tlsClientHeaders           = flag.Bool("tls.client-headers", false, "send the TLS version and cipher suite of the client connection and the subject and fingerprint of its verified certificate to the backends as X-Client-Tls-* and X-Client-Cert-* headers")
+	clientIPAnonymize          = flag.String("client-ip.anonymize", "", "truncate or hash the client IPs before they are forwarded, logged or recorded, disabled if empty")
+	forwardClientIP            = flag.Bool("forward-client-ip", false, "enable forwarding of the client IP to the backend using the 'X-Forwarded-For' and 'Forwarded' headers")
+	forwardProtoHost           = flag.Bool("forward-proto-host", false, "set the 'X-Forwarded-Proto' and 'X-Forwarded-Host' headers to the scheme the client connected with and the host it requested, keeping the values of upstream proxies")
+	closeConnections           = flag.Bool("close-connections", false, "close connections to the clients and backends")
+	idleTimeout                = flag.Int("idle-timeout", 90000, "timeout in milliseconds after which idle connections to the backends are closed")
+	maxIdleConnections         = flag.Int("max-idle-connections", 100, "maximum number of idle connections kept per backend")
+	maxConnections             = flag.Int("max-connections", 0, "maximum number of open connections to all backends, idle ones are evicted when reached, unlimited if 0")
+	clientCloseConnections     = flag.Bool("close-connections.client", false, "close connections to the clients")
+	clientHeaderTimeout        = flag.Int("client.header-timeout", 0, "timeout in milliseconds for the clients to send the request headers, unlimited if 0")
+	clientIdleTimeout          = flag.Int("client.idle-timeout", 0, "timeout in milliseconds after which idle keep-alive connections of the clients are closed, unlimited if 0")
+	safeDefaultsPreset         = flag.Bool("safe-defaults", false, "default to the settings recommended in production: -tls.verify-backends, client timeouts, -mirror.workers, safe -b.methods, common -healthcheck.paths and a longer -shutdown.timeout, explicit flags take precedence")
+	productionCloseConnections = flag.Bool("a.close-connections", false, "close connections to the production target")
+	alternateCloseConnections  = flag.Bool("b.close-connections", false, "close connections to the alternate backends")
+	mirrorSequential           = flag.Bool("mirror.sequential", false, "mirror a request only after the production target answered it with a status below 400")
+	mirrorOnStatus             = flag.String("mirror.on-status", "", "with -mirror.sequential, production statuses after which a request is mirrored, comma separated classes like 5xx, codes, ranges like 500-504 or error, below 400 if empty")
+	mirrorDelay                = flag.Int("mirror.delay", 0, "seconds the mirrored requests are held before they are sent, shifting the shadow traffic in time, disabled if 0")
+	mirrorDelaySize            = flag.Int("mirror.delay.size", 100000, "with -mirror.delay, number of mirrored requests held, more are dropped")
+	tlsSessionCache            = flag.Int("tls.session-cache", 64, "number of TLS sessions cached per backend for resumption, disabled if 0")
+	tlsVerifyBackends          = flag.Bool("tls.verify-backends", false, "verify the certificates of the https backends")
+	dnsServers                 = flag.String("dns.servers", "", "comma separated DNS servers, ip or ip:port, resolving the backend hosts instead of the system resolver")
+	dnsTTL                     = flag.Int("dns.ttl", 0, "seconds the resolved backend addresses are cached, disabled if 0")
+	productionSign             = flag.String("a.sign", "", "sign the production requests with sigv4:<service> (AWS Signature Version 4) or hmac, disabled if empty")
+	productionTransformFailure = flag.String("a.transform-failure", "fail", "on a failed transform of the production request, such as -a.sign: fail answers 500, forward sends the request untransformed")
+	alternateSign              = flag.String("b.sign", "", "sign the mirrored requests with sigv4:<service> (AWS Signature Version 4) or hmac, disabled if empty")
+	signRegion                 = flag.String("sign.region", "", "AWS region of the sigv4 signatures, $AWS_REGION or us-east-1 if empty")
+	signHMACKey                = flag.String("sign.hmac.key", "", "key of the hmac signatures, env:NAME or file:PATH to keep it out of the process listing")
+	signHMACHeader             = flag.String("sign.hmac.header", "X-Signature", "header of the hmac signatures")
+	verifyHMACKey              = flag.String("verify.hmac.key", "", "key verifying the hmac signatures of the incoming requests, rejecting unsigned and invalid ones, env:NAME or file:PATH to keep it out of the process listing, disabled if empty")
+	verifyHMACHeader           = flag.String("verify.hmac.header", "X-Signature", "header of the hmac signatures of the incoming requests")
+	verifyHMACTolerance        = flag.Int("verify.hmac.tolerance", 300, "seconds the timestamp of a verified signature may differ from the clock, a signature is accepted once within this window")
+	verifyHMACMaxBody          = flag.Int64("verify.hmac.max-body", 1<<20, "largest body in bytes of a request verified with -verify.hmac.key, larger ones are rejected with 413, not limited if 0")
+	alternateOAuth2TokenURL    = flag.String("b.oauth2.token-url", "", "token endpoint of an OAuth2 client credentials flow whose token replaces the Authorization header of the requests mirrored to the -b backends, disabled if empty")
+	alternateOAuth2Client      = flag.String("b.oauth2.client-id", "", "client id of the -b.oauth2.token-url flow")
+	alternateOAuth2Secret      = flag.String("b.oauth2.client-secret", "", "client secret of the -b.oauth2.token-url flow, env:NAME or file:PATH to keep it out of the process listing")
+	alternateOAuth2Scopes      = flag.String("b.oauth2.scopes", "", "comma separated scopes requested by the -b.oauth2.token-url flow")
+	alternateUploads           = flag.String("b.uploads", "buffer", "treatment of the chunked request bodies and those above -b.uploads.max-bytes mirrored to the -b backends: buffer, stream or skip")
+	alternateUploadMaxBytes    = flag.Int64("b.uploads.max-bytes", 0, "largest request body buffered for the -b backends, not limited if 0")
+	alternateAuthorization     = flag.String("b.authorization", "pass", "Authorization sent to the -b backends: pass the one of the client, strip it, a static -b.authorization.token or exchange it with -b.authorization.hook")
+	alternateAuthToken         = flag.String("b.authorization.token", "", "token sent as Authorization with -b.authorization static, or env:NAME or file:PATH")
+	alternateAuthHook          = flag.String("b.authorization.hook", "", "URL of the hook exchanging the Authorization with -b.authorization exchange")
+	alternateBandwidth         = flag.Int64("b.bandwidth", 0, "maximum bytes per second of the request and response bodies of each -b backend, unlimited if 0")
+	alternateUnconditional     = flag.Bool("b.unconditional", false, "remove If-None-Match and If-Modified-Since from the mirrored requests, so that the -b backends answer with full responses instead of 304, the production requests keep them")
+	alternateRange             = flag.String("b.range", "forward", "how Range requests are mirrored: forward sends the Range header as is, strip removes it so that the -b backends answer with full responses, skip does not mirror them")
+	bodyChecksumHeader         = flag.String("body.checksum", "", "header set to the SHA-256 of the request body on the production and mirrored requests and the recordings, buffering the body, hex or sha-256=:<base64>: for Content-Digest, disabled if empty")
+	alternateIdempotencyKey    = flag.Bool("b.idempotency-key", false, "add an Idempotency-Key header, the same for all duplicates of a request, to the mirrored POST, PUT, PATCH and DELETE requests, keeping the key sent by the client")
+	alternateGzip              = flag.Bool("b.gzip", false, "gzip the bodies of the mirrored requests, setting Content-Encoding, for -b backends accepting compressed requests")
+	alternateGzipMinSize       = flag.Int("b.gzip.min-size", 1024, "minimum size in bytes of the request bodies gzipped with -b.gzip")
+	mirrorWorkers              = flag.Int("mirror.workers", 0, "number of workers sending the mirrored requests by priority class, every mirrored request is sent right away if 0")
+	mirrorQueue                = flag.Int("mirror.queue", 1000, "with -mirror.workers, number of mirrored requests queued per priority class, more are dropped")
+	webhookDestinations        = flag.String("webhook.fork", "", "comma separated destinations to which every request is delivered with retries, after acknowledging it with 200, instead of proxying it, disabled if empty")
+	webhookDir                 = flag.String("webhook.dir", "", "directory, s3://bucket/prefix or redis:<hash> store persisting the -webhook.fork requests until they are delivered, required with -webhook.fork")
+	webhookRetries             = flag.Int("webhook.retries", 8, "number of retries of a -webhook.fork delivery not acknowledged with 2xx before it fails")
+	webhookBackoff             = flag.Int("webhook.backoff", 1000, "milliseconds before the first retry of a -webhook.fork delivery, doubling with every retry up to 5 minutes")
+	webhookWorkers             = flag.Int("webhook.workers", 16, "number of -webhook.fork deliveries sent at a time, the others wait in a queue")
+	sourceSpec                 = flag.String("source", "", "read the requests from file:<recording>, redis:<list> or pcap:<capture> instead of listening, mirroring and comparing them offline")
+	sourceConcurrency          = flag.Int("source.concurrency", 64, "number of requests of -source handled at a time, the source is read on once one completed")
+	urlHandling                = flag.String("url.handling", "raw", "how the request URI is forwarded: raw keeps the encoding and semicolons sent by the client, normalize removes dot segments and duplicate slashes and re-encodes the path")
+	tenantKey                  = flag.String("tenant.key", "", "where the tenant id of a request is taken from, header:<name>, query:<name>, cookie:<name>, jwt:<claim>, path:<segment> or host, for the tenants of the -config policies")
+	configFile                 = flag.String("config", "", "path or http(s), s3 or consul URL of a JSON config file defining additional mirroring policies")
+	configPoll                 = flag.Int("config.poll", 30, "seconds between fetches of a remote -config, applied when changed, disabled if 0")
+	configProfile              = flag.String("config.profile", "", "comma separated profiles of the -config file applied in order, e.g. staging")
+	adminListen                = flag.String("admin", "", "address to serve the admin endpoints (e.g. /metrics) on, disabled if empty")
+	metricsRoutesLimit         = flag.Int("metrics.routes", 0, "maximum number of routes with their own request metrics, the busiest of the last -metrics.routes.interval, the others are reported as route other; 0 is unlimited")
+	metricsRoutesInterval      = flag.Int("metrics.routes.interval", 300, "seconds between the rankings of the routes by requests for -metrics.routes")
+	adminReadToken             = flag.String("admin.token.read", "", "bearer token allowing GET and HEAD requests to the admin endpoints, env:NAME or file:PATH to keep it out of the process listing")
+	adminWriteToken            = flag.String("admin.token.write", "", "bearer token allowing all requests to the admin endpoints, including the ones changing the mirroring, env:NAME or file:PATH to keep it out of the process listing")
+	adminCertificate           = flag.String("admin.cert.file", "", "path to the TLS certificate file of the admin endpoints, served over plain HTTP if empty")
+	adminPrivateKey            = flag.String("admin.key.file", "", "path to the TLS private key file of the admin endpoints")
+	adminClientCA              = flag.String("admin.client-ca", "", "path to the CA certificates verifying the client certificates of the admin endpoints, clients with a verified certificate may read")
+	adminWriters               = flag.String("admin.writers", "", "comma separated common names of the admin client certificates which may also change the mirroring")
+	routesOpenAPI              = flag.String("route.openapi", "", "path to a JSON OpenAPI spec whose paths are used as route templates for metrics")
+	alternateGroupSelect       = flag.String("b.group.select", "round-robin", "how a member of a -b.group is selected: round-robin or random")
+	alternateGroupCount        = flag.Int("b.group.count", 1, "number of members of each -b.group a mirrored request goes to")
+	viaPseudonym               = flag.String("via", "teeproxy", "name identifying teeproxy in the Via header of forwarded requests and responses, no Via header is added if empty")
+	preserveHeaders            = flag.Bool("preserve-headers", false, "forward and record the request headers of HTTP/1.x clients in their original order and casing, sending the requests with a header order on new connections")
+	proxiedBy                  = flag.Bool("proxied-by", false, "add the X-Proxied-By header with the teeproxy version to forwarded requests and responses")
+	printVersion               = flag.Bool("version", false, "print the version and exit")
+	benchRequests              = flag.Int("bench-inprocess", 0, "loop the given number of synthetic requests through the handler with in-process backends, report the throughput and exit, disabled if 0")
+	benchConcurrency           = flag.Int("bench-inprocess.concurrency", 8, "number of synthetic requests of -bench-inprocess in flight at once")
+	benchBodySize              = flag.Int("bench-inprocess.body", 0, "size in bytes of the bodies of the -bench-inprocess requests, GET requests without a body if 0")
+	mirrorHeader               = flag.String("mirror-header", "", "response header, e.g. X-Teeproxy-Mirrored, telling the client the alternate backends the request was mirrored to or none, disabled if empty")
+	alternateLogErrorBody      = flag.Int("b.log-error-body", 0, "log up to the given number of bytes of the alternate response bodies with status 4xx or 5xx")
+	alternateWarmup            = flag.Int("b.warmup", 0, "seconds to ramp mirrored traffic from 0 to the configured percentage after startup or after an alternate backend recovers")
+	alternateBackoffPercent    = flag.Float64("b.backoff.percent", 10, "percentage of the requests still mirrored to an alternate backend backing off after answering 429 or 503 with Retry-After")
+	alternateBackoffMax        = flag.Int("b.backoff.max", 300, "maximum seconds an alternate backend backs off, longer Retry-After values are capped")
+	latencyBreakdown           = flag.Bool("latency-breakdown", false, "record the DNS, connect, TLS, time to first byte and transfer time of each backend request in the metrics and debug log")
+	memoryLimit                = flag.Int("memory-limit", 0, "soft memory limit in MiB for the Go runtime, like GOMEMLIMIT, disabled if 0")
+	telemetryInterval          = flag.Int("telemetry.interval", 0, "seconds between | TELEMETRY | log lines with the goroutines, heap, requests in flight per backend and queue depths, disabled if 0")
+	watchdogGoroutines         = flag.Int("watchdog.goroutines", 0, "number of goroutines above which mirroring is shed until there are fewer, disabled if 0")
+	memoryShed                 = flag.Float64("memory-shed", 0.9, "with -memory-limit, fraction of the limit used by the heap above which mirroring is shed, disabled if 0")
+	slowLog                    = flag.Int("slowlog", 0, "log the details of production requests taking longer than the given milliseconds, disabled if 0")
+	slowLogMirrors             = flag.Bool("slowlog.b", false, "with -slowlog, also log the outcome of the mirrored requests of slow production requests")
+	logAsync                   = flag.Int("log.async", 0, "write the log asynchronously buffering up to the given number of lines, lines are dropped when the buffer is full, disabled if 0")
+	logFile                    = flag.String("logfile", "", "append the log to the given file instead of writing it to stderr")
+	auditLog                   = flag.String("audit", "", "append a JSON line to the given file for every runtime configuration change, pausing, percentages and reloaded policies, telling who changed what when, disabled if empty")
+	pidFile                    = flag.String("pidfile", "", "write the process id to the given file")
+	shutdownTimeout            = flag.Int("shutdown.timeout", 10000, "timeout in milliseconds to drain in-flight requests when shutting down")
+	healthCheckPaths           = flag.String("healthcheck.paths", "", "comma separated paths of the health checks of the load balancers, not mirrored")
+	healthCheckAgents          = flag.String("healthcheck.agents", "kube-probe/,ELB-HealthChecker/,GoogleHC/,Consul Health Check,Envoy/HC", "comma separated User-Agent prefixes of the health checks of the load balancers, not mirrored")
+	debugTraceHeader           = flag.String("debug.header", "X-Teeproxy-Debug", "request header turning on the tracing of the request if its value is the -debug.token, or 1 from -debug.networks, disabled if empty")
+	debugTraceToken            = flag.String("debug.token", "", "token of the -debug.header, literally or as env:NAME or file:PATH")
+	debugTraceNetworks         = flag.String("debug.networks", "", "comma separated CIDRs of the clients trusted to send -debug.header 1")
+	healthCheckMetrics         = flag.Bool("healthcheck.metrics", false, "count the health checks in the request metrics")
+	maxLifetime                = flag.Int("max-lifetime", 0, "seconds, plus up to 10% at random, after which teeproxy drains and exits for its supervisor to restart it, disabled if 0")
+	maxRequests                = flag.Int64("max-requests", 0, "number of requests after which teeproxy drains and exits for its supervisor to restart it, disabled if 0")
+	compactInterval            = flag.Int("compact.interval", 0, "interval in seconds between the compactions of the idle state, the expired cache entries and idle connections, disabled if 0")
+	redisAddress               = flag.String("redis", "", "Redis server, host:port or redis://[:password@]host:port[/db], sharing the runtime mirroring state with other replicas, disabled if empty")
+	redisPassword              = flag.String("redis.password", "", "password of the -redis server replacing the one of the URL, env:NAME or file:PATH to keep it out of the process listing")
+	redisKey                   = flag.String("redis.key", "teeproxy:mirror", "Redis hash holding the shared mirroring state")
+	redisInterval              = flag.Int("redis.interval", 1000, "interval in milliseconds to poll the shared mirroring state, also used as Redis timeout")
+	flagProvider               = flag.String("flags.ofrep", "", "base URL of an OpenFeature Remote Evaluation Protocol (OFREP) flag provider driving the mirroring with -flags.percent and -flags.tenants, disabled if empty")
+	flagToken                  = flag.String("flags.token", "", "bearer token of the -flags.ofrep provider, env:NAME or file:PATH to keep it out of the process listing")
+	flagPercent                = flag.String("flags.percent", "", "number flag of the -flags.ofrep provider setting the mirror percentage, not evaluated if empty")
+	flagTenants                = flag.String("flags.tenants", "", "boolean flag of the -flags.ofrep provider evaluated per -tenant.key tenant, the requests of tenants for whom it is false are not mirrored, not evaluated if empty")
+	flagInterval               = flag.Int("flags.interval", 30, "interval in seconds to evaluate the -flags.ofrep flags again")
+	sampleKeySource            = flag.String("sample.key", "", "sample requests consistently by header:<name>, cookie:<name>, query:<name> or ip instead of at random, disabled if empty")
+	sampleStrategy             = flag.String("sample.strategy", "", "sampling strategy of the policies: percentage, consistent, rate-limited, adaptive, scripted or deterministic, consistent with -sample.key and percentage otherwise if empty")
+	randomSeed                 = flag.Int64("seed", 0, "seed of the random mirroring decisions, for reproducible runs, taken from the start time if 0")
+	sampleRate                 = flag.Float64("sample.rate", 0, "mirrored requests per second per policy, the maximum of the rate-limited and the target of the adaptive strategy")
+	sampleScript               = flag.String("sample.script", "", "daily schedule of the scripted strategy, comma separated HH:MM=percent steps scaling the policy percentage, e.g. 08:00=10,20:00=100")
+	sampleSaltValue            = flag.String("sample.salt", "", "salt of the -sample.key hash, replicas with the same salt sample the same users, shared in Redis if empty and -redis is set")
+	compareResponses           = flag.Bool("compare", false, "compare the responses of the mirrored requests to the production responses, logging the differences")
+	compareHeaders             = flag.String("compare.headers", "Content-Type", "comma separated response headers compared with -compare")
+	compareBodyLimit           = flag.Int("compare.body", 1<<20, "maximum number of bytes of the response bodies compared with -compare, larger bodies are not compared")
+	compareWindow              = flag.Int("compare.window", 300, "seconds of comparisons summarized into the fidelity scores of /scores")
+	compareNormalize           = flag.String("compare.normalize", "query,json,headers", "comma separated normalizations applied before comparing: query sorts the query parameters, json canonicalizes JSON bodies, headers the header values, grpc decodes gRPC bodies, see -grpc.descriptors, and xml canonicalizes XML bodies")
+	compareXMLIgnore           = flag.String("compare.xml-ignore", "", "comma separated paths of the XML elements and attributes ignored by the xml normalization, e.g. /Envelope/Header,//@timestamp")
+	alertWebhook               = flag.String("alert.webhook", "", "URL, e.g. of a Slack incoming webhook, receiving a JSON alert when an -alert threshold is exceeded, disabled if empty")
+	alertAlternateErrors       = flag.Float64("alert.b-errors", 0, "alert when this fraction of the mirrored requests fails or returns 5xx within a window, disabled if 0")
+	alertMismatch              = flag.Float64("alert.mismatch", 0, "alert when this fraction of the mirrored requests gets another status class than the production request within a window, disabled if 0")
+	alertProxyErrors           = flag.Float64("alert.proxy-errors", 0, "alert when this fraction of the production requests fails within a window, disabled if 0")
+	alertWindow                = flag.Int("alert.window", 60, "seconds of the window the alert rates are computed for")
+	alertMinRequests           = flag.Int("alert.min-requests", 20, "minimum number of requests within a window to alert")
+	alertInterval              = flag.Int("alert.interval", 600, "minimum seconds between two alerts of the same kind")
+	recordFile                 = flag.String("record", "", "record the production exchanges, including streamed bodies and WebSocket frames, as JSON lines to the given file, or in segments to an s3://bucket/prefix or redis:<hash> store, disabled if empty")
+	recordFormat               = flag.String("record.format", "json", "format of the -record file and of the recording to replay, json lines or length-delimited protobuf envelopes, see envelope.proto")
+	recordAnonymize            = flag.String("record.anonymize", "", "anonymization profile applied to the recorded exchanges, e.g. strict or hash-identifiers")
+	recordPercent              = flag.Float64("record.percent", 100, "percentage of the production exchanges to record with -record")
+	recordMaxBody              = flag.Int("record.max-body", 1<<20, "maximum bytes of the bodies or WebSocket frames recorded per exchange")
+	snapshotDir                = flag.String("snapshot.dir", "", "directory of the files written by POST /record/snapshot on the admin listener, the temporary directory if empty")
+	snapshotMaxSeconds         = flag.Int("snapshot.max-seconds", 600, "maximum and default duration in seconds of a snapshot taken with POST /record/snapshot")
+	analyzeSocket              = flag.String("analyze", "", "stream the production responses with their request line and headers to an analyzer process listening on the given Unix socket, dropped when it does not keep up, disabled if empty")
+	analyzePercent             = flag.Float64("analyze.percent", 100, "percentage of the production responses to stream with -analyze")
+	analyzeFormat              = flag.String("analyze.format", "json", "format of the exchanges streamed to -analyze, json lines or length-delimited protobuf envelopes, see envelope.proto")
+	analyzeQueue               = flag.Int("analyze.queue", 1024, "number of exchanges queued for -analyze before they are dropped")
+	captureURL                 = flag.String("capture", "", "upload the mirrored request/response pairs in batches to s3://bucket/prefix or gs://bucket/prefix, or post them to an http(s) collector URL, disabled if empty")
+	capturePercent             = flag.Float64("capture.percent", 100, "percentage of the mirrored requests to capture with -capture")
+	captureBatch               = flag.Int("capture.batch", 1000, "number of captured exchanges per uploaded object")
+	captureInterval            = flag.Int("capture.interval", 60, "seconds after which an incomplete batch is uploaded")
+	captureFormat              = flag.String("capture.format", "json", "format of the -capture objects, json lines or length-delimited protobuf envelopes, see envelope.proto")
+	captureAnonymize           = flag.String("capture.anonymize", "", "anonymization profile applied to the captured exchanges, e.g. strict or hash-identifiers")
+	captureGzip                = flag.Bool("capture.gzip", true, "gzip the uploaded objects")
+	captureEndpoint            = flag.String("capture.endpoint", "", "S3 compatible endpoint URL, e.g. of MinIO, defaults to AWS S3 for s3:// and storage.googleapis.com for gs://")
+	captureRegion              = flag.String("capture.region", "", "region of the bucket, defaults to $AWS_REGION or us-east-1, auto for gs://")
+	alternateAnonymize         = flag.String("b.anonymize", "", "anonymization profile applied to the requests mirrored to the -b backends, e.g. strict or hash-identifiers")
+	anonymizeSecret            = flag.String("anonymize.key", "", "HMAC key of the values hashed by the anonymization profiles, env:NAME or file:PATH to keep it out of the process listing, random if empty")
+	replaySpeed                = flag.Float64("replay.speed", 1, "speed factor of replay relative to the recorded timing, 0 replays as fast as possible")
+	cacheSize                  = flag.Int("cache.size", 64, "size in MiB of the in-memory cache for the production responses of the routes with a cache rule in the -config file, disabled if 0")
+	corsPreflight              = flag.Bool("cors.preflight", false, "answer CORS preflight requests at the proxy instead of forwarding and mirroring them")
+	corsOrigins                = flag.String("cors.origins", "*", "comma separated origins allowed by -cors.preflight, * allows any")
+	corsMethods                = flag.String("cors.methods", "GET,HEAD,POST,PUT,PATCH,DELETE", "comma separated methods allowed by -cors.preflight, * allows any")
+	corsHeaders                = flag.String("cors.headers", "*", "comma separated request headers allowed by -cors.preflight, * allows any")
+	corsCredentials            = flag.Bool("cors.credentials", false, "with -cors.preflight, allow credentials in cross-origin requests")
+	corsMaxAge                 = flag.Int("cors.max-age", 0, "seconds clients may cache the answer to a preflight request, not sent if 0")
+	failFast                   = flag.Bool("fail-fast", false, "exit at startup if the production target is unreachable")
+	failFastAlternates         = flag.Bool("fail-fast.b", false, "with -fail-fast, also exit at startup if an alternate backend is unreachable")
+	grpcHealth                 = flag.Bool("b.grpc-health", false, "mirror to an alternate backend only while its grpc.health.v1 check reports SERVING")
+	grpcHealthService          = flag.String("b.grpc-health.service", "", "service name passed to the gRPC health check, empty checks the whole server")
+	grpcHealthInterval         = flag.Int("b.grpc-health.interval", 5000, "interval in milliseconds between gRPC health checks of the alternate backends")
+	grpcExpectedServices       = flag.String("b.grpc-services", "", "comma separated gRPC services that server reflection must list before mirroring begins")
+	grpcDescriptorSets         = flag.String("grpc.descriptors", "", "comma separated FileDescriptorSet files (protoc --include_imports --descriptor_set_out) used to decode the gRPC messages to JSON in the recordings and comparisons")
+	grpcReflection             = flag.Bool("grpc.reflection", false, "fetch the descriptors to decode the gRPC messages from the server reflection of the production target")
+
+	routes routeNormalizer
 )
 
-// Sets the request URL.
-//
-// This turns a inbound request (a request without URL) into an outbound request.
-func setRequestTarget(request *http.Request, target string, scheme string) {
-	URL, err := url.Parse(scheme + "://" + target + request.URL.String())
-	if err != nil {
-		log.Println(err)
+// getTransport creates the transport for the requests to a backend.
+func getTransport(scheme string, timeout time.Duration, disableKeepAlives bool) (transport *http.Transport) {
+	dial := trackingDialer(&net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 10 * timeout,
+	})
+	transport = &http.Transport{
+		DialContext:           dial,
+		DisableKeepAlives:     disableKeepAlives,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		IdleConnTimeout:       time.Duration(*idleTimeout) * time.Millisecond,
+		MaxIdleConnsPerHost:   *maxIdleConnections,
 	}
-	request.URL = URL
-}
-
-func getTransport(scheme string, timeout time.Duration) (transport *http.Transport) {
 	if scheme == "https" {
-		transport = &http.Transport{
-			Dial: (&net.Dialer{ // go1.8 deprecated: Use DialContext instead
-				Timeout:   timeout,
-				KeepAlive: 10 * timeout,
-			}).Dial,
-			DisableKeepAlives:     *closeConnections,
-			TLSHandshakeTimeout:   timeout,
-			ResponseHeaderTimeout: timeout,
-			TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
-		}
-	} else {
-		transport = &http.Transport{
-			Dial: (&net.Dialer{ // go1.8 deprecated: Use DialContext instead
-				Timeout:   timeout,
-				KeepAlive: 10 * timeout,
-			}).Dial,
-			DisableKeepAlives:     *closeConnections,
-			TLSHandshakeTimeout:   timeout,
-			ResponseHeaderTimeout: timeout,
-		}
+		transport.TLSClientConfig = newTLSClientConfig()
+		transport.DialTLSContext = tlsDialer(dial, transport.TLSClientConfig, timeout)
 	}
+	registerTransport(transport)
 	return
 }
 
 // handleAlternativeRequest duplicate request and sent it to alternative backend
-func handleAlternativeRequest(request *http.Request, timeout time.Duration, scheme string) {
+func handleAlternativeRequest(request *http.Request, alt *backend, route string, slow *slowRequest, comparison *statusComparison, responses *responseComparison, trace *debugTrace) {
 	defer func() {
 		if r := recover(); r != nil && *debug {
 			log.Println("Recovered in ServeHTTP(alternate request) from:", r)
 		}
 	}()
-	response := handleRequest(request, timeout, scheme)
+	backend := backendLabel(request)
+	recording := newRecording(captureSink, *capturePercent, "b", request, backend)
+	recording.recordRequestBody(request)
+	compared := responses.response("b", backend)
+	requestBody := countBody(request)
+	request, timing := traceRequest(request)
+	start := time.Now()
+	defer trackInFlight(backend)()
+	response := handleRequest("b", request, alt.Transport())
+	trace.logf("%s answered %s in %v", request.URL.Host, responseStatus(response), time.Since(start).Round(time.Microsecond))
+	observeRequest("b", backend, route, traceID(request), response, time.Since(start).Seconds())
+	slow.addOutcome(backend, response, time.Since(start))
+	alt.recordOutcome(response != nil)
+	alt.recordThrottling(response)
+	alternateErrorAlert.observe(response == nil || response.StatusCode >= 500)
+	comparison.addAlternate(statusCode(response))
 	if response != nil {
-		log.Printf("| B | \"%s %s %v\" %s", request.Method, request.URL.RequestURI(), request.Proto, response.Status)
+		response.Body = compared.capture(response, recording.recordResponse(response, response.Body))
+		// read the response body to account for its size
+		var errorBody bytes.Buffer
+		var responseBytes int64
+		if response.StatusCode >= 400 && *alternateLogErrorBody > 0 {
+			responseBytes, _ = io.Copy(&errorBody, io.LimitReader(response.Body, int64(*alternateLogErrorBody)))
+		}
+		discarded, err := io.Copy(ioutil.Discard, response.Body)
+		responseBytes += discarded
 		response.Body.Close()
+		countBodyFailure("b", request, err)
+		observeSizes("b", backend, requestBody.count(), responseBytes)
+		log.Printf("| B | %s \"%s %s %v\" %s %v %dB", request.URL.Host, request.Method, request.URL.RequestURI(), request.Proto,
+			response.Status, time.Since(start).Round(time.Microsecond), responseBytes)
+		if errorBody.Len() > 0 {
+			log.Printf("| B | %s error body: %q", request.URL.Host, errorBody.Bytes())
+		}
+	} else {
+		log.Printf("| B | %s \"%s %s %v\" failed %v", request.URL.Host, request.Method, request.URL.RequestURI(), request.Proto,
+			time.Since(start).Round(time.Microsecond))
 	}
+	recording.finish()
+	compared.finish()
+	timing.done("b", backend, request)
+}
+
+// Sends a request and returns the response, side is "a" or "b" for the metrics.
+func handleRequest(side string, request *http.Request, transport http.RoundTripper) *http.Response {
+	response, _ := roundTrip(side, request, transport)
+	return response
 }
 
-// Sends a request and returns the response.
-func handleRequest(request *http.Request, timeout time.Duration, scheme string) *http.Response {
-	transport := getTransport(scheme, timeout)
+// roundTrip sends a request like handleRequest and returns the class of the
+// failure if there is no response.
+func roundTrip(side string, request *http.Request, transport http.RoundTripper) (*http.Response, string) {
 	response, err := transport.RoundTrip(request)
+	class := countFailure(side, request, response, err)
 	if err != nil {
-		log.Println("Request failed:", err)
+		log.Printf("Request to %s failed [%s]: %s", request.URL.Host, class, err)
 	}
-	return response
+	return response, class
 }
 
-// SchemeAndHost parse URL into scheme and rest of endpoint
+// SchemeAndHost parse URL into scheme and rest of endpoint, the host and
+// base path without the userinfo
 func SchemeAndHost(url string) (scheme, hostname string) {
+	if t, err := parseBackendTarget(url); err == nil {
+		return t.Scheme, t.Endpoint
+	}
 	if strings.HasPrefix(url, "https") {
 		hostname = strings.TrimPrefix(url, "https://")
 		scheme = "https"
@@ -113,59 +329,310 @@ func SchemeAndHost(url string) (scheme, hostname string) {
 type handler struct {
 	Target       string
 	TargetScheme string
-	Alternatives []backend
+	// TargetUser is the userinfo of the target URL, sent as basic auth
+	TargetUser   *url.Userinfo
+	Transport    http.RoundTripper
+	Alternatives []*backend
 	Randomizer   rand.Rand
+
+	// policies holds the current []*policy, replaced when reloading the config
+	policies atomic.Value
+	// maintenance holds the current []*maintenance responses
+	maintenance atomic.Value
+	// cacheRules holds the current []*cacheRule
+	cacheRules atomic.Value
+	// priorities holds the current []*priorityRule
+	priorities atomic.Value
+}
+
+// Policies returns the current mirroring policies.
+func (h *handler) Policies() []*policy {
+	policies, _ := h.policies.Load().([]*policy)
+	return policies
+}
+
+func (h *handler) SetPolicies(policies []*policy) {
+	h.policies.Store(policies)
 }
 
-type backend struct {
-	Alternative       string
-	AlternativeScheme string
+// Maintenance returns the first maintenance response matching the request.
+func (h *handler) Maintenance(req *http.Request) *maintenance {
+	responses, _ := h.maintenance.Load().([]*maintenance)
+	for _, m := range responses {
+		if m.Matches(req) {
+			return m
+		}
+	}
+	return nil
 }
 
-type arrayAlternatives []backend
+func (h *handler) SetMaintenance(responses []*maintenance) {
+	h.maintenance.Store(responses)
+}
 
-func (i *arrayAlternatives) String() string {
-	return "my string representation"
+// CacheRule returns the first cache rule matching the request.
+func (h *handler) CacheRule(req *http.Request) *cacheRule {
+	rules, _ := h.cacheRules.Load().([]*cacheRule)
+	for _, r := range rules {
+		if r.Matches(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (h *handler) SetCacheRules(rules []*cacheRule) {
+	h.cacheRules.Store(rules)
+}
+
+// Priority returns the priority class of the request.
+func (h *handler) Priority(req *http.Request) int {
+	rules, _ := h.priorities.Load().([]*priorityRule)
+	for _, r := range rules {
+		if r.Matches(req) {
+			return r.Class
+		}
+	}
+	return priorityNormal
+}
+
+func (h *handler) SetPriorities(rules []*priorityRule) {
+	h.priorities.Store(rules)
+}
+
+// mirrorHeaderValue lists the alternate backends for the -mirror-header.
+func mirrorHeaderValue(mirroredTo []string) string {
+	if len(mirroredTo) == 0 {
+		return "none"
+	}
+	return strings.Join(mirroredTo, ",")
+}
+
+type arrayAlternatives []*backend
+
+func (i arrayAlternatives) String() string {
+	var alternatives []string
+	for _, alt := range i {
+		alternatives = append(alternatives, alt.AlternativeScheme+"://"+alt.Alternative)
+	}
+	return strings.Join(alternatives, ", ")
 }
 
 func (i *arrayAlternatives) Set(value string) error {
-	scheme, endpoint := SchemeAndHost(value)
-	altServer := backend{AlternativeScheme: scheme, Alternative: endpoint}
-	*i = append(*i, altServer)
+	b, err := parseBackend(value)
+	if err != nil {
+		return err
+	}
+	*i = append(*i, b)
+	return nil
+}
+
+// stringList is a flag that can be given multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
 	return nil
 }
 
 func (h *handler) SetSchemes() {
+	if t, err := parseTarget(h.Target); err == nil {
+		h.TargetUser = t.User
+	}
 	h.TargetScheme, h.Target = SchemeAndHost(h.Target)
 }
 
 // ServeHTTP duplicates the incoming request (req) and does the request to the
 // Target and the Alternate target discading the Alternate response
-func (h handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	var alternativeRequest *http.Request
 	var productionRequest *http.Request
 
+	if *corsPreflight && isPreflight(req) {
+		answerPreflight(w, req)
+		return
+	}
+	if !verifyRequest(w, req) {
+		return
+	}
+	if isWebSocket(req) {
+		if maintenance := h.Maintenance(req); maintenance != nil {
+			maintenance.ServeHTTP(w, req)
+			return
+		}
+		h.serveWebSocket(w, req)
+		return
+	}
+
+	trace := startDebugTrace(w, req)
+	if *preserveHeaders {
+		req = captureHeaderOrder(req)
+	}
+	prepareRequestHeaders(req)
+	anonymizeClient(req)
+	trace.headers("prepared", req.Header)
 	if *forwardClientIP {
 		updateForwardedHeaders(req)
+		trace.headers("forwarded", req.Header)
 	}
-	if *percent == 100.0 || h.Randomizer.Float64()*100 < *percent {
-		if matchedByHttpMethod(req.Method) {
-			for _, alt := range h.Alternatives {
-				alternativeRequest = DuplicateRequest(req)
-
-				timeout := time.Duration(*alternateTimeout) * time.Millisecond
+	if *forwardProtoHost {
+		setForwardedProtoHost(req)
+		trace.headers("forwarded proto and host", req.Header)
+	}
+	if *tlsClientHeaders {
+		setClientTLSHeaders(req)
+		trace.headers("client TLS", req.Header)
+	}
+	if *bodyChecksumHeader != "" {
+		if err := setBodyChecksum(req, *bodyChecksumHeader); err != nil {
+			log.Printf("Failed to read the request body of %s: %s", req.URL.RequestURI(), err)
+			http.Error(w, "failed to read the request body", http.StatusBadRequest)
+			return
+		}
+		trace.headers("checksum", req.Header)
+	}
+	route := routes.Normalize(req.URL.Path)
+	trace.logf("route %s", route)
+	slow := newSlowRequest()
+	comparison := newStatusComparison()
+	comparedResponses := newResponseComparison(req, route)
+	unconditional := *alternateUnconditional && hasConditions(req)
+	if unconditional {
+		comparison.skip(http.StatusNotModified)
+		comparedResponses.skip(http.StatusNotModified)
+	}
+	idempotency := idempotencyKey(req)
+	stripRange := *alternateRange == rangeStrip && isRange(req)
+	if stripRange {
+		comparison.skip(http.StatusPartialContent)
+		comparedResponses.skip(http.StatusPartialContent)
+	}
+	mirrored := make(map[*backend]bool)
+	var mirroredTo []string
+	var held heldMirrors
+	maintenance := h.Maintenance(req)
+	healthCheck := healthChecks.Matches(req)
+	if healthCheck {
+		healthChecksTotal.Inc()
+	}
+	observed := !healthCheck || *healthCheckMetrics
+	if maintenance != nil && !maintenance.Mirror {
+		// planned downtime of the production target, nothing to compare
+		trace.logf("not mirrored: maintenance")
+	} else if healthCheck {
+		// probes of the load balancers, not traffic
+		trace.logf("not mirrored: health check")
+	} else if mirroringShed() {
+		mirrorShedTotal.Inc()
+		trace.logf("not mirrored: shedding")
+	} else if *alternateRange == rangeSkip && isRange(req) {
+		rangeRequestsTotal.Inc(rangeSkip)
+		trace.logf("not mirrored: range request")
+	} else if mirroringPaused() {
+		trace.logf("not mirrored: paused")
+	} else {
+		tenant := tenants.Tenant(req)
+		flagged := flagByTenants.Mirrors(tenant)
+		held.priority = h.Priority(req)
+		for _, p := range h.Policies() {
+			if reason := h.skipPolicy(p, req, tenant, flagged); reason != "" {
+				trace.logf("policy %s skipped: %s", p.Name, reason)
+				continue
+			}
+			for _, alt := range p.Select(&h.Randomizer) {
+				if reason := h.skipBackend(alt, mirrored); reason != "" {
+					trace.logf("not mirrored to %s: %s", alt.Alternative, reason)
+					continue
+				}
+				endpoint, err := alt.Endpoint(req)
+				if err != nil {
+					templateSkipsTotal.Inc(alt.Alternative)
+					if *debug {
+						log.Printf("Not mirroring to %s: %s", alt.Alternative, err)
+					}
+					trace.logf("not mirrored to %s: %s", alt.Alternative, err)
+					continue
+				}
+				// transformed and held duplicates are not read along with production
+				buffered := p.Anonymize != nil || *alternateGzip || alternateSigner != nil || *mirrorSequential || *mirrorDelay > 0
+				if alternativeRequest = alt.UploadPolicy().Duplicate(req, alt.Alternative, buffered); alternativeRequest == nil {
+					trace.logf("not mirrored to %s: upload skipped", alt.Alternative)
+					continue
+				}
+				mirrored[alt] = true
+				mirroredTo = append(mirroredTo, endpoint)
+				if p.Anonymize != nil {
+					p.Anonymize.Request(alternativeRequest)
+				}
+				if unconditional {
+					stripConditions(alternativeRequest)
+				}
+				if stripRange {
+					stripRangeHeaders(alternativeRequest)
+				}
+				if idempotency != "" {
+					alternativeRequest.Header.Set(idempotencyHeader, idempotency)
+				}
 
-				setRequestTarget(alternativeRequest, alt.Alternative, alt.AlternativeScheme)
+				setRequestTarget(alternativeRequest, endpoint, alt.AlternativeScheme)
 
 				if *alternateHostRewrite {
-					alternativeRequest.Host = alt.Alternative
+					alternativeRequest.Host = endpointHost(endpoint)
 				}
+				if alt.template != nil {
+					alternativeRequest = withBackendLabel(alternativeRequest, alt.Alternative)
+				}
+
+				trace.logf("mirrored by policy %s to %s", p.Name, endpoint)
+				trace.headers("mirrored to "+endpoint, alternativeRequest.Header)
+				task := &mirrorTask{request: alternativeRequest, alt: alt, route: route, slow: slow, comparison: comparison, responses: comparedResponses, trace: trace}
+				if *mirrorSequential {
+					held.tasks = append(held.tasks, task)
+				} else {
+					dispatchMirror(held.priority, task)
+				}
+			}
+		}
+	}
 
-				go handleAlternativeRequest(alternativeRequest, timeout, alt.AlternativeScheme)
+	defer abortStreamedDuplicates(req.Body)
+
+	if maintenance != nil {
+		held.release(maintenance.Status)
+		maintenance.ServeHTTP(w, req)
+		return
+	}
+
+	var cacheable *cacheRule
+	var key string
+	if *cacheSize > 0 {
+		cacheable = h.CacheRule(req)
+	}
+	if cacheable != nil {
+		key = cacheKey(req)
+	}
+	if key != "" {
+		if cached := responses.Get(key); cached != nil {
+			cacheRequestsTotal.Inc("hit")
+			trace.logf("answered from the cache with %d", cached.status)
+			log.Printf("| A | \"%s %s %v\" %d (cached)", req.Method, req.URL.RequestURI(), req.Proto, cached.status)
+			if !held.release(cached.status) {
+				mirroredTo = nil
+			}
+			if *mirrorHeader != "" {
+				w.Header().Set(*mirrorHeader, mirrorHeaderValue(mirroredTo))
 			}
+			serveCached(w, cached)
+			return
 		}
+		cacheRequestsTotal.Inc("miss")
 	}
 
+	clientHost := req.Host
 	productionRequest = req
 	defer func() {
 		if r := recover(); r != nil && *debug {
@@ -174,13 +641,42 @@ func (h handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}()
 
 	setRequestTarget(productionRequest, h.Target, h.TargetScheme)
+	setBasicAuth(productionRequest, h.TargetUser)
 
 	if *productionHostRewrite {
-		productionRequest.Host = h.Target
+		productionRequest.Host = endpointHost(h.Target)
+	}
+
+	recording := newRecording(recordSink, *recordPercent, "a", productionRequest, h.Target)
+	recording.recordRequestBody(productionRequest)
+	analysis := newRecording(analyzeSink, *analyzePercent, "a", productionRequest, h.Target)
+	sample := newRecording(snapshotSink(), 100, "a", productionRequest, h.Target)
+	sample.recordRequestBody(productionRequest)
+	compared := comparedResponses.response("a", h.Target)
+	requestBody := countBody(productionRequest)
+	productionRequest, timing := traceRequest(productionRequest)
+	productionRequest, conn := traceConn(productionRequest)
+	start := time.Now()
+	defer trackInFlight(h.Target)()
+	resp, class := roundTrip("a", productionRequest, h.Transport)
+	trace.logf("production answered %s in %v", responseStatus(resp), time.Since(start).Round(time.Microsecond))
+	if observed {
+		observeRequest("a", h.Target, route, traceID(productionRequest), resp, time.Since(start).Seconds())
+		proxyErrorAlert.observe(resp == nil)
+	}
+	comparison.setProduction(statusCode(resp))
+	if !held.release(statusCode(resp)) {
+		mirroredTo = nil
 	}
 
-	timeout := time.Duration(*productionTimeout) * time.Millisecond
-	resp := handleRequest(productionRequest, timeout, h.TargetScheme)
+	if resp != nil && !checkBodyless(productionRequest, resp, conn) {
+		resp.Body.Close()
+		resp = nil
+		class = "invalid-response"
+	}
+	if resp == nil {
+		writeProblem(w, req, []failedAttempt{{Target: "production", Class: class}})
+	}
 
 	if resp != nil {
 		defer resp.Body.Close()
@@ -188,75 +684,463 @@ func (h handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		log.Printf("| A | \"%s %s %v\" %s", productionRequest.Method, productionRequest.URL.RequestURI(), productionRequest.Proto, resp.Status)
 
 		// Forward response headers.
+		prepareResponseHeaders(resp)
+		responseHosts.Rewrite(resp.Header, req, clientHost, h.Target)
 		for k, v := range resp.Header {
 			w.Header()[k] = v
 		}
+		setContentLength(w.Header(), productionRequest, resp)
+		if *mirrorHeader != "" {
+			w.Header().Set(*mirrorHeader, mirrorHeaderValue(mirroredTo))
+		}
 		w.WriteHeader(resp.StatusCode)
 
-		// Forward response body.
-		io.Copy(w, resp.Body)
+		// Forward response body, storing it in the cache if allowed.
+		responseBody := &errorRecordingBody{ReadCloser: compared.capture(resp, sample.recordResponse(resp, analysis.recordResponse(resp, recording.recordResponse(resp, resp.Body))))}
+		var body io.Reader = responseBody
+		var caching *cachingBody
+		if key != "" {
+			if ttl := freshness(resp, cacheable.TTL); ttl > 0 {
+				caching = newCachingBody(responseBody, key, resp, ttl)
+				body = caching
+			}
+		}
+		var client io.Writer = w
+		if isStreaming(resp) {
+			client = flushWriter{w: w, controller: http.NewResponseController(w)}
+		}
+		responseBytes, err := io.Copy(client, body)
+		if caching != nil {
+			caching.store(err)
+		}
+		countBodyFailure("a", productionRequest, responseBody.err)
+		if observed {
+			observeSizes("a", h.Target, requestBody.count(), responseBytes)
+		}
 	}
+	recording.finish()
+	analysis.finish()
+	sample.finish()
+	compared.finish()
+	timing.done("a", h.Target, productionRequest)
+	logSlowRequest(slow, productionRequest, route, resp, time.Since(start))
+	trace.logf("done")
 }
 
-func matchedByHttpMethod(requestMethod string) bool {
-	if alternateMethodsRegex == nil {
-		return true
+// skipPolicy returns why the request is not mirrored by the policy, empty if
+// it is.
+func (h *handler) skipPolicy(p *policy, req *http.Request, tenant string, flagged bool) string {
+	switch {
+	case !flagged:
+		return "tenant flag off"
+	case !p.Matches(req):
+		return "no match"
+	case !p.MatchesTenant(tenant):
+		return "other tenant"
+	case !p.Sample(req, &h.Randomizer):
+		return "not sampled"
 	}
-	return alternateMethodsRegex.MatchString(requestMethod)
+	return ""
+}
+
+// skipBackend returns why the request is not mirrored to the backend, empty
+// if it is.
+func (h *handler) skipBackend(alt *backend, mirrored map[*backend]bool) string {
+	switch {
+	case mirrored[alt]:
+		return "already mirrored"
+	case !alt.Ready():
+		return "not ready"
+	case !alt.warmedUp(&h.Randomizer):
+		return "warming up"
+	case !alt.admitThrottled(&h.Randomizer):
+		return "throttled"
+	}
+	return ""
 }
 
 func main() {
 	var altServers arrayAlternatives
+	var routeTemplates, routeRules, altGroups stringList
 	flag.Var(&altServers, "b", "where testing traffic goes. response are skipped. http://localhost:8081/test, allowed multiple times for multiple testing backends")
+	flag.Var(&altGroups, "b.group", "comma separated testing backends of which each mirrored request goes to exactly one, allowed multiple times for multiple groups")
+	flag.Var(&routeTemplates, "route", "route template like /users/{id} used to aggregate metrics, allowed multiple times")
+	flag.Var(&routeRules, "route.rule", "path normalization rule regex=replacement used when no route template matches, allowed multiple times")
 	flag.Parse()
 
-	if *alternateMethods != "" {
-		alternateMethodsRegex = regexp.MustCompile(*alternateMethods)
+	if *printVersion {
+		fmt.Println("teeproxy", version)
+		return
+	}
+	if err := applySafeDefaults(); err != nil {
+		fatalf("Invalid -safe-defaults: %s", err)
 	}
 
-	log.Printf("Starting teeproxy at %s sending to A: %s and B: %s",
-		*listen, *targetProduction, altServers)
+	if flag.Arg(0) == "selftest" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+		os.Exit(selfTestCommand())
+	}
+	if flag.Arg(0) == "test" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+		os.Exit(testCommand())
+	}
+	if *benchRequests > 0 {
+		os.Exit(benchCommand())
+	}
+	if flag.Arg(0) == "replay" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+		if flag.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "usage: teeproxy -a <target> replay <recording>")
+			os.Exit(2)
+		}
+		os.Exit(replayCommand(flag.Arg(0)))
+	}
+	if flag.Arg(0) == "compare" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "usage: teeproxy compare <recording-A> <recording-B>")
+			os.Exit(2)
+		}
+		os.Exit(compareCommand(flag.Arg(0), flag.Arg(1)))
+	}
 
-	runtime.GOMAXPROCS(runtime.NumCPU())
+	var logOutput io.Writer = os.Stderr
+	if *logFile != "" {
+		file, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			fatalf("Failed to open log file %s: %s", *logFile, err)
+		}
+		logOutput = file
+	}
+	setAsyncLog(logOutput)
 
 	var err error
+	tenants, err = parseTenantSource(*tenantKey)
+	if err != nil {
+		fatalf("Invalid -tenant.key: %s", err)
+	}
+	compareNormalizers, err = parseNormalizers(*compareNormalize)
+	if err != nil {
+		fatalf("Invalid -compare.normalize: %s", err)
+	}
+	if err := checkURLHandling(*urlHandling); err != nil {
+		fatalf("Invalid -url.handling: %s", err)
+	}
+	responseHosts = newHostRewriter(*rewriteHosts, *rewritePublicHost, *productionRedirectRewrite)
+	if _, err := parseTarget(*targetProduction); err != nil {
+		fatalf("Invalid -a: %s", err)
+	}
+	if err := checkBodylessPolicy(*bodylessStatus); err != nil {
+		fatalf("Invalid -a.bodyless-status: %s", err)
+	}
+	if err := checkPlaintextPolicy(*tlsPlaintext); err != nil {
+		fatalf("Invalid -tls.plaintext: %s", err)
+	}
+	if err := checkRangePolicy(*alternateRange); err != nil {
+		fatalf("Invalid -b.range: %s", err)
+	}
+	c, err := currentConfig()
+	if err != nil {
+		fatalf("Invalid -config: %s", err)
+	}
+	profiles, err := buildAnonymizers(c.Anonymization)
+	if err != nil {
+		fatalf("Invalid anonymization profiles: %s", err)
+	}
+	policies, applyPolicies, err := buildPolicies(c, profiles, altServers, altGroups)
+	if err != nil {
+		fatalf("Invalid mirroring policies: %s", err)
+	}
+	maintenance, err := c.buildMaintenance()
+	if err != nil {
+		fatalf("Invalid maintenance responses: %s", err)
+	}
+	cacheRules, err := c.buildCacheRules()
+	if err != nil {
+		fatalf("Invalid cache rules: %s", err)
+	}
+	priorities, err := c.buildPriorities()
+	if err != nil {
+		fatalf("Invalid priorities: %s", err)
+	}
+	listeners, err := c.buildListeners()
+	if err != nil {
+		fatalf("Invalid listeners: %s", err)
+	}
+	setAnonymizers(profiles)
+	applyPolicies()
 
-	var listener net.Listener
+	for _, template := range routeTemplates {
+		routes.AddTemplate(template)
+	}
+	if *routesOpenAPI != "" {
+		if err := routes.LoadOpenAPI(*routesOpenAPI); err != nil {
+			fatalf("Failed to load route templates: %s", err)
+		}
+	}
+	if len(routeRules) == 0 {
+		routeRules = defaultRouteRules
+	}
+	for _, rule := range routeRules {
+		if err := routes.AddRule(rule); err != nil {
+			fatalf("Invalid route rule: %s", err)
+		}
+	}
 
-	if len(*tlsPrivateKey) > 0 {
-		cer, err := tls.LoadX509KeyPair(*tlsCertificate, *tlsPrivateKey)
-		if err != nil {
-			log.Fatalf("Failed to load certficate: %s and private key: %s", *tlsCertificate, *tlsPrivateKey)
+	if *adminListen != "" {
+		startAdmin(*adminListen)
+	}
+	if *tlsRedirect != "" {
+		if *tlsPrivateKey == "" {
+			fatalf("-tls.redirect requires -key.file and -cert.file")
+		}
+		startHTTPSRedirect(*tlsRedirect, *listen)
+	}
+	startAlerts()
+	if *auditLog != "" {
+		if err := startAudit(*auditLog); err != nil {
+			fatalf("Failed to open audit log %s: %s", *auditLog, err)
+		}
+	}
+	if !validSampleKey(*sampleKeySource) {
+		fatalf("Invalid -sample.key %s, expected header:<name>, cookie:<name>, query:<name> or ip", *sampleKeySource)
+	}
+	sampleSalt.Store(*sampleSaltValue)
+	if *clientIPAnonymize != "" && *clientIPAnonymize != "truncate" && *clientIPAnonymize != "hash" {
+		fatalf("Invalid -client-ip.anonymize %s, expected truncate or hash", *clientIPAnonymize)
+	}
+	if *mirrorOnStatus != "" {
+		if !*mirrorSequential {
+			fatalf("-mirror.on-status requires -mirror.sequential")
 		}
+		if mirrorStatuses, err = parseStatusRules(*mirrorOnStatus); err != nil {
+			fatalf("Invalid -mirror.on-status: %s", err)
+		}
+	}
+	if backendResolver, err = newResolver(*dnsServers, time.Duration(*dnsTTL)*time.Second); err != nil {
+		fatalf("Invalid -dns.servers: %s", err)
+	}
+	if err := parseTransformFailure(*productionTransformFailure); err != nil {
+		fatalf("Invalid -a.transform-failure: %s", err)
+	}
+	if productionSigner, err = parseSigner(*productionSign); err != nil {
+		fatalf("Invalid -a.sign: %s", err)
+	}
+	if alternateSigner, err = parseSigner(*alternateSign); err != nil {
+		fatalf("Invalid -b.sign: %s", err)
+	}
+	healthChecks = newHealthCheckMatcher(*healthCheckPaths, *healthCheckAgents)
+	if *metricsRoutesLimit > 0 {
+		metricRoutes = newRouteRanking(*metricsRoutesLimit)
+	}
+	if debugTrustedNetworks, err = parseNetworks(*debugTraceNetworks); err != nil {
+		fatalf("Invalid -debug.networks: %s", err)
+	}
+	if err := setAnonymizeKey(); err != nil {
+		fatalf("Invalid -anonymize.key: %s", err)
+	}
+	if *debugTraceToken != "" {
+		debugToken = newSecret(*debugTraceToken)
+		if _, err := debugToken.Value(); err != nil {
+			fatalf("Invalid -debug.token: %s", err)
+		}
+	}
+	if inboundVerifier = newSignatureVerifier(); inboundVerifier != nil {
+		if _, err := inboundVerifier.key.Value(); err != nil {
+			fatalf("Invalid -verify.hmac.key: %s", err)
+		}
+	}
+	startMirrorWorkers()
+	startDelayBuffer()
+	if *recordFile != "" {
+		startRecording()
+	}
+	if *captureURL != "" {
+		startCapture()
+	}
+	if *analyzeSocket != "" {
+		startAnalyzer()
+	}
+	if *redisAddress != "" {
+		startSharedState()
+		startSharedSampling()
+	}
+	if err := startFeatureFlags(); err != nil {
+		fatalf("Invalid feature flags: %s", err)
+	}
 
-		config := &tls.Config{Certificates: []tls.Certificate{cer}}
-		listener, err = tls.Listen("tcp", *listen, config)
-		if err != nil {
-			log.Fatalf("Failed to listen to %s: %s", *listen, err)
+	from := *listen
+	if *sourceSpec != "" {
+		from = *sourceSpec
+	}
+	log.Printf("Starting teeproxy at %s sending to A: %s and B: %s",
+		from, redactURL(*targetProduction, false), altServers)
+	logPolicies(policies)
+	logMaintenance(maintenance)
+	logCacheRules(cacheRules)
+
+	setMaxProcs()
+	setMemoryLimit()
+	startTelemetry()
+
+	var source Source
+	if *sourceSpec != "" {
+		if source, err = newSource(*sourceSpec); err != nil {
+			fatalf("Failed to open the source: %s", err)
 		}
 	} else {
-		listener, err = net.Listen("tcp", *listen)
+		listener, err := newListener(*listen)
 		if err != nil {
-			log.Fatalf("Failed to listen to %s: %s", *listen, err)
+			fatalf("Failed to listen to %s: %s", *listen, err)
 		}
+		source = newHTTPSource(listener)
 	}
 
-	h := handler{
+	h := &handler{
 		Target:       *targetProduction,
-		Alternatives: arrayAlternatives(altServers),
-		Randomizer:   *rand.New(rand.NewSource(time.Now().UnixNano())),
+		Alternatives: registeredBackends(),
+		Randomizer:   *seedDecisions(*randomSeed),
 	}
+	h.SetPolicies(policies)
+	h.SetMaintenance(maintenance)
+	h.SetCacheRules(cacheRules)
+	h.SetPriorities(priorities)
 
 	h.SetSchemes()
+	if err := startGrpcDecoding(h.TargetScheme, h.Target); err != nil {
+		fatalf("Invalid -grpc.descriptors: %s", err)
+	}
+	h.Transport = withRedirects(withProductionSigner(withOrderedHeaders(getTransport(h.TargetScheme, time.Duration(*productionTimeout)*time.Millisecond,
+		*closeConnections || *productionCloseConnections)), productionSigner), productionRedirectLimit)
+
+	if *failFast {
+		timeout := time.Duration(*productionTimeout) * time.Millisecond
+		if err := probeBackend(h.TargetScheme, h.Target, timeout); err != nil {
+			fatalf("Production target %s://%s is unreachable: %s", h.TargetScheme, h.Target, err)
+		}
+		if *failFastAlternates {
+			timeout := time.Duration(*alternateTimeout) * time.Millisecond
+			for _, alt := range h.Alternatives {
+				if alt.template != nil {
+					continue
+				}
+				if err := probeBackend(alt.AlternativeScheme, alt.Alternative, timeout); err != nil {
+					fatalf("Alternate backend %s://%s is unreachable: %s", alt.AlternativeScheme, alt.Alternative, err)
+				}
+			}
+		}
+	}
+
+	instances, err := startListeners(listeners, profiles)
+	if err != nil {
+		fatalf("Failed to start the listeners: %s", err)
+	}
+	startBackends(h.Alternatives)
+	startCompaction()
+	startRouteRanking()
+	adminMux.HandleFunc("/selftest", h.selfTestHandler)
+	adminMux.HandleFunc("/config", effectiveConfigHandler(h, instances))
+	logStartupBanner(h, instances, source.String())
+
+	// reloading serializes the reloads on SIGHUP and of the config polling
+	var reloading sync.Mutex
+	reload := func(source string) {
+		reloading.Lock()
+		defer reloading.Unlock()
+		c, err := currentConfig()
+		if err != nil {
+			log.Printf("Failed to reload the config: %s", err)
+			setConfigError(err)
+			return
+		}
+		profiles, err := buildAnonymizers(c.Anonymization)
+		if err != nil {
+			log.Printf("Failed to reload the anonymization profiles: %s", err)
+			setConfigError(err)
+			return
+		}
+		policies, applyPolicies, err := buildPolicies(c, profiles, altServers, altGroups)
+		if err != nil {
+			log.Printf("Failed to reload the mirroring policies: %s", err)
+			setConfigError(err)
+			return
+		}
+		maintenance, err := c.buildMaintenance()
+		if err != nil {
+			log.Printf("Failed to reload the maintenance responses: %s", err)
+			setConfigError(err)
+			return
+		}
+		cacheRules, err := c.buildCacheRules()
+		if err != nil {
+			log.Printf("Failed to reload the cache rules: %s", err)
+			setConfigError(err)
+			return
+		}
+		priorities, err := c.buildPriorities()
+		if err != nil {
+			log.Printf("Failed to reload the priorities: %s", err)
+			setConfigError(err)
+			return
+		}
+		listeners, err := c.buildListeners()
+		if err == nil {
+			err = reloadListeners(instances, listeners, profiles, source)
+		}
+		if err != nil {
+			log.Printf("Failed to reload the listeners: %s", err)
+			setConfigError(err)
+			return
+		}
+		setConfigError(err)
+		setAnonymizers(profiles)
+		applyPolicies()
+		audit(source, "policies", describePolicies(h.Policies()), describePolicies(policies))
+		h.SetPolicies(policies)
+		h.SetPriorities(priorities)
+		h.SetMaintenance(maintenance)
+		h.SetCacheRules(cacheRules)
+		startBackends(registeredBackends())
+		log.Printf("Reloaded the mirroring policies on %s", source)
+		logPolicies(policies)
+		logMaintenance(maintenance)
+		logCacheRules(cacheRules)
+	}
+	done := make(chan struct{})
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() {
+			closeListeners(instances)
+			shutdown(source)
+			close(done)
+		})
+	}
+	handleSignals(stop, func() {
+		pollRemoteConfigs()
+		reload("SIGHUP")
+	})
+	startConfigPolling(reload)
+	if err := writePidFile(); err != nil {
+		fatalf("Failed to write pid file %s: %s", *pidFile, err)
+	}
 
-	server := &http.Server{
-		Handler: h,
+	var served http.Handler = h
+	if *webhookDestinations != "" {
+		if served, err = startWebhookFork(); err != nil {
+			fatalf("Invalid -webhook.fork: %s", err)
+		}
 	}
-	if *closeConnections {
-		// Close connections to clients by setting the "Connection": "close" header in the response.
-		server.SetKeepAlivesEnabled(false)
+	served = limitLifetime(served, stop)
+	if !runService(func() { source.Serve(served) }, stop) {
+		if err := source.Serve(served); err != nil {
+			fatalf("Failed to serve: %s", err)
+		}
+		// offline sources return once exhausted
+		stop()
 	}
-	server.Serve(listener)
+	<-done
+	stopRecording()
+	flushLog()
 }
 
 type nopCloser struct {
@@ -265,41 +1149,27 @@ type nopCloser struct {
 
 func (nopCloser) Close() error { return nil }
 
-// DuplicateRequest duplicate http request
-func DuplicateRequest(request *http.Request) (dup *http.Request) {
-	var bodyBytes []byte
-	if request.Body != nil {
-		bodyBytes, _ = ioutil.ReadAll(request.Body)
-	}
-	request.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
-	dup = &http.Request{
-		Method:        request.Method,
-		URL:           request.URL,
-		Proto:         request.Proto,
-		ProtoMajor:    request.ProtoMajor,
-		ProtoMinor:    request.ProtoMinor,
-		Header:        request.Header,
-		Body:          ioutil.NopCloser(bytes.NewBuffer(bodyBytes)),
-		Host:          request.Host,
-		ContentLength: request.ContentLength,
-		Close:         true,
-	}
-	return
-}
-
 func updateForwardedHeaders(request *http.Request) {
-	positionOfColon := strings.LastIndex(request.RemoteAddr, ":")
-	var remoteIP string
-	if positionOfColon != -1 {
-		remoteIP = request.RemoteAddr[:positionOfColon]
-	} else {
-		log.Printf("The default format of request.RemoteAddr should be IP:Port but was %s\n", remoteIP)
+	remoteIP, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		log.Printf("The default format of request.RemoteAddr should be IP:Port but was %s\n", request.RemoteAddr)
 		remoteIP = request.RemoteAddr
 	}
 	insertOrExtendForwardedHeader(request, remoteIP)
 	insertOrExtendXFFHeader(request, remoteIP)
 }
 
+// setForwardedProtoHost tells the backends how the client connected, unless
+// an upstream proxy did.
+func setForwardedProtoHost(request *http.Request) {
+	if request.Header.Get("X-Forwarded-Proto") == "" {
+		request.Header.Set("X-Forwarded-Proto", requestScheme(request))
+	}
+	if request.Header.Get("X-Forwarded-Host") == "" && request.Host != "" {
+		request.Header.Set("X-Forwarded-Host", request.Host)
+	}
+}
+
 const XFF_HEADER = "X-Forwarded-For"
 
 func insertOrExtendXFFHeader(request *http.Request, remoteIP string) {
@@ -318,6 +1188,10 @@ const FORWARDED_HEADER = "Forwarded"
 // Implementation according to rfc7239
 func insertOrExtendForwardedHeader(request *http.Request, remoteIP string) {
 	extension := "for=" + remoteIP
+	if strings.Contains(remoteIP, ":") {
+		// IPv6 addresses are bracketed and quoted
+		extension = "for=\"[" + remoteIP + "]\""
+	}
 	header := request.Header.Get(FORWARDED_HEADER)
 	if header != "" {
 		// extend
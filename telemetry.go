@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// teeproxy reports its own health: the goroutines, the heap, the requests in
+// flight per backend and the depths of the mirroring queues are exported as
+// metrics, and with -telemetry.interval logged as | TELEMETRY | lines, so
+// that operators can see the trend. With -watchdog.goroutines, mirroring is
+// shed while there are more goroutines, e.g. because a slow alternate
+// backend piles up mirrored requests.
+
+var (
+	inFlightMutex sync.Mutex
+	inFlight      = make(map[string]*int64)
+)
+
+func init() {
+	newGaugeFunc("teeproxy_goroutines", "Number of goroutines of the proxy.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	newGaugeFunc("teeproxy_heap_bytes", "Bytes of the heap objects of the proxy.", func() float64 {
+		return float64(heapBytes())
+	})
+	newGaugeVecFunc("teeproxy_requests_in_flight", "Number of requests sent to a backend and not completed.", "backend", requestsInFlight)
+	newGaugeVecFunc("teeproxy_mirror_queue_depth", "Number of mirrored requests waiting by queue, the priority classes of -mirror.workers and the delay buffer.", "queue", queueDepths)
+}
+
+// trackInFlight counts a request to the backend until the returned function
+// is called.
+func trackInFlight(backend string) func() {
+	inFlightMutex.Lock()
+	count, ok := inFlight[backend]
+	if !ok {
+		count = new(int64)
+		inFlight[backend] = count
+	}
+	inFlightMutex.Unlock()
+	atomic.AddInt64(count, 1)
+	return func() { atomic.AddInt64(count, -1) }
+}
+
+func requestsInFlight() map[string]float64 {
+	inFlightMutex.Lock()
+	defer inFlightMutex.Unlock()
+	values := make(map[string]float64, len(inFlight))
+	for backend, count := range inFlight {
+		values[backend] = float64(atomic.LoadInt64(count))
+	}
+	return values
+}
+
+func queueDepths() map[string]float64 {
+	values := make(map[string]float64)
+	for class, queue := range mirrorQueues {
+		values[priorityNames[class]] = float64(len(queue))
+	}
+	if delayedMirrors != nil {
+		values["delay"] = float64(len(delayedMirrors))
+	}
+	return values
+}
+
+func heapBytes() uint64 {
+	samples := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return samples[0].Value.Uint64()
+}
+
+// telemetryLine describes the health of the proxy for the log.
+func telemetryLine() string {
+	line := fmt.Sprintf("| TELEMETRY | goroutines=%d heap=%dMiB shed=%v", runtime.NumGoroutine(), heapBytes()>>20, mirroringShed())
+	for _, values := range []struct {
+		name   string
+		values map[string]float64
+	}{{"in_flight", requestsInFlight()}, {"queue", queueDepths()}} {
+		var pairs []string
+		for _, key := range sortedKeys(values.values) {
+			pairs = append(pairs, fmt.Sprintf("%s:%d", key, int64(values.values[key])))
+		}
+		if len(pairs) > 0 {
+			line += " " + values.name + "=" + strings.Join(pairs, ",")
+		}
+	}
+	return line
+}
+
+// startTelemetry logs the telemetry every -telemetry.interval seconds and
+// starts the -watchdog.goroutines watchdog.
+func startTelemetry() {
+	if *telemetryInterval > 0 {
+		go func() {
+			for range time.Tick(time.Duration(*telemetryInterval) * time.Second) {
+				log.Print(telemetryLine())
+			}
+		}()
+	}
+	if *watchdogGoroutines > 0 {
+		go func() {
+			for range time.Tick(time.Second) {
+				setMirroringShed("goroutines", runtime.NumGoroutine() > *watchdogGoroutines)
+			}
+		}()
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTrackInFlight(t *testing.T) {
+	done := trackInFlight("inflight.example:8080")
+	trackInFlight("inflight.example:8080")()
+	if value := requestsInFlight()["inflight.example:8080"]; value != 1 {
+		t.Errorf("Expected '%v', but received '%v'", 1, value)
+	}
+	if line := telemetryLine(); !strings.Contains(line, "inflight.example:8080:1") {
+		t.Errorf("Expected '%s', but received '%s'", "inflight.example:8080:1", line)
+	}
+	done()
+	if value := requestsInFlight()["inflight.example:8080"]; value != 0 {
+		t.Errorf("Expected '%v', but received '%v'", 0, value)
+	}
+}
+
+func TestGaugeVecFuncExposition(t *testing.T) {
+	g := &gaugeVecFunc{name: "test_depth", help: "Test.", label: "queue", function: func() map[string]float64 {
+		return map[string]float64{"low": 2, "high": 1}
+	}}
+	var out bytes.Buffer
+	g.write(&out)
+	expectation := `# HELP test_depth Test.
+# TYPE test_depth gauge
+test_depth{queue="high"} 1
+test_depth{queue="low"} 2
+`
+	if out.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, out.String())
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The URL of an alternate backend can be a template resolved per request, so
+// that one proxy mirrors into region or tenant specific shadow stacks:
+//
+//	http://{header:X-Region}.shadow.internal:8080
+//	http://shadow-{path:1}.internal
+//
+// {header:Name} is the value of the request header and {path:N} the N-th
+// segment of the request path, counting from 1. The values are restricted to
+// letters, digits, - and _, so that a client cannot steer the mirrored
+// requests outside of the templated names, and a request without a valid
+// value is not mirrored to the backend. Templated backends are not probed or
+// health checked, and their scheme is http or https. The metrics of a
+// templated backend are labeled with its template, not the resolved host, so
+// that the clients do not choose the series.
+
+// templateValue matches the values substituted into a template.
+var templateValue = regexp.MustCompile(`^[A-Za-z0-9_-]{1,63}$`)
+
+var templateSkipsTotal = newCounterVec("teeproxy_template_skips_total",
+	"Number of requests not mirrored to a templated backend for lack of a valid value, by backend.", "backend")
+
+// templatePart is a literal or, if source is set, a placeholder.
+type templatePart struct {
+	literal string
+	source  string
+	name    string
+	segment int
+}
+
+// targetTemplate is the endpoint of a templated backend.
+type targetTemplate struct {
+	parts []templatePart
+}
+
+// isTargetTemplate reports whether the backend URL has placeholders.
+func isTargetTemplate(value string) bool {
+	return strings.Contains(value, "{")
+}
+
+// parseTargetTemplate parses a templated backend URL into its scheme, its
+// endpoint with the placeholders and the template of the endpoint.
+func parseTargetTemplate(value string) (scheme, endpoint string, template *targetTemplate, err error) {
+	raw := value
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	scheme, endpoint, _ = strings.Cut(raw, "://")
+	if scheme != "http" && scheme != "https" {
+		return "", "", nil, fmt.Errorf("templated backend %q: unsupported scheme %q, expected http or https", value, scheme)
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	template = &targetTemplate{}
+	sample := endpoint
+	for rest := endpoint; rest != ""; {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			template.parts = append(template.parts, templatePart{literal: rest})
+			break
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return "", "", nil, fmt.Errorf("templated backend %q: unterminated placeholder", value)
+		}
+		placeholder := rest[start+1 : start+end]
+		part, err := parsePlaceholder(placeholder)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("templated backend %q: %v", value, err)
+		}
+		template.parts = append(template.parts, templatePart{literal: rest[:start]}, part)
+		sample = strings.Replace(sample, "{"+placeholder+"}", "x", 1)
+		rest = rest[start+end+1:]
+	}
+	if _, err := parseTarget(scheme + "://" + sample); err != nil {
+		return "", "", nil, fmt.Errorf("templated backend: %v", err)
+	}
+	return scheme, endpoint, template, nil
+}
+
+func parsePlaceholder(placeholder string) (templatePart, error) {
+	source, name, _ := strings.Cut(placeholder, ":")
+	switch source {
+	case "header":
+		if name == "" {
+			return templatePart{}, fmt.Errorf("placeholder {%s} names no header", placeholder)
+		}
+		return templatePart{source: source, name: http.CanonicalHeaderKey(name)}, nil
+	case "path":
+		segment, err := strconv.Atoi(name)
+		if err != nil || segment < 1 {
+			return templatePart{}, fmt.Errorf("placeholder {%s} names no path segment, expected {path:N} with N from 1", placeholder)
+		}
+		return templatePart{source: source, segment: segment}, nil
+	}
+	return templatePart{}, fmt.Errorf("unknown placeholder {%s}, expected {header:Name} or {path:N}", placeholder)
+}
+
+// Resolve returns the endpoint for the request.
+func (t *targetTemplate) Resolve(req *http.Request) (string, error) {
+	var endpoint strings.Builder
+	for _, part := range t.parts {
+		endpoint.WriteString(part.literal)
+		var value string
+		switch part.source {
+		case "":
+			continue
+		case "header":
+			value = req.Header.Get(part.name)
+		case "path":
+			if segments := strings.Split(strings.Trim(req.URL.Path, "/"), "/"); part.segment <= len(segments) {
+				value = segments[part.segment-1]
+			}
+		}
+		if !templateValue.MatchString(value) {
+			if part.source == "header" {
+				return "", fmt.Errorf("no valid %s header", part.name)
+			}
+			return "", fmt.Errorf("no valid path segment %d", part.segment)
+		}
+		endpoint.WriteString(value)
+	}
+	return endpoint.String(), nil
+}
+
+// Endpoint returns the endpoint the request is mirrored to, the resolved
+// template of a templated backend.
+func (b *backend) Endpoint(req *http.Request) (string, error) {
+	if b.template == nil {
+		return b.Alternative, nil
+	}
+	return b.template.Resolve(req)
+}
+
+type backendLabelKey struct{}
+
+// withBackendLabel returns the request mirrored to a templated backend
+// carrying the template as the backend label of its metrics.
+func withBackendLabel(req *http.Request, label string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), backendLabelKey{}, label))
+}
+
+// backendLabel returns the backend label of the metrics of the request, the
+// host it is sent to unless it is mirrored to a templated backend.
+func backendLabel(req *http.Request) string {
+	if label, ok := req.Context().Value(backendLabelKey{}).(string); ok {
+		return label
+	}
+	return req.URL.Host
+}
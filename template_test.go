@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseTargetTemplate(t *testing.T) {
+	for _, invalid := range []string{
+		"http://{header:X-Region",
+		"http://{query:region}.shadow.internal",
+		"http://{path:0}.shadow.internal",
+		"http://{header:}.shadow.internal",
+		"lambda://{header:X-Function}",
+		"http://shadow.internal:{header:X-Port}",
+	} {
+		if _, _, _, err := parseTargetTemplate(invalid); err == nil {
+			t.Errorf("Expected 'an error for %s', but received none", invalid)
+		}
+	}
+
+	scheme, endpoint, template, err := parseTargetTemplate("https://{header:x-region}.shadow.internal:8080/{path:2}/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheme != "https" || endpoint != "{header:x-region}.shadow.internal:8080/{path:2}" {
+		t.Errorf("Expected 'https {header:x-region}.shadow.internal:8080/{path:2}', but received '%s %s'", scheme, endpoint)
+	}
+	for _, test := range []struct {
+		region, path, expectation string
+	}{
+		{"eu-west", "/api/orders/1", "eu-west.shadow.internal:8080/orders"},
+		{"", "/api/orders/1", ""},
+		{"evil.example.com#", "/api/orders/1", ""},
+		{"eu-west", "/api", ""},
+	} {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.region != "" {
+			req.Header.Set("X-Region", test.region)
+		}
+		resolved, err := template.Resolve(req)
+		if resolved != test.expectation || (err == nil) != (test.expectation != "") {
+			t.Errorf("Expected '%s', but received '%s' %v", test.expectation, resolved, err)
+		}
+	}
+}
+
+func TestTemplatedBackend(t *testing.T) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer production.Close()
+	var mu sync.Mutex
+	var paths []string
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+	}))
+	defer alternate.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler(production.URL, alternate.URL+"/{header:X-Tenant}")
+	for _, tenant := range []string{"acme", "", "../admin"} {
+		req := httptest.NewRequest("GET", "/orders", nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	mirrorsInFlight.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 1 || paths[0] != "/acme/orders" {
+		t.Errorf("Expected '[/acme/orders]', but received '%v'", paths)
+	}
+	if skipped := templateSkipsTotal.values[labelKey([]string{h.Alternatives[0].Alternative})]; skipped != 2 {
+		t.Errorf("Expected '2', but received '%v'", skipped)
+	}
+	var out strings.Builder
+	requestDuration.write(&out)
+	if label := `backend="` + h.Alternatives[0].Alternative + `"`; !strings.Contains(out.String(), label) {
+		t.Errorf("Expected the template as the backend label %s, but received '%s'", label, out.String())
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Tenants are identified by -tenant.key, policies with "tenants" only mirror
+// the requests of the listed tenants, e.g. to shadow the traffic of beta
+// customers at 100%.
+
+// tenantSource says where the tenant id of a request is taken from.
+type tenantSource struct {
+	kind string
+	name string
+	// segment is the 1-based index of the path segment for kind "path"
+	segment int
+}
+
+func parseTenantSource(value string) (*tenantSource, error) {
+	if value == "" {
+		return nil, nil
+	}
+	kind, name, _ := strings.Cut(value, ":")
+	source := &tenantSource{kind: kind, name: name}
+	switch kind {
+	case "header", "query", "cookie", "jwt":
+		if name == "" {
+			return nil, fmt.Errorf("missing name in %s", value)
+		}
+	case "path":
+		segment, err := strconv.Atoi(name)
+		if err != nil || segment < 1 {
+			return nil, fmt.Errorf("invalid path segment in %s", value)
+		}
+		source.segment = segment
+	case "host":
+	default:
+		return nil, fmt.Errorf("unknown tenant source %s, expected header, query, cookie, jwt, path or host", kind)
+	}
+	return source, nil
+}
+
+// Tenant returns the tenant id of the request, "" if there is none.
+func (s *tenantSource) Tenant(req *http.Request) string {
+	if s == nil {
+		return ""
+	}
+	switch s.kind {
+	case "header":
+		return req.Header.Get(s.name)
+	case "query":
+		return req.URL.Query().Get(s.name)
+	case "cookie":
+		if cookie, err := req.Cookie(s.name); err == nil {
+			return cookie.Value
+		}
+	case "path":
+		segments := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+		if s.segment <= len(segments) {
+			return segments[s.segment-1]
+		}
+	case "host":
+		host := req.Host
+		if i := strings.IndexByte(host, '.'); i > 0 {
+			return host[:i]
+		}
+	case "jwt":
+		return jwtClaim(req.Header.Get("Authorization"), s.name)
+	}
+	return ""
+}
+
+// jwtClaim returns a claim of the bearer token, nested claims are separated
+// by dots. The signature is not verified, the backends do that.
+func jwtClaim(authorization, claim string) string {
+	token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		return ""
+	}
+	for _, name := range strings.Split(claim, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[name]
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// tenants is the -tenant.key source, nil if tenants are not identified.
+var tenants *tenantSource
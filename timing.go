@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestTiming breaks down the latency of a backend request into the DNS,
+// connect, TLS, time to first byte and transfer phases.
+type requestTiming struct {
+	mu sync.Mutex
+
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+
+	phases []phaseTiming
+}
+
+type phaseTiming struct {
+	name     string
+	duration time.Duration
+}
+
+var requestPhaseDuration = newHistogramVec("teeproxy_request_phase_seconds",
+	"Latency of the phases (dns, connect, tls, ttfb, transfer) of the requests sent to the backends.",
+	latencyBuckets, "side", "backend", "phase")
+
+// traceRequest returns the request with a httptrace attached if -latency-breakdown is set.
+func traceRequest(request *http.Request) (*http.Request, *requestTiming) {
+	if !*latencyBreakdown {
+		return request, nil
+	}
+	t := &requestTiming{start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { t.mark(&t.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.phase("dns", &t.dnsStart) },
+		ConnectStart: func(network, addr string) {
+			t.mark(&t.connectStart)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.phase("connect", &t.connectStart)
+		},
+		TLSHandshakeStart: func() { t.mark(&t.tlsStart) },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.phase("tls", &t.tlsStart)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) { t.mark(&t.wroteRequest) },
+		GotFirstResponseByte: func() {
+			t.mark(&t.firstByte)
+			t.phase("ttfb", &t.wroteRequest)
+		},
+	}
+	return request.WithContext(httptrace.WithClientTrace(request.Context(), trace)), t
+}
+
+func (t *requestTiming) mark(at *time.Time) {
+	t.mu.Lock()
+	*at = time.Now()
+	t.mu.Unlock()
+}
+
+func (t *requestTiming) phase(name string, since *time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if since.IsZero() {
+		return
+	}
+	t.phases = append(t.phases, phaseTiming{name: name, duration: time.Since(*since)})
+}
+
+// done is called once the response body was read, it records the phases in
+// the metrics and the debug log.
+func (t *requestTiming) done(side, backend string, request *http.Request) {
+	if t == nil {
+		return
+	}
+	t.phase("transfer", &t.firstByte)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var fields []string
+	for _, p := range t.phases {
+		requestPhaseDuration.Observe(p.duration.Seconds(), side, backend, p.name)
+		fields = append(fields, fmt.Sprintf("%s=%v", p.name, p.duration))
+	}
+	if *debug {
+		log.Printf("| %s | \"%s %s\" timings %s total=%v", strings.ToUpper(side),
+			request.Method, request.URL.RequestURI(), strings.Join(fields, " "), time.Since(t.start))
+	}
+}
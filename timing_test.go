@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLatencyBreakdown(t *testing.T) {
+	defer func(enabled bool) { *latencyBreakdown = enabled }(*latencyBreakdown)
+	*latencyBreakdown = true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request, timing := traceRequest(request)
+	response := handleRequest("a", request, getTransport("http", time.Second, false))
+	if response == nil {
+		t.Fatal("Expected a response")
+	}
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	timing.done("a", "test", request)
+
+	phases := make(map[string]bool)
+	for _, p := range timing.phases {
+		phases[p.name] = true
+	}
+	for _, name := range []string{"connect", "ttfb", "transfer"} {
+		if !phases[name] {
+			t.Errorf("Expected the phase '%s' in '%v'", name, timing.phases)
+		}
+	}
+}
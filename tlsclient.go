@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"strconv"
+	"time"
+)
+
+// The TLS handshakes with the backends are done by teeproxy instead of the
+// transport to count them and measure their duration. Each transport, one
+// per backend, has its own session cache of -tls.session-cache entries so
+// new connections resume the previous sessions instead of full handshakes.
+
+var (
+	tlsHandshakesTotal = newCounterVec("teeproxy_tls_handshakes_total",
+		"Number of TLS handshakes with the backends.", "backend", "resumed", "result")
+	tlsHandshakeDuration = newHistogramVec("teeproxy_tls_handshake_seconds",
+		"Duration of the TLS handshakes with the backends.", latencyBuckets, "backend", "resumed")
+)
+
+// newTLSClientConfig returns the client config of a backend transport.
+func newTLSClientConfig() *tls.Config {
+	config := &tls.Config{InsecureSkipVerify: !*tlsVerifyBackends}
+	if *tlsSessionCache > 0 {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(*tlsSessionCache)
+	}
+	return config
+}
+
+// tlsDialer dials with dial and does the TLS handshake within the timeout,
+// reporting it to the httptrace of the request.
+func tlsDialer(dial func(ctx context.Context, network, address string) (net.Conn, error), config *tls.Config,
+	timeout time.Duration) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		c := config.Clone()
+		if c.ServerName == "" {
+			c.ServerName = host
+		}
+		tlsConn := tls.Client(conn, c)
+
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		handshakeCtx := ctx
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			handshakeCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		start := time.Now()
+		err = tlsConn.HandshakeContext(handshakeCtx)
+		state := tlsConn.ConnectionState()
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(state, err)
+		}
+		observeHandshake(address, state.DidResume, err, time.Since(start))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+func observeHandshake(backend string, resumed bool, err error, duration time.Duration) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	tlsHandshakesTotal.Inc(backend, strconv.FormatBool(resumed), result)
+	if err == nil {
+		tlsHandshakeDuration.Observe(duration.Seconds(), backend, strconv.FormatBool(resumed))
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTLSSessionResumption(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	backend := strings.TrimPrefix(server.URL, "https://")
+
+	transport := getTransport("https", time.Second, true)
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		response, err := transport.RoundTrip(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(response.Body)
+		response.Body.Close()
+	}
+	for resumed, expectation := range map[string]float64{"false": 1, "true": 1} {
+		if count := tlsHandshakesTotal.values[labelKey([]string{backend, resumed, "success"})]; count != expectation {
+			t.Errorf("Expected '%v' handshakes with resumed=%s, but received '%v'", expectation, resumed, count)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// The transforms of the production request, such as the signing of -a.sign,
+// go through transformProduction, so that experimenting with them cannot take
+// down the production traffic. When one fails, -a.transform-failure decides:
+//
+//	fail     the client is answered with 500, the default
+//	forward  the request is forwarded as it was before the transform
+//
+// The failures are counted by transform and action.
+
+const (
+	transformFail    = "fail"
+	transformForward = "forward"
+)
+
+var transformFailuresTotal = newCounterVec("teeproxy_transform_failures_total",
+	"Number of failed transforms of production requests by transform and action, fail or forward.", "transform", "action")
+
+// transformError is the failure of a transform of the production request,
+// answered with 500.
+type transformError struct {
+	transform string
+	err       error
+}
+
+func (e *transformError) Error() string {
+	return fmt.Sprintf("%s of the production request: %v", e.transform, e.err)
+}
+
+func (e *transformError) Unwrap() error {
+	return e.err
+}
+
+// parseTransformFailure validates -a.transform-failure.
+func parseTransformFailure(value string) error {
+	if value != transformFail && value != transformForward {
+		return fmt.Errorf("unknown action %q, expected fail or forward", value)
+	}
+	return nil
+}
+
+// transformProduction applies the transform to a clone of the production
+// request. If it fails, the request is returned with the headers it had
+// before, and its body as buffered by the transform since the original one
+// may have been read, or with -a.transform-failure fail a transformError.
+func transformProduction(name string, req *http.Request, transform func(*http.Request) error) (*http.Request, error) {
+	transformed := req.Clone(req.Context())
+	err := transform(transformed)
+	if err == nil {
+		return transformed, nil
+	}
+	if *productionTransformFailure != transformForward {
+		transformFailuresTotal.Inc(name, transformFail)
+		return nil, &transformError{transform: name, err: err}
+	}
+	transformFailuresTotal.Inc(name, transformForward)
+	log.Printf("Forwarding %s %s untransformed, %s failed: %s", req.Method, req.URL.RequestURI(), name, err)
+	transformed.Header = req.Header
+	return transformed, nil
+}
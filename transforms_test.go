@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTransformFailure(t *testing.T) {
+	defer func(action string) { *productionTransformFailure = action }(*productionTransformFailure)
+	var received, signature string
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received, signature = string(body), r.Header.Get("X-Signature")
+	}))
+	defer production.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler(production.URL)
+	h.Transport = withProductionSigner(h.Transport, &signer{HMACKey: newSecret("env:TEEPROXY_TEST_UNSET_KEY"), HMACHeader: "X-Signature"})
+
+	*productionTransformFailure = transformFail
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/orders", strings.NewReader("order")))
+	if w.Code != http.StatusInternalServerError || received != "" {
+		t.Errorf("Expected '500 and nothing forwarded', but received '%d %s'", w.Code, received)
+	}
+	if !strings.Contains(w.Body.String(), `"class":"transform"`) {
+		t.Errorf("Expected 'a transform error', but received '%s'", w.Body.String())
+	}
+
+	*productionTransformFailure = transformForward
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/orders", strings.NewReader("order")))
+	if w.Code != http.StatusOK || received != "order" || signature != "" {
+		t.Errorf("Expected '200 with the unsigned order', but received '%d %s %s'", w.Code, received, signature)
+	}
+
+	for _, action := range []string{transformFail, transformForward} {
+		if value := transformFailuresTotal.values[labelKey([]string{"signing", action})]; value != 1 {
+			t.Errorf("Expected '1' %s, but received '%v'", action, value)
+		}
+	}
+	if err := parseTransformFailure("ignore"); err == nil {
+		t.Errorf("Expected 'an error for ignore', but received none")
+	}
+}
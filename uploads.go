@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// The request bodies mirrored are read into memory by default, which suits
+// a JSON API but not file uploads. The upload policy of a backend decides
+// what happens to the chunked bodies, of unknown length, and to the bodies
+// larger than its max_bytes:
+//
+//	buffer  read into memory up to max_bytes, not mirrored beyond, the default
+//	stream  mirrored while the production request reads them, see
+//	        DuplicateRequestStreaming, smaller bodies are buffered
+//	skip    not mirrored, smaller bodies are buffered
+//
+// max_bytes 0 does not limit the bodies buffered, and stream and skip then
+// only apply to chunked bodies.
+
+const (
+	uploadBuffer = "buffer"
+	uploadStream = "stream"
+	uploadSkip   = "skip"
+)
+
+var uploadDuplicatesTotal = newCounterVec("teeproxy_upload_duplicates_total",
+	"Number of chunked or large request bodies by backend and treatment, buffered, streamed or skipped.", "backend", "treatment")
+
+type uploadConfig struct {
+	// Backend is the URL of the alternate backend, as in the policies.
+	Backend string `json:"backend"`
+	// Mode is buffer, stream or skip.
+	Mode string `json:"mode"`
+	// MaxBytes is the largest body buffered, 0 for no limit.
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// uploadPolicy is the treatment of the request bodies mirrored to a backend.
+type uploadPolicy struct {
+	mode     string
+	maxBytes int64
+}
+
+func newUploadPolicy(config uploadConfig) (*uploadPolicy, error) {
+	switch config.Mode {
+	case "", uploadBuffer, uploadStream, uploadSkip:
+	default:
+		return nil, fmt.Errorf("unknown upload mode %q of %s, expected buffer, stream or skip", config.Mode, config.Backend)
+	}
+	if config.MaxBytes < 0 {
+		return nil, fmt.Errorf("max_bytes of the uploads to %s must not be negative", config.Backend)
+	}
+	if (config.Mode == "" || config.Mode == uploadBuffer) && config.MaxBytes == 0 {
+		return nil, nil
+	}
+	mode := config.Mode
+	if mode == "" {
+		mode = uploadBuffer
+	}
+	return &uploadPolicy{mode: mode, maxBytes: config.MaxBytes}, nil
+}
+
+// exceeds reports whether the body of the request is chunked or larger than
+// the bodies buffered, so that the policy applies.
+func (p *uploadPolicy) exceeds(req *http.Request) bool {
+	return req.ContentLength < 0 || p.maxBytes > 0 && req.ContentLength > p.maxBytes
+}
+
+// Duplicate returns a copy of the request as DuplicateRequest does, nil if
+// its body is not mirrored to the backend. If the duplicate is not read along
+// with production, as it is transformed, anonymized, gzipped or signed,
+// reading its whole body first, or held by -mirror.sequential or
+// -mirror.delay, a streamed body is buffered instead, as with the buffer
+// mode, so that it is bounded by max_bytes.
+func (p *uploadPolicy) Duplicate(req *http.Request, backend string, buffered bool) *http.Request {
+	if p == nil || isBodyless(req) {
+		return DuplicateRequest(req)
+	}
+	switch {
+	case p.mode == uploadStream && p.exceeds(req) && !buffered:
+		uploadDuplicatesTotal.Inc(backend, "streamed")
+		return DuplicateRequestStreaming(req)
+	case p.mode == uploadSkip && p.exceeds(req):
+		uploadDuplicatesTotal.Inc(backend, "skipped")
+		return nil
+	case p.mode == uploadBuffer || p.mode == uploadStream && p.exceeds(req):
+		return p.buffer(req, backend)
+	}
+	return DuplicateRequest(req)
+}
+
+// buffer duplicates the request with its body read into memory, nil if it
+// has more than max_bytes.
+func (p *uploadPolicy) buffer(req *http.Request, backend string) *http.Request {
+	if p.maxBytes > 0 {
+		if req.ContentLength > p.maxBytes {
+			uploadDuplicatesTotal.Inc(backend, "skipped")
+			return nil
+		}
+		if req.ContentLength < 0 && !bufferBody(req, p.maxBytes) {
+			uploadDuplicatesTotal.Inc(backend, "skipped")
+			return nil
+		}
+	}
+	if p.exceeds(req) {
+		uploadDuplicatesTotal.Inc(backend, "buffered")
+	}
+	return DuplicateRequest(req)
+}
+
+// bufferBody reads a chunked body into memory if it has at most limit bytes
+// and reports whether it did. Either way the body of the request returns the
+// same bytes as before.
+func bufferBody(req *http.Request, limit int64) bool {
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil || int64(len(data)) > limit {
+		req.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(data), req.Body), Closer: req.Body}
+		return false
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return true
+}
+
+// prefixedBody returns the bytes read by bufferBody before the rest of the
+// original body.
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// buildUploadPolicies builds the upload policies of the backends, the
+// -b.uploads flags apply to the -b backends and the config file to the
+// backends listed. The returned func sets them on the backends.
+func buildUploadPolicies(configs []uploadConfig, altServers []*backend) (func(), error) {
+	policies := make(map[*backend]*uploadPolicy)
+	for _, b := range altServers {
+		policy, err := newUploadPolicy(uploadConfig{Backend: b.Alternative, Mode: *alternateUploads, MaxBytes: *alternateUploadMaxBytes})
+		if err != nil {
+			return nil, err
+		}
+		policies[b] = policy
+	}
+	for _, config := range configs {
+		b, err := parseBackend(config.Backend)
+		if err != nil {
+			return nil, err
+		}
+		config.Backend = b.Alternative
+		policy, err := newUploadPolicy(config)
+		if err != nil {
+			return nil, err
+		}
+		policies[b] = policy
+	}
+	return func() {
+		for _, b := range registeredBackends() {
+			b.setUploadPolicy(policies[b])
+		}
+	}, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUploadPolicies(t *testing.T) {
+	var mu sync.Mutex
+	received := make(map[string]string)
+	record := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			mu.Lock()
+			received[name] = string(body)
+			mu.Unlock()
+		}))
+	}
+	production := record("a")
+	defer production.Close()
+	streaming := record("stream")
+	defer streaming.Close()
+	buffering := record("buffer")
+	defer buffering.Close()
+	skipping := record("skip")
+	defer skipping.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler(production.URL, streaming.URL+"/uploads", buffering.URL+"/uploads", skipping.URL+"/uploads")
+	for i, config := range []uploadConfig{{Mode: uploadStream}, {Mode: uploadBuffer, MaxBytes: 4}, {Mode: uploadSkip}} {
+		policy, err := newUploadPolicy(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Alternatives[i].setUploadPolicy(policy)
+	}
+
+	for _, test := range []struct {
+		body          string
+		contentLength int64
+		expectation   map[string]string
+	}{
+		{"hello world", -1, map[string]string{"a": "hello world", "stream": "hello world"}},
+		{"hi", -1, map[string]string{"a": "hi", "stream": "hi", "buffer": "hi"}},
+		{"hello world", 11, map[string]string{"a": "hello world", "stream": "hello world", "skip": "hello world"}},
+	} {
+		received = make(map[string]string)
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(test.body))
+		req.ContentLength = test.contentLength
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		mirrorsInFlight.Wait()
+		mu.Lock()
+		if len(received) != len(test.expectation) {
+			t.Errorf("Expected '%v', but received '%v'", test.expectation, received)
+		}
+		for name, body := range test.expectation {
+			if received[name] != body {
+				t.Errorf("Expected '%s' for %s, but received '%s'", body, name, received[name])
+			}
+		}
+		mu.Unlock()
+	}
+	if value := uploadDuplicatesTotal.values[labelKey([]string{h.Alternatives[1].Alternative, "skipped"})]; value != 2 {
+		t.Errorf("Expected '2', but received '%v'", value)
+	}
+
+	for _, config := range []uploadConfig{{Mode: "chunk"}, {Mode: uploadSkip, MaxBytes: -1}} {
+		if _, err := newUploadPolicy(config); err == nil {
+			t.Errorf("Expected an error for %+v", config)
+		}
+	}
+	if policy, _ := newUploadPolicy(uploadConfig{}); policy != nil {
+		t.Errorf("Expected no policy for the default, but received %+v", policy)
+	}
+}
+
+func TestTransformedUploadsAreBuffered(t *testing.T) {
+	policy, _ := newUploadPolicy(uploadConfig{Mode: uploadStream})
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("hello world"))
+	req.ContentLength = -1
+	// anonymizing reads the body of the duplicate before production reads
+	// the original, which would block a streamed duplicate
+	duplicate := policy.Duplicate(req, "transformed:1", true)
+	if body, _ := ioutil.ReadAll(duplicate.Body); string(body) != "hello world" {
+		t.Errorf("Expected 'hello world', but received '%s'", body)
+	}
+	if body, _ := ioutil.ReadAll(req.Body); string(body) != "hello world" {
+		t.Errorf("Expected 'hello world', but received '%s'", body)
+	}
+	if value := uploadDuplicatesTotal.Value("transformed:1", "buffered"); value != 1 {
+		t.Errorf("Expected '1', but received '%v'", value)
+	}
+}
+
+func TestHeldUploadsAreBuffered(t *testing.T) {
+	defer func(sequential bool) { *mirrorSequential = sequential }(*mirrorSequential)
+	*mirrorSequential = true
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer production.Close()
+	mirrored := make(chan string, 1)
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- string(body)
+	}))
+	defer alternate.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler(production.URL, alternate.URL+"/held-uploads")
+	policy, _ := newUploadPolicy(uploadConfig{Mode: uploadStream, MaxBytes: 4})
+	h.Alternatives[0].setUploadPolicy(policy)
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("hello world"))
+	req.ContentLength = -1
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	mirrorsInFlight.Wait()
+	select {
+	case body := <-mirrored:
+		t.Errorf("Expected the held upload over max_bytes to be skipped, but received '%s'", body)
+	default:
+	}
+	if value := uploadDuplicatesTotal.Value(h.Alternatives[0].Alternative, "skipped"); value != 1 {
+		t.Errorf("Expected '1', but received '%v'", value)
+	}
+}
+
+func TestStreamedUploadDuringMaintenance(t *testing.T) {
+	c, err := loadConfig(writeConfig(t, `{"maintenance": [{"name": "uploads", "path": "^/upload", "mirror": true}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses, err := c.buildMaintenance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer production.Close()
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	defer alternate.Close()
+	defer evictIdleConnections()
+
+	h := newTestHandler(production.URL, alternate.URL+"/maintenance-uploads")
+	policy, _ := newUploadPolicy(uploadConfig{Mode: uploadStream})
+	h.Alternatives[0].setUploadPolicy(policy)
+	h.SetMaintenance(responses)
+	req := httptest.NewRequest("POST", "/upload", strings.NewReader("hello world"))
+	req.ContentLength = -1
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	// the maintenance response never reads the body, the streamed duplicate
+	// must not wait for it
+	mirrorsInFlight.Wait()
+}
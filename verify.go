@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -verify.hmac.key, e.g. where teeproxy is the first hop receiving
+// webhooks, the incoming requests must carry the HMAC signature of the
+// -a.sign hmac format, t=<unix time>,v1=<hex HMAC-SHA256 of the timestamp,
+// method, URI and body hash>, in -verify.hmac.header. Requests without a
+// valid signature, with a timestamp outside -verify.hmac.tolerance or with a
+// signature already seen within it, are rejected with 401 before they are
+// proxied or mirrored. The timestamp is checked before the body is read, and
+// bodies larger than -verify.hmac.max-body are rejected with 413.
+
+var signatureVerificationsTotal = newCounterVec("teeproxy_signature_verifications_total",
+	"Number of incoming requests whose signature was verified by result, valid, missing, invalid, expired, replayed or too-large.", "result")
+
+var (
+	errSignatureMissing  = errors.New("missing")
+	errSignatureInvalid  = errors.New("invalid")
+	errSignatureExpired  = errors.New("expired")
+	errSignatureReplayed = errors.New("replayed")
+	errSignatureTooLarge = errors.New("too-large")
+)
+
+// seenSignatureLimit bounds the signatures remembered for the replay
+// protection, when reached the oldest are forgotten first.
+const seenSignatureLimit = 100000
+
+type signatureVerifier struct {
+	key       *secret
+	header    string
+	tolerance time.Duration
+	// maxBody is the largest body hashed, not limited if 0
+	maxBody int64
+
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []string
+}
+
+// newSignatureVerifier returns nil without -verify.hmac.key.
+func newSignatureVerifier() *signatureVerifier {
+	if *verifyHMACKey == "" {
+		return nil
+	}
+	return &signatureVerifier{
+		key:       newSecret(*verifyHMACKey),
+		header:    *verifyHMACHeader,
+		tolerance: time.Duration(*verifyHMACTolerance) * time.Second,
+		maxBody:   *verifyHMACMaxBody,
+		seen:      make(map[string]time.Time),
+	}
+}
+
+// Verify checks the signature of the request, buffering its body to hash it.
+func (v *signatureVerifier) Verify(req *http.Request, now time.Time) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(req.Header.Get(v.header), ",") {
+		if value := strings.TrimPrefix(part, "t="); value != part {
+			timestamp = value
+		} else if value := strings.TrimPrefix(part, "v1="); value != part {
+			signature = value
+		}
+	}
+	if timestamp == "" || signature == "" {
+		return errSignatureMissing
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	signed := time.Unix(seconds, 0)
+	if math.Abs(now.Sub(signed).Seconds()) > v.tolerance.Seconds() {
+		return errSignatureExpired
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var reader io.Reader = req.Body
+		if v.maxBody > 0 {
+			reader = io.LimitReader(req.Body, v.maxBody+1)
+		}
+		if body, err = ioutil.ReadAll(reader); err != nil {
+			return err
+		}
+		if v.maxBody > 0 && int64(len(body)) > v.maxBody {
+			return errSignatureTooLarge
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	key, err := v.key.Value()
+	if err != nil {
+		return err
+	}
+	expected := hmacSignature(key, timestamp, req.Method, req.RequestURI, sha256Hex(body))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errSignatureInvalid
+	}
+	if !v.firstSeen(signature, signed, now) {
+		return errSignatureReplayed
+	}
+	return nil
+}
+
+// firstSeen remembers the signature until it expires and reports whether it
+// was new.
+func (v *signatureVerifier) firstSeen(signature string, signed, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// signatures are added in about the order they expire in
+	for len(v.order) > 0 && (len(v.order) >= seenSignatureLimit || now.Sub(v.seen[v.order[0]]) > v.tolerance) {
+		delete(v.seen, v.order[0])
+		v.order = v.order[1:]
+	}
+	if _, ok := v.seen[signature]; ok {
+		return false
+	}
+	v.seen[signature] = signed
+	v.order = append(v.order, signature)
+	return true
+}
+
+// inboundVerifier verifies the incoming requests of -verify.hmac.key, set in main.
+var inboundVerifier *signatureVerifier
+
+// verifyRequest rejects the request and returns false if its signature is
+// not valid.
+func verifyRequest(w http.ResponseWriter, req *http.Request) bool {
+	if inboundVerifier == nil {
+		return true
+	}
+	err := inboundVerifier.Verify(req, time.Now())
+	if err == nil {
+		signatureVerificationsTotal.Inc("valid")
+		return true
+	}
+	result := "invalid"
+	switch err {
+	case errSignatureMissing, errSignatureExpired, errSignatureReplayed, errSignatureTooLarge:
+		result = err.Error()
+	}
+	signatureVerificationsTotal.Inc(result)
+	log.Printf("Rejected \"%s %s\" from %s, signature %s", req.Method, req.RequestURI, anonymizeIP(req.RemoteAddr, *clientIPAnonymize), err)
+	if err == errSignatureTooLarge {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	http.Error(w, "signature "+result, http.StatusUnauthorized)
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signedRequest(key, body string, at time.Time) *http.Request {
+	request := httptest.NewRequest("POST", "/hooks/github?id=1", strings.NewReader(body))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	request.Header.Set("X-Signature", "t="+timestamp+",v1="+hmacSignature(key, timestamp, "POST", "/hooks/github?id=1", sha256Hex([]byte(body))))
+	return request
+}
+
+func TestSignatureVerifier(t *testing.T) {
+	v := &signatureVerifier{key: newSecret("secret"), header: "X-Signature", tolerance: 5 * time.Minute, seen: make(map[string]time.Time)}
+	now := time.Now()
+
+	request := signedRequest("secret", `{"action":"opened"}`, now)
+	if err := v.Verify(request, now); err != nil {
+		t.Errorf("Expected a valid signature, but received '%v'", err)
+	}
+	if body, _ := ioutil.ReadAll(request.Body); string(body) != `{"action":"opened"}` {
+		t.Errorf("Expected the body to be kept, but received '%s'", body)
+	}
+	for _, test := range []struct {
+		request     *http.Request
+		expectation error
+	}{
+		{signedRequest("secret", `{"action":"opened"}`, now), errSignatureReplayed},
+		{signedRequest("other", `{"action":"closed"}`, now), errSignatureInvalid},
+		{signedRequest("secret", `{"action":"closed"}`, now.Add(-10*time.Minute)), errSignatureExpired},
+		{httptest.NewRequest("POST", "/hooks/github?id=1", nil), errSignatureMissing},
+	} {
+		if err := v.Verify(test.request, now); err != test.expectation {
+			t.Errorf("Expected '%v', but received '%v'", test.expectation, err)
+		}
+	}
+	v.maxBody = 8
+	if err := v.Verify(signedRequest("secret", `{"action":"reopened"}`, now), now); err != errSignatureTooLarge {
+		t.Errorf("Expected '%v', but received '%v'", errSignatureTooLarge, err)
+	}
+	unread := signedRequest("secret", `{"action":"closed"}`, now.Add(-10*time.Minute))
+	if err := v.Verify(unread, now); err != errSignatureExpired {
+		t.Errorf("Expected '%v', but received '%v'", errSignatureExpired, err)
+	}
+	if body, _ := ioutil.ReadAll(unread.Body); string(body) != `{"action":"closed"}` {
+		t.Errorf("Expected the body of an expired request not to be read, but received '%s'", body)
+	}
+	if !v.firstSeen("old", now, now.Add(10*time.Minute)) || len(v.seen) != 1 {
+		t.Errorf("Expected the expired signatures to be forgotten, but received '%v'", v.seen)
+	}
+}
+
+func TestVerifyRequestRejects(t *testing.T) {
+	defer func(v *signatureVerifier) { inboundVerifier = v }(inboundVerifier)
+	inboundVerifier = &signatureVerifier{key: newSecret("secret"), header: "X-Signature", tolerance: time.Minute, seen: make(map[string]time.Time)}
+	h := newTestHandler("http://127.0.0.1:1")
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("POST", "/hooks/github", strings.NewReader("{}")))
+	if recorder.Code != http.StatusUnauthorized || strings.TrimSpace(recorder.Body.String()) != "signature missing" {
+		t.Errorf("Expected '401 signature missing', but received '%d %s'", recorder.Code, recorder.Body)
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -webhook.fork, teeproxy fans webhooks out instead of proxying: each
+// request is persisted to -webhook.dir and acknowledged with 200, then
+// delivered to every destination, retried with exponential backoff until a
+// destination answers 2xx or -webhook.retries are exhausted. The state of
+// the deliveries of every destination is served on /webhooks by the admin
+// listener. Webhooks not delivered to all destinations are resumed after a
+// restart. The deliveries are sent by -webhook.workers workers, a retry is
+// queued again once its backoff elapsed.
+
+const (
+	webhookMaxBody    = 10 << 20
+	webhookHistory    = 1000
+	webhookMaxBackoff = 5 * time.Minute
+)
+
+var webhookDeliveriesTotal = newCounterVec("teeproxy_webhook_deliveries_total",
+	"Number of webhook delivery attempts by destination and result, delivered, retried or failed.", "destination", "result")
+
+// webhook is an accepted request and its deliveries.
+type webhook struct {
+	ID         string             `json:"id"`
+	Received   time.Time          `json:"received"`
+	Method     string             `json:"method"`
+	URI        string             `json:"uri"`
+	Header     http.Header        `json:"header,omitempty"`
+	Body       []byte             `json:"body,omitempty"`
+	Deliveries []*webhookDelivery `json:"deliveries"`
+}
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// webhookDelivery is the state of a webhook at a destination.
+type webhookDelivery struct {
+	Destination string    `json:"destination"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	Status      int       `json:"status,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+}
+
+// webhookFork accepts, persists and delivers the webhooks.
+type webhookFork struct {
+	destinations []string
+	// users holds the userinfo of the destination URLs, sent as basic auth
+	users map[string]*url.Userinfo
+	// store persists the webhooks
+	store  blobStore
+	client *http.Client
+
+	mu       sync.Mutex
+	webhooks map[string]*webhook
+	order    []string
+
+	// queue holds the attempts waiting for a worker
+	queueMu sync.Mutex
+	ready   *sync.Cond
+	queue   []webhookAttempt
+}
+
+// webhookAttempt is a delivery to send and the backoff before its retry.
+type webhookAttempt struct {
+	hook     *webhook
+	delivery *webhookDelivery
+	backoff  time.Duration
+}
+
+func newWebhookFork(destinations, dir string) (*webhookFork, error) {
+	f := &webhookFork{
+		client:   &http.Client{Timeout: time.Duration(*alternateTimeout) * time.Millisecond},
+		webhooks: make(map[string]*webhook),
+		users:    make(map[string]*url.Userinfo),
+	}
+	for _, destination := range strings.Split(destinations, ",") {
+		if destination = strings.TrimSpace(destination); destination != "" {
+			t, err := parseTarget(destination)
+			if err != nil {
+				return nil, err
+			}
+			f.destinations = append(f.destinations, t.Scheme+"://"+t.Endpoint)
+			f.users[t.Scheme+"://"+t.Endpoint] = t.User
+		}
+	}
+	if len(f.destinations) == 0 {
+		return nil, fmt.Errorf("no destinations")
+	}
+	if dir == "" {
+		// an acknowledged webhook must survive a restart
+		return nil, fmt.Errorf("-webhook.dir must be set to persist the webhooks")
+	}
+	if *webhookWorkers <= 0 {
+		return nil, fmt.Errorf("-webhook.workers must be positive")
+	}
+	store, err := openStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	f.store = store
+	f.client.Transport = getTransport("https", time.Duration(*alternateTimeout)*time.Millisecond, false)
+	f.ready = sync.NewCond(&f.queueMu)
+	for i := 0; i < *webhookWorkers; i++ {
+		go f.work()
+	}
+	return f, nil
+}
+
+// resume loads the persisted webhooks and delivers them to the destinations
+// they were not delivered to yet.
+func (f *webhookFork) resume() error {
+	keys, err := f.store.List()
+	if err != nil {
+		return err
+	}
+	resumed := 0
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".json") {
+			continue
+		}
+		content, err := f.store.Get(key)
+		if err == errNotStored {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var w webhook
+		if err := json.Unmarshal(content, &w); err != nil {
+			return fmt.Errorf("parsing %s: %v", key, err)
+		}
+		resumed++
+		f.remember(&w)
+		for _, d := range w.Deliveries {
+			if d.State == deliveryPending {
+				f.deliver(&w, d)
+			}
+		}
+	}
+	if resumed > 0 {
+		log.Printf("Resumed %d persisted webhooks from %s", resumed, f.store)
+	}
+	return nil
+}
+
+func (f *webhookFork) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !verifyRequest(w, req) {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, webhookMaxBody+1))
+	if err != nil {
+		http.Error(w, "failed to read the body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > webhookMaxBody {
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	prepareRequestHeaders(req)
+	hook := &webhook{ID: newWebhookID(), Received: time.Now().UTC(), Method: req.Method, URI: req.RequestURI, Header: req.Header.Clone(), Body: body}
+	for _, destination := range f.destinations {
+		hook.Deliveries = append(hook.Deliveries, &webhookDelivery{Destination: destination, State: deliveryPending})
+	}
+	f.mu.Lock()
+	err = f.persist(hook)
+	f.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to persist webhook \"%s %s\": %s", req.Method, req.RequestURI, err)
+		http.Error(w, "failed to persist the webhook", http.StatusServiceUnavailable)
+		return
+	}
+	f.remember(hook)
+	log.Printf("| WEBHOOK | %s \"%s %s\" accepted for %d destinations", hook.ID, hook.Method, hook.URI, len(hook.Deliveries))
+	for _, d := range hook.Deliveries {
+		f.deliver(hook, d)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"id\":%q}\n", hook.ID)
+}
+
+func newWebhookID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// remember keeps the webhook for the status, forgetting the oldest finished
+// ones beyond webhookHistory.
+func (f *webhookFork) remember(hook *webhook) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.webhooks[hook.ID] = hook
+	f.order = append(f.order, hook.ID)
+	for i := 0; len(f.order) > webhookHistory && i < len(f.order); {
+		if old := f.webhooks[f.order[i]]; old != nil && old.pending() {
+			i++
+			continue
+		}
+		delete(f.webhooks, f.order[i])
+		f.order = append(f.order[:i], f.order[i+1:]...)
+	}
+}
+
+func (hook *webhook) pending() bool {
+	for _, d := range hook.Deliveries {
+		if d.State == deliveryPending {
+			return true
+		}
+	}
+	return false
+}
+
+// persist writes the webhook to the -webhook.dir store, removing it once it
+// is delivered everywhere, called with the lock held.
+func (f *webhookFork) persist(hook *webhook) error {
+	key := hook.ID + ".json"
+	if !hook.pending() && !hook.hasState(deliveryFailed) {
+		return f.store.Delete(key)
+	}
+	// failed webhooks are kept for a retry through the admin endpoint
+	content, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+	return f.store.Put(key, content)
+}
+
+// deliver queues the webhook for the destination, it is sent until it is
+// acknowledged with 2xx or the retries are exhausted.
+func (f *webhookFork) deliver(hook *webhook, d *webhookDelivery) {
+	f.enqueue(webhookAttempt{hook: hook, delivery: d, backoff: time.Duration(*webhookBackoff) * time.Millisecond})
+}
+
+func (f *webhookFork) enqueue(a webhookAttempt) {
+	f.queueMu.Lock()
+	f.queue = append(f.queue, a)
+	f.queueMu.Unlock()
+	f.ready.Signal()
+}
+
+// work sends the queued attempts one at a time.
+func (f *webhookFork) work() {
+	for {
+		f.queueMu.Lock()
+		for len(f.queue) == 0 {
+			f.ready.Wait()
+		}
+		a := f.queue[0]
+		f.queue[0] = webhookAttempt{}
+		f.queue = f.queue[1:]
+		f.queueMu.Unlock()
+		f.attempt(a)
+	}
+}
+
+// attempt sends the delivery once and schedules its retry.
+func (f *webhookFork) attempt(a webhookAttempt) {
+	hook, d := a.hook, a.delivery
+	status, err := f.send(hook, d.Destination)
+	f.mu.Lock()
+	d.Attempts++
+	d.LastAttempt = time.Now().UTC()
+	d.Status, d.Error = status, ""
+	if err != nil {
+		d.Error = err.Error()
+	}
+	result := "retried"
+	switch {
+	case err == nil && status >= 200 && status < 300:
+		d.State = deliveryDelivered
+		result = deliveryDelivered
+	case d.Attempts > *webhookRetries:
+		d.State = deliveryFailed
+		result = deliveryFailed
+	}
+	if err := f.persist(hook); err != nil {
+		log.Printf("Failed to persist webhook %s: %s", hook.ID, err)
+	}
+	f.mu.Unlock()
+	webhookDeliveriesTotal.Inc(d.Destination, result)
+	if result != "retried" {
+		log.Printf("| WEBHOOK | %s %s to %s after %d attempts, status %d %s", hook.ID, result, d.Destination, d.Attempts, status, d.Error)
+		return
+	}
+	next := a.backoff * 2
+	if next > webhookMaxBackoff {
+		next = webhookMaxBackoff
+	}
+	time.AfterFunc(a.backoff, func() {
+		f.enqueue(webhookAttempt{hook: hook, delivery: d, backoff: next})
+	})
+}
+
+func (f *webhookFork) send(hook *webhook, destination string) (int, error) {
+	req, err := http.NewRequest(hook.Method, destination+hook.URI, bytes.NewReader(hook.Body))
+	if err != nil {
+		return 0, err
+	}
+	for name, values := range hook.Header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	req.Header.Set("X-Teeproxy-Webhook-Id", hook.ID)
+	setBasicAuth(req, f.users[destination])
+	if *alternateIdempotencyKey && req.Header.Get(idempotencyHeader) == "" {
+		req.Header.Set(idempotencyHeader, hook.ID)
+	}
+	response, err := f.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	return response.StatusCode, nil
+}
+
+// retry redelivers the webhook to the destinations it failed at.
+func (f *webhookFork) retry(id string) (*webhook, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hook, ok := f.webhooks[id]
+	if !ok {
+		return nil, false
+	}
+	for _, d := range hook.Deliveries {
+		if d.State == deliveryFailed {
+			d.State, d.Attempts = deliveryPending, 0
+			f.deliver(hook, d)
+		}
+	}
+	return hook, true
+}
+
+// statusHandler serves GET /webhooks, the recent webhooks without their
+// bodies, newest first, optionally ?state=failed or pending, GET
+// /webhooks/<id> and POST /webhooks/<id>/retry.
+func (f *webhookFork) statusHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks"), "/")
+	if id := strings.TrimSuffix(path, "/retry"); id != path {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		hook, ok := f.retry(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Webhook %s retried by %s", id, adminSource(r))
+		f.writeStatus(w, hook)
+		return
+	}
+	if path != "" {
+		f.mu.Lock()
+		hook, ok := f.webhooks[path]
+		f.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f.writeStatus(w, hook)
+		return
+	}
+	state := r.URL.Query().Get("state")
+	f.mu.Lock()
+	hooks := []*webhook{}
+	for i := len(f.order) - 1; i >= 0; i-- {
+		hook := f.webhooks[f.order[i]]
+		if state == "" || hook.hasState(state) {
+			hooks = append(hooks, hook)
+		}
+	}
+	f.mu.Unlock()
+	f.writeStatus(w, hooks)
+}
+
+func (hook *webhook) hasState(state string) bool {
+	for _, d := range hook.Deliveries {
+		if d.State == state {
+			return true
+		}
+	}
+	return false
+}
+
+// writeStatus encodes the webhooks without their headers and bodies.
+func (f *webhookFork) writeStatus(w http.ResponseWriter, value interface{}) {
+	f.mu.Lock()
+	var status interface{}
+	switch v := value.(type) {
+	case *webhook:
+		status = v.summary()
+	case []*webhook:
+		summaries := make([]webhook, len(v))
+		for i, hook := range v {
+			summaries[i] = hook.summary()
+		}
+		status = summaries
+	}
+	content, err := json.Marshal(status)
+	f.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(content, '\n'))
+}
+
+func (hook *webhook) summary() webhook {
+	summary := *hook
+	summary.Header, summary.Body = nil, nil
+	summary.Deliveries = make([]*webhookDelivery, len(hook.Deliveries))
+	for i, d := range hook.Deliveries {
+		copied := *d
+		summary.Deliveries[i] = &copied
+	}
+	return summary
+}
+
+// startWebhookFork returns the handler of -webhook.fork.
+func startWebhookFork() (*webhookFork, error) {
+	f, err := newWebhookFork(*webhookDestinations, *webhookDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.resume(); err != nil {
+		return nil, err
+	}
+	adminMux.HandleFunc("/webhooks", f.statusHandler)
+	adminMux.HandleFunc("/webhooks/", f.statusHandler)
+	log.Printf("Forking webhooks to %s", strings.Join(f.destinations, ", "))
+	return f, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookFork(t *testing.T) {
+	defer func(retries, backoff int) { *webhookRetries, *webhookBackoff = retries, backoff }(*webhookRetries, *webhookBackoff)
+	*webhookRetries, *webhookBackoff = 2, 10
+
+	var received string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = r.Method + " " + r.RequestURI + " " + string(body)
+	}))
+	defer healthy.Close()
+	var attempts int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer flaky.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	dir := t.TempDir()
+	f, err := newWebhookFork(healthy.URL+","+flaky.URL+","+down.URL, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	f.ServeHTTP(recorder, httptest.NewRequest("POST", "/hooks/github", strings.NewReader(`{"action":"opened"}`)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected '200', but received '%d'", recorder.Code)
+	}
+	var accepted struct{ ID string }
+	json.Unmarshal(recorder.Body.Bytes(), &accepted)
+
+	var hook webhook
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		recorder = httptest.NewRecorder()
+		f.statusHandler(recorder, httptest.NewRequest("GET", "/webhooks/"+accepted.ID, nil))
+		json.Unmarshal(recorder.Body.Bytes(), &hook)
+		if !hook.pending() {
+			break
+		}
+	}
+	for i, expectation := range []struct {
+		state    string
+		attempts int
+	}{{deliveryDelivered, 1}, {deliveryDelivered, 2}, {deliveryFailed, 3}} {
+		if d := hook.Deliveries[i]; d.State != expectation.state || d.Attempts != expectation.attempts {
+			t.Errorf("Expected %s after %d attempts, but received '%v'", expectation.state, expectation.attempts, d)
+		}
+	}
+	if expectation := `POST /hooks/github {"action":"opened"}`; received != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, received)
+	}
+	if _, err := os.Stat(filepath.Join(dir, accepted.ID+".json")); err != nil {
+		t.Errorf("Expected the failed webhook to stay persisted, but received '%v'", err)
+	}
+	if _, err := newWebhookFork(healthy.URL, ""); err == nil {
+		t.Errorf("Expected an error without a store")
+	}
+}
+
+func TestWebhookWorkers(t *testing.T) {
+	defer func(workers int) { *webhookWorkers = workers }(*webhookWorkers)
+	*webhookWorkers = 2
+	var sending, most int32
+	delivered := make(chan bool, 5)
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&sending, 1)
+		for m := atomic.LoadInt32(&most); n > m && !atomic.CompareAndSwapInt32(&most, m, n); m = atomic.LoadInt32(&most) {
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&sending, -1)
+		delivered <- true
+	}))
+	defer destination.Close()
+
+	f, err := newWebhookFork(destination.URL, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/hooks", strings.NewReader("{}")))
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-delivered:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected '5' deliveries, but received '%d'", i)
+		}
+	}
+	if most := atomic.LoadInt32(&most); most > 2 {
+		t.Errorf("Expected at most '2' deliveries at a time, but received '%d'", most)
+	}
+}
+
+func TestWebhookResume(t *testing.T) {
+	delivered := make(chan string, 1)
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- r.Header.Get("X-Teeproxy-Webhook-Id")
+	}))
+	defer destination.Close()
+
+	dir := t.TempDir()
+	f, err := newWebhookFork(destination.URL, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := &webhook{ID: "persisted", Method: "POST", URI: "/hooks", Header: http.Header{},
+		Deliveries: []*webhookDelivery{{Destination: f.destinations[0], State: deliveryPending}}}
+	if err := f.persist(hook); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.resume(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-delivered:
+		if id != "persisted" {
+			t.Errorf("Expected 'persisted', but received '%s'", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected the persisted webhook to be delivered")
+	}
+}
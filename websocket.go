@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket upgrades are proxied to the production target by relaying the
+// raw connections after the 101 response. They are not mirrored, but their
+// frames are recorded with -record.
+
+// isWebSocket reports whether the request asks for a WebSocket upgrade.
+func isWebSocket(req *http.Request) bool {
+	return headerContainsToken(req.Header, "Connection", "upgrade") &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dialBackend connects to a backend, with TLS for https.
+func dialBackend(scheme, host string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	address := hostPort(scheme, endpointHost(host))
+	conn, err := dialAddress(context.Background(), dialer, "tcp", address)
+	if err != nil || scheme != "https" {
+		return conn, err
+	}
+	serverName, _, _ := net.SplitHostPort(address)
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: !*tlsVerifyBackends, ServerName: serverName})
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// serveWebSocket relays a WebSocket session between the client and the
+// production target.
+func (h *handler) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	anonymizeClient(req)
+	if *forwardClientIP {
+		updateForwardedHeaders(req)
+	}
+	if *forwardProtoHost {
+		setForwardedProtoHost(req)
+	}
+	if *tlsClientHeaders {
+		setClientTLSHeaders(req)
+	}
+	recording := newRecording(recordSink, *recordPercent, "a", req, h.Target)
+	setRequestTarget(req, h.Target, h.TargetScheme)
+	setBasicAuth(req, h.TargetUser)
+	if *productionHostRewrite {
+		req.Host = endpointHost(h.Target)
+	}
+
+	backendConn, err := dialBackend(h.TargetScheme, h.Target, time.Duration(*productionTimeout)*time.Millisecond)
+	if err != nil {
+		requestErrorsTotal.Inc("a", h.Target, classifyError(err))
+		log.Printf("Request to %s failed [%s]: %s", h.Target, classifyError(err), err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer backendConn.Close()
+	if err := req.Write(backendConn); err != nil {
+		log.Printf("Request to %s failed [%s]: %s", h.Target, classifyError(err), err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	backendReader := bufio.NewReader(backendConn)
+	resp, err := http.ReadResponse(backendReader, req)
+	if err != nil {
+		log.Printf("Request to %s failed [%s]: %s", h.Target, classifyError(err), err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	log.Printf("| A | \"%s %s %v\" %s (websocket)", req.Method, req.URL.RequestURI(), req.Proto, resp.Status)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, recording.recordResponse(resp, resp.Body))
+		recording.finish()
+		return
+	}
+	recording.recordResponse(resp, resp.Body)
+
+	clientConn, clientReader, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Printf("Failed to take over the WebSocket connection: %s", err)
+		return
+	}
+	defer clientConn.Close()
+	fmt.Fprintf(clientConn, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(clientConn)
+	io.WriteString(clientConn, "\r\n")
+
+	var relay sync.WaitGroup
+	relay.Add(2)
+	go func() {
+		defer relay.Done()
+		var client io.Reader = clientReader
+		if recording != nil {
+			client = io.TeeReader(client, newFrameParser(recording, true))
+		}
+		io.Copy(backendConn, client)
+		closeWrite(backendConn)
+	}()
+	go func() {
+		defer relay.Done()
+		var backend io.Reader = backendReader
+		if recording != nil {
+			backend = io.TeeReader(backend, newFrameParser(recording, false))
+		}
+		io.Copy(clientConn, backend)
+		closeWrite(clientConn)
+	}()
+	relay.Wait()
+	recording.finish()
+}
+
+// closeWrite signals the end of the stream to the peer.
+func closeWrite(conn net.Conn) {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		c.CloseWrite()
+	case *tls.Conn:
+		c.CloseWrite()
+	default:
+		conn.Close()
+	}
+}
+
+// maxFrameBuffer limits the bytes buffered to record a single frame.
+const maxFrameBuffer = 1 << 20
+
+// frameParser splits a relayed WebSocket stream into frames.
+type frameParser struct {
+	recording  *recording
+	fromClient bool
+	buffer     []byte
+	skip       int64
+}
+
+func newFrameParser(recording *recording, fromClient bool) *frameParser {
+	return &frameParser{recording: recording, fromClient: fromClient}
+}
+
+func (p *frameParser) Write(data []byte) (int, error) {
+	n := len(data)
+	if p.skip > 0 {
+		skipped := p.skip
+		if skipped > int64(len(data)) {
+			skipped = int64(len(data))
+		}
+		data = data[skipped:]
+		p.skip -= skipped
+	}
+	p.buffer = append(p.buffer, data...)
+	for p.skip == 0 {
+		f, size, masked, key, ok := parseFrameHeader(p.buffer)
+		if !ok {
+			break
+		}
+		f.FromClient = p.fromClient
+		end := int64(size) + f.Length
+		if f.Length > maxFrameBuffer {
+			// record the frame without its payload
+			p.recording.addFrame(f)
+			if int64(len(p.buffer)) >= end {
+				p.buffer = p.buffer[end:]
+				continue
+			}
+			p.skip = end - int64(len(p.buffer))
+			p.buffer = nil
+			break
+		}
+		if int64(len(p.buffer)) < end {
+			break
+		}
+		f.Data = append([]byte(nil), p.buffer[size:size+int(f.Length)]...)
+		if masked {
+			for i := range f.Data {
+				f.Data[i] ^= key[i%4]
+			}
+		}
+		p.recording.addFrame(f)
+		p.buffer = p.buffer[size+int(f.Length):]
+	}
+	return n, nil
+}
+
+// parseFrameHeader parses the header of a frame, reporting its size.
+func parseFrameHeader(b []byte) (f frame, size int, masked bool, key [4]byte, ok bool) {
+	if len(b) < 2 {
+		return
+	}
+	f.Final = b[0]&0x80 != 0
+	f.Opcode = int(b[0] & 0x0f)
+	masked = b[1]&0x80 != 0
+	f.Length = int64(b[1] & 0x7f)
+	size = 2
+	switch f.Length {
+	case 126:
+		if len(b) < 4 {
+			return
+		}
+		f.Length = int64(binary.BigEndian.Uint16(b[2:]))
+		size = 4
+	case 127:
+		if len(b) < 10 {
+			return
+		}
+		f.Length = int64(binary.BigEndian.Uint64(b[2:]) & (1<<63 - 1))
+		size = 10
+	}
+	if masked {
+		if len(b) < size+4 {
+			return
+		}
+		copy(key[:], b[size:])
+		size += 4
+	}
+	ok = true
+	return
+}
+
+// appendFrame encodes a frame, masked as required for clients.
+func appendFrame(b []byte, f frame, masked bool, key [4]byte) []byte {
+	first := byte(f.Opcode & 0x0f)
+	if f.Final {
+		first |= 0x80
+	}
+	b = append(b, first)
+	var mask byte
+	if masked {
+		mask = 0x80
+	}
+	switch length := len(f.Data); {
+	case length < 126:
+		b = append(b, mask|byte(length))
+	case length <= 0xffff:
+		b = append(b, mask|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(length))
+	default:
+		b = append(b, mask|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(length))
+	}
+	if !masked {
+		return append(b, f.Data...)
+	}
+	b = append(b, key[:]...)
+	for i, c := range f.Data {
+		b = append(b, c^key[i%4])
+	}
+	return b
+}
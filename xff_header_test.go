@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"net/http"
 	"testing"
 )
@@ -80,3 +81,38 @@ func TestBothProvidedWithMoreProxies(t *testing.T) {
 		t.Errorf("Expected '%s', but received '%s'", expectation, forwardedHeader)
 	}
 }
+
+func TestForwardedProtoHost(t *testing.T) {
+	request, _ := http.NewRequest("GET", "http://www.example.com/test", nil)
+	setForwardedProtoHost(request)
+	if proto := request.Header.Get("X-Forwarded-Proto"); proto != "http" {
+		t.Errorf("Expected '%s', but received '%s'", "http", proto)
+	}
+	if host := request.Header.Get("X-Forwarded-Host"); host != "www.example.com" {
+		t.Errorf("Expected '%s', but received '%s'", "www.example.com", host)
+	}
+
+	request.TLS = &tls.ConnectionState{}
+	request.Header.Set("X-Forwarded-Host", "public.example.com")
+	request.Header.Del("X-Forwarded-Proto")
+	setForwardedProtoHost(request)
+	if proto := request.Header.Get("X-Forwarded-Proto"); proto != "https" {
+		t.Errorf("Expected '%s', but received '%s'", "https", proto)
+	}
+	if host := request.Header.Get("X-Forwarded-Host"); host != "public.example.com" {
+		t.Errorf("Expected '%s', but received '%s'", "public.example.com", host)
+	}
+}
+
+func TestIPv6ClientForwarded(t *testing.T) {
+	request, _ := http.NewRequest("GET", "ad1/test", nil)
+	request.RemoteAddr = "[2001:db8::1]:80"
+	request.Header.Set("Forwarded", "for=192.0.2.43")
+	updateForwardedHeaders(request)
+	if expectation := "2001:db8::1"; request.Header.Get("X-Forwarded-For") != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, request.Header.Get("X-Forwarded-For"))
+	}
+	if expectation := `for=192.0.2.43, for="[2001:db8::1]"`; request.Header.Get("Forwarded") != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, request.Header.Get("Forwarded"))
+	}
+}
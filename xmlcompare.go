@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// The xml normalization makes XML bodies, e.g. of SOAP services, comparable:
+// the elements and attributes are compared by their local names, so that the
+// namespace prefixes chosen by the implementations do not matter, the
+// attributes are sorted, the namespace declarations, comments, processing
+// instructions and the whitespace around the text are dropped, and so are
+// the -compare.xml-ignore elements and attributes, e.g. message ids and
+// timestamps. The ignored paths are a subset of XPath on the local names:
+//
+//	/Envelope/Header         the Header element of the root Envelope
+//	//Timestamp              any Timestamp element
+//	/Envelope/Body/*/@id     the id attribute of the children of Body
+
+// xsiNamespace is the namespace of xsi:type, whose value is a prefixed name.
+const xsiNamespace = "http://www.w3.org/2001/XMLSchema-instance"
+
+// xmlStep is a step of an ignored path, matching an element or, if name
+// starts with @, an attribute, anywhere below the previous step if
+// descendant is set.
+type xmlStep struct {
+	name       string
+	descendant bool
+}
+
+// xmlIgnorePaths are the paths of -compare.xml-ignore, set by
+// parseNormalizers.
+var xmlIgnorePaths [][]xmlStep
+
+// parseXMLPaths parses comma separated ignored paths.
+func parseXMLPaths(spec string) ([][]xmlStep, error) {
+	var paths [][]xmlStep
+	for _, path := range strings.Split(spec, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("path %q is not absolute, expected /Name or //Name", path)
+		}
+		var steps []xmlStep
+		for rest := path; rest != ""; {
+			step := xmlStep{descendant: strings.HasPrefix(rest, "//")}
+			rest = strings.TrimLeft(rest, "/")
+			var name string
+			name, rest, _ = strings.Cut(rest, "/")
+			if rest != "" {
+				rest = "/" + rest
+			}
+			// the prefix of the name is dropped, as for the document
+			local := name[strings.LastIndex(name, ":")+1:]
+			if strings.HasPrefix(name, "@") && !strings.HasPrefix(local, "@") {
+				local = "@" + local
+			}
+			step.name = local
+			if step.name == "" || step.name == "@" {
+				return nil, fmt.Errorf("path %q has an empty step", path)
+			}
+			if strings.HasPrefix(step.name, "@") && rest != "" {
+				return nil, fmt.Errorf("path %q has an attribute before its last step", path)
+			}
+			steps = append(steps, step)
+		}
+		paths = append(paths, steps)
+	}
+	return paths, nil
+}
+
+// matchXMLPath reports whether the steps match the path of an element or
+// attribute, the local names from the root.
+func matchXMLPath(steps []xmlStep, path []string) bool {
+	if len(steps) == 0 {
+		return len(path) == 0
+	}
+	step := steps[0]
+	for i := range path {
+		if matchXMLName(step.name, path[i]) && matchXMLPath(steps[1:], path[i+1:]) {
+			return true
+		}
+		if !step.descendant {
+			break
+		}
+	}
+	return false
+}
+
+func matchXMLName(pattern, name string) bool {
+	switch pattern {
+	case "*":
+		return !strings.HasPrefix(name, "@")
+	case "@*":
+		return strings.HasPrefix(name, "@")
+	}
+	return pattern == name
+}
+
+func ignoredXMLPath(path []string) bool {
+	for _, steps := range xmlIgnorePaths {
+		if matchXMLPath(steps, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// xmlNode is an element reduced to what is compared.
+type xmlNode struct {
+	name     string
+	attrs    []xml.Attr
+	text     strings.Builder
+	children []*xmlNode
+}
+
+// parseXMLNode reads the document into its root element, without the
+// ignored elements and attributes.
+func parseXMLNode(body []byte) (*xmlNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	var root *xmlNode
+	var stack []*xmlNode
+	var path []string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			if ignoredXMLPath(path) {
+				path = path[:len(path)-1]
+				if err := decoder.Skip(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			node := &xmlNode{name: t.Name.Local}
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Space == "" && attr.Name.Local == "xmlns" {
+					continue
+				}
+				if ignoredXMLPath(append(path, "@"+attr.Name.Local)) {
+					continue
+				}
+				value := attr.Value
+				if attr.Name.Space == xsiNamespace && attr.Name.Local == "type" {
+					value = value[strings.LastIndex(value, ":")+1:]
+				}
+				node.attrs = append(node.attrs, xml.Attr{Name: xml.Name{Local: attr.Name.Local}, Value: value})
+			}
+			sort.Slice(node.attrs, func(i, j int) bool { return node.attrs[i].Name.Local < node.attrs[j].Name.Local })
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else if root == nil {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+			path = path[:len(path)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.WriteString(strings.TrimSpace(string(t)))
+			}
+		}
+	}
+	if root == nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return root, nil
+}
+
+// write writes the element in its canonical form.
+func (n *xmlNode) write(b *bytes.Buffer) {
+	b.WriteString("<" + n.name)
+	for _, attr := range n.attrs {
+		b.WriteString(" " + attr.Name.Local + `="`)
+		xml.EscapeText(b, []byte(attr.Value))
+		b.WriteString(`"`)
+	}
+	b.WriteString(">")
+	xml.EscapeText(b, []byte(n.text.String()))
+	for _, child := range n.children {
+		child.write(b)
+	}
+	b.WriteString("</" + n.name + ">")
+}
+
+func isXML(mediaType string) bool {
+	return mediaType == "text/xml" || mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+// normalizeXML replaces XML bodies by their canonical form.
+func normalizeXML(r *comparedResponse) {
+	if r.truncated || r.body.Len() == 0 || !isXML(mediaType(r.header)) {
+		return
+	}
+	root, err := parseXMLNode(r.body.Bytes())
+	if err != nil {
+		return
+	}
+	r.body.Reset()
+	root.write(&r.body)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func xmlTestResponse(body string) *comparedResponse {
+	r := &comparedResponse{status: 200, header: http.Header{"Content-Type": {"text/xml; charset=utf-8"}}}
+	r.body.WriteString(body)
+	normalizeXML(r)
+	return r
+}
+
+func TestNormalizeXML(t *testing.T) {
+	defer func(paths [][]xmlStep) { xmlIgnorePaths = paths }(xmlIgnorePaths)
+	var err error
+	if xmlIgnorePaths, err = parseXMLPaths("/Envelope/Header, //soap:Body/*/@requestId"); err != nil {
+		t.Fatal(err)
+	}
+	a := xmlTestResponse(`<?xml version="1.0"?>
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <soap:Header><MessageId>1</MessageId></soap:Header>
+  <soap:Body>
+    <m:Price xmlns:m="urn:shop" currency="EUR" requestId="a1"><!-- cached -->
+      <m:Amount xsi:type="xsd:decimal">3.50</m:Amount>
+    </m:Price>
+  </soap:Body>
+</soap:Envelope>`)
+	b := xmlTestResponse(`<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/" xmlns:i="http://www.w3.org/2001/XMLSchema-instance"><S:Header><MessageId>2</MessageId></S:Header><S:Body><ns1:Price requestId="b2" currency="EUR" xmlns:ns1="urn:shop"><ns1:Amount i:type="s:decimal">3.50</ns1:Amount></ns1:Price></S:Body></S:Envelope>`)
+	if d := differences(a, b); len(d) != 0 {
+		t.Errorf("Expected equal responses, but received '%v' for %q and %q", d, a.body.String(), b.body.String())
+	}
+	expected := `<Envelope><Body><Price currency="EUR"><Amount type="decimal">3.50</Amount></Price></Body></Envelope>`
+	if a.body.String() != expected {
+		t.Errorf("Expected '%s', but received '%s'", expected, a.body.String())
+	}
+	c := xmlTestResponse(`<Envelope><Body><Price currency="USD"><Amount>3.50</Amount></Price></Body></Envelope>`)
+	if d := differences(a, c); len(d) == 0 {
+		t.Errorf("Expected a difference for another currency")
+	}
+}
+
+func TestParseXMLPaths(t *testing.T) {
+	for _, test := range []struct {
+		spec, path string
+		matches    bool
+	}{
+		{"/Envelope/Header", "Envelope/Header", true},
+		{"/Envelope/Header", "Envelope/Body/Header", false},
+		{"//Header", "Envelope/Body/Header", true},
+		{"/Envelope//@id", "Envelope/Body/Item/@id", true},
+		{"/Envelope/*/@*", "Envelope/Body/@id", true},
+		{"/Envelope/*", "Envelope/@id", false},
+	} {
+		paths, err := parseXMLPaths(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched := matchXMLPath(paths[0], strings.Split(test.path, "/")); matched != test.matches {
+			t.Errorf("Expected '%v' for %s on %s, but received '%v'", test.matches, test.spec, test.path, matched)
+		}
+	}
+	for _, spec := range []string{"Envelope", "/Envelope/@id/Body", "/Envelope//"} {
+		if _, err := parseXMLPaths(spec); err == nil {
+			t.Errorf("Expected an error for %s", spec)
+		}
+	}
+}